@@ -0,0 +1,14 @@
+-- Single use tokens for resetting a forgotten password.  The token itself is hashed the same as user_authtokens.token
+BEGIN;
+CREATE TABLE IF NOT EXISTS user_password_reset_tokens(
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id integer REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  token text NOT NULL DEFAULT '',
+  expires_at timestamp with time zone NOT NULL,
+  used_at timestamp with time zone DEFAULT NULL,
+
+  created_at timestamp with time zone DEFAULT now(),
+  updated_at timestamp with time zone
+);
+CREATE INDEX IF NOT EXISTS user_password_reset_tokens_user_id_idx ON user_password_reset_tokens (user_id);
+COMMIT;
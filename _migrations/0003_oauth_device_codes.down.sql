@@ -0,0 +1,4 @@
+BEGIN;
+DROP TABLE IF EXISTS oauth_device_codes;
+ALTER TABLE user_authtokens DROP COLUMN IF EXISTS sensor_id;
+COMMIT;
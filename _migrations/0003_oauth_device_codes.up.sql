@@ -0,0 +1,28 @@
+-- OAuth 2.0 device authorization grant (RFC 8628) for sensors which cannot easily have a token typed into them.
+-- device_code is hashed the same as user_authtokens.token.  user_code is what the user types in to approve the device.
+BEGIN;
+-- tokens issued to a device may only be used for that device's sensor
+ALTER TABLE user_authtokens ADD COLUMN IF NOT EXISTS sensor_id integer REFERENCES sensors (id) ON DELETE CASCADE DEFAULT NULL;
+
+CREATE TABLE IF NOT EXISTS oauth_device_codes(
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  device_code text NOT NULL DEFAULT '',
+  user_code text NOT NULL,
+  client_id text NOT NULL DEFAULT '',
+  sensor_name text NOT NULL DEFAULT '',
+  status integer NOT NULL DEFAULT 0,
+  -- set when approved
+  user_id integer REFERENCES users (id) ON DELETE CASCADE DEFAULT NULL,
+  sensor_id integer REFERENCES sensors (id) ON DELETE CASCADE DEFAULT NULL,
+  -- seconds the device must wait between polls
+  poll_interval integer NOT NULL DEFAULT 5,
+  last_polled_at timestamp with time zone DEFAULT NULL,
+  expires_at timestamp with time zone NOT NULL,
+
+  created_at timestamp with time zone DEFAULT now(),
+  updated_at timestamp with time zone
+);
+-- only one pending device may have a given user code at a time
+CREATE UNIQUE INDEX IF NOT EXISTS oauth_device_codes_pending_user_code_idx ON oauth_device_codes (user_code)
+  WHERE status = 0;
+COMMIT;
@@ -0,0 +1,22 @@
+-- TLS client certificates registered to a user, and optionally a sensor, for devices which authenticate with a
+-- certificate rather than a token.  Certificates are matched by sha256 fingerprint or, when no fingerprint is
+-- registered, by the subject common name of a certificate signed by the configured client CA.
+BEGIN;
+CREATE TABLE IF NOT EXISTS client_certificates(
+  id SERIAL PRIMARY KEY,
+  -- lower case hex sha256 of the DER encoded certificate
+  fingerprint text NOT NULL DEFAULT '',
+  subject text NOT NULL DEFAULT '',
+  user_id integer REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  sensor_id integer REFERENCES sensors (id) ON DELETE CASCADE DEFAULT NULL,
+  revoked_at timestamp with time zone DEFAULT NULL,
+
+  created_at timestamp with time zone DEFAULT now(),
+  updated_at timestamp with time zone,
+  CHECK (fingerprint <> '' OR subject <> '')
+);
+CREATE UNIQUE INDEX IF NOT EXISTS client_certificates_fingerprint_idx ON client_certificates (fingerprint)
+  WHERE revoked_at IS NULL AND fingerprint <> '';
+CREATE UNIQUE INDEX IF NOT EXISTS client_certificates_subject_idx ON client_certificates (subject)
+  WHERE revoked_at IS NULL AND fingerprint = '';
+COMMIT;
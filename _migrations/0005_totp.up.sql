@@ -0,0 +1,19 @@
+-- Optional TOTP (RFC 6238) two-factor authentication.  The secret has to be kept as is to generate codes, recovery
+-- codes are hashed the same as user_authtokens.token.
+BEGIN;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret text NOT NULL DEFAULT '';
+-- false until the user confirms a code from their authenticator app
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT false;
+-- the last time step a code was accepted for, so a code cannot be used twice
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS user_recovery_codes(
+  id SERIAL PRIMARY KEY,
+  user_id integer REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  code text NOT NULL,
+  used_at timestamp with time zone DEFAULT NULL,
+
+  created_at timestamp with time zone DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS user_recovery_codes_user_id_idx ON user_recovery_codes (user_id);
+COMMIT;
@@ -0,0 +1,3 @@
+BEGIN;
+ALTER TABLE user_authtokens DROP COLUMN IF EXISTS hash_version;
+COMMIT;
@@ -0,0 +1,5 @@
+-- The pepper version user_authtokens.token was hashed with.  0 is the unkeyed SHA-512 tokens were hashed with before
+-- peppers, so every existing token starts there and is re-hashed with the current pepper when it is next used.
+BEGIN;
+ALTER TABLE user_authtokens ADD COLUMN IF NOT EXISTS hash_version integer NOT NULL DEFAULT 0;
+COMMIT;
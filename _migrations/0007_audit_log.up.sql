@@ -0,0 +1,31 @@
+-- Append-only record of security relevant and data changing actions.  There are no foreign keys so that entries
+-- outlive the users and entities they refer to, and a trigger refuses any update or delete.
+BEGIN;
+CREATE TABLE IF NOT EXISTS audit_log(
+  id BIGSERIAL PRIMARY KEY,
+  -- the user who acted, or whose account was acted on for logins.  NULL if there is no such user.
+  user_id integer,
+  -- the user_authtokens id the action was taken with, if any
+  token_id text NOT NULL DEFAULT '',
+  action text NOT NULL,
+  entity_type text NOT NULL DEFAULT '',
+  entity_id text NOT NULL DEFAULT '',
+  -- {"Field": {"before": ..., "after": ...}} for each changed field
+  changes jsonb NOT NULL DEFAULT '{}',
+  ip text NOT NULL DEFAULT '',
+
+  created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS audit_log_user_id_created_at_idx ON audit_log (user_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (entity_type, entity_id);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+  FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only();
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+ALTER TABLE fermentors DROP COLUMN IF EXISTS team_id;
+ALTER TABLE sensors DROP COLUMN IF EXISTS team_id;
+ALTER TABLE batches DROP COLUMN IF EXISTS team_id;
+DROP TABLE IF EXISTS team_members;
+DROP TABLE IF EXISTS teams;
+COMMIT;
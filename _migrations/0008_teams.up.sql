@@ -0,0 +1,32 @@
+-- Teams let users share batches, sensors, and fermentors.  Owners manage the members, brewers can change the team's
+-- data, and viewers can only see it.  Whatever belongs to a team still has the user_id of whoever created it.
+BEGIN;
+CREATE TABLE IF NOT EXISTS teams(
+  id SERIAL PRIMARY KEY,
+  uuid uuid DEFAULT gen_random_uuid(),
+  name text NOT NULL,
+
+  created_at timestamp with time zone DEFAULT now(),
+  updated_at timestamp with time zone DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS teams_uuid_idx ON teams (uuid);
+
+CREATE TABLE IF NOT EXISTS team_members(
+  team_id integer REFERENCES teams (id) ON DELETE CASCADE NOT NULL,
+  user_id integer REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  -- see worrywort.TeamRole. 0 viewer, 1 brewer, 2 owner
+  role integer NOT NULL DEFAULT 0,
+
+  created_at timestamp with time zone DEFAULT now(),
+  updated_at timestamp with time zone DEFAULT now(),
+  PRIMARY KEY (team_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS team_members_user_id_idx ON team_members (user_id);
+
+ALTER TABLE batches ADD COLUMN IF NOT EXISTS team_id integer REFERENCES teams (id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS batches_team_id_idx ON batches (team_id);
+ALTER TABLE sensors ADD COLUMN IF NOT EXISTS team_id integer REFERENCES teams (id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS sensors_team_id_idx ON sensors (team_id);
+ALTER TABLE fermentors ADD COLUMN IF NOT EXISTS team_id integer REFERENCES teams (id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS fermentors_team_id_idx ON fermentors (team_id);
+COMMIT;
@@ -0,0 +1,17 @@
+-- Public, read-only links to a batch.  The slug is the whole secret, anyone with it can see the batch until the link
+-- expires or is revoked.  It is stored as is so that the link can be shown again to whoever shared it.
+BEGIN;
+CREATE TABLE IF NOT EXISTS batch_share_links(
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  batch_id integer REFERENCES batches (id) ON DELETE CASCADE NOT NULL,
+  -- who shared it
+  user_id integer REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  slug text NOT NULL UNIQUE,
+  expires_at timestamp with time zone DEFAULT NULL,
+  revoked_at timestamp with time zone DEFAULT NULL,
+
+  created_at timestamp with time zone DEFAULT now(),
+  updated_at timestamp with time zone DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS batch_share_links_batch_id_idx ON batch_share_links (batch_id);
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+DELETE FROM user_authtokens WHERE impersonator_id IS NOT NULL;
+ALTER TABLE user_authtokens DROP COLUMN IF EXISTS impersonator_id;
+ALTER TABLE user_authtokens DROP COLUMN IF EXISTS writes_allowed;
+ALTER TABLE audit_log DROP COLUMN IF EXISTS impersonator_id;
+COMMIT;
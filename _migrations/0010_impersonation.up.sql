@@ -0,0 +1,8 @@
+-- Impersonation tokens let an admin see the site as another user.  The token belongs to the impersonated user, with
+-- the admin kept in impersonator_id so that what they do can be attributed to them.
+BEGIN;
+ALTER TABLE user_authtokens ADD COLUMN IF NOT EXISTS impersonator_id integer REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE user_authtokens ADD COLUMN IF NOT EXISTS writes_allowed boolean NOT NULL DEFAULT false;
+-- like user_id, no foreign key so that entries outlive the user
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS impersonator_id integer;
+COMMIT;
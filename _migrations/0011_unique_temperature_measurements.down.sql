@@ -0,0 +1,3 @@
+BEGIN;
+DROP INDEX IF EXISTS temperature_measurements_sensor_id_recorded_at_idx;
+COMMIT;
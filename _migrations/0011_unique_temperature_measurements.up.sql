@@ -0,0 +1,10 @@
+-- A sensor cannot record two temperatures at the same moment, so a second measurement for the same sensor and
+-- recorded_at is a device retrying after a timeout.  Remove the duplicates retries already created, keeping the
+-- first, and make inserting another return the original instead.
+BEGIN;
+DELETE FROM temperature_measurements a USING temperature_measurements b
+  WHERE a.sensor_id = b.sensor_id AND a.recorded_at = b.recorded_at
+  AND (a.created_at > b.created_at OR (a.created_at = b.created_at AND a.id > b.id));
+CREATE UNIQUE INDEX IF NOT EXISTS temperature_measurements_sensor_id_recorded_at_idx
+  ON temperature_measurements (sensor_id, recorded_at);
+COMMIT;
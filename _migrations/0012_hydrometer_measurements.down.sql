@@ -0,0 +1,5 @@
+BEGIN;
+DROP TABLE IF EXISTS hydrometer_measurements;
+DROP INDEX IF EXISTS sensors_user_id_device_id_idx;
+ALTER TABLE sensors DROP COLUMN IF EXISTS device_id;
+COMMIT;
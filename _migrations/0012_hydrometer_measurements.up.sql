@@ -0,0 +1,29 @@
+-- Devices which identify themselves, such as an iSpindel by its chip id, are matched to a sensor by device_id.
+-- Hydrometers such as the iSpindel and Tilt report gravity along with temperature, which is stored separately in
+-- temperature_measurements.
+BEGIN;
+ALTER TABLE sensors ADD COLUMN IF NOT EXISTS device_id text NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX IF NOT EXISTS sensors_user_id_device_id_idx ON sensors (user_id, device_id) WHERE device_id <> '';
+
+CREATE TABLE IF NOT EXISTS hydrometer_measurements(
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id integer REFERENCES users (id) ON DELETE SET NULL,
+  sensor_id integer REFERENCES sensors (id) ON DELETE SET NULL,
+  -- in whatever scale the device reports, usually specific gravity
+  gravity double precision NOT NULL,
+  -- tilt in degrees, which devices such as the iSpindel calculate gravity from
+  angle double precision,
+  -- battery voltage
+  battery double precision,
+  rssi integer,
+  -- how often the device reports, in seconds
+  interval_seconds integer,
+  recorded_at timestamp with time zone NOT NULL,
+
+  created_at timestamp with time zone DEFAULT now(),
+  updated_at timestamp with time zone
+);
+CREATE UNIQUE INDEX IF NOT EXISTS hydrometer_measurements_sensor_id_recorded_at_idx
+  ON hydrometer_measurements (sensor_id, recorded_at);
+CREATE INDEX IF NOT EXISTS hydrometer_measurements_recorded_at_idx ON hydrometer_measurements (recorded_at);
+COMMIT;
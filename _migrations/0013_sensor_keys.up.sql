@@ -0,0 +1,17 @@
+-- Pre-shared keys which constrained devices sign their CoAP measurements with instead of sending an auth token.  The
+-- key has to be stored as is to check signatures with, so it only allows saving measurements for its one sensor.
+BEGIN;
+CREATE TABLE IF NOT EXISTS sensor_keys(
+  -- an integer rather than a uuid so that it is cheap for a device to send with every measurement
+  id serial PRIMARY KEY,
+  sensor_id integer REFERENCES sensors (id) ON DELETE CASCADE NOT NULL,
+  -- who made the key, measurements signed with it are saved as them
+  user_id integer REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  key bytea NOT NULL,
+  revoked_at timestamp with time zone DEFAULT NULL,
+
+  created_at timestamp with time zone DEFAULT now(),
+  updated_at timestamp with time zone DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS sensor_keys_sensor_id_idx ON sensor_keys (sensor_id);
+COMMIT;
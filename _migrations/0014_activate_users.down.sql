@@ -0,0 +1,5 @@
+-- users are left active, there is no telling which ones were not before
+BEGIN;
+ALTER TABLE users ALTER COLUMN is_active DROP NOT NULL;
+ALTER TABLE users ALTER COLUMN is_active SET DEFAULT FALSE;
+COMMIT;
@@ -0,0 +1,7 @@
+-- users.is_active was never checked until logins and tokens started requiring it, so every user is activated rather
+-- than locked out.  New users are active unless created otherwise.  See `wortuser deactivate`.
+BEGIN;
+UPDATE users SET is_active = TRUE, updated_at = NOW() WHERE is_active IS NOT TRUE;
+ALTER TABLE users ALTER COLUMN is_active SET DEFAULT TRUE;
+ALTER TABLE users ALTER COLUMN is_active SET NOT NULL;
+COMMIT;
@@ -0,0 +1,4 @@
+-- When the password last changed, so that JWTs issued before then can be refused even though they are never stored
+BEGIN;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_changed_at timestamp with time zone;
+COMMIT;
@@ -0,0 +1,4 @@
+BEGIN;
+ALTER TABLE user_authtokens DROP COLUMN IF EXISTS failed_attempts;
+ALTER TABLE user_recovery_codes DROP COLUMN IF EXISTS hash_version;
+COMMIT;
@@ -0,0 +1,7 @@
+-- Recovery codes are hashed with the token peppers the same as user_authtokens.token, see 0006.  Codes made before
+-- this are version 0.  failed_attempts counts wrong codes entered for a TOTP challenge token, which is refused after
+-- too many.
+BEGIN;
+ALTER TABLE user_recovery_codes ADD COLUMN IF NOT EXISTS hash_version integer NOT NULL DEFAULT 0;
+ALTER TABLE user_authtokens ADD COLUMN IF NOT EXISTS failed_attempts integer NOT NULL DEFAULT 0;
+COMMIT;
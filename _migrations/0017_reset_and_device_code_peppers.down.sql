@@ -0,0 +1,4 @@
+BEGIN;
+ALTER TABLE oauth_device_codes DROP COLUMN IF EXISTS hash_version;
+ALTER TABLE user_password_reset_tokens DROP COLUMN IF EXISTS hash_version;
+COMMIT;
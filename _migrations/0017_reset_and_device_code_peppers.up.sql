@@ -0,0 +1,6 @@
+-- Password reset tokens and device codes are hashed with the token peppers the same as user_authtokens.token, see
+-- 0006.  Ones made before this are version 0.
+BEGIN;
+ALTER TABLE user_password_reset_tokens ADD COLUMN IF NOT EXISTS hash_version integer NOT NULL DEFAULT 0;
+ALTER TABLE oauth_device_codes ADD COLUMN IF NOT EXISTS hash_version integer NOT NULL DEFAULT 0;
+COMMIT;
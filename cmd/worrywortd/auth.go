@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"os"
+	"strings"
+)
+
+// The authentication schemes used if WORRYWORTD_AUTH_SCHEMES is not set.  The query parameter scheme is left out
+// because the token ends up in the request logs.  jwt is added to the front if JWTs are configured and cert if
+// client certificates are.
+const defaultAuthSchemes = "token,bearer,basic"
+
+// Sets worrywort.TokenPeppers from WORRYWORTD_TOKEN_PEPPERS.  wortuser reads the same variable so that the tokens it
+// makes can be used here.
+func setTokenPeppersFromEnv() error {
+	peppers, ok := os.LookupEnv("WORRYWORTD_TOKEN_PEPPERS")
+	if !ok {
+		log.Printf("WORRYWORTD_TOKEN_PEPPERS is not set, auth tokens will be hashed without a pepper")
+		return nil
+	}
+	parsed, err := worrywort.ParseTokenPeppers(peppers)
+	if err != nil {
+		return fmt.Errorf("WORRYWORTD_TOKEN_PEPPERS: %v", err)
+	}
+	worrywort.TokenPeppers = parsed
+	return nil
+}
+
+// Returns a middleware.TokenLookupFunc which closes over the db needed to look up the token
+func newTokenLookup(db *sqlx.DB) middleware.TokenLookupFunc {
+	return func(tokenStr string) (*worrywort.User, *worrywort.AuthToken, error) {
+		t, err := worrywort.AuthenticateUserByToken(tokenStr, db)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &t.User, &t, nil
+	}
+}
+
+// Returns a middleware.CertificateLookupFunc for client certificates registered with `wortuser registercert`
+func newCertificateLookup(db *sqlx.DB) middleware.CertificateLookupFunc {
+	return func(cert *x509.Certificate) (*worrywort.User, *worrywort.AuthToken, error) {
+		t, err := worrywort.AuthenticateClientCertificate(cert, db)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &t.User, &t, nil
+	}
+}
+
+// Builds the authenticators for a comma separated list of schemes, in the order they should be tried.
+// jwtConfig may be nil if JWTs are not enabled, in which case the jwt scheme is an error.  JWTs are only checked
+// against the database when WORRYWORTD_JWT_CHECK_USER is set.
+// lockout may be nil if failed logins are not limited.
+func newAuthenticators(schemes string, db *sqlx.DB, jwtConfig *worrywort.JWTConfig,
+	lockout *ratelimit.Lockout) ([]middleware.Authenticator, error) {
+	authenticators := []middleware.Authenticator{}
+	for _, scheme := range strings.Split(schemes, ",") {
+		switch strings.ToLower(strings.TrimSpace(scheme)) {
+		case "jwt":
+			if jwtConfig == nil {
+				return nil, fmt.Errorf("The jwt authentication scheme requires WORRYWORTD_JWT_SECRET or WORRYWORTD_JWT_RSA_KEYS")
+			}
+			a := &middleware.JWTBearerAuthenticator{Config: jwtConfig}
+			if _, ok := os.LookupEnv("WORRYWORTD_JWT_CHECK_USER"); ok {
+				a.Db = db
+			}
+			authenticators = append(authenticators, a)
+		case "cert":
+			authenticators = append(authenticators, &middleware.ClientCertAuthenticator{Lookup: newCertificateLookup(db)})
+		case "token":
+			authenticators = append(authenticators, &middleware.TokenHeaderAuthenticator{Lookup: newTokenLookup(db)})
+		case "bearer":
+			authenticators = append(authenticators, &middleware.BearerAuthenticator{Lookup: newTokenLookup(db)})
+		case "basic":
+			var login ratelimit.LoginFunc = func(email, password string) (*worrywort.User, error) {
+				return worrywort.AuthenticateLogin(email, password, db)
+			}
+			if lockout != nil {
+				login = lockout.Login(login)
+			}
+			authenticators = append(authenticators, &middleware.BasicAuthenticator{Login: login})
+		case "query":
+			authenticators = append(authenticators, &middleware.QueryParamAuthenticator{Lookup: newTokenLookup(db)})
+		case "":
+			continue
+		default:
+			return nil, fmt.Errorf("Unknown authentication scheme %q", scheme)
+		}
+	}
+	return authenticators, nil
+}
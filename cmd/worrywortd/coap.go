@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jmichalicek/worrywort-server-go/coap_api"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net"
+	"os"
+)
+
+// Listens for CoAP measurements on the UDP address in WORRYWORTD_COAP_ADDR, such as `:5683`.  Does nothing if no
+// address is configured.  ipLimiter is the same limit as for the REST api, applied to each address sending requests.
+func startCoAPFromEnv(db *sqlx.DB, ipLimiter, sensorLimiter *ratelimit.Limiter,
+	notifier worrywort.TemperatureMeasurementNotifier) error {
+	addr, ok := os.LookupEnv("WORRYWORTD_COAP_ADDR")
+	if !ok {
+		return nil
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("Listening for CoAP on %s: %v", addr, err)
+	}
+	server := &coap_api.Server{Db: db, IPLimiter: ipLimiter, SensorLimiter: sensorLimiter, Notifier: notifier}
+	log.Printf("Listening for CoAP measurements on %s", conn.LocalAddr())
+	go func() {
+		log.Fatal(server.Serve(conn))
+	}()
+	return nil
+}
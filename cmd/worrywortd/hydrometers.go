@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/rest_api"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"os"
+	"time"
+)
+
+// Configures the Tilt endpoint from WORRYWORTD_TILT_CREATE_SENSORS and WORRYWORTD_TILT_TIMEZONE, the IANA name of
+// the timezone the Tilt app or TiltPi is in, such as `America/New_York`.
+func newTiltHandlerFromEnv(db *sqlx.DB, sensorLimiter *ratelimit.Limiter,
+	notifier worrywort.TemperatureMeasurementNotifier) (*rest_api.TiltHandler, error) {
+	_, createSensors := os.LookupEnv("WORRYWORTD_TILT_CREATE_SENSORS")
+	handler := &rest_api.TiltHandler{Db: db, CreateSensors: createSensors, Location: time.UTC,
+		SensorLimiter: sensorLimiter, Notifier: notifier}
+	if tz, ok := os.LookupEnv("WORRYWORTD_TILT_TIMEZONE"); ok {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("WORRYWORTD_TILT_TIMEZONE: %v", err)
+		}
+		handler.Location = loc
+	}
+	return handler, nil
+}
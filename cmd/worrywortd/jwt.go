@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// HS256 secrets shorter than this are refused since the secret is all that protects the tokens
+const minJWTSecretLength = 32
+
+// Builds the JWT config from the environment.  Returns nil if JWTs are not configured.
+//
+// WORRYWORTD_JWT_RSA_KEYS is a comma separated list of `kid=/path/to/key.pem`.  Each file may be a private
+// or public key.  WORRYWORTD_JWT_RSA_SIGNING_KID picks which private key new tokens are signed with.
+func newJWTConfigFromEnv() (*worrywort.JWTConfig, error) {
+	secret, hasSecret := os.LookupEnv("WORRYWORTD_JWT_SECRET")
+	rsaKeys, hasRSAKeys := os.LookupEnv("WORRYWORTD_JWT_RSA_KEYS")
+	if !hasSecret && !hasRSAKeys {
+		return nil, nil
+	}
+
+	config := &worrywort.JWTConfig{RSAPublicKeys: map[string]*rsa.PublicKey{}}
+	if hasSecret {
+		if len(secret) < minJWTSecretLength {
+			return nil, fmt.Errorf("WORRYWORTD_JWT_SECRET must be at least %d characters", minJWTSecretLength)
+		}
+		config.Secret = []byte(secret)
+	}
+
+	privateKeys := map[string]*rsa.PrivateKey{}
+	for _, entry := range strings.Split(rsaKeys, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("WORRYWORTD_JWT_RSA_KEYS entry %q should be kid=/path/to/key.pem", entry)
+		}
+		kid, path := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pem); err == nil {
+			privateKeys[kid] = privateKey
+			config.RSAPublicKeys[kid] = &privateKey.PublicKey
+		} else if publicKey, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+			config.RSAPublicKeys[kid] = publicKey
+		} else {
+			return nil, fmt.Errorf("Could not parse RSA key %s: %v", path, err)
+		}
+	}
+
+	if kid, ok := os.LookupEnv("WORRYWORTD_JWT_RSA_SIGNING_KID"); ok {
+		key, ok := privateKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("WORRYWORTD_JWT_RSA_SIGNING_KID %q is not a private key in WORRYWORTD_JWT_RSA_KEYS", kid)
+		}
+		config.RSASigningKey = key
+		config.RSASigningKeyId = kid
+	} else if !hasSecret {
+		return nil, fmt.Errorf("WORRYWORTD_JWT_RSA_SIGNING_KID or WORRYWORTD_JWT_SECRET is needed to sign JWTs")
+	}
+
+	if ttl, ok := os.LookupEnv("WORRYWORTD_JWT_TTL"); ok {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, err
+		}
+		config.TTL = d
+	}
+	return config, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jmichalicek/worrywort-server-go/graphql_api"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strings"
+)
+
+// Returns a graphql_api.PasswordResetNotifier which emails the reset token using the smtp server at addr.
+// If resetURL is not empty then the token is added to it as the `token` query parameter and that link is
+// sent as well.
+func newSMTPPasswordResetNotifier(addr, username, password, from, resetURL string) graphql_api.PasswordResetNotifier {
+	var auth smtp.Auth
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return func(user worrywort.User, token string) error {
+		body := []string{
+			"A password reset was requested for your WorryWort account.",
+			"",
+			"Your password reset token is: " + token,
+		}
+		if resetURL != "" {
+			link, err := url.Parse(resetURL)
+			if err != nil {
+				return err
+			}
+			q := link.Query()
+			q.Set("token", token)
+			link.RawQuery = q.Encode()
+			body = append(body, "", "Or follow this link to reset your password: "+link.String())
+		}
+		body = append(body, "", "If you did not request a password reset you can ignore this email.")
+
+		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: WorryWort password reset\r\n\r\n%s\r\n",
+			from, user.Email, strings.Join(body, "\r\n"))
+		return smtp.SendMail(addr, auth, from, []string{user.Email}, []byte(msg))
+	}
+}
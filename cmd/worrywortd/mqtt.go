@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jmichalicek/worrywort-server-go/mqtt_api"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Connects to the broker in WORRYWORTD_MQTT_BROKER, such as `tcp://mosquitto:1883`, and saves the measurements
+// published to WORRYWORTD_MQTT_TOPIC.  If WORRYWORTD_MQTT_PUBLISH is set, saved measurements are also published, see
+// newMQTTPublisherFromEnv, and the returned notifier should be given to everything else which saves measurements.
+// Does nothing if no broker is configured.
+func startMQTTFromEnv(db *sqlx.DB, sensorLimiter *ratelimit.Limiter) (worrywort.TemperatureMeasurementNotifier, error) {
+	broker, ok := os.LookupEnv("WORRYWORTD_MQTT_BROKER")
+	if !ok {
+		return nil, nil
+	}
+	pattern, err := mqttTopicPatternFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	clientId, ok := os.LookupEnv("WORRYWORTD_MQTT_CLIENT_ID")
+	if !ok {
+		clientId = "worrywortd"
+	}
+	username, _ := os.LookupEnv("WORRYWORTD_MQTT_USERNAME")
+	password, _ := os.LookupEnv("WORRYWORTD_MQTT_PASSWORD")
+
+	subscriber := &mqtt_api.Subscriber{Db: db, Pattern: pattern, QoS: 1, SensorLimiter: sensorLimiter}
+	opts := mqtt.NewClientOptions().AddBroker(broker).SetClientID(clientId).SetUsername(username).
+		SetPassword(password).SetAutoReconnect(true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			if err := subscriber.Subscribe(client); err != nil {
+				log.Printf("Subscribing to %s: %v", pattern.Subscription(), err)
+			}
+		}).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.Printf("Lost connection to MQTT broker: %v", err)
+		})
+	client := mqtt.NewClient(opts)
+
+	// set up before connecting so that the subscriber publishes the measurements it saves as well
+	var notifier worrywort.TemperatureMeasurementNotifier
+	if _, ok := os.LookupEnv("WORRYWORTD_MQTT_PUBLISH"); ok {
+		publisher, err := newMQTTPublisherFromEnv(client, db, pattern)
+		if err != nil {
+			return nil, err
+		}
+		notifier = newMQTTPublishQueue(publisher)
+		subscriber.Notifier = notifier
+		log.Printf("Publishing measurements to MQTT topic %s", publisher.MeasurementPattern.Subscription())
+	}
+
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("Connecting to MQTT broker %s: %v", broker, token.Error())
+	}
+	log.Printf("Subscribed to MQTT topic %s on %s", pattern.Subscription(), broker)
+	return notifier, nil
+}
+
+// How many saved measurements may be waiting to be published before more are dropped
+const mqttPublishQueueSize = 1000
+
+// Publishes measurements one at a time in the background so that saving them is not held up by the broker
+func newMQTTPublishQueue(publisher *mqtt_api.Publisher) worrywort.TemperatureMeasurementNotifier {
+	measurements := make(chan worrywort.TemperatureMeasurement, mqttPublishQueueSize)
+	go func() {
+		for tm := range measurements {
+			if err := publisher.Publish(tm); err != nil {
+				log.Printf("Publishing measurement %s to MQTT: %v", tm.Id, err)
+			}
+		}
+	}()
+	return func(tm worrywort.TemperatureMeasurement) {
+		select {
+		case measurements <- tm:
+		default:
+			log.Printf("MQTT publish queue is full, not publishing measurement %s", tm.Id)
+		}
+	}
+}
+
+// Configures the publisher from WORRYWORTD_MQTT_PUBLISH_TOPIC, WORRYWORTD_MQTT_BATCH_TOPIC, and
+// WORRYWORTD_MQTT_DISCOVERY_PREFIX.  Setting the batch topic or discovery prefix to an empty string turns them off.
+func newMQTTPublisherFromEnv(client mqtt.Client, db *sqlx.DB, subscribed mqtt_api.TopicPattern) (*mqtt_api.Publisher, error) {
+	publisher, err := mqttPublishTopicsFromEnv(subscribed)
+	if err != nil {
+		return nil, err
+	}
+	publisher.Client = client
+	publisher.Db = db
+	publisher.QoS = 1
+	return publisher, nil
+}
+
+// The topics a Publisher publishes to, which the broker's ACL checks let users read as well
+func mqttPublishTopicsFromEnv(subscribed mqtt_api.TopicPattern) (*mqtt_api.Publisher, error) {
+	topic, ok := os.LookupEnv("WORRYWORTD_MQTT_PUBLISH_TOPIC")
+	if !ok {
+		topic = mqtt_api.DefaultPublishTopicPattern
+	}
+	pattern, err := mqtt_api.ParseTopicPattern(topic)
+	if err != nil {
+		return nil, fmt.Errorf("WORRYWORTD_MQTT_PUBLISH_TOPIC: %v", err)
+	}
+	// the subscriber would otherwise be sent every measurement it had just saved
+	if pattern.String() == subscribed.String() {
+		return nil, fmt.Errorf("WORRYWORTD_MQTT_PUBLISH_TOPIC must differ from WORRYWORTD_MQTT_TOPIC")
+	}
+	batchTopic, ok := os.LookupEnv("WORRYWORTD_MQTT_BATCH_TOPIC")
+	if !ok {
+		batchTopic = mqtt_api.DefaultBatchTopic
+	}
+	if batchTopic != "" {
+		if err := mqtt_api.ValidateBatchTopic(batchTopic); err != nil {
+			return nil, fmt.Errorf("WORRYWORTD_MQTT_BATCH_TOPIC: %v", err)
+		}
+	}
+	discoveryPrefix, ok := os.LookupEnv("WORRYWORTD_MQTT_DISCOVERY_PREFIX")
+	if !ok {
+		discoveryPrefix = "homeassistant"
+	}
+	return &mqtt_api.Publisher{MeasurementPattern: pattern, BatchTopic: batchTopic, DiscoveryPrefix: discoveryPrefix},
+		nil
+}
+
+func mqttTopicPatternFromEnv() (mqtt_api.TopicPattern, error) {
+	topic, ok := os.LookupEnv("WORRYWORTD_MQTT_TOPIC")
+	if !ok {
+		topic = mqtt_api.DefaultTopicPattern
+	}
+	pattern, err := mqtt_api.ParseTopicPattern(topic)
+	if err != nil {
+		return pattern, fmt.Errorf("WORRYWORTD_MQTT_TOPIC: %v", err)
+	}
+	return pattern, nil
+}
+
+// Serves the broker's authentication and ACL checks on WORRYWORTD_MQTT_AUTH_ADDR, such as `:8081`.  It is a separate
+// listener so that it can be kept off the public network and so the broker's checks are not rate limited.
+func startMQTTBrokerAuthFromEnv(db *sqlx.DB) error {
+	addr, ok := os.LookupEnv("WORRYWORTD_MQTT_AUTH_ADDR")
+	if !ok {
+		return nil
+	}
+	pattern, err := mqttTopicPatternFromEnv()
+	if err != nil {
+		return err
+	}
+	username, _ := os.LookupEnv("WORRYWORTD_MQTT_USERNAME")
+	password, _ := os.LookupEnv("WORRYWORTD_MQTT_PASSWORD")
+	handler := &mqtt_api.BrokerAuthHandler{Db: db, Pattern: pattern, ServiceUsername: username,
+		ServicePassword: password}
+	if _, ok := os.LookupEnv("WORRYWORTD_MQTT_PUBLISH"); ok {
+		published, err := mqttPublishTopicsFromEnv(pattern)
+		if err != nil {
+			return err
+		}
+		handler.PublishPattern = published.MeasurementPattern
+		handler.BatchTopic = published.BatchTopic
+		handler.DiscoveryPrefix = published.DiscoveryPrefix
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/mqtt/", handler)
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+	log.Printf("MQTT broker authentication listening on %s\n", addr)
+	return nil
+}
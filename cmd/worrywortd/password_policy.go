@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+)
+
+// Sets the bcrypt cost from WORRYWORTD_PASSWORD_HASH_COST.  Existing hashes with another cost are upgraded the
+// next time their user logs in.
+func passwordHashCostFromEnv() (int, error) {
+	cost, err := envInt("WORRYWORTD_PASSWORD_HASH_COST", worrywort.DefaultPasswordHashCost)
+	if err != nil {
+		return 0, err
+	}
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return 0, fmt.Errorf("WORRYWORTD_PASSWORD_HASH_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return cost, nil
+}
+
+func newPasswordPolicyFromEnv() (*worrywort.PasswordPolicy, error) {
+	policy := worrywort.NewPasswordPolicy()
+	minLength, err := envInt("WORRYWORTD_PASSWORD_MIN_LENGTH", worrywort.DefaultMinPasswordLength)
+	if err != nil {
+		return nil, err
+	}
+	policy.MinLength = minLength
+	if path, ok := os.LookupEnv("WORRYWORTD_PASSWORD_BLOCKLIST"); ok {
+		blocklist, err := worrywort.LoadPasswordBlocklist(path)
+		if err != nil {
+			return nil, fmt.Errorf("WORRYWORTD_PASSWORD_BLOCKLIST: %v", err)
+		}
+		policy.Blocklist = blocklist
+	}
+	return policy, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Requests per minute allowed if the matching WORRYWORTD_RATELIMIT_* variable is not set
+const (
+	defaultIPRateLimit     = 300
+	defaultUserRateLimit   = 600
+	defaultSensorRateLimit = 60
+)
+
+const defaultLoginMaxFailures = 5
+const defaultLoginLockout = 15 * time.Minute
+
+// Limiter state is kept in Redis if WORRYWORTD_REDIS_ADDR is set so that it is shared between processes,
+// otherwise in memory.
+func newRateLimitStoreFromEnv() ratelimit.Store {
+	addr, ok := os.LookupEnv("WORRYWORTD_REDIS_ADDR")
+	if !ok {
+		return ratelimit.NewMemoryStore()
+	}
+	password, _ := os.LookupEnv("WORRYWORTD_REDIS_PASSWORD")
+	return ratelimit.NewRedisStore(redis.NewClient(&redis.Options{Addr: addr, Password: password}))
+}
+
+func envInt(name string, defaultValue int) (int, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%s must be a number 0 or greater", name)
+	}
+	return i, nil
+}
+
+// Returns a Limiter allowing the number of requests per minute in the environment variable, or nil if it is 0
+func newLimiterFromEnv(store ratelimit.Store, name string, defaultPerMinute int, prefix string) (*ratelimit.Limiter, error) {
+	perMinute, err := envInt(name, defaultPerMinute)
+	if err != nil || perMinute == 0 {
+		return nil, err
+	}
+	return &ratelimit.Limiter{Store: store, Limit: ratelimit.PerMinute(perMinute), Prefix: prefix}, nil
+}
+
+// Returns nil if WORRYWORTD_LOGIN_MAX_FAILURES is 0
+func newLoginLockoutFromEnv(store ratelimit.Store) (*ratelimit.Lockout, error) {
+	maxFailures, err := envInt("WORRYWORTD_LOGIN_MAX_FAILURES", defaultLoginMaxFailures)
+	if err != nil || maxFailures == 0 {
+		return nil, err
+	}
+	duration := defaultLoginLockout
+	if v, ok := os.LookupEnv("WORRYWORTD_LOGIN_LOCKOUT"); ok {
+		if duration, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("WORRYWORTD_LOGIN_LOCKOUT: %v", err)
+		}
+	}
+	return &ratelimit.Lockout{Store: store, MaxFailures: maxFailures, Duration: duration, Prefix: "login:"}, nil
+}
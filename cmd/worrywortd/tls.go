@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Builds the TLS config from the environment.  Returns nil if TLS is not configured.
+//
+// WORRYWORTD_TLS_CERT and WORRYWORTD_TLS_KEY are the server's certificate and key files.  If WORRYWORTD_TLS_CLIENT_CA
+// is set then clients may present a certificate signed by that CA, which is verified and may be used to
+// authenticate.  Client certificates are optional so that browsers and token authenticated clients still work.
+func newTLSConfigFromEnv() (*tls.Config, error) {
+	certFile, hasCert := os.LookupEnv("WORRYWORTD_TLS_CERT")
+	keyFile, hasKey := os.LookupEnv("WORRYWORTD_TLS_KEY")
+	if !hasCert && !hasKey {
+		return nil, nil
+	}
+	if !hasCert || !hasKey {
+		return nil, fmt.Errorf("WORRYWORTD_TLS_CERT and WORRYWORTD_TLS_KEY must both be set")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if caFile, ok := os.LookupEnv("WORRYWORTD_TLS_CLIENT_CA"); ok {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in WORRYWORTD_TLS_CLIENT_CA %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/graph-gophers/graphql-go/relay"
 	"github.com/jmichalicek/worrywort-server-go/graphql_api"
 	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
 	"github.com/jmichalicek/worrywort-server-go/rest_api"
 	"github.com/jmichalicek/worrywort-server-go/worrywort"
 	"github.com/jmoiron/sqlx"
@@ -20,16 +21,6 @@ import (
 
 var schema *graphql.Schema
 
-// Returns a function for looking up a user by token for middleware.NewTokenAuthHandler()
-// which closes over the db needed to look up the user
-func newTokenAuthLookup(db *sqlx.DB) func(token string) (*worrywort.User, error) {
-	return func(token string) (*worrywort.User, error) {
-		// TODO: return the token? That could be more useful in many places than just the user.
-		t, err := worrywort.AuthenticateUserByToken(token, db)
-		return &t.User, err
-	}
-}
-
 func main() {
 	// For now, force postgres
 	// TODO: write something to parse db uri?
@@ -47,12 +38,94 @@ func main() {
 		dbHost, dbPort, dbUser, dbPassword, dbName)
 
 	db, _ := sqlx.Connect("postgres", connectionString)
-	schema = graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db))
+
+	resolverOpts := []graphql_api.ResolverOption{}
+	if smtpAddr, ok := os.LookupEnv("WORRYWORTD_SMTP_ADDR"); ok {
+		smtpUser, _ := os.LookupEnv("WORRYWORTD_SMTP_USER")
+		smtpPassword, _ := os.LookupEnv("WORRYWORTD_SMTP_PASSWORD")
+		emailFrom, _ := os.LookupEnv("WORRYWORTD_EMAIL_FROM")
+		resetURL, _ := os.LookupEnv("WORRYWORTD_PASSWORD_RESET_URL")
+		resolverOpts = append(resolverOpts, graphql_api.WithPasswordResetNotifier(
+			newSMTPPasswordResetNotifier(smtpAddr, smtpUser, smtpPassword, emailFrom, resetURL)))
+	}
+	jwtConfig, err := newJWTConfigFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if jwtConfig != nil {
+		resolverOpts = append(resolverOpts, graphql_api.WithJWTConfig(jwtConfig))
+	}
+	if err := setTokenPeppersFromEnv(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	hashCost, err := passwordHashCostFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	worrywort.PasswordHashCost = hashCost
+	passwordPolicy, err := newPasswordPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	resolverOpts = append(resolverOpts, graphql_api.WithPasswordHashCost(hashCost),
+		graphql_api.WithPasswordPolicy(passwordPolicy))
+	rateLimitStore := newRateLimitStoreFromEnv()
+	loginLockout, err := newLoginLockoutFromEnv(rateLimitStore)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if loginLockout != nil {
+		resolverOpts = append(resolverOpts, graphql_api.WithLoginLockout(loginLockout))
+	}
+	ipLimiter, err := newLimiterFromEnv(rateLimitStore, "WORRYWORTD_RATELIMIT_IP", defaultIPRateLimit, "ip:")
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	userLimiter, err := newLimiterFromEnv(rateLimitStore, "WORRYWORTD_RATELIMIT_USER", defaultUserRateLimit, "user:")
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	sensorLimiter, err := newLimiterFromEnv(rateLimitStore, "WORRYWORTD_RATELIMIT_SENSOR", defaultSensorRateLimit,
+		"sensor:")
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	// started before the apis are set up since each of them is given what publishes new measurements
+	measurementNotifier, err := startMQTTFromEnv(db, sensorLimiter)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	resolverOpts = append(resolverOpts, graphql_api.WithTemperatureMeasurementNotifier(measurementNotifier))
+	resolver := graphql_api.NewResolver(db, resolverOpts...)
+	schema = graphql.MustParseSchema(graphql_api.Schema, resolver)
+	// for read-only impersonation tokens
+	readOnlySchema := graphql.MustParseSchema(graphql_api.ReadOnlySchema, resolver)
 
 	// could do a middleware in this style to add db to the context like I used to, but more middleware friendly.
 	// Could also do that to add a logger, etc. For now, that stuff is getting attached to each handler
-	tokenAuthHandler := middleware.NewTokenAuthHandler(newTokenAuthLookup(db))
+	tlsConfig, err := newTLSConfigFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	authSchemes, ok := os.LookupEnv("WORRYWORTD_AUTH_SCHEMES")
+	if !ok {
+		authSchemes = defaultAuthSchemes
+		if jwtConfig != nil {
+			authSchemes = "jwt," + authSchemes
+		}
+		if tlsConfig != nil && tlsConfig.ClientCAs != nil {
+			authSchemes = "cert," + authSchemes
+		}
+	}
+	authenticators, err := newAuthenticators(authSchemes, db, jwtConfig, loginLockout)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	authHandler := middleware.NewAuthenticatorChainHandler(authenticators...)
 	authRequiredHandler := middleware.NewLoginRequiredHandler()
+	readOnlyHandler := middleware.NewReadOnlyHandler()
+	// the measurement endpoints are the only ones tokens with less than TOKEN_SCOPE_ALL may use
+	writeTempsHandler := middleware.NewScopeRequiredHandler(worrywort.TOKEN_SCOPE_WRITE_TEMPS)
 
 	// Not really sure I needed to switch to Chi here instead of the built in stuff.
 	// TODO: Test the actual server being built here. Will maybe need some restructuring of this
@@ -65,10 +138,58 @@ func main() {
 	// }
 	r := chi.NewRouter()
 	r.Use(chimiddleware.Compress(5, "text/html", "application/javascript"))
-	r.Use(chimiddleware.Logger)
-	r.Use(tokenAuthHandler)
-	r.Handle("/graphql", &graphql_api.Handler{Db: db, Handler: &relay.Handler{Schema: schema}})
-	r.Method("POST", "/api/v1/measurement", authRequiredHandler(&rest_api.MeasurementHandler{Db: db}))
+	// hydrometers can only be configured with a URL, so their routes have the token in the path
+	r.Use(middleware.NewRequestLogger(log.New(os.Stdout, "", log.LstdFlags), "/api/v1/ispindel/", "/api/v1/tilt/",
+		"/api/v1/fermentrack/"))
+	// limit by ip before authenticating so that guessing credentials is limited as well
+	if ipLimiter != nil {
+		r.Use(ratelimit.NewRateLimitHandler(ipLimiter, ratelimit.KeyByIP))
+	}
+	r.Use(authHandler)
+	if userLimiter != nil {
+		r.Use(ratelimit.NewRateLimitHandler(userLimiter, ratelimit.KeyByUser))
+	}
+	r.Handle("/graphql", &graphql_api.Handler{Db: db, Handler: &relay.Handler{Schema: schema},
+		ReadOnly: &relay.Handler{Schema: readOnlySchema}})
+	r.Method("POST", "/api/v1/measurement", authRequiredHandler(writeTempsHandler(readOnlyHandler(&rest_api.MeasurementHandler{Db: db,
+		SensorLimiter: sensorLimiter, Notifier: measurementNotifier}))))
+	r.Method("POST", "/api/v1/measurements/bulk", authRequiredHandler(writeTempsHandler(readOnlyHandler(
+		&rest_api.BulkMeasurementHandler{Db: db, SensorLimiter: sensorLimiter, Notifier: measurementNotifier}))))
+	// InfluxDB clients such as Telegraf are given `/influx` as the url and add `/write` or `/api/v2/write` to it
+	influxHandler := authRequiredHandler(writeTempsHandler(readOnlyHandler(&rest_api.InfluxWriteHandler{Db: db,
+		SensorLimiter: sensorLimiter, Notifier: measurementNotifier})))
+	r.Method("POST", "/influx/write", influxHandler)
+	r.Method("POST", "/influx/api/v2/write", influxHandler)
+	// Hydrometers can only be configured with a URL, so their token is part of the path
+	pathTokenHandler := middleware.NewAuthenticatorChainHandler(&middleware.PathTokenAuthenticator{
+		Token:  func(req *http.Request) string { return chi.URLParam(req, "token") },
+		Lookup: newTokenLookup(db)})
+	_, ispindelCreateSensors := os.LookupEnv("WORRYWORTD_ISPINDEL_CREATE_SENSORS")
+	r.With(pathTokenHandler).Method("POST", "/api/v1/ispindel/{token}", authRequiredHandler(writeTempsHandler(readOnlyHandler(
+		&rest_api.ISpindelHandler{Db: db, CreateSensors: ispindelCreateSensors, SensorLimiter: sensorLimiter,
+			Notifier: measurementNotifier}))))
+	tiltHandler, err := newTiltHandlerFromEnv(db, sensorLimiter, measurementNotifier)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	r.With(pathTokenHandler).Method("POST", "/api/v1/tilt/{token}", authRequiredHandler(writeTempsHandler(
+		readOnlyHandler(tiltHandler))))
+	_, fermentrackCreateSensors := os.LookupEnv("WORRYWORTD_FERMENTRACK_CREATE_SENSORS")
+	r.With(pathTokenHandler).Method("POST", "/api/v1/fermentrack/{token}", authRequiredHandler(writeTempsHandler(readOnlyHandler(
+		&rest_api.FermentrackHandler{Db: db, CreateSensors: fermentrackCreateSensors,
+			SensorLimiter: sensorLimiter, Notifier: measurementNotifier}))))
+	// OAuth 2.0 device authorization flow.  Only enabled once there is a page for users to enter codes on.
+	if verificationURI, ok := os.LookupEnv("WORRYWORTD_DEVICE_VERIFICATION_URL"); ok {
+		r.Method("POST", "/oauth/device/code", &rest_api.DeviceAuthorizationHandler{Db: db,
+			VerificationURI: verificationURI})
+		r.Method("POST", "/oauth/token", &rest_api.DeviceTokenHandler{Db: db})
+	}
+	if err := startMQTTBrokerAuthFromEnv(db); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := startCoAPFromEnv(db, ipLimiter, sensorLimiter, measurementNotifier); err != nil {
+		log.Fatalf("%v", err)
+	}
 	// TODO: need to manually handle CORS? Chi has some cors stuff, yay
 	// https://github.com/graph-gophers/graphql-go/issues/74#issuecomment-289098639
 	uri, uriSet := os.LookupEnv("WORRYWORTD_HOST")
@@ -76,5 +197,10 @@ func main() {
 		uri = ":8080"
 	}
 	log.Printf("WorryWort now listening on %s\n", uri)
+	if tlsConfig != nil {
+		server := &http.Server{Addr: uri, Handler: r, TLSConfig: tlsConfig}
+		// the certificate is already loaded into tlsConfig
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
 	log.Fatal(http.ListenAndServe(uri, r))
 }
@@ -24,12 +24,36 @@ func main() {
 		dbHost, dbPort, dbUser, dbPassword, dbName)
 
 	db, _ := sqlx.Connect("postgres", connectionString)
+	if peppers, ok := os.LookupEnv("WORRYWORTD_TOKEN_PEPPERS"); ok {
+		parsed, err := worrywort.ParseTokenPeppers(peppers)
+		if err != nil {
+			fmt.Printf("WORRYWORTD_TOKEN_PEPPERS: %v\n", err)
+			os.Exit(1)
+		}
+		worrywort.TokenPeppers = parsed
+	}
 
 	// subcommands
 	clearTokenCmd := flag.NewFlagSet("clear", flag.ExitOnError)
 	makeTokenCmd := flag.NewFlagSet("maketoken", flag.ExitOnError)
 	//tokenId := clearTokenCmd.String("tokenId", "", "Token id to clear")
 	email := makeTokenCmd.String("email", "", "Email address of user")
+	sensorId := makeTokenCmd.String("sensor", "", "Id of a sensor to bind the token to. It may only write for that sensor")
+	registerCertCmd := flag.NewFlagSet("registercert", flag.ExitOnError)
+	certEmail := registerCertCmd.String("email", "", "Email address of user")
+	certFingerprint := registerCertCmd.String("fingerprint", "", "sha256 fingerprint of the certificate")
+	certSubject := registerCertCmd.String("subject", "", "Subject common name, instead of a fingerprint")
+	certSensorId := registerCertCmd.String("sensor", "", "Id of a sensor the certificate may only write for")
+	revokeCertCmd := flag.NewFlagSet("revokecert", flag.ExitOnError)
+	revokeFingerprint := revokeCertCmd.String("fingerprint", "", "sha256 fingerprint of the certificate")
+	revokeSubject := revokeCertCmd.String("subject", "", "Subject common name the certificate was registered with")
+	rotatePepperCmd := flag.NewFlagSet("rotatepepper", flag.ExitOnError)
+	prunePepper := rotatePepperCmd.Bool("prune", false,
+		"Delete tokens not hashed with a pepper in WORRYWORTD_TOKEN_PEPPERS instead of making a new pepper")
+	activateCmd := flag.NewFlagSet("activate", flag.ExitOnError)
+	activateEmail := activateCmd.String("email", "", "Email address of user")
+	deactivateCmd := flag.NewFlagSet("deactivate", flag.ExitOnError)
+	deactivateEmail := deactivateCmd.String("email", "", "Email address of user")
 	// flag.Parse()
 
 	if len(os.Args) == 1 {
@@ -37,6 +61,11 @@ func main() {
 		fmt.Println("The most commonly used wortuser commands are: ")
 		fmt.Println(" cleartoken   Find the most recent auth token for a user")
 		fmt.Println(" maketoken  Make an authentication token for a user")
+		fmt.Println(" registercert  Register a TLS client certificate for a user")
+		fmt.Println(" revokecert  Revoke a registered TLS client certificate")
+		fmt.Println(" rotatepepper  Make a new pepper for hashing auth tokens")
+		fmt.Println(" activate  Allow a user to log in")
+		fmt.Println(" deactivate  Stop a user from logging in and delete their tokens")
 		return
 	}
 
@@ -45,6 +74,16 @@ func main() {
 		clearTokenCmd.Parse(os.Args[2:])
 	case "maketoken":
 		makeTokenCmd.Parse(os.Args[2:])
+	case "registercert":
+		registerCertCmd.Parse(os.Args[2:])
+	case "revokecert":
+		revokeCertCmd.Parse(os.Args[2:])
+	case "rotatepepper":
+		rotatePepperCmd.Parse(os.Args[2:])
+	case "activate":
+		activateCmd.Parse(os.Args[2:])
+	case "deactivate":
+		deactivateCmd.Parse(os.Args[2:])
 	default:
 		fmt.Printf("%q is not valid command.\n", os.Args[1])
 		os.Exit(2)
@@ -56,7 +95,7 @@ func main() {
 
 	if makeTokenCmd.Parsed() {
 		fmt.Printf("Making token for user: %s\n", *email)
-		token, err := makeToken(*email, db)
+		token, err := makeToken(*email, *sensorId, db)
 		if err != nil {
 			fmt.Printf("Error creating token: %v\n", err)
 		} else {
@@ -65,16 +104,65 @@ func main() {
 
 	}
 
+	if registerCertCmd.Parsed() {
+		cert, err := registerCert(*certEmail, *certFingerprint, *certSubject, *certSensorId, db)
+		if err != nil {
+			fmt.Printf("Error registering certificate: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Registered certificate %d\n", *cert.Id)
+	}
+
+	if revokeCertCmd.Parsed() {
+		if err := revokeCert(*revokeFingerprint, *revokeSubject, db); err != nil {
+			fmt.Printf("Error revoking certificate: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Revoked certificate")
+	}
+
+	if rotatePepperCmd.Parsed() {
+		if err := rotatePepper(*prunePepper, db); err != nil {
+			fmt.Printf("Error rotating pepper: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if activateCmd.Parsed() {
+		if err := setActive(*activateEmail, true, db); err != nil {
+			fmt.Printf("Error activating user: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Activated user")
+	}
+
+	if deactivateCmd.Parsed() {
+		if err := setActive(*deactivateEmail, false, db); err != nil {
+			fmt.Printf("Error deactivating user: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Deactivated user")
+	}
 }
 
 // Make token for user...  should really take User
-func makeToken(username string, db *sqlx.DB) (*worrywort.AuthToken, error) {
+// If sensorUUID is not empty the token is bound to that sensor and may only write temperatures for it.
+func makeToken(username string, sensorUUID string, db *sqlx.DB) (*worrywort.AuthToken, error) {
 	user, err := worrywort.FindUser(map[string]interface{}{"email": username}, db)
 	if err != nil {
 		return nil, err
 	}
 
-	token, err := worrywort.GenerateTokenForUser(*user, worrywort.TOKEN_SCOPE_ALL)
+	var token worrywort.AuthToken
+	if sensorUUID != "" {
+		sensor, err := worrywort.FindSensor(map[string]interface{}{"uuid": sensorUUID, "user_id": user.Id}, db)
+		if err != nil {
+			return nil, err
+		}
+		token, err = worrywort.GenerateSensorToken(*user, *sensor.Id, worrywort.TOKEN_SCOPE_WRITE_TEMPS)
+	} else {
+		token, err = worrywort.GenerateTokenForUser(*user, worrywort.TOKEN_SCOPE_ALL)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -85,3 +173,101 @@ func makeToken(username string, db *sqlx.DB) (*worrywort.AuthToken, error) {
 	}
 	return &token, nil
 }
+
+// Register a client certificate by fingerprint or subject common name for the user with the given email.
+// If sensorUUID is not empty the certificate may only write temperatures for that sensor.
+func registerCert(email, fingerprint, subject, sensorUUID string, db *sqlx.DB) (*worrywort.ClientCertificate, error) {
+	if (fingerprint == "") == (subject == "") {
+		return nil, fmt.Errorf("Exactly one of -fingerprint or -subject is required")
+	}
+	user, err := worrywort.FindUser(map[string]interface{}{"email": email}, db)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := worrywort.ClientCertificate{Fingerprint: fingerprint, UserId: user.Id}
+	if fingerprint == "" {
+		cert.Subject = subject
+	}
+	if sensorUUID != "" {
+		sensor, err := worrywort.FindSensor(map[string]interface{}{"uuid": sensorUUID, "user_id": user.Id}, db)
+		if err != nil {
+			return nil, err
+		}
+		cert.SensorId = sensor.Id
+	}
+	if err := cert.Save(db); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// Revoke the active client certificate with the given fingerprint or subject
+func revokeCert(fingerprint, subject string, db *sqlx.DB) error {
+	params := map[string]interface{}{"revoked": false}
+	if fingerprint != "" {
+		params["fingerprint"] = fingerprint
+	} else if subject != "" {
+		params["fingerprint"] = ""
+		params["subject"] = subject
+	} else {
+		return fmt.Errorf("One of -fingerprint or -subject is required")
+	}
+	cert, err := worrywort.FindClientCertificate(params, db)
+	if err != nil {
+		return err
+	}
+	return cert.Revoke(db)
+}
+
+// Prints WORRYWORTD_TOKEN_PEPPERS with a new pepper added.  Once worrywortd is using it, tokens are re-hashed with the
+// new pepper as they are used.  The old peppers can be removed after the tokens still using them have expired, or
+// after deleting those tokens with prune.
+func rotatePepper(prune bool, db *sqlx.DB) error {
+	if prune {
+		deleted, err := worrywort.DeleteUnpepperedAuthTokens(db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %d tokens\n", deleted)
+		return nil
+	}
+
+	counts, err := worrywort.CountAuthTokensByHashVersion(db)
+	if err != nil {
+		return err
+	}
+	for version, count := range counts {
+		fmt.Printf("%d tokens hashed with version %d\n", count, version)
+	}
+
+	pepper, err := worrywort.GenerateTokenPepper()
+	if err != nil {
+		return err
+	}
+	peppers := map[int][]byte{}
+	for version, p := range worrywort.TokenPeppers {
+		peppers[version] = p
+	}
+	peppers[worrywort.CurrentTokenHashVersion()+1] = []byte(pepper)
+	fmt.Printf("Set this for worrywortd and wortuser:\nWORRYWORTD_TOKEN_PEPPERS=%s\n",
+		worrywort.FormatTokenPeppers(peppers))
+	return nil
+}
+
+// Activates or deactivates the user with the given email.  A deactivated user's tokens are deleted as well, so that
+// activating them again does not bring back tokens they may have lost track of.
+func setActive(email string, active bool, db *sqlx.DB) error {
+	user, err := worrywort.FindUser(map[string]interface{}{"email": email}, db)
+	if err != nil {
+		return err
+	}
+	user.IsActive = active
+	if err := user.Save(db); err != nil {
+		return err
+	}
+	if !active {
+		return worrywort.DeleteAllUserAuthTokens(*user.Id, db)
+	}
+	return nil
+}
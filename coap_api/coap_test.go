@@ -0,0 +1,287 @@
+package coap_api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	txdb "github.com/DATA-DOG/go-txdb"
+	"github.com/fxamacker/cbor"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	dbUser, _ := os.LookupEnv("DATABASE_USER")
+	dbPassword, _ := os.LookupEnv("DATABASE_PASSWORD")
+	dbHost, _ := os.LookupEnv("DATABASE_HOST")
+	// we register an sql driver txdb
+	connString := fmt.Sprintf("host=%s port=5432 user=%s dbname=worrywort_test sslmode=disable", dbHost,
+		dbUser)
+	if dbPassword != "" {
+		connString += fmt.Sprintf(" password=%s", dbPassword)
+	}
+	txdb.Register("txdb", "postgres", connString)
+	retCode := m.Run()
+	os.Exit(retCode)
+}
+
+func setUpTestDb() (*sqlx.DB, error) {
+	_db, err := sql.Open("txdb", "one")
+	if err != nil {
+		return nil, err
+	}
+	return sqlx.NewDb(_db, "postgres"), nil
+}
+
+func TestMessage(t *testing.T) {
+	m := message{Type: typeConfirmable, Code: codePOST, MessageId: 0x1234, Token: []byte{1, 2, 3, 4},
+		Options: []option{
+			{Number: optionUriQuery, Value: []byte("k=12")},
+			{Number: optionUriPath, Value: []byte(MeasurementPath)},
+			{Number: optionContentFormat, Value: encodeUint(contentFormatCBOR)},
+			// needs the extended delta and length
+			{Number: 300, Value: bytes.Repeat([]byte("x"), 20)},
+		},
+		Payload: []byte{0xa0},
+	}
+	parsed, err := parseMessage(m.marshal())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if parsed.Type != m.Type || parsed.Code != m.Code || parsed.MessageId != m.MessageId ||
+		!bytes.Equal(parsed.Token, m.Token) || !bytes.Equal(parsed.Payload, m.Payload) {
+		t.Errorf("Expected %v but got %v", m, parsed)
+	}
+	if len(parsed.Options) != 4 || parsed.Options[3].Number != 300 || len(parsed.Options[3].Value) != 20 {
+		t.Errorf("Unexpected options %v", parsed.Options)
+	}
+	if p := parsed.path(); p != MeasurementPath {
+		t.Errorf("Expected path %s but got %s", MeasurementPath, p)
+	}
+	if q := parsed.query(); q["k"] != "12" {
+		t.Errorf("Unexpected query %v", q)
+	}
+	if f, ok := parsed.contentFormat(); !ok || f != contentFormatCBOR {
+		t.Errorf("Expected content format %d but got %d, %v", contentFormatCBOR, f, ok)
+	}
+
+	for _, b := range [][]byte{{}, {0x40, 0x02}, {0x80, 0x02, 0, 1}, {0x49, 0x02, 0, 1}, {0x40, 0x02, 0, 1, 0xff}} {
+		if _, err := parseMessage(b); err != errInvalidMessage {
+			t.Errorf("Expected %x to be invalid but got %v", b, err)
+		}
+	}
+}
+
+func TestPayloadValues(t *testing.T) {
+	cborPayload, err := cbor.Marshal(map[string]interface{}{"value": 20.5, "recorded_at": 1555846233},
+		cbor.EncOptions{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := url.Values{"metric": {"temperature"}, "units": {"CELSIUS"}, "value": {"20.5"},
+		"recorded_at": {"1555846233"}}
+
+	var tests = []struct {
+		name    string
+		format  []byte
+		payload []byte
+		values  url.Values
+		err     error
+	}{
+		{"JSON", encodeUint(contentFormatJSON), []byte(`{"value": 20.5, "recorded_at": 1555846233}`), expected, nil},
+		{"JSON without Content-Format", nil, []byte(`{"value": 20.5, "recorded_at": 1555846233}`), expected, nil},
+		{"CBOR", encodeUint(contentFormatCBOR), cborPayload, expected, nil},
+		{"CBOR without Content-Format", nil, cborPayload, expected, nil},
+		{"Units", encodeUint(contentFormatJSON),
+			[]byte(`{"value": 68, "units": "FAHRENHEIT", "recorded_at": "2019-04-21T11:30:33Z"}`),
+			url.Values{"metric": {"temperature"}, "units": {"FAHRENHEIT"}, "value": {"68"},
+				"recorded_at": {"2019-04-21T11:30:33Z"}}, nil},
+		{"Nested", encodeUint(contentFormatJSON), []byte(`{"value": {"c": 20.5}}`), nil, errInvalidPayload},
+		{"Invalid JSON", encodeUint(contentFormatJSON), []byte(`{"value": `), nil, errInvalidPayload},
+		{"Text", encodeUint(0), []byte(`20.5`), nil, errUnsupportedContentFormat},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := message{Type: typeConfirmable, Code: codePOST, Payload: tc.payload}
+			if tc.format != nil {
+				req.Options = []option{{Number: optionContentFormat, Value: tc.format}}
+			}
+			values, err := payloadValues(req)
+			if err != tc.err || (tc.err == nil && !reflect.DeepEqual(values, tc.values)) {
+				t.Errorf("Expected %v, %v but got %v, %v", tc.values, tc.err, values, err)
+			}
+		})
+	}
+}
+
+func TestCacheResponse(t *testing.T) {
+	server := &Server{}
+	now := time.Now()
+	for i := 0; i <= maxCachedResponses; i++ {
+		server.cacheResponse(fmt.Sprintf("192.0.2.1:5683/%d", i), []byte{byte(i)}, now)
+	}
+	if len(server.responses) != maxCachedResponses {
+		t.Errorf("Expected %d cached responses but got %d", maxCachedResponses, len(server.responses))
+	}
+	// room again once the others have expired
+	later := now.Add(exchangeLifetime + time.Second)
+	server.cacheResponse("192.0.2.1:5683/new", []byte{1}, later)
+	if len(server.responses) != 1 || server.cachedResponse("192.0.2.1:5683/new", later) == nil {
+		t.Errorf("Expected only the new response to be cached but got %d", len(server.responses))
+	}
+}
+
+func TestServer(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := worrywort.Sensor{Name: "Test Sensor", UserId: user.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	key, err := worrywort.NewSensorKey(sensor, user)
+	if err == nil {
+		err = key.Save(db)
+	}
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	server := &Server{Db: db}
+	// shortly after the measurements in the payloads were recorded
+	now := time.Unix(1555846300, 0)
+
+	signedRequest := func(t messageType, messageId uint16, payload []byte, signature []byte) []byte {
+		return message{Type: t, Code: codePOST, MessageId: messageId, Token: []byte{0xbe, 0xef},
+			Options: []option{
+				{Number: optionUriPath, Value: []byte(MeasurementPath)},
+				{Number: optionContentFormat, Value: encodeUint(contentFormatJSON)},
+				{Number: optionUriQuery, Value: []byte("k=" + strconv.FormatInt(key.Id, 10))},
+				{Number: optionUriQuery, Value: []byte("s=" + base64.RawURLEncoding.EncodeToString(signature))},
+			},
+			Payload: payload}.marshal()
+	}
+	payload := []byte(`{"value": 20.5, "recorded_at": 1555846233}`)
+
+	t.Run("Saves the measurement", func(t *testing.T) {
+		packet := signedRequest(typeConfirmable, 1, payload, key.Sign(payload))
+		b := server.handlePacket("192.0.2.1:5683", packet, now)
+		response, err := parseMessage(b)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if response.Type != typeAcknowledgement || response.Code != codeCreated || response.MessageId != 1 ||
+			!bytes.Equal(response.Token, []byte{0xbe, 0xef}) {
+			t.Errorf("Unexpected response %v", response)
+		}
+		saved, err := worrywort.FindTemperatureMeasurement(
+			map[string]interface{}{"sensor_id": *sensor.Id, "user_id": *user.Id}, db)
+		if err != nil {
+			t.Fatalf("Expected TemperatureMeasurement not found in database: %v", err)
+		}
+		if saved.Temperature != 20.5 || saved.Units != worrywort.CELSIUS ||
+			!saved.RecordedAt.Equal(time.Unix(1555846233, 0)) {
+			t.Errorf("Unexpected measurement %v", saved)
+		}
+
+		// a retransmission gets the same response without being saved again
+		if again := server.handlePacket("192.0.2.1:5683", packet, now.Add(time.Second)); !bytes.Equal(again, b) {
+			t.Errorf("Expected the response %x to the retransmission but got %x", b, again)
+		}
+	})
+
+	t.Run("Same measurement in a new message", func(t *testing.T) {
+		b := server.handlePacket("192.0.2.1:5683", signedRequest(typeConfirmable, 2, payload, key.Sign(payload)), now)
+		if response, err := parseMessage(b); err != nil || response.Code != codeChanged {
+			t.Errorf("Expected 2.04 but got %v, %v", response, err)
+		}
+	})
+
+	t.Run("Non-confirmable", func(t *testing.T) {
+		p := []byte(`{"value": 20.6, "recorded_at": 1555846293}`)
+		b := server.handlePacket("192.0.2.1:5683", signedRequest(typeNonConfirmable, 3, p, key.Sign(p)), now)
+		response, err := parseMessage(b)
+		if err != nil || response.Type != typeNonConfirmable || response.Code != codeCreated ||
+			!bytes.Equal(response.Token, []byte{0xbe, 0xef}) {
+			t.Errorf("Unexpected response %v, %v", response, err)
+		}
+	})
+
+	t.Run("Invalid signature", func(t *testing.T) {
+		other, _ := worrywort.NewSensorKey(sensor, user)
+		b := server.handlePacket("192.0.2.1:5683", signedRequest(typeConfirmable, 4, payload, other.Sign(payload)),
+			now)
+		if response, err := parseMessage(b); err != nil || response.Code != codeUnauthorized ||
+			len(response.Payload) != 0 {
+			t.Errorf("Expected 4.01 but got %v, %v", response, err)
+		}
+	})
+
+	t.Run("Missing recorded_at", func(t *testing.T) {
+		p := []byte(`{"value": 20.5}`)
+		b := server.handlePacket("192.0.2.1:5683", signedRequest(typeConfirmable, 5, p, key.Sign(p)), now)
+		if response, err := parseMessage(b); err != nil || response.Code != codeBadRequest {
+			t.Errorf("Expected 4.00 but got %v, %v", response, err)
+		}
+	})
+
+	t.Run("Stale recorded_at", func(t *testing.T) {
+		p := []byte(`{"value": 20.5, "recorded_at": 1555000000}`)
+		b := server.handlePacket("192.0.2.1:5683", signedRequest(typeConfirmable, 8, p, key.Sign(p)), now)
+		if response, err := parseMessage(b); err != nil || response.Code != codeBadRequest ||
+			string(response.Payload) != errStaleRecordedAt.Error() {
+			t.Errorf("Expected 4.00 but got %v, %v", response, err)
+		}
+	})
+
+	t.Run("Rate limited by address", func(t *testing.T) {
+		limited := &Server{Db: db, IPLimiter: &ratelimit.Limiter{Store: ratelimit.NewMemoryStore(),
+			Limit: ratelimit.Limit{Rate: 0.1, Burst: 1}, Prefix: "ip:"}}
+		other, _ := worrywort.NewSensorKey(sensor, user)
+		for i, expected := range []code{codeUnauthorized, codeTooManyRequests} {
+			packet := signedRequest(typeConfirmable, uint16(9+i), payload, other.Sign(payload))
+			b := limited.handlePacket("192.0.2.2:5683", packet, now)
+			if response, err := parseMessage(b); err != nil || response.Code != expected {
+				t.Errorf("Expected %v but got %v, %v", expected, response, err)
+			}
+		}
+	})
+
+	t.Run("Revoked key", func(t *testing.T) {
+		revoked, _ := worrywort.NewSensorKey(sensor, user)
+		if err := revoked.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := revoked.Revoke(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		req, _ := parseMessage(signedRequest(typeConfirmable, 6, payload, revoked.Sign(payload)))
+		req.Options[2].Value = []byte("k=" + strconv.FormatInt(revoked.Id, 10))
+		b := server.handlePacket("192.0.2.1:5683", req.marshal(), now)
+		if response, err := parseMessage(b); err != nil || response.Code != codeUnauthorized {
+			t.Errorf("Expected 4.01 but got %v, %v", response, err)
+		}
+	})
+
+	t.Run("Ping", func(t *testing.T) {
+		b := server.handlePacket("192.0.2.1:5683", message{Type: typeConfirmable, MessageId: 7}.marshal(), now)
+		if response, err := parseMessage(b); err != nil || response.Type != typeReset || response.MessageId != 7 {
+			t.Errorf("Expected a reset but got %v, %v", response, err)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package coap_api
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Just enough of CoAP (RFC 7252) to receive measurements: parsing and building single messages, without observe,
+// blockwise transfers, or DTLS.
+
+var errInvalidMessage = errors.New("Invalid CoAP message")
+
+type messageType uint8
+
+const (
+	typeConfirmable     messageType = 0
+	typeNonConfirmable  messageType = 1
+	typeAcknowledgement messageType = 2
+	typeReset           messageType = 3
+)
+
+// Codes are `class.detail` such as 2.01, stored as class<<5 | detail
+type code uint8
+
+const (
+	codeEmpty                    code = 0
+	codePOST                     code = 2
+	codeCreated                  code = 2<<5 | 1
+	codeChanged                  code = 2<<5 | 4
+	codeBadRequest               code = 4<<5 | 0
+	codeUnauthorized             code = 4<<5 | 1
+	codeNotFound                 code = 4<<5 | 4
+	codeMethodNotAllowed         code = 4<<5 | 5
+	codeUnsupportedContentFormat code = 4<<5 | 15
+	// from RFC 8516
+	codeTooManyRequests     code = 4<<5 | 29
+	codeInternalServerError code = 5<<5 | 0
+)
+
+func (c code) isRequest() bool {
+	return c != codeEmpty && c>>5 == 0
+}
+
+const (
+	optionMaxAge        = 14
+	optionUriPath       = 11
+	optionContentFormat = 12
+	optionUriQuery      = 15
+)
+
+// Content-Format option values
+const (
+	contentFormatJSON = 50
+	contentFormatCBOR = 60
+)
+
+const payloadMarker = 0xff
+
+type option struct {
+	Number uint16
+	Value  []byte
+}
+
+type message struct {
+	Type      messageType
+	Code      code
+	MessageId uint16
+	Token     []byte
+	Options   []option
+	Payload   []byte
+}
+
+// Reads the 4, 8, or 16 bit extended option delta or length which follows the option header
+func optionNibble(nibble uint8, b []byte) (uint16, []byte, error) {
+	switch {
+	case nibble < 13:
+		return uint16(nibble), b, nil
+	case nibble == 13 && len(b) >= 1:
+		return uint16(b[0]) + 13, b[1:], nil
+	case nibble == 14 && len(b) >= 2:
+		return binary.BigEndian.Uint16(b) + 269, b[2:], nil
+	}
+	return 0, nil, errInvalidMessage
+}
+
+func parseMessage(b []byte) (message, error) {
+	m := message{}
+	if len(b) < 4 || b[0]>>6 != 1 {
+		return m, errInvalidMessage
+	}
+	m.Type = messageType(b[0] >> 4 & 0x3)
+	tokenLength := int(b[0] & 0xf)
+	m.Code = code(b[1])
+	m.MessageId = binary.BigEndian.Uint16(b[2:4])
+	b = b[4:]
+	if tokenLength > 8 || len(b) < tokenLength {
+		return m, errInvalidMessage
+	}
+	m.Token = b[:tokenLength]
+	b = b[tokenLength:]
+
+	var number uint16
+	for len(b) > 0 {
+		if b[0] == payloadMarker {
+			if len(b) == 1 {
+				return m, errInvalidMessage
+			}
+			m.Payload = b[1:]
+			break
+		}
+		delta, rest, err := optionNibble(b[0]>>4, b[1:])
+		if err != nil {
+			return m, err
+		}
+		length, rest, err := optionNibble(b[0]&0xf, rest)
+		if err != nil || len(rest) < int(length) {
+			return m, errInvalidMessage
+		}
+		number += delta
+		m.Options = append(m.Options, option{Number: number, Value: rest[:length]})
+		b = rest[length:]
+	}
+	return m, nil
+}
+
+// Writes an option delta or length as its header nibble and extended bytes
+func encodeOptionNibble(v int) (uint8, []byte) {
+	switch {
+	case v < 13:
+		return uint8(v), nil
+	case v < 269:
+		return 13, []byte{uint8(v - 13)}
+	}
+	ext := make([]byte, 2)
+	binary.BigEndian.PutUint16(ext, uint16(v-269))
+	return 14, ext
+}
+
+func (m message) marshal() []byte {
+	b := []byte{1<<6 | uint8(m.Type)<<4 | uint8(len(m.Token)), uint8(m.Code), 0, 0}
+	binary.BigEndian.PutUint16(b[2:], m.MessageId)
+	b = append(b, m.Token...)
+
+	options := append([]option{}, m.Options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Number < options[j].Number })
+	var number uint16
+	for _, o := range options {
+		delta, deltaExt := encodeOptionNibble(int(o.Number - number))
+		length, lengthExt := encodeOptionNibble(len(o.Value))
+		b = append(b, delta<<4|length)
+		b = append(b, deltaExt...)
+		b = append(b, lengthExt...)
+		b = append(b, o.Value...)
+		number = o.Number
+	}
+	if len(m.Payload) > 0 {
+		b = append(b, payloadMarker)
+		b = append(b, m.Payload...)
+	}
+	return b
+}
+
+// Options such as Uri-Path which may be repeated
+func (m message) optionStrings(number uint16) []string {
+	values := []string{}
+	for _, o := range m.Options {
+		if o.Number == number {
+			values = append(values, string(o.Value))
+		}
+	}
+	return values
+}
+
+func (m message) path() string {
+	return strings.Join(m.optionStrings(optionUriPath), "/")
+}
+
+// The Uri-Query options as key value pairs, such as `k=12`
+func (m message) query() map[string]string {
+	query := map[string]string{}
+	for _, q := range m.optionStrings(optionUriQuery) {
+		parts := strings.SplitN(q, "=", 2)
+		if len(parts) == 2 {
+			query[parts[0]] = parts[1]
+		} else {
+			query[parts[0]] = ""
+		}
+	}
+	return query
+}
+
+// ok is false if the message has no Content-Format
+func (m message) contentFormat() (format uint, ok bool) {
+	for _, o := range m.Options {
+		if o.Number == optionContentFormat {
+			return decodeUint(o.Value), true
+		}
+	}
+	return 0, false
+}
+
+// Options with uint values are big endian with leading zero bytes left off
+func decodeUint(b []byte) uint {
+	var v uint
+	for _, c := range b {
+		v = v<<8 | uint(c)
+	}
+	return v
+}
+
+func encodeUint(v uint) []byte {
+	b := []byte{}
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{uint8(v)}, b...)
+	}
+	return b
+}
@@ -0,0 +1,369 @@
+package coap_api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/rest_api"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The path measurements are posted to, short since it is sent with every measurement
+const MeasurementPath = "m"
+
+// How long a response is kept to answer retransmissions of the request with, EXCHANGE_LIFETIME from RFC 7252
+const exchangeLifetime = 247 * time.Second
+
+// Larger messages would be fragmented, see section 4.6 of RFC 7252
+const maxMessageBytes = 1152
+
+// How many packets are handled at once unless Server.Workers says otherwise, and how many more may wait for a worker
+// before they are dropped.  A confirmable message which is dropped is retransmitted by the device.
+const defaultWorkers = 16
+const packetQueueSize = 256
+
+// How many responses are kept for retransmissions.  Once full, new responses are not kept until older ones expire, and
+// a retransmission of one of those requests is handled again, which saves nothing new since it is a duplicate.
+const maxCachedResponses = 10000
+
+// How far recorded_at may be from the time a message arrives.  A device may send readings it saved while it was offline,
+// but a signed message much older than that is more likely being replayed.  A little in the future allows for clocks
+// which are slightly off.
+const maxRecordedAtAge = 7 * 24 * time.Hour
+const maxRecordedAtSkew = 5 * time.Minute
+
+var errUnauthorized = errors.New("Unauthorized")
+var errUnsupportedContentFormat = errors.New("The payload must be JSON or CBOR")
+var errInvalidPayload = errors.New("The payload must be a JSON or CBOR map of strings and numbers")
+
+// Signed messages without a time could be replayed to save the same temperature again
+var errMissingRecordedAt = errors.New("recorded_at is required")
+var errStaleRecordedAt = errors.New("recorded_at is too far from the current time")
+
+// Receives measurements over CoAP (RFC 7252), which costs a battery powered device much less than an HTTPS request.
+// A device POSTs to `/m` with a JSON or CBOR map of the same fields as a measurement posted to
+// rest_api.MeasurementHandler, although the sensor comes from the key, metric defaults to temperature and units to
+// Celsius.  recorded_at is required and must be within the last week.
+//
+// Rather than a token, each message is signed with a worrywort.SensorKey.  The `k` Uri-Query option is the key's id and
+// `s` is the unpadded base64url encoding of the key's signature of the payload, so a message looks like
+// `POST /m?k=12&s=<signature>`.  Messages are not encrypted, so anyone on the network can see the measurements, but
+// only the holder of the key can make them.
+//
+// Confirmable messages are acknowledged with the response piggybacked, and non-confirmable ones get a non-confirmable
+// response.  Successful responses are 2.01 Created, or 2.04 Changed if the sensor already had a measurement at the
+// same time, with no payload.
+type Server struct {
+	Db *sqlx.DB
+	// Optional limit on how often each address may send requests, checked before the key is looked up
+	IPLimiter *ratelimit.Limiter
+	// Optional limit on how often each sensor may post, the same as for the REST api
+	SensorLimiter *ratelimit.Limiter
+	Notifier      worrywort.TemperatureMeasurementNotifier
+	// How many packets are handled at once, defaults to 16
+	Workers int
+
+	mu sync.Mutex
+	// responses by the address and message id of the request they answer
+	responses     map[string]cachedResponse
+	lastPurge     time.Time
+	nextMessageId uint16
+}
+
+type cachedResponse struct {
+	response []byte
+	expires  time.Time
+}
+
+type receivedPacket struct {
+	addr   net.Addr
+	packet []byte
+}
+
+// Answers messages received on conn until it is closed
+func (s *Server) Serve(conn net.PacketConn) error {
+	workers := s.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	packets := make(chan receivedPacket, packetQueueSize)
+	defer close(packets)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for p := range packets {
+				if response := s.handlePacket(p.addr.String(), p.packet, time.Now()); response != nil {
+					if _, err := conn.WriteTo(response, p.addr); err != nil {
+						log.Printf("CoAP response to %s: %v", p.addr, err)
+					}
+				}
+			}
+		}()
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n > maxMessageBytes {
+			continue
+		}
+		select {
+		case packets <- receivedPacket{addr: addr, packet: append([]byte{}, buf[:n]...)}:
+		default:
+		}
+	}
+}
+
+// The response to a packet from the address `from`, or nil if there should be none
+func (s *Server) handlePacket(from string, packet []byte, now time.Time) []byte {
+	req, err := parseMessage(packet)
+	if err != nil {
+		// a confirmable message which cannot be read is rejected, anything else is ignored
+		if len(packet) >= 4 && packet[0]>>6 == 1 && messageType(packet[0]>>4&0x3) == typeConfirmable {
+			return message{Type: typeReset, MessageId: binary.BigEndian.Uint16(packet[2:4])}.marshal()
+		}
+		return nil
+	}
+	if req.Type == typeAcknowledgement || req.Type == typeReset {
+		return nil
+	} else if !req.Code.isRequest() {
+		// an empty confirmable message is a ping
+		if req.Type == typeConfirmable {
+			return message{Type: typeReset, MessageId: req.MessageId}.marshal()
+		}
+		return nil
+	}
+
+	// a retransmission gets the same response rather than being handled again
+	exchange := fmt.Sprintf("%s/%d", from, req.MessageId)
+	if response := s.cachedResponse(exchange, now); response != nil {
+		return response
+	}
+	status, options, payload := s.handleRequest(req, from, now)
+	response := message{Type: typeAcknowledgement, Code: status, MessageId: req.MessageId, Token: req.Token,
+		Options: options, Payload: payload}
+	if req.Type == typeNonConfirmable {
+		response.Type = typeNonConfirmable
+		response.MessageId = s.newMessageId()
+	}
+	b := response.marshal()
+	s.cacheResponse(exchange, b, now)
+	return b
+}
+
+func (s *Server) cachedResponse(exchange string, now time.Time) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cached, ok := s.responses[exchange]; ok && now.Before(cached.expires) {
+		return cached.response
+	}
+	return nil
+}
+
+func (s *Server) cacheResponse(exchange string, response []byte, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.responses == nil {
+		s.responses = map[string]cachedResponse{}
+	}
+	if now.Sub(s.lastPurge) > time.Second {
+		for k, cached := range s.responses {
+			if !now.Before(cached.expires) {
+				delete(s.responses, k)
+			}
+		}
+		s.lastPurge = now
+	}
+	if len(s.responses) >= maxCachedResponses {
+		return
+	}
+	s.responses[exchange] = cachedResponse{response: response, expires: now.Add(exchangeLifetime)}
+}
+
+func (s *Server) newMessageId() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nextMessageId == 0 {
+		// RFC 7252 says to start somewhere unpredictable
+		s.nextMessageId = uint16(time.Now().UnixNano())
+	}
+	s.nextMessageId++
+	return s.nextMessageId
+}
+
+// Finds the key the message was signed with and the user it saves measurements as
+func (s *Server) authenticate(req message) (*worrywort.SensorKey, *worrywort.User, error) {
+	query := req.query()
+	id, err := strconv.ParseInt(query["k"], 10, 64)
+	if err != nil {
+		return nil, nil, errUnauthorized
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(query["s"])
+	if err != nil {
+		return nil, nil, errUnauthorized
+	}
+	key, err := worrywort.FindSensorKey(map[string]interface{}{"id": id, "active": true}, s.Db)
+	if err == sql.ErrNoRows {
+		return nil, nil, errUnauthorized
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if !key.Verify(req.Payload, signature) {
+		return nil, nil, errUnauthorized
+	}
+	user, err := worrywort.FindUser(map[string]interface{}{"id": *key.UserId, "is_active": true}, s.Db)
+	if err == sql.ErrNoRows {
+		return nil, nil, errUnauthorized
+	}
+	return key, user, err
+}
+
+// The fields of a JSON or CBOR map, as url.Values for rest_api.TemperatureMeasurementForm
+func payloadValues(req message) (url.Values, error) {
+	format, ok := req.contentFormat()
+	if !ok {
+		// small devices do not always bother setting the Content-Format
+		format = contentFormatCBOR
+		if bytes.HasPrefix(bytes.TrimSpace(req.Payload), []byte("{")) {
+			format = contentFormatJSON
+		}
+	}
+
+	body := map[string]interface{}{}
+	switch format {
+	case contentFormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(req.Payload))
+		decoder.UseNumber()
+		if err := decoder.Decode(&body); err != nil {
+			return nil, errInvalidPayload
+		}
+	case contentFormatCBOR:
+		if err := cbor.Unmarshal(req.Payload, &body); err != nil {
+			return nil, errInvalidPayload
+		}
+	default:
+		return nil, errUnsupportedContentFormat
+	}
+
+	values := url.Values{"metric": {"temperature"}, "units": {"CELSIUS"}}
+	for k, v := range body {
+		switch v := v.(type) {
+		case string:
+			values.Set(k, v)
+		case json.Number:
+			values.Set(k, v.String())
+		case uint64:
+			values.Set(k, strconv.FormatUint(v, 10))
+		case int64:
+			values.Set(k, strconv.FormatInt(v, 10))
+		case float32:
+			values.Set(k, strconv.FormatFloat(float64(v), 'f', -1, 32))
+		case float64:
+			values.Set(k, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			return nil, errInvalidPayload
+		}
+	}
+	return values, nil
+}
+
+// A 4.29 with Max-Age as the number of seconds to wait
+func tooManyRequests(wait time.Duration) (code, []option, []byte) {
+	maxAge := uint(math.Ceil(wait.Seconds()))
+	return codeTooManyRequests, []option{{Number: optionMaxAge, Value: encodeUint(maxAge)}}, nil
+}
+
+func (s *Server) handleRequest(req message, from string, now time.Time) (code, []option, []byte) {
+	if req.path() != MeasurementPath {
+		return codeNotFound, nil, nil
+	} else if req.Code != codePOST {
+		return codeMethodNotAllowed, nil, nil
+	}
+	// messages are not authenticated until the key is looked up, so the sender is limited first
+	if s.IPLimiter != nil {
+		host, _, err := net.SplitHostPort(from)
+		if err != nil {
+			host = from
+		}
+		allowed, wait, err := s.IPLimiter.Allow(host)
+		if err != nil {
+			log.Printf("%v", err)
+		} else if !allowed {
+			return tooManyRequests(wait)
+		}
+	}
+	// before looking at the payload, so that only key holders get anything more than an empty response
+	key, user, err := s.authenticate(req)
+	if err == errUnauthorized {
+		return codeUnauthorized, nil, nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return codeInternalServerError, nil, nil
+	}
+
+	values, err := payloadValues(req)
+	if err == errUnsupportedContentFormat {
+		return codeUnsupportedContentFormat, nil, nil
+	} else if err != nil {
+		return codeBadRequest, nil, []byte(err.Error())
+	}
+	if values.Get("recorded_at") == "" {
+		return codeBadRequest, nil, []byte(errMissingRecordedAt.Error())
+	}
+	// an unparseable time is left to the form's errors
+	if recordedAt, err := worrywort.ParseTimestamp(values.Get("recorded_at")); err == nil &&
+		(recordedAt.Before(now.Add(-maxRecordedAtAge)) || recordedAt.After(now.Add(maxRecordedAtSkew))) {
+		return codeBadRequest, nil, []byte(errStaleRecordedAt.Error())
+	}
+	// the key decides the sensor
+	sensor, err := worrywort.FindSensor(map[string]interface{}{"id": *key.SensorId}, s.Db)
+	if err != nil {
+		log.Printf("%v", err)
+		return codeInternalServerError, nil, nil
+	}
+	values.Set("sensor_id", sensor.UUID)
+
+	form := rest_api.NewTemperatureMeasurementForm(user, nil, s.Db)
+	form.Validate(values)
+	if !form.IsValid() {
+		diagnostic, _ := json.Marshal(form)
+		return codeBadRequest, []option{{Number: optionContentFormat, Value: encodeUint(contentFormatJSON)}},
+			diagnostic
+	}
+
+	m := form.CleanedMeasurement
+	if s.SensorLimiter != nil {
+		allowed, wait, err := s.SensorLimiter.Allow(fmt.Sprintf("%d", *m.SensorId))
+		if err != nil {
+			log.Printf("%v", err)
+		} else if !allowed {
+			return tooManyRequests(wait)
+		}
+	}
+	switch err := m.Save(s.Db); err {
+	case nil:
+		s.Notifier.Created(m)
+		return codeCreated, nil, nil
+	case worrywort.ErrDuplicateTemperatureMeasurement:
+		return codeChanged, nil, nil
+	default:
+		log.Printf("%v", err)
+		return codeInternalServerError, nil, nil
+	}
+}
@@ -0,0 +1,245 @@
+package graphql_api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"sync"
+)
+
+// Admin only queries and mutations.  Everything here must check middleware.RequireAdmin()
+
+// Checks that the user in the context is an admin, converting the middleware errors to what the api returns
+func requireAdmin(ctx context.Context) (*worrywort.User, error) {
+	u, err := middleware.RequireAdmin(ctx)
+	if err == middleware.ErrUserNotInContext {
+		return nil, ErrUserNotAuthenticated
+	}
+	return u, err
+}
+
+type adminResolver struct {
+	db *sqlx.DB
+}
+
+func (r *Resolver) Admin(ctx context.Context) (*adminResolver, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	return &adminResolver{db: r.db}, nil
+}
+
+func (r *adminResolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*adminUserResolver, error) {
+	user, err := worrywort.FindUser(map[string]interface{}{"uuid": string(args.ID)}, r.db)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%v", err)
+			return nil, ErrServerError
+		}
+		return nil, nil
+	}
+	return &adminUserResolver{u: user, db: r.db}, nil
+}
+
+func (r *adminResolver) Users(ctx context.Context, args struct {
+	First    *int32
+	After    *string
+	Search   *string
+	IsActive *bool
+}) (*adminUserConnection, error) {
+	var first *int
+	if args.First != nil {
+		first = new(int)
+		*first = int(*args.First)
+	}
+
+	queryparams := map[string]interface{}{}
+	if args.Search != nil && *args.Search != "" {
+		queryparams["search"] = *args.Search
+	}
+	if args.IsActive != nil {
+		queryparams["is_active"] = *args.IsActive
+	}
+
+	offset := 0
+	if args.After != nil && *args.After != "" {
+		if cursorData, err := DecodeCursor(*args.After); err == nil && cursorData.Offset != nil {
+			offset = *cursorData.Offset
+			queryparams["offset"] = *cursorData.Offset
+		}
+	}
+
+	if first != nil {
+		queryparams["limit"] = *first + 1 // +1 to easily see if there are more
+	}
+
+	users, err := worrywort.FindUsers(queryparams, r.db)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+
+	hasNextPage := false
+	hasPreviousPage := false
+	edges := []*adminUserEdge{}
+	for i, u := range users {
+		if first == nil || i < *first {
+			c, err := MakeOffsetCursor(offset + i + 1)
+			if err != nil {
+				log.Printf("%s", err)
+				return nil, ErrServerError
+			}
+			edges = append(edges, &adminUserEdge{Node: &adminUserResolver{u: u, db: r.db}, Cursor: c})
+		} else {
+			hasNextPage = true
+		}
+	}
+	return &adminUserConnection{
+		PageInfo: &pageInfo{HasNextPage: hasNextPage, HasPreviousPage: hasPreviousPage},
+		Edges:    &edges}, nil
+}
+
+type adminUserResolver struct {
+	u  *worrywort.User
+	db *sqlx.DB
+
+	// the counts are all fetched with one query the first time any of them is resolved
+	countsOnce sync.Once
+	counts     worrywort.UserCounts
+	countsErr  error
+}
+
+func (r *adminUserResolver) ID() graphql.ID      { return graphql.ID(r.u.UUID) }
+func (r *adminUserResolver) User() *userResolver { return &userResolver{u: r.u} }
+func (r *adminUserResolver) IsActive() bool      { return r.u.IsActive }
+func (r *adminUserResolver) IsAdmin() bool       { return r.u.IsAdmin }
+
+func (r *adminUserResolver) userCounts() (worrywort.UserCounts, error) {
+	r.countsOnce.Do(func() {
+		r.counts, r.countsErr = worrywort.FindUserCounts(*r.u.Id, r.db)
+		if r.countsErr != nil {
+			log.Printf("%v", r.countsErr)
+			r.countsErr = ErrServerError
+		}
+	})
+	return r.counts, r.countsErr
+}
+
+func (r *adminUserResolver) BatchCount() (int32, error) {
+	c, err := r.userCounts()
+	return int32(c.Batches), err
+}
+
+func (r *adminUserResolver) SensorCount() (int32, error) {
+	c, err := r.userCounts()
+	return int32(c.Sensors), err
+}
+
+func (r *adminUserResolver) TemperatureMeasurementCount() (int32, error) {
+	c, err := r.userCounts()
+	return int32(c.TemperatureMeasurements), err
+}
+
+type adminUserEdge struct {
+	Cursor string
+	Node   *adminUserResolver
+}
+
+func (r *adminUserEdge) CURSOR() string {
+	return base64.StdEncoding.EncodeToString([]byte(r.Cursor))
+}
+func (r *adminUserEdge) NODE() *adminUserResolver { return r.Node }
+
+type adminUserConnection struct {
+	Edges    *[]*adminUserEdge
+	PageInfo *pageInfo
+}
+
+func (r *adminUserConnection) PAGEINFO() pageInfo       { return *r.PageInfo }
+func (r *adminUserConnection) EDGES() *[]*adminUserEdge { return r.Edges }
+
+// Mutations
+
+// Input types
+type adminSetUserActiveInput struct {
+	UserId   graphql.ID
+	IsActive bool
+}
+
+type adminResetUserTokensInput struct {
+	UserId graphql.ID
+}
+
+// Mutation Payloads
+type adminUserPayload struct {
+	adminUser  *adminUserResolver
+	userErrors []*userErrorResolver
+}
+
+func (p adminUserPayload) AdminUser() *adminUserResolver     { return p.adminUser }
+func (p adminUserPayload) UserErrors() *[]*userErrorResolver { return &p.userErrors }
+
+func (r *Resolver) AdminSetUserActive(ctx context.Context, args *struct {
+	Input *adminSetUserActiveInput
+}) (*adminUserPayload, error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	input := *args.Input
+	user, err := worrywort.FindUser(map[string]interface{}{"uuid": string(input.UserId)}, r.db)
+	if err == sql.ErrNoRows {
+		e := &userErrorResolver{f: []string{"userId"}, err: "User does not exist."}
+		return &adminUserPayload{userErrors: []*userErrorResolver{e}}, nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+
+	// An admin locking themselves out is almost certainly a mistake and there may be no one to undo it
+	if *user.Id == *admin.Id && !input.IsActive {
+		e := &userErrorResolver{f: []string{"userId"}, err: "You cannot deactivate your own account."}
+		return &adminUserPayload{userErrors: []*userErrorResolver{e}}, nil
+	}
+
+	before := *user
+	user.IsActive = input.IsActive
+	if err := user.Save(r.db); err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, admin, worrywort.AUDIT_ACTION_SET_ACTIVE, worrywort.AUDIT_ENTITY_USER, user.UUID, before, user)
+	return &adminUserPayload{adminUser: &adminUserResolver{u: user, db: r.db}}, nil
+}
+
+func (r *Resolver) AdminResetUserTokens(ctx context.Context, args *struct {
+	Input *adminResetUserTokensInput
+}) (*adminUserPayload, error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	input := *args.Input
+	user, err := worrywort.FindUser(map[string]interface{}{"uuid": string(input.UserId)}, r.db)
+	if err == sql.ErrNoRows {
+		e := &userErrorResolver{f: []string{"userId"}, err: "User does not exist."}
+		return &adminUserPayload{userErrors: []*userErrorResolver{e}}, nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+
+	if err := worrywort.DeleteAllUserAuthTokens(*user.Id, r.db); err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, admin, worrywort.AUDIT_ACTION_RESET_TOKENS, worrywort.AUDIT_ENTITY_USER, user.UUID, nil, nil)
+	return &adminUserPayload{adminUser: &adminUserResolver{u: user, db: r.db}}, nil
+}
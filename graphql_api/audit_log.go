@@ -0,0 +1,142 @@
+package graphql_api
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/graph-gophers/graphql-go"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"log"
+)
+
+// Context key for the IP of the client making the request, set by Handler
+const remoteIPKey = "remoteIP"
+
+// Records an action in the audit log.  actor is who acted, or nil to use the authenticated user.  before and after
+// are the entity before and after the change and either may be nil, see worrywort.AuditChanges.  Failures are only
+// logged since the change has already been made by the time it is recorded.
+func (r *Resolver) audit(ctx context.Context, actor *worrywort.User, action, entityType, entityId string,
+	before, after interface{}) {
+	entry := worrywort.AuditLogEntry{Action: action, EntityType: entityType, EntityId: entityId}
+	if actor == nil {
+		actor, _ = middleware.UserFromContext(ctx)
+	}
+	if actor != nil {
+		entry.UserId = actor.Id
+	}
+	if token, _ := middleware.AuthTokenFromContext(ctx); token != nil {
+		entry.TokenId = token.Id
+	}
+	entry.ImpersonatorId = middleware.ImpersonatorIdFromContext(ctx)
+	entry.IP, _ = ctx.Value(remoteIPKey).(string)
+
+	changes, err := worrywort.AuditChanges(before, after)
+	if err != nil {
+		log.Printf("Failed to record %s %s in the audit log: %v", action, entityType, err)
+		return
+	}
+	entry.Changes = changes
+	if err := entry.Save(r.db); err != nil {
+		log.Printf("Failed to record %s %s in the audit log: %v", action, entityType, err)
+	}
+}
+
+type auditLogEntryResolver struct {
+	e *worrywort.AuditLogEntry
+}
+
+func (r *auditLogEntryResolver) ID() graphql.ID       { return graphql.ID(fmt.Sprintf("%d", *r.e.Id)) }
+func (r *auditLogEntryResolver) Action() string       { return r.e.Action }
+func (r *auditLogEntryResolver) EntityType() string   { return r.e.EntityType }
+func (r *auditLogEntryResolver) EntityId() graphql.ID { return graphql.ID(r.e.EntityId) }
+func (r *auditLogEntryResolver) Changes() string      { return string(r.e.Changes) }
+func (r *auditLogEntryResolver) TokenId() string      { return r.e.TokenId }
+func (r *auditLogEntryResolver) IP() string           { return r.e.IP }
+func (r *auditLogEntryResolver) Impersonated() bool   { return r.e.ImpersonatorId != nil }
+func (r *auditLogEntryResolver) CreatedAt() DateTime  { return DateTime{r.e.CreatedAt} }
+
+type auditLogEntryEdge struct {
+	Cursor string
+	Node   *auditLogEntryResolver
+}
+
+func (r *auditLogEntryEdge) CURSOR() string {
+	return base64.StdEncoding.EncodeToString([]byte(r.Cursor))
+}
+func (r *auditLogEntryEdge) NODE() *auditLogEntryResolver { return r.Node }
+
+type auditLogEntryConnection struct {
+	Edges    *[]*auditLogEntryEdge
+	PageInfo *pageInfo
+}
+
+func (r *auditLogEntryConnection) PAGEINFO() pageInfo           { return *r.PageInfo }
+func (r *auditLogEntryConnection) EDGES() *[]*auditLogEntryEdge { return r.Edges }
+
+// The authenticated user's audit trail, newest first
+func (r *Resolver) AuditLog(ctx context.Context, args struct {
+	First      *int32
+	After      *string
+	EntityType *string
+	EntityId   *string
+	Since      *DateTime
+	Until      *DateTime
+}) (*auditLogEntryConnection, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+
+	queryparams := map[string]interface{}{"user_id": *u.Id}
+	if args.EntityType != nil {
+		queryparams["entity_type"] = *args.EntityType
+	}
+	if args.EntityId != nil {
+		queryparams["entity_id"] = *args.EntityId
+	}
+	if args.Since != nil {
+		queryparams["since"] = args.Since.Time
+	}
+	if args.Until != nil {
+		queryparams["until"] = args.Until.Time
+	}
+
+	offset := 0
+	if args.After != nil && *args.After != "" {
+		if cursorData, err := DecodeCursor(*args.After); err == nil && cursorData.Offset != nil {
+			offset = *cursorData.Offset
+			queryparams["offset"] = *cursorData.Offset
+		}
+	}
+	var first *int
+	if args.First != nil {
+		first = new(int)
+		*first = int(*args.First)
+		queryparams["limit"] = *first + 1 // +1 to easily see if there are more
+	}
+
+	entries, err := worrywort.FindAuditLogEntries(queryparams, r.db)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+
+	hasNextPage := false
+	edges := []*auditLogEntryEdge{}
+	for i, e := range entries {
+		if first != nil && i >= *first {
+			hasNextPage = true
+			break
+		}
+		c, err := MakeOffsetCursor(offset + i + 1)
+		if err != nil {
+			log.Printf("%s", err)
+			return nil, ErrServerError
+		}
+		edges = append(edges, &auditLogEntryEdge{Node: &auditLogEntryResolver{e: e}, Cursor: c})
+	}
+	return &auditLogEntryConnection{
+		PageInfo: &pageInfo{HasNextPage: hasNextPage, HasPreviousPage: false},
+		Edges:    &edges}, nil
+}
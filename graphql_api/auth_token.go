@@ -13,3 +13,10 @@ type authTokenResolver struct {
 
 func (a *authTokenResolver) ID() graphql.ID { return graphql.ID(a.t.ForAuthenticationHeader()) }
 func (a *authTokenResolver) Token() string  { return a.t.ForAuthenticationHeader() }
+
+func (a *authTokenResolver) ExpiresAt() *DateTime {
+	if !a.t.ExpiresAt.Valid {
+		return nil
+	}
+	return &DateTime{a.t.ExpiresAt.Time}
+}
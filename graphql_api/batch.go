@@ -118,6 +118,9 @@ func (r *batchResolver) CreatedBy(ctx context.Context) (*userResolver, error) {
 	return resolved, err
 }
 
+// The team the batch is shared with, if the authenticated user is in it
+func (r *batchResolver) Team(ctx context.Context) *teamResolver { return resolveTeam(ctx, r.b.TeamId) }
+
 type batchEdge struct {
 	Cursor string
 	Node   *batchResolver
@@ -164,6 +167,7 @@ type createBatchInput struct {
 	// AverageTemperature *float64  not even sure this should be on the model...
 	RecipeURL    *string
 	TastingNotes *string
+	TeamId       *graphql.ID
 }
 
 // Mutation Payloads
@@ -197,10 +201,18 @@ func (r *Resolver) CreateBatch(ctx context.Context, args *struct {
 	// TODO: Handle all of the optional inputs which could come in as null here but should be empty string when saved
 	// or could come in as an empty string but should be saved to db as null or nullint, etc.
 	batch := worrywort.Batch{UserId: u.Id, Name: input.Name, BrewedDate: brewedAt, BottledDate: &bottledAt}
+	if input.TeamId != nil {
+		team, err := findMemberTeam(*input.TeamId, *u.Id, worrywort.TEAM_ROLE_BREWER, r.db)
+		if err != nil {
+			return nil, err
+		}
+		batch.TeamId = team.Id
+	}
 	if err := batch.Save(r.db); err != nil {
 		log.Printf("Failed to save Batch: %v\n", err)
 		return nil, err
 	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_CREATE, worrywort.AUDIT_ENTITY_BATCH, batch.UUID, nil, batch)
 
 	resolvedBatch := batchResolver{b: &batch}
 	result := createBatchPayload{b: &resolvedBatch}
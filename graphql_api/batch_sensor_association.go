@@ -131,7 +131,7 @@ func (r *Resolver) AssociateSensorToBatch(ctx context.Context, args *struct {
 	var inputPtr *associateSensorToBatchInput = args.Input
 	var input associateSensorToBatchInput = *inputPtr
 
-	batchPtr, err := worrywort.FindBatch(map[string]interface{}{"user_id": *u.Id, "uuid": input.BatchId}, db)
+	batchPtr, err := worrywort.FindBatch(map[string]interface{}{"editable_by": *u.Id, "uuid": input.BatchId}, db)
 	if err != nil || batchPtr == nil {
 		if err != sql.ErrNoRows {
 			log.Printf("%v", err)
@@ -141,7 +141,7 @@ func (r *Resolver) AssociateSensorToBatch(ctx context.Context, args *struct {
 	}
 
 	// TODO!: Make sure the sensor is not already associated with a batch
-	sensorPtr, err := worrywort.FindSensor(map[string]interface{}{"uuid": input.SensorId, "user_id": *u.Id}, db)
+	sensorPtr, err := worrywort.FindSensor(map[string]interface{}{"uuid": input.SensorId, "editable_by": *u.Id}, db)
 	if err != nil || sensorPtr == nil {
 		// TODO: Probably need a friendlier error here or for our payload to have a shopify style userErrors
 		// and then not ever return nil from this either way...maybe
@@ -156,7 +156,7 @@ func (r *Resolver) AssociateSensorToBatch(ctx context.Context, args *struct {
 	// TODO: Is this correct?  Maybe I really want to associate a sensor with 2 batches, such as for
 	// ambient air temperature. Maybe this should only ensure it's not associated with the same batch twice.
 	_, err = worrywort.FindBatchSensorAssociation(
-		map[string]interface{}{"sensor_id": *sensorPtr.Id, "disassociated_at": nil, "user_id": *u.Id}, db)
+		map[string]interface{}{"sensor_id": *sensorPtr.Id, "disassociated_at": nil}, db)
 
 	if err != nil && err != sql.ErrNoRows {
 		log.Printf("%v", err)
@@ -180,6 +180,8 @@ func (r *Resolver) AssociateSensorToBatch(ctx context.Context, args *struct {
 
 	association.Batch = batchPtr
 	association.Sensor = sensorPtr
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_CREATE, worrywort.AUDIT_ENTITY_BATCH_SENSOR_ASSOCIATION, association.Id,
+		nil, association)
 	resolvedAssoc := batchSensorAssociationResolver{assoc: association}
 	result := associateSensorToBatchPayload{assoc: &resolvedAssoc}
 	return &result, nil
@@ -207,7 +209,7 @@ func (r *Resolver) UpdatebatchSensorAssociation(ctx context.Context, args *struc
 	}
 	associatedAt := input.AssociatedAt.Time
 	association, err := worrywort.FindBatchSensorAssociation(
-		map[string]interface{}{"id": string(input.ID), "user_id": u.Id}, db)
+		map[string]interface{}{"id": string(input.ID), "editable_by": *u.Id}, db)
 
 	if err == sql.ErrNoRows {
 		return nil, errors.New("BatchSensorAssociation does not exist.")
@@ -222,6 +224,7 @@ func (r *Resolver) UpdatebatchSensorAssociation(ctx context.Context, args *struc
 	} else {
 		description = ""
 	}
+	before := *association
 	association.Description = description
 	association.AssociatedAt = associatedAt
 	association.DisassociatedAt = disassociatedAt
@@ -230,6 +233,8 @@ func (r *Resolver) UpdatebatchSensorAssociation(ctx context.Context, args *struc
 	if err != nil {
 		return nil, err
 	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_UPDATE, worrywort.AUDIT_ENTITY_BATCH_SENSOR_ASSOCIATION, association.Id,
+		before, association)
 
 	resolvedAssoc := batchSensorAssociationResolver{assoc: association}
 	result := updateBatchSensorAssociationPayload{assoc: &resolvedAssoc}
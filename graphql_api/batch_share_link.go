@@ -0,0 +1,354 @@
+package graphql_api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"time"
+)
+
+// Share links and the public, read-only view of a batch they give.  Anyone may use sharedBatch, so the Shared* types
+// only expose what is safe to show to strangers.  Do not return the regular Batch, Sensor, or User types from them.
+
+// Most temperature measurements returned per page through a share link
+const maxSharedMeasurementsPage = 500
+
+var ErrShareLinkNotFound = errors.New("Specified share link does not exist.")
+
+type batchShareLinkResolver struct {
+	l *worrywort.BatchShareLink
+}
+
+func (r *batchShareLinkResolver) ID() graphql.ID      { return graphql.ID(r.l.Id) }
+func (r *batchShareLinkResolver) Slug() string        { return r.l.Slug }
+func (r *batchShareLinkResolver) IsActive() bool      { return r.l.IsActive() }
+func (r *batchShareLinkResolver) CreatedAt() DateTime { return DateTime{r.l.CreatedAt} }
+func (r *batchShareLinkResolver) ExpiresAt() *DateTime {
+	if r.l.ExpiresAt == nil {
+		return nil
+	}
+	return &DateTime{*r.l.ExpiresAt}
+}
+func (r *batchShareLinkResolver) RevokedAt() *DateTime {
+	if r.l.RevokedAt == nil {
+		return nil
+	}
+	return &DateTime{*r.l.RevokedAt}
+}
+
+// The batch's share links, newest first.  Null unless the authenticated user can change the batch.
+func (r *batchResolver) ShareLinks(ctx context.Context) (*[]*batchShareLinkResolver, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	db, ok := ctx.Value("db").(*sqlx.DB)
+	if u == nil || !ok {
+		return nil, nil
+	}
+	if _, err := worrywort.FindBatch(map[string]interface{}{"id": *r.b.Id, "editable_by": *u.Id}, db); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%v", err)
+		}
+		return nil, nil
+	}
+	links, err := worrywort.FindBatchShareLinks(map[string]interface{}{"batch_id": *r.b.Id}, db)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	resolved := []*batchShareLinkResolver{}
+	for _, l := range links {
+		resolved = append(resolved, &batchShareLinkResolver{l: l})
+	}
+	return &resolved, nil
+}
+
+// The public view of a batch
+type sharedBatchResolver struct {
+	b *worrywort.Batch
+}
+
+func (r *sharedBatchResolver) Name() string         { return r.b.Name }
+func (r *sharedBatchResolver) BrewNotes() string    { return r.b.BrewNotes }
+func (r *sharedBatchResolver) TastingNotes() string { return r.b.TastingNotes }
+func (r *sharedBatchResolver) RecipeURL() string    { return r.b.RecipeURL }
+
+// The rest are the same as on Batch
+func (r *sharedBatchResolver) BrewedDate() *DateTime  { return (&batchResolver{b: r.b}).BrewedDate() }
+func (r *sharedBatchResolver) BottledDate() *DateTime { return (&batchResolver{b: r.b}).BottledDate() }
+func (r *sharedBatchResolver) VolumeBoiled() *float64 { return (&batchResolver{b: r.b}).VolumeBoiled() }
+func (r *sharedBatchResolver) VolumeInFermentor() *float64 {
+	return (&batchResolver{b: r.b}).VolumeInFermentor()
+}
+func (r *sharedBatchResolver) OriginalGravity() *float64 {
+	return (&batchResolver{b: r.b}).OriginalGravity()
+}
+func (r *sharedBatchResolver) FinalGravity() *float64 { return (&batchResolver{b: r.b}).FinalGravity() }
+func (r *sharedBatchResolver) VolumeUnits() worrywort.VolumeUnitType {
+	return r.b.VolumeUnits
+}
+
+// Only the username of whoever brewed it
+func (r *sharedBatchResolver) CreatedBy(ctx context.Context) (*sharedUserResolver, error) {
+	db, ok := ctx.Value("db").(*sqlx.DB)
+	if !ok {
+		log.Printf("No database in context")
+		return nil, ErrServerError
+	}
+	user, err := worrywort.FindUser(map[string]interface{}{"id": *r.b.UserId}, db)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%v", err)
+		}
+		return nil, nil
+	}
+	return &sharedUserResolver{username: user.Username}, nil
+}
+
+func (r *sharedBatchResolver) SensorAssociations(ctx context.Context) ([]*sharedBatchSensorAssociationResolver,
+	error) {
+	db, ok := ctx.Value("db").(*sqlx.DB)
+	if !ok {
+		log.Printf("No database in context")
+		return nil, ErrServerError
+	}
+	associations, err := worrywort.FindBatchSensorAssociations(map[string]interface{}{"batch_id": *r.b.Id}, db)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	resolved := []*sharedBatchSensorAssociationResolver{}
+	for _, a := range associations {
+		resolved = append(resolved, &sharedBatchSensorAssociationResolver{assoc: a})
+	}
+	return resolved, nil
+}
+
+// The batch's temperatures, oldest first
+func (r *sharedBatchResolver) TemperatureMeasurements(ctx context.Context, args struct {
+	First *int32
+	After *string
+}) (*sharedTemperatureMeasurementConnection, error) {
+	db, ok := ctx.Value("db").(*sqlx.DB)
+	if !ok {
+		log.Printf("No database in context")
+		return nil, ErrServerError
+	}
+
+	first := maxSharedMeasurementsPage
+	if args.First != nil && int(*args.First) < maxSharedMeasurementsPage {
+		first = int(*args.First)
+	}
+	offset := 0
+	queryparams := map[string]interface{}{"batch_uuid": r.b.UUID, "order_by": "recorded_at", "limit": first + 1}
+	if args.After != nil && *args.After != "" {
+		if cursorData, err := DecodeCursor(*args.After); err == nil && cursorData.Offset != nil {
+			offset = *cursorData.Offset
+			queryparams["offset"] = *cursorData.Offset
+		}
+	}
+
+	measurements, err := worrywort.FindTemperatureMeasurements(queryparams, db)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	// the sensor names, without looking each sensor up again
+	sensorNames := map[int64]string{}
+	associations, err := worrywort.FindBatchSensorAssociations(map[string]interface{}{"batch_id": *r.b.Id}, db)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	for _, a := range associations {
+		sensorNames[*a.SensorId] = a.Sensor.Name
+	}
+
+	hasNextPage := false
+	edges := []*sharedTemperatureMeasurementEdge{}
+	for i, m := range measurements {
+		if i >= first {
+			hasNextPage = true
+			break
+		}
+		c, err := MakeOffsetCursor(offset + i + 1)
+		if err != nil {
+			log.Printf("%s", err)
+			return nil, ErrServerError
+		}
+		resolved := &sharedTemperatureMeasurementResolver{m: m, sensorName: sensorNames[*m.SensorId]}
+		edges = append(edges, &sharedTemperatureMeasurementEdge{Node: resolved, Cursor: c})
+	}
+	return &sharedTemperatureMeasurementConnection{
+		PageInfo: &pageInfo{HasNextPage: hasNextPage, HasPreviousPage: false},
+		Edges:    &edges}, nil
+}
+
+type sharedUserResolver struct {
+	username string
+}
+
+func (r *sharedUserResolver) Username() string { return r.username }
+
+type sharedBatchSensorAssociationResolver struct {
+	assoc *worrywort.BatchSensor
+}
+
+func (r *sharedBatchSensorAssociationResolver) SensorName() string  { return r.assoc.Sensor.Name }
+func (r *sharedBatchSensorAssociationResolver) Description() string { return r.assoc.Description }
+func (r *sharedBatchSensorAssociationResolver) AssociatedAt() DateTime {
+	return DateTime{r.assoc.AssociatedAt}
+}
+func (r *sharedBatchSensorAssociationResolver) DisassociatedAt() *DateTime {
+	if r.assoc.DisassociatedAt == nil {
+		return nil
+	}
+	return &DateTime{*r.assoc.DisassociatedAt}
+}
+
+type sharedTemperatureMeasurementResolver struct {
+	m          *worrywort.TemperatureMeasurement
+	sensorName string
+}
+
+func (r *sharedTemperatureMeasurementResolver) Temperature() float64 { return r.m.Temperature }
+func (r *sharedTemperatureMeasurementResolver) Units() worrywort.TemperatureUnitType {
+	return r.m.Units
+}
+func (r *sharedTemperatureMeasurementResolver) RecordedAt() DateTime { return DateTime{r.m.RecordedAt} }
+func (r *sharedTemperatureMeasurementResolver) SensorName() string   { return r.sensorName }
+
+type sharedTemperatureMeasurementEdge struct {
+	Cursor string
+	Node   *sharedTemperatureMeasurementResolver
+}
+
+func (r *sharedTemperatureMeasurementEdge) CURSOR() string {
+	return base64.StdEncoding.EncodeToString([]byte(r.Cursor))
+}
+func (r *sharedTemperatureMeasurementEdge) NODE() *sharedTemperatureMeasurementResolver {
+	return r.Node
+}
+
+type sharedTemperatureMeasurementConnection struct {
+	Edges    *[]*sharedTemperatureMeasurementEdge
+	PageInfo *pageInfo
+}
+
+func (r *sharedTemperatureMeasurementConnection) PAGEINFO() pageInfo { return *r.PageInfo }
+func (r *sharedTemperatureMeasurementConnection) EDGES() *[]*sharedTemperatureMeasurementEdge {
+	return r.Edges
+}
+
+// The batch for a share link.  Does not require authentication.  Null if the link does not exist, has expired, or
+// was revoked.
+func (r *Resolver) SharedBatch(ctx context.Context, args struct{ Slug string }) (*sharedBatchResolver, error) {
+	batch, err := worrywort.FindSharedBatch(args.Slug, r.db)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%v", err)
+			return nil, ErrServerError
+		}
+		return nil, nil
+	}
+	return &sharedBatchResolver{b: batch}, nil
+}
+
+// Input types
+type createBatchShareLinkInput struct {
+	BatchId   graphql.ID
+	ExpiresAt *DateTime
+}
+
+type revokeBatchShareLinkInput struct {
+	ID graphql.ID
+}
+
+// Mutation Payloads
+type batchShareLinkPayload struct {
+	shareLink  *batchShareLinkResolver
+	userErrors []*userErrorResolver
+}
+
+func (p batchShareLinkPayload) ShareLink() *batchShareLinkResolver { return p.shareLink }
+func (p batchShareLinkPayload) UserErrors() *[]*userErrorResolver  { return &p.userErrors }
+
+// Mutations
+
+// Shares a batch the authenticated user can change
+func (r *Resolver) CreateBatchShareLink(ctx context.Context, args *struct {
+	Input *createBatchShareLinkInput
+}) (*batchShareLinkPayload, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+	input := args.Input
+	batch, err := worrywort.FindBatch(
+		map[string]interface{}{"uuid": string(input.BatchId), "editable_by": *u.Id}, r.db)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Specified Batch does not exist.")
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+
+	var expiresAt *time.Time
+	if input.ExpiresAt != nil {
+		if !input.ExpiresAt.Time.After(time.Now()) {
+			e := &userErrorResolver{f: []string{"expiresAt"}, err: "expiresAt must be in the future."}
+			return &batchShareLinkPayload{userErrors: []*userErrorResolver{e}}, nil
+		}
+		expiresAt = &input.ExpiresAt.Time
+	}
+	link, err := worrywort.NewBatchShareLink(*batch, *u, expiresAt)
+	if err == nil {
+		err = link.Save(r.db)
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	// the slug is left out, it is all that is needed to view the batch
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_CREATE, worrywort.AUDIT_ENTITY_BATCH_SHARE_LINK, link.Id, nil,
+		map[string]interface{}{"batch_id": batch.UUID, "expires_at": link.ExpiresAt})
+	return &batchShareLinkPayload{shareLink: &batchShareLinkResolver{l: &link}}, nil
+}
+
+// Stops a share link from working.  Anyone who can change the batch may revoke its links.
+func (r *Resolver) RevokeBatchShareLink(ctx context.Context, args *struct {
+	Input *revokeBatchShareLinkInput
+}) (*batchShareLinkPayload, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+	link, err := worrywort.FindBatchShareLink(map[string]interface{}{"id": string(args.Input.ID)}, r.db)
+	if err == nil {
+		_, err = worrywort.FindBatch(map[string]interface{}{"id": *link.BatchId, "editable_by": *u.Id}, r.db)
+	}
+	if err == sql.ErrNoRows {
+		return nil, ErrShareLinkNotFound
+	} else if err != nil {
+		// also an invalid uuid for the id
+		log.Printf("%v", err)
+		return nil, ErrShareLinkNotFound
+	}
+
+	switch err := link.Revoke(r.db); err {
+	case nil:
+	case worrywort.ErrShareLinkRevoked:
+		e := &userErrorResolver{f: []string{"id"}, err: err.Error()}
+		return &batchShareLinkPayload{shareLink: &batchShareLinkResolver{l: link},
+			userErrors: []*userErrorResolver{e}}, nil
+	default:
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_REVOKE, worrywort.AUDIT_ENTITY_BATCH_SHARE_LINK, link.Id, nil, nil)
+	return &batchShareLinkPayload{shareLink: &batchShareLinkResolver{l: link}}, nil
+}
@@ -0,0 +1,88 @@
+package graphql_api
+
+import (
+	"context"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"log"
+)
+
+// Approving and denying devices using the OAuth 2.0 device authorization flow.  See worrywort.DeviceCode
+
+// Input types
+type approveDeviceInput struct {
+	UserCode   string
+	SensorName *string
+}
+
+type denyDeviceInput struct {
+	UserCode string
+}
+
+// Mutation Payloads
+type approveDevicePayload struct {
+	sensor     *sensorResolver
+	userErrors []*userErrorResolver
+}
+
+func (p approveDevicePayload) Sensor() *sensorResolver           { return p.sensor }
+func (p approveDevicePayload) UserErrors() *[]*userErrorResolver { return &p.userErrors }
+
+type denyDevicePayload struct {
+	userErrors []*userErrorResolver
+}
+
+func (p denyDevicePayload) Ok() bool                          { return len(p.userErrors) == 0 }
+func (p denyDevicePayload) UserErrors() *[]*userErrorResolver { return &p.userErrors }
+
+// Approves a device, creating the Sensor its token will be bound to
+func (r *Resolver) ApproveDevice(ctx context.Context, args *struct {
+	Input *approveDeviceInput
+}) (*approveDevicePayload, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+
+	input := *args.Input
+	sensorName := ""
+	if input.SensorName != nil {
+		sensorName = *input.SensorName
+	}
+	// TODO: MAGIC NUMBERS!!! same max sensor name length as UpdateSensor
+	if len(sensorName) > 25 {
+		e := &userErrorResolver{f: []string{"sensorName"}, err: "Name must be between 1 and 25 characters."}
+		return &approveDevicePayload{userErrors: []*userErrorResolver{e}}, nil
+	}
+
+	sensor, err := worrywort.ApproveDeviceCode(input.UserCode, *u, sensorName, r.db)
+	if err == worrywort.ErrInvalidUserCode {
+		e := &userErrorResolver{f: []string{"userCode"}, err: err.Error()}
+		return &approveDevicePayload{userErrors: []*userErrorResolver{e}}, nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_DEVICE_APPROVE, worrywort.AUDIT_ENTITY_SENSOR, sensor.UUID, nil, sensor)
+	return &approveDevicePayload{sensor: &sensorResolver{s: sensor}}, nil
+}
+
+func (r *Resolver) DenyDevice(ctx context.Context, args *struct {
+	Input *denyDeviceInput
+}) (*denyDevicePayload, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+
+	err := worrywort.DenyDeviceCode(args.Input.UserCode, *u, r.db)
+	if err == worrywort.ErrInvalidUserCode {
+		e := &userErrorResolver{f: []string{"userCode"}, err: err.Error()}
+		return &denyDevicePayload{userErrors: []*userErrorResolver{e}}, nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_DEVICE_DENY, worrywort.AUDIT_ENTITY_DEVICE_CODE, "", nil, nil)
+	return &denyDevicePayload{}, nil
+}
@@ -13,11 +13,16 @@ import (
 	"github.com/google/uuid"
 	"github.com/graph-gophers/graphql-go"
 	graphqlErrors "github.com/graph-gophers/graphql-go/errors"
+	"github.com/graph-gophers/graphql-go/relay"
 	"github.com/jmichalicek/worrywort-server-go/graphql_api"
 	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
 	"github.com/jmichalicek/worrywort-server-go/worrywort"
 	"github.com/jmoiron/sqlx"
+	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -64,6 +69,8 @@ func TestMain(m *testing.M) {
 		connString += fmt.Sprintf(" password=%s", dbPassword)
 	}
 	txdb.Register("txdb", "postgres", connString)
+	// test users are hashed with bcrypt.MinCost, don't slow every login down by upgrading them
+	worrywort.PasswordHashCost = bcrypt.MinCost
 	retCode := m.Run()
 	os.Exit(retCode)
 }
@@ -110,7 +117,8 @@ func TestLoginMutation(t *testing.T) {
 	defer db.Close()
 
 	var worrywortSchema = graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db))
-	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
 	// This is the hash for the password `password`
 	// var hashedPassword string = "$2a$13$pPg7mwPA.VFf3W9AUZyMGO0Q2nhoh/979F/TZ8ED.iqVubLe.TDmi"
 	err = worrywort.SetUserPassword(&user, "password", bcrypt.MinCost)
@@ -172,7 +180,8 @@ func TestLoginMutation(t *testing.T) {
 		query = db.Rebind(
 			`SELECT t.id, t.token, t.scope, t.expires_at, t.created_at, t.updated_at, t.type, u.id "user.id", u.uuid "user.uuid",
 				u.full_name "user.full_name", u.username "user.username", u.email "user.email",
-				u.created_at "user.created_at", u.updated_at "user.updated_at", u.password "user.password"
+				u.created_at "user.created_at", u.updated_at "user.updated_at", u.password "user.password",
+				u.is_active "user.is_active", u.is_admin "user.is_admin"
 			 FROM user_authtokens t
 			 INNER JOIN users u ON t.user_id = u.id
 			 WHERE t.id = ? AND t.type = ?`)
@@ -195,6 +204,55 @@ func TestLoginMutation(t *testing.T) {
 			t.Errorf("Expected User.Id %s but got %s", user.UUID, result.Login.User.Id)
 		}
 	})
+
+	t.Run("Test tokenType JWT returns a JWT", func(t *testing.T) {
+		jwtConfig := &worrywort.JWTConfig{Secret: []byte("01234567890123456789012345678901")}
+		jwtSchema := graphql.MustParseSchema(graphql_api.Schema,
+			graphql_api.NewResolver(db, graphql_api.WithJWTConfig(jwtConfig)))
+		variables := map[string]interface{}{"username": "user@example.com", "password": "password"}
+		query := `
+			mutation Login($username: String!, $password: String!) {
+				login(username: $username, password: $password, tokenType: JWT) {
+					token { token expiresAt }
+				}
+			}
+		`
+		resultData := jwtSchema.Exec(context.Background(), query, "", variables)
+		var result struct {
+			Login struct {
+				Token struct {
+					Token     string  `json:"token"`
+					ExpiresAt *string `json:"expiresAt"`
+				} `json:"token"`
+			} `json:"login"`
+		}
+		if err := json.Unmarshal(resultData.Data, &result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if result.Login.Token.ExpiresAt == nil {
+			t.Errorf("Expected expiresAt to be set")
+		}
+		token, err := jwtConfig.ParseAccessToken(result.Login.Token.Token)
+		if err != nil {
+			t.Fatalf("Could not parse returned JWT: %v", err)
+		}
+		if token.User.UUID != user.UUID {
+			t.Errorf("Expected JWT for user %s but got %s", user.UUID, token.User.UUID)
+		}
+	})
+
+	t.Run("Test tokenType JWT when not configured returns error", func(t *testing.T) {
+		variables := map[string]interface{}{"username": "user@example.com", "password": "password"}
+		query := `
+			mutation Login($username: String!, $password: String!) {
+				login(username: $username, password: $password, tokenType: JWT) { token { token } }
+			}
+		`
+		resultData := worrywortSchema.Exec(context.Background(), query, "", variables)
+		if len(resultData.Errors) != 1 || resultData.Errors[0].Message != worrywort.ErrJWTNotConfigured.Error() {
+			t.Errorf("Expected error %v but got %v", worrywort.ErrJWTNotConfigured, resultData.Errors)
+		}
+	})
 }
 
 func TestCurrentUserQuery(t *testing.T) {
@@ -611,6 +669,83 @@ func TestCreateTemperatureMeasurementMutation(t *testing.T) {
 		}
 
 	})
+
+	t.Run("Sensor bound token", func(t *testing.T) {
+		defer cleanMeasurements()
+		otherSensor := worrywort.Sensor{UserId: u.Id, Name: "Other Sensor", CreatedBy: &u}
+		if err := otherSensor.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		token, err := worrywort.GenerateSensorToken(u, *sensor.Id, worrywort.TOKEN_SCOPE_WRITE_TEMPS)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		ctx := context.WithValue(ctx, middleware.DefaultUserKey, &u)
+		ctx = context.WithValue(ctx, middleware.DefaultTokenKey, &token)
+
+		var tests = []struct {
+			name     string
+			sensorId interface{}
+			ok       bool
+		}{
+			{"implied sensor", nil, true},
+			{"bound sensor", sensor.UUID, true},
+			{"other sensor", otherSensor.UUID, false},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				input := map[string]interface{}{
+					"units":       "FAHRENHEIT",
+					"temperature": 70.0,
+					"recordedAt":  "2018-10-14T15:26:00+00:00",
+				}
+				if tc.sensorId != nil {
+					input["sensorId"] = tc.sensorId
+				}
+				result := worrywortSchema.Exec(ctx, query, operationName, map[string]interface{}{"input": input})
+				if tc.ok && len(result.Errors) != 0 {
+					t.Errorf("Unexpected errors: %v", result.Errors)
+				} else if !tc.ok && len(result.Errors) == 0 {
+					t.Errorf("Expected an error creating a measurement for another sensor")
+				}
+			})
+		}
+
+		tm, err := worrywort.FindTemperatureMeasurements(map[string]interface{}{"sensor_id": *otherSensor.Id}, db)
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if len(tm) != 0 {
+			t.Errorf("Expected no measurements for the other sensor but got: %s", spew.Sdump(tm))
+		}
+	})
+
+	t.Run("sensorId required without a bound token", func(t *testing.T) {
+		ctx := context.WithValue(ctx, middleware.DefaultUserKey, &u)
+		input := map[string]interface{}{"units": "FAHRENHEIT", "temperature": 70.0,
+			"recordedAt": "2018-10-14T15:26:00+00:00"}
+		result := worrywortSchema.Exec(ctx, query, operationName, map[string]interface{}{"input": input})
+		if len(result.Errors) == 0 {
+			t.Errorf("Expected an error when sensorId is missing")
+		}
+	})
+
+	t.Run("Retry returns the original", func(t *testing.T) {
+		defer cleanMeasurements()
+		ctx := context.WithValue(ctx, middleware.DefaultUserKey, &u)
+		first := worrywortSchema.Exec(ctx, query, operationName, variables)
+		retried := worrywortSchema.Exec(ctx, query, operationName, variables)
+		if len(first.Errors) != 0 || len(retried.Errors) != 0 {
+			t.Fatalf("Unexpected errors: %v %v", first.Errors, retried.Errors)
+		}
+		if string(first.Data) != string(retried.Data) {
+			t.Errorf("Expected the original measurement %s but got %s", first.Data, retried.Data)
+		}
+		tm, err := worrywort.FindTemperatureMeasurements(map[string]interface{}{"sensor_id": *sensor.Id}, db)
+		if err != nil || len(tm) != 1 {
+			t.Errorf("Expected 1 measurement but got %d: %v", len(tm), err)
+		}
+	})
 }
 
 func TestSensorQuery(t *testing.T) {
@@ -2046,3 +2181,1303 @@ func TestUpdateSensorMutation(t *testing.T) {
 		})
 	}
 }
+
+func TestChangePasswordMutation(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	u := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	if err := worrywort.SetUserPassword(&u, "password", bcrypt.MinCost); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := u.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+
+	var worrywortSchema = graphql.MustParseSchema(graphql_api.Schema,
+		graphql_api.NewResolver(db, graphql_api.WithPasswordHashCost(bcrypt.MinCost)))
+	query := `
+		mutation changePassword($input: ChangePasswordInput!) {
+			changePassword(input: $input) {
+				token { token }
+				userErrors { field error }
+			}
+		}`
+
+	type payload struct {
+		Token *struct {
+			Token string `json:"token"`
+		} `json:"token"`
+		UserErrors []struct {
+			Field []string `json:"field"`
+			Error string   `json:"error"`
+		} `json:"userErrors"`
+	}
+	type changePassword struct {
+		ChangePassword *payload `json:"changePassword"`
+	}
+
+	t.Run("Wrong current password", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), middleware.DefaultUserKey, &u)
+		variables := map[string]interface{}{
+			"input": map[string]interface{}{"currentPassword": "wrong", "newPassword": "newpassword"}}
+		resultData := worrywortSchema.Exec(ctx, query, "", variables)
+		result := new(changePassword)
+		if err := json.Unmarshal(resultData.Data, result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if result.ChangePassword == nil || result.ChangePassword.Token != nil ||
+			len(result.ChangePassword.UserErrors) != 1 ||
+			!cmp.Equal(result.ChangePassword.UserErrors[0].Field, []string{"currentPassword"}) {
+			t.Errorf("Unexpected result: %s", spew.Sdump(result))
+		}
+	})
+
+	t.Run("New password breaks the password policy", func(t *testing.T) {
+		policy := worrywort.NewPasswordPolicy()
+		policy.Blocklist = map[string]bool{"hunter2": true}
+		schema := graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db,
+			graphql_api.WithPasswordHashCost(bcrypt.MinCost), graphql_api.WithPasswordPolicy(policy)))
+		ctx := context.WithValue(context.Background(), middleware.DefaultUserKey, &u)
+		variables := map[string]interface{}{
+			"input": map[string]interface{}{"currentPassword": "password", "newPassword": "Hunter2"}}
+		resultData := schema.Exec(ctx, query, "", variables)
+		result := new(changePassword)
+		if err := json.Unmarshal(resultData.Data, result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if result.ChangePassword == nil || result.ChangePassword.Token != nil ||
+			len(result.ChangePassword.UserErrors) != 2 {
+			t.Fatalf("Unexpected result: %s", spew.Sdump(result))
+		}
+		for _, e := range result.ChangePassword.UserErrors {
+			if !cmp.Equal(e.Field, []string{"newPassword"}) {
+				t.Errorf("Expected newPassword field errors but got: %s", spew.Sdump(result))
+			}
+		}
+		if _, err := worrywort.AuthenticateLogin(u.Email, "password", db); err != nil {
+			t.Errorf("Password should not have changed: %v", err)
+		}
+	})
+
+	t.Run("Valid change", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), middleware.DefaultUserKey, &u)
+		variables := map[string]interface{}{
+			"input": map[string]interface{}{"currentPassword": "password", "newPassword": "newpassword"}}
+		resultData := worrywortSchema.Exec(ctx, query, "", variables)
+		result := new(changePassword)
+		if err := json.Unmarshal(resultData.Data, result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if result.ChangePassword == nil || result.ChangePassword.Token == nil {
+			t.Fatalf("Expected a new token but got: %s", spew.Sdump(resultData))
+		}
+
+		if _, err := worrywort.AuthenticateUserByToken(result.ChangePassword.Token.Token, db); err != nil {
+			t.Errorf("Returned token could not be used: %v", err)
+		}
+		if _, err := worrywort.AuthenticateLogin(u.Email, "newpassword", db); err != nil {
+			t.Errorf("Could not log in with the new password: %v", err)
+		}
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), middleware.DefaultUserKey, nil)
+		variables := map[string]interface{}{
+			"input": map[string]interface{}{"currentPassword": "password", "newPassword": "newpassword"}}
+		resultData := worrywortSchema.Exec(ctx, query, "", variables)
+		result := new(changePassword)
+		if err := json.Unmarshal(resultData.Data, result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if result.ChangePassword != nil {
+			t.Errorf("Expected null changePassword but got: %s", spew.Sdump(result))
+		}
+	})
+}
+
+func TestPasswordResetMutations(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	u := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	if err := worrywort.SetUserPassword(&u, "password", bcrypt.MinCost); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := u.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+
+	// capture the token rather than sending it anywhere.  It is sent after the response.
+	sentTokens := make(chan string, 1)
+	notifier := func(user worrywort.User, token string) error {
+		sentTokens <- token
+		return nil
+	}
+	sentToken := func(t *testing.T) string {
+		select {
+		case token := <-sentTokens:
+			return token
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected a reset token to be sent")
+		}
+		return ""
+	}
+	var worrywortSchema = graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db,
+		graphql_api.WithPasswordHashCost(bcrypt.MinCost), graphql_api.WithPasswordResetNotifier(notifier)))
+
+	requestQuery := `
+		mutation requestPasswordReset($email: String!) {
+			requestPasswordReset(email: $email) { ok }
+		}`
+	resetQuery := `
+		mutation resetPassword($input: ResetPasswordInput!) {
+			resetPassword(input: $input) {
+				user { id }
+				userErrors { field error }
+			}
+		}`
+
+	type resetPayload struct {
+		User *struct {
+			Id string `json:"id"`
+		} `json:"user"`
+		UserErrors []struct {
+			Field []string `json:"field"`
+			Error string   `json:"error"`
+		} `json:"userErrors"`
+	}
+	type resetPassword struct {
+		ResetPassword *resetPayload `json:"resetPassword"`
+	}
+
+	t.Run("Unknown email does not send a token", func(t *testing.T) {
+		resultData := worrywortSchema.Exec(context.Background(), requestQuery, "",
+			map[string]interface{}{"email": "nobody@example.com"})
+		if len(resultData.Errors) != 0 {
+			t.Fatalf("Unexpected errors: %v", resultData.Errors)
+		}
+		select {
+		case token := <-sentTokens:
+			t.Errorf("Expected no tokens to be sent but got %v", token)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		variables := map[string]interface{}{
+			"input": map[string]interface{}{"token": "abc:123", "newPassword": "resetpassword"}}
+		resultData := worrywortSchema.Exec(context.Background(), resetQuery, "", variables)
+		result := new(resetPassword)
+		if err := json.Unmarshal(resultData.Data, result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if result.ResetPassword == nil || result.ResetPassword.User != nil ||
+			len(result.ResetPassword.UserErrors) != 1 ||
+			!cmp.Equal(result.ResetPassword.UserErrors[0].Field, []string{"token"}) {
+			t.Errorf("Unexpected result: %s", spew.Sdump(result))
+		}
+	})
+
+	t.Run("Request and reset", func(t *testing.T) {
+		resultData := worrywortSchema.Exec(context.Background(), requestQuery, "",
+			map[string]interface{}{"email": u.Email})
+		if len(resultData.Errors) != 0 {
+			t.Fatalf("Unexpected errors: %v", resultData.Errors)
+		}
+		token := sentToken(t)
+
+		variables := map[string]interface{}{
+			"input": map[string]interface{}{"token": token, "newPassword": "resetpassword"}}
+		resultData = worrywortSchema.Exec(context.Background(), resetQuery, "", variables)
+		result := new(resetPassword)
+		if err := json.Unmarshal(resultData.Data, result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if result.ResetPassword == nil || result.ResetPassword.User == nil || result.ResetPassword.User.Id != u.UUID {
+			t.Fatalf("Unexpected result: %s", spew.Sdump(resultData))
+		}
+
+		if _, err := worrywort.AuthenticateLogin(u.Email, "resetpassword", db); err != nil {
+			t.Errorf("Could not log in with the new password: %v", err)
+		}
+	})
+
+	t.Run("New password is the user's email", func(t *testing.T) {
+		resultData := worrywortSchema.Exec(context.Background(), requestQuery, "",
+			map[string]interface{}{"email": u.Email})
+		if len(resultData.Errors) != 0 {
+			t.Fatalf("Unexpected errors: %v", resultData.Errors)
+		}
+		token := sentToken(t)
+
+		variables := map[string]interface{}{
+			"input": map[string]interface{}{"token": token, "newPassword": "User@Example.com"}}
+		resultData = worrywortSchema.Exec(context.Background(), resetQuery, "", variables)
+		result := new(resetPassword)
+		if err := json.Unmarshal(resultData.Data, result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if result.ResetPassword == nil || result.ResetPassword.User != nil ||
+			len(result.ResetPassword.UserErrors) != 1 ||
+			!cmp.Equal(result.ResetPassword.UserErrors[0].Field, []string{"newPassword"}) {
+			t.Fatalf("Unexpected result: %s", spew.Sdump(result))
+		}
+
+		// the token was not used up by the rejected password
+		variables = map[string]interface{}{
+			"input": map[string]interface{}{"token": token, "newPassword": "anotherpassword"}}
+		resultData = worrywortSchema.Exec(context.Background(), resetQuery, "", variables)
+		result = new(resetPassword)
+		if err := json.Unmarshal(resultData.Data, result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if result.ResetPassword == nil || result.ResetPassword.User == nil {
+			t.Errorf("Expected the token to still work but got: %s", spew.Sdump(resultData))
+		}
+	})
+}
+
+func TestAdminQueries(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	admin := worrywort.User{Email: "admin@example.com", FullName: "Admin User", Username: "admin", IsActive: true,
+		IsAdmin: true}
+	u := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	for _, user := range []*worrywort.User{&admin, &u} {
+		if err := user.Save(db); err != nil {
+			t.Fatalf("failed to insert user: %s", err)
+		}
+	}
+	sensor := worrywort.Sensor{Name: "Test Sensor", UserId: u.Id, CreatedBy: &u}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var worrywortSchema = graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db))
+	adminCtx := context.WithValue(context.Background(), middleware.DefaultUserKey, &admin)
+	userCtx := context.WithValue(context.Background(), middleware.DefaultUserKey, &u)
+
+	usersQuery := `
+		query adminUsers($search: String) {
+			admin {
+				users(search: $search) {
+					edges { node { id isActive isAdmin batchCount sensorCount temperatureMeasurementCount } }
+				}
+			}
+		}`
+
+	t.Run("Admin can search users", func(t *testing.T) {
+		result := worrywortSchema.Exec(adminCtx, usersQuery, "", map[string]interface{}{"search": "michalicek"})
+		if len(result.Errors) != 0 {
+			t.Fatalf("Unexpected errors: %v", result.Errors)
+		}
+		var expected interface{}
+		err := json.Unmarshal([]byte(fmt.Sprintf(`{"admin": {"users": {"edges": [{"node": {"id": "%s",
+			"isActive": true, "isAdmin": false, "batchCount": 0, "sensorCount": 1,
+			"temperatureMeasurementCount": 0}}]}}}`, u.UUID)), &expected)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		var actual interface{}
+		if err := json.Unmarshal(result.Data, &actual); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !cmp.Equal(expected, actual) {
+			t.Errorf("Expected: - | Got +\n%s", cmp.Diff(expected, actual))
+		}
+	})
+
+	t.Run("Non-admin gets an error", func(t *testing.T) {
+		result := worrywortSchema.Exec(userCtx, usersQuery, "", nil)
+		if len(result.Errors) != 1 || result.Errors[0].Message != middleware.ErrAdminRequired.Error() {
+			t.Errorf("Expected error %v but got %v", middleware.ErrAdminRequired, result.Errors)
+		}
+		if string(result.Data) != `{"admin":null}` {
+			t.Errorf("Expected no admin data but got %s", result.Data)
+		}
+	})
+
+	setActiveQuery := `
+		mutation adminSetUserActive($input: AdminSetUserActiveInput!) {
+			adminSetUserActive(input: $input) {
+				adminUser { id isActive }
+				userErrors { field error }
+			}
+		}`
+
+	t.Run("Admin can deactivate a user", func(t *testing.T) {
+		variables := map[string]interface{}{
+			"input": map[string]interface{}{"userId": u.UUID, "isActive": false}}
+		result := worrywortSchema.Exec(adminCtx, setActiveQuery, "", variables)
+		if len(result.Errors) != 0 {
+			t.Fatalf("Unexpected errors: %v", result.Errors)
+		}
+		updated, err := worrywort.FindUser(map[string]interface{}{"id": *u.Id}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if updated.IsActive {
+			t.Errorf("Expected user to be deactivated")
+		}
+	})
+
+	t.Run("Admin cannot deactivate themselves", func(t *testing.T) {
+		variables := map[string]interface{}{
+			"input": map[string]interface{}{"userId": admin.UUID, "isActive": false}}
+		result := worrywortSchema.Exec(adminCtx, setActiveQuery, "", variables)
+		expected := `{"adminSetUserActive":{"adminUser":null,"userErrors":[{"field":["userId"],` +
+			`"error":"You cannot deactivate your own account."}]}}`
+		if string(result.Data) != expected {
+			t.Errorf("Expected %s but got %s", expected, result.Data)
+		}
+	})
+
+	t.Run("Admin can reset a user's tokens", func(t *testing.T) {
+		token := worrywort.NewLoginToken("secret", u, worrywort.TOKEN_SCOPE_ALL)
+		if err := token.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		query := `
+			mutation adminResetUserTokens($input: AdminResetUserTokensInput!) {
+				adminResetUserTokens(input: $input) { adminUser { id } }
+			}`
+		variables := map[string]interface{}{"input": map[string]interface{}{"userId": u.UUID}}
+		result := worrywortSchema.Exec(adminCtx, query, "", variables)
+		if len(result.Errors) != 0 {
+			t.Fatalf("Unexpected errors: %v", result.Errors)
+		}
+		var count int
+		if err := db.Get(&count, db.Rebind(`SELECT COUNT(*) FROM user_authtokens WHERE user_id = ?`), *u.Id); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if count != 0 {
+			t.Errorf("Expected all tokens to be deleted but %d remain", count)
+		}
+	})
+}
+
+func TestApproveDeviceMutation(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	u := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	if err := u.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	d, err := worrywort.NewDeviceCode("esp32-thermometer", "Chamber", worrywort.DefaultDeviceCodeTTL)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := d.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var worrywortSchema = graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db))
+	ctx := context.WithValue(context.Background(), middleware.DefaultUserKey, &u)
+	query := `
+		mutation approveDevice($input: ApproveDeviceInput!) {
+			approveDevice(input: $input) {
+				sensor { name }
+				userErrors { field error }
+			}
+		}`
+
+	t.Run("Invalid code", func(t *testing.T) {
+		variables := map[string]interface{}{"input": map[string]interface{}{"userCode": "AAAA-AAAA"}}
+		result := worrywortSchema.Exec(ctx, query, "", variables)
+		expected := `{"approveDevice":{"sensor":null,"userErrors":[{"field":["userCode"],` +
+			`"error":"Invalid or expired code."}]}}`
+		if string(result.Data) != expected {
+			t.Errorf("Expected %s but got %s", expected, result.Data)
+		}
+	})
+
+	t.Run("Valid code", func(t *testing.T) {
+		variables := map[string]interface{}{
+			"input": map[string]interface{}{"userCode": d.UserCodeForDisplay(), "sensorName": "Keezer"}}
+		result := worrywortSchema.Exec(ctx, query, "", variables)
+		expected := `{"approveDevice":{"sensor":{"name":"Keezer"},"userErrors":[]}}`
+		if string(result.Data) != expected {
+			t.Errorf("Expected %s but got %s", expected, result.Data)
+		}
+	})
+}
+
+func TestTOTPMutations(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	var worrywortSchema = graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db))
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	if err := worrywort.SetUserPassword(&user, "password", bcrypt.MinCost); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	ctx := context.WithValue(context.Background(), middleware.DefaultUserKey, &user)
+
+	// enroll and confirm
+	enroll := worrywortSchema.Exec(ctx, `mutation { enrollTOTP { provisioningUri secret userErrors { error } } }`,
+		"", nil)
+	var enrollResult struct {
+		EnrollTOTP struct {
+			ProvisioningURI string `json:"provisioningUri"`
+			Secret          string `json:"secret"`
+		} `json:"enrollTOTP"`
+	}
+	if err := json.Unmarshal(enroll.Data, &enrollResult); err != nil || len(enroll.Errors) != 0 {
+		t.Fatalf("Unexpected result %s %v", enroll.Data, enroll.Errors)
+	}
+	if !strings.HasPrefix(enrollResult.EnrollTOTP.ProvisioningURI, "otpauth://totp/") {
+		t.Errorf("Unexpected provisioning uri %s", enrollResult.EnrollTOTP.ProvisioningURI)
+	}
+
+	code, _ := totp.GenerateCode(enrollResult.EnrollTOTP.Secret, time.Now())
+	confirm := worrywortSchema.Exec(ctx,
+		`mutation confirm($input: ConfirmTOTPInput!) { confirmTOTP(input: $input) { recoveryCodes userErrors { error } } }`,
+		"", map[string]interface{}{"input": map[string]interface{}{"code": code}})
+	var confirmResult struct {
+		ConfirmTOTP struct {
+			RecoveryCodes []string `json:"recoveryCodes"`
+		} `json:"confirmTOTP"`
+	}
+	if err := json.Unmarshal(confirm.Data, &confirmResult); err != nil || len(confirm.Errors) != 0 {
+		t.Fatalf("Unexpected result %s %v", confirm.Data, confirm.Errors)
+	}
+	if len(confirmResult.ConfirmTOTP.RecoveryCodes) != worrywort.RecoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %s", worrywort.RecoveryCodeCount, confirm.Data)
+	}
+
+	loginQuery := `mutation { login(username: "user@example.com", password: "password") {
+		token { token } totpRequired totpChallenge } }`
+	type loginResult struct {
+		Token *struct {
+			Token string `json:"token"`
+		} `json:"token"`
+		TOTPRequired  bool   `json:"totpRequired"`
+		TOTPChallenge string `json:"totpChallenge"`
+	}
+
+	t.Run("Login requires a code", func(t *testing.T) {
+		login := worrywortSchema.Exec(context.Background(), loginQuery, "", nil)
+		var result struct {
+			Login loginResult `json:"login"`
+		}
+		if err := json.Unmarshal(login.Data, &result); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if result.Login.Token != nil || !result.Login.TOTPRequired || result.Login.TOTPChallenge == "" {
+			t.Fatalf("Expected only a challenge, got %s", login.Data)
+		}
+
+		verifyQuery := `mutation verify($challenge: String!, $code: String!) {
+			verifyLoginTOTP(challenge: $challenge, code: $code) { token { token } totpRequired } }`
+		wrong := worrywortSchema.Exec(context.Background(), verifyQuery, "",
+			map[string]interface{}{"challenge": result.Login.TOTPChallenge, "code": "not-a-code"})
+		if len(wrong.Errors) == 0 {
+			t.Errorf("Expected an error for the wrong code, got %s", wrong.Data)
+		}
+
+		verify := worrywortSchema.Exec(context.Background(), verifyQuery, "",
+			map[string]interface{}{"challenge": result.Login.TOTPChallenge,
+				"code": confirmResult.ConfirmTOTP.RecoveryCodes[0]})
+		var verifyResult struct {
+			VerifyLoginTOTP loginResult `json:"verifyLoginTOTP"`
+		}
+		if err := json.Unmarshal(verify.Data, &verifyResult); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if verifyResult.VerifyLoginTOTP.Token == nil {
+			t.Fatalf("Expected a token, got %s %v", verify.Data, verify.Errors)
+		}
+		if _, err := worrywort.AuthenticateUserByToken(verifyResult.VerifyLoginTOTP.Token.Token, db); err != nil {
+			t.Errorf("Expected the token to work, got %v", err)
+		}
+	})
+
+	t.Run("Disable", func(t *testing.T) {
+		disable := worrywortSchema.Exec(ctx,
+			`mutation disable($input: DisableTOTPInput!) { disableTOTP(input: $input) { user { totpEnabled } userErrors { field error } } }`,
+			"", map[string]interface{}{"input": map[string]interface{}{"password": "wrong"}})
+		expected := `{"disableTOTP":{"user":null,"userErrors":[{"field":["password"],"error":"Password is incorrect."}]}}`
+		if string(disable.Data) != expected {
+			t.Errorf("Expected: %s\nGot: %s", expected, disable.Data)
+		}
+
+		disable = worrywortSchema.Exec(ctx,
+			`mutation disable($input: DisableTOTPInput!) { disableTOTP(input: $input) { user { totpEnabled } userErrors { field error } } }`,
+			"", map[string]interface{}{"input": map[string]interface{}{"password": "password"}})
+		expected = `{"disableTOTP":{"user":{"totpEnabled":false},"userErrors":[]}}`
+		if string(disable.Data) != expected {
+			t.Errorf("Expected: %s\nGot: %s", expected, disable.Data)
+		}
+
+		login := worrywortSchema.Exec(context.Background(), loginQuery, "", nil)
+		var result struct {
+			Login loginResult `json:"login"`
+		}
+		json.Unmarshal(login.Data, &result)
+		if result.Login.Token == nil || result.Login.TOTPRequired {
+			t.Errorf("Expected a token without a code once disabled, got %s", login.Data)
+		}
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	lockout := &ratelimit.Lockout{Store: ratelimit.NewMemoryStore(), MaxFailures: 2, Duration: time.Minute}
+	worrywortSchema := graphql.MustParseSchema(graphql_api.Schema,
+		graphql_api.NewResolver(db, graphql_api.WithLoginLockout(lockout)))
+	h := &graphql_api.Handler{Db: db, Handler: &relay.Handler{Schema: worrywortSchema}}
+	post := func(query string, variables map[string]interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body))))
+		return rr
+	}
+
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	totpUser := worrywort.User{Email: "totp@example.com", FullName: "Totp User", Username: "totp", IsActive: true}
+	for _, u := range []*worrywort.User{&user, &totpUser} {
+		if err := worrywort.SetUserPassword(u, "password", bcrypt.MinCost); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := u.Save(db); err != nil {
+			t.Fatalf("failed to insert user: %s", err)
+		}
+	}
+	key, err := worrywort.EnrollTOTP(&totpUser, db)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	code, _ := totp.GenerateCode(key.Secret(), time.Now())
+	if _, err := worrywort.ConfirmTOTP(&totpUser, code, db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	loginQuery := `mutation login($username: String!, $password: String!) {
+		login(username: $username, password: $password) { token { token } totpChallenge } }`
+
+	t.Run("login", func(t *testing.T) {
+		variables := map[string]interface{}{"username": user.Email, "password": "wrong"}
+		for i := 0; i < lockout.MaxFailures; i++ {
+			if rr := post(loginQuery, variables); rr.Code != http.StatusOK {
+				t.Fatalf("Expected status %d for a wrong password but got %d", http.StatusOK, rr.Code)
+			}
+		}
+		// even the right password is refused while locked out
+		variables["password"] = "password"
+		rr := post(loginQuery, variables)
+		if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected status %d with Retry-After but got %d %v", http.StatusTooManyRequests, rr.Code,
+				rr.Header())
+		}
+		if !strings.Contains(rr.Body.String(), `"errors"`) || strings.Contains(rr.Body.String(), `"token":{`) {
+			t.Errorf("Expected an error and no token but got %s", rr.Body.String())
+		}
+	})
+
+	t.Run("verifyLoginTOTP", func(t *testing.T) {
+		rr := post(loginQuery, map[string]interface{}{"username": totpUser.Email, "password": "password"})
+		var result struct {
+			Data struct {
+				Login struct {
+					TOTPChallenge string `json:"totpChallenge"`
+				} `json:"login"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil || result.Data.Login.TOTPChallenge == "" {
+			t.Fatalf("Expected a challenge but got %s %v", rr.Body.String(), err)
+		}
+
+		verifyQuery := `mutation verify($challenge: String!, $code: String!) {
+			verifyLoginTOTP(challenge: $challenge, code: $code) { token { token } } }`
+		variables := map[string]interface{}{"challenge": result.Data.Login.TOTPChallenge, "code": "000000"}
+		for i := 0; i < lockout.MaxFailures; i++ {
+			if rr := post(verifyQuery, variables); rr.Code != http.StatusOK {
+				t.Fatalf("Expected status %d for a wrong code but got %d", http.StatusOK, rr.Code)
+			}
+		}
+		rr = post(verifyQuery, variables)
+		if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected status %d with Retry-After but got %d %v", http.StatusTooManyRequests, rr.Code,
+				rr.Header())
+		}
+	})
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	u := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := u.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	u2 := worrywort.User{Email: "user2@example.com", FullName: "Justin Michalicek", Username: "worrywort2"}
+	if err := u2.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := worrywort.Sensor{UserId: u.Id, Name: "Test Sensor", CreatedBy: &u}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	worrywortSchema := graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db))
+	ctx := context.WithValue(context.Background(), "db", db)
+	// normally set by graphql_api.Handler
+	ctx = context.WithValue(ctx, "remoteIP", "192.0.2.1")
+	userCtx := context.WithValue(ctx, middleware.DefaultUserKey, &u)
+
+	update := worrywortSchema.Exec(userCtx,
+		`mutation updateSensor($input: UpdateSensorInput!) { updateSensor(input: $input) { sensor { id } } }`, "",
+		map[string]interface{}{"input": map[string]interface{}{"id": sensor.UUID, "name": "My Sensor"}})
+	if len(update.Errors) > 0 {
+		t.Fatalf("%v", update.Errors)
+	}
+
+	query := `
+		query auditLog($entityId: ID, $since: DateTime) {
+			auditLog(entityType: "sensor", entityId: $entityId, since: $since) {
+				edges { node { action entityType entityId changes ip } }
+			}
+		}`
+	type auditLog struct {
+		AuditLog struct {
+			Edges []struct {
+				Node struct {
+					Action     string `json:"action"`
+					EntityType string `json:"entityType"`
+					EntityId   string `json:"entityId"`
+					Changes    string `json:"changes"`
+					IP         string `json:"ip"`
+				} `json:"node"`
+			} `json:"edges"`
+		} `json:"auditLog"`
+	}
+
+	t.Run("Own audit trail", func(t *testing.T) {
+		resultData := worrywortSchema.Exec(userCtx, query, "", map[string]interface{}{"entityId": sensor.UUID})
+		result := new(auditLog)
+		if err := json.Unmarshal(resultData.Data, result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if len(result.AuditLog.Edges) != 1 {
+			t.Fatalf("Expected 1 entry but got: %s", resultData.Data)
+		}
+		entry := result.AuditLog.Edges[0].Node
+		if entry.Action != worrywort.AUDIT_ACTION_UPDATE || entry.EntityId != sensor.UUID || entry.IP != "192.0.2.1" {
+			t.Errorf("Unexpected entry: %s", spew.Sdump(entry))
+		}
+		changes := map[string]struct {
+			Before interface{} `json:"before"`
+			After  interface{} `json:"after"`
+		}{}
+		if err := json.Unmarshal([]byte(entry.Changes), &changes); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if changes["Name"].Before != "Test Sensor" || changes["Name"].After != "My Sensor" {
+			t.Errorf("Unexpected changes: %s", entry.Changes)
+		}
+	})
+
+	t.Run("Filtered by time", func(t *testing.T) {
+		since := time.Now().Add(time.Hour).Format(time.RFC3339)
+		resultData := worrywortSchema.Exec(userCtx, query, "",
+			map[string]interface{}{"entityId": sensor.UUID, "since": since})
+		result := new(auditLog)
+		if err := json.Unmarshal(resultData.Data, result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if len(result.AuditLog.Edges) != 0 {
+			t.Errorf("Expected no entries but got: %s", resultData.Data)
+		}
+	})
+
+	t.Run("Other user's audit trail", func(t *testing.T) {
+		otherCtx := context.WithValue(ctx, middleware.DefaultUserKey, &u2)
+		resultData := worrywortSchema.Exec(otherCtx, query, "", map[string]interface{}{"entityId": sensor.UUID})
+		result := new(auditLog)
+		if err := json.Unmarshal(resultData.Data, result); err != nil {
+			t.Fatalf("%v: %v", err, resultData)
+		}
+		if len(result.AuditLog.Edges) != 0 {
+			t.Errorf("Expected no entries but got: %s", resultData.Data)
+		}
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		resultData := worrywortSchema.Exec(ctx, query, "", nil)
+		if len(resultData.Errors) == 0 {
+			t.Errorf("Expected an error but got: %s", resultData.Data)
+		}
+	})
+}
+
+func TestTeams(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	owner := worrywort.User{Email: "owner@example.com", FullName: "Justin Michalicek", Username: "owner",
+		IsActive: true}
+	if err := owner.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	viewer := worrywort.User{Email: "viewer@example.com", FullName: "Justin Michalicek", Username: "viewer",
+		IsActive: true}
+	if err := viewer.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+
+	worrywortSchema := graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db))
+	ctx := context.WithValue(context.Background(), "db", db)
+	ownerCtx := context.WithValue(ctx, middleware.DefaultUserKey, &owner)
+	viewerCtx := context.WithValue(ctx, middleware.DefaultUserKey, &viewer)
+
+	created := worrywortSchema.Exec(ownerCtx,
+		`mutation createTeam($input: CreateTeamInput!) { createTeam(input: $input) { team { id role } } }`, "",
+		map[string]interface{}{"input": map[string]interface{}{"name": "Homebrew Club"}})
+	type createTeam struct {
+		CreateTeam struct {
+			Team struct {
+				ID   string `json:"id"`
+				Role string `json:"role"`
+			} `json:"team"`
+		} `json:"createTeam"`
+	}
+	team := new(createTeam)
+	if err := json.Unmarshal(created.Data, team); err != nil || len(created.Errors) > 0 {
+		t.Fatalf("%v: %v", err, created)
+	}
+	teamId := team.CreateTeam.Team.ID
+	if team.CreateTeam.Team.Role != "OWNER" {
+		t.Errorf("Expected the creator to be OWNER but got %s", created.Data)
+	}
+
+	added := worrywortSchema.Exec(ownerCtx,
+		`mutation setTeamMember($input: SetTeamMemberInput!) {
+			setTeamMember(input: $input) { team { members { user { email } role } } userErrors { field error } }
+		}`, "",
+		map[string]interface{}{"input": map[string]interface{}{"teamId": teamId, "email": viewer.Email,
+			"role": "VIEWER"}})
+	if len(added.Errors) > 0 {
+		t.Fatalf("%v", added.Errors)
+	}
+
+	sensorCreated := worrywortSchema.Exec(ownerCtx,
+		`mutation createSensor($input: CreateSensorInput!) { createSensor(input: $input) { sensor { id } } }`, "",
+		map[string]interface{}{"input": map[string]interface{}{"name": "Team Sensor", "teamId": teamId}})
+	type createSensor struct {
+		CreateSensor struct {
+			Sensor struct {
+				ID string `json:"id"`
+			} `json:"sensor"`
+		} `json:"createSensor"`
+	}
+	sensor := new(createSensor)
+	if err := json.Unmarshal(sensorCreated.Data, sensor); err != nil || len(sensorCreated.Errors) > 0 {
+		t.Fatalf("%v: %v", err, sensorCreated)
+	}
+	sensorId := sensor.CreateSensor.Sensor.ID
+
+	t.Run("Viewer can see the team's sensor", func(t *testing.T) {
+		result := worrywortSchema.Exec(viewerCtx, `query sensor($id: ID!) { sensor(id: $id) { id team { id } } }`,
+			"", map[string]interface{}{"id": sensorId})
+		expected := fmt.Sprintf(`{"sensor":{"id":"%s","team":{"id":"%s"}}}`, sensorId, teamId)
+		if string(result.Data) != expected {
+			t.Errorf("Expected: %s\nGot: %s", expected, result.Data)
+		}
+	})
+
+	t.Run("Viewer cannot update the team's sensor", func(t *testing.T) {
+		result := worrywortSchema.Exec(viewerCtx,
+			`mutation updateSensor($input: UpdateSensorInput!) { updateSensor(input: $input) { sensor { id } } }`,
+			"", map[string]interface{}{"input": map[string]interface{}{"id": sensorId, "name": "Mine Now"}})
+		if string(result.Data) != `{"updateSensor":null}` {
+			t.Errorf("Expected no update but got: %s", result.Data)
+		}
+	})
+
+	t.Run("Viewer cannot add sensors to the team", func(t *testing.T) {
+		result := worrywortSchema.Exec(viewerCtx,
+			`mutation createSensor($input: CreateSensorInput!) { createSensor(input: $input) { sensor { id } } }`,
+			"", map[string]interface{}{"input": map[string]interface{}{"name": "Sensor", "teamId": teamId}})
+		if len(result.Errors) != 1 || result.Errors[0].Message != graphql_api.ErrTeamNotFound.Error() {
+			t.Errorf("Expected ErrTeamNotFound but got: %v", result.Errors)
+		}
+	})
+
+	t.Run("Viewer cannot manage members", func(t *testing.T) {
+		result := worrywortSchema.Exec(viewerCtx,
+			`mutation setTeamMember($input: SetTeamMemberInput!) { setTeamMember(input: $input) { team { id } } }`,
+			"", map[string]interface{}{"input": map[string]interface{}{"teamId": teamId, "email": viewer.Email,
+				"role": "OWNER"}})
+		if len(result.Errors) != 1 || result.Errors[0].Message != graphql_api.ErrTeamNotFound.Error() {
+			t.Errorf("Expected ErrTeamNotFound but got: %v", result.Errors)
+		}
+	})
+
+	t.Run("Viewer can leave", func(t *testing.T) {
+		result := worrywortSchema.Exec(viewerCtx,
+			`mutation removeTeamMember($input: RemoveTeamMemberInput!) {
+				removeTeamMember(input: $input) { team { role } userErrors { field error } }
+			}`, "", map[string]interface{}{"input": map[string]interface{}{"teamId": teamId,
+				"userId": viewer.UUID}})
+		expected := `{"removeTeamMember":{"team":{"role":null},"userErrors":[]}}`
+		if string(result.Data) != expected {
+			t.Errorf("Expected: %s\nGot: %s", expected, result.Data)
+		}
+	})
+}
+
+func TestBatchShareLinks(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	u := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := u.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	batch := worrywort.Batch{Name: "Shared Batch", UserId: u.Id, BrewedDate: time.Now().Add(-time.Hour),
+		VolumeUnits: worrywort.GALLON}
+	if err := batch.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	sensor := worrywort.Sensor{Name: "Fermentor Probe", UserId: u.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	associatedAt := time.Now().Add(-time.Hour)
+	if _, err := worrywort.AssociateBatchToSensor(&batch, &sensor, "In the wort", &associatedAt, db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i := 3; i > 0; i-- {
+		m := worrywort.TemperatureMeasurement{SensorId: sensor.Id, UserId: u.Id, Temperature: float64(60 + i),
+			Units: worrywort.FAHRENHEIT, RecordedAt: time.Now().Add(time.Duration(-i) * time.Minute)}
+		if err := m.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	worrywortSchema := graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db))
+	ctx := context.WithValue(context.Background(), "db", db)
+	userCtx := context.WithValue(ctx, middleware.DefaultUserKey, &u)
+
+	created := worrywortSchema.Exec(userCtx,
+		`mutation createBatchShareLink($input: CreateBatchShareLinkInput!) {
+			createBatchShareLink(input: $input) { shareLink { id slug isActive } }
+		}`, "", map[string]interface{}{"input": map[string]interface{}{"batchId": batch.UUID}})
+	type createLink struct {
+		CreateBatchShareLink struct {
+			ShareLink struct {
+				ID       string `json:"id"`
+				Slug     string `json:"slug"`
+				IsActive bool   `json:"isActive"`
+			} `json:"shareLink"`
+		} `json:"createBatchShareLink"`
+	}
+	link := new(createLink)
+	if err := json.Unmarshal(created.Data, link); err != nil || len(created.Errors) > 0 {
+		t.Fatalf("%v: %v", err, created)
+	}
+	if link.CreateBatchShareLink.ShareLink.Slug == "" || !link.CreateBatchShareLink.ShareLink.IsActive {
+		t.Fatalf("Expected an active share link but got: %s", created.Data)
+	}
+	slug := link.CreateBatchShareLink.ShareLink.Slug
+
+	query := `query sharedBatch($slug: String!) {
+		sharedBatch(slug: $slug) {
+			name
+			createdBy { username }
+			sensorAssociations { sensorName description }
+			temperatureMeasurements(first: 2) { pageInfo { hasNextPage } edges { node { temperature sensorName } } }
+		}
+	}`
+
+	t.Run("Without authentication", func(t *testing.T) {
+		result := worrywortSchema.Exec(ctx, query, "", map[string]interface{}{"slug": slug})
+		expected := `{"sharedBatch":{"name":"Shared Batch","createdBy":{"username":"worrywort"},` +
+			`"sensorAssociations":[{"sensorName":"Fermentor Probe","description":"In the wort"}],` +
+			`"temperatureMeasurements":{"pageInfo":{"hasNextPage":true},"edges":[` +
+			`{"node":{"temperature":63,"sensorName":"Fermentor Probe"}},` +
+			`{"node":{"temperature":62,"sensorName":"Fermentor Probe"}}]}}}`
+		if len(result.Errors) > 0 || string(result.Data) != expected {
+			t.Errorf("Expected: %s\nGot: %s %v", expected, result.Data, result.Errors)
+		}
+	})
+
+	t.Run("Email cannot be queried", func(t *testing.T) {
+		result := worrywortSchema.Exec(ctx, `query sharedBatch($slug: String!) {
+			sharedBatch(slug: $slug) { createdBy { email } }
+		}`, "", map[string]interface{}{"slug": slug})
+		if len(result.Errors) == 0 {
+			t.Errorf("Expected a validation error but got: %s", result.Data)
+		}
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		revoked := worrywortSchema.Exec(userCtx,
+			`mutation revokeBatchShareLink($input: RevokeBatchShareLinkInput!) {
+				revokeBatchShareLink(input: $input) { shareLink { isActive } }
+			}`, "", map[string]interface{}{"input": map[string]interface{}{
+				"id": link.CreateBatchShareLink.ShareLink.ID}})
+		if string(revoked.Data) != `{"revokeBatchShareLink":{"shareLink":{"isActive":false}}}` {
+			t.Fatalf("Unexpected result revoking: %s %v", revoked.Data, revoked.Errors)
+		}
+		result := worrywortSchema.Exec(ctx, query, "", map[string]interface{}{"slug": slug})
+		if string(result.Data) != `{"sharedBatch":null}` {
+			t.Errorf("Expected null for a revoked link but got: %s", result.Data)
+		}
+	})
+}
+
+func TestSensorKeys(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	u := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	otherUser := worrywort.User{Email: "other@example.com", FullName: "Other User", Username: "other"}
+	for _, user := range []*worrywort.User{&u, &otherUser} {
+		if err := user.Save(db); err != nil {
+			t.Fatalf("failed to insert user: %s", err)
+		}
+	}
+	sensor := worrywort.Sensor{Name: "Fermentor Probe", UserId: u.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	worrywortSchema := graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db))
+	ctx := context.WithValue(context.Background(), "db", db)
+	userCtx := context.WithValue(ctx, middleware.DefaultUserKey, &u)
+	otherCtx := context.WithValue(ctx, middleware.DefaultUserKey, &otherUser)
+	createQuery := `mutation createSensorKey($input: CreateSensorKeyInput!) {
+		createSensorKey(input: $input) { sensorKey { id key isActive } }
+	}`
+	variables := map[string]interface{}{"input": map[string]interface{}{"sensorId": sensor.UUID}}
+
+	t.Run("Only for sensors the user can change", func(t *testing.T) {
+		result := worrywortSchema.Exec(otherCtx, createQuery, "", variables)
+		if len(result.Errors) == 0 {
+			t.Errorf("Expected an error but got: %s", result.Data)
+		}
+	})
+
+	created := worrywortSchema.Exec(userCtx, createQuery, "", variables)
+	type createKey struct {
+		CreateSensorKey struct {
+			SensorKey struct {
+				ID       string `json:"id"`
+				Key      string `json:"key"`
+				IsActive bool   `json:"isActive"`
+			} `json:"sensorKey"`
+		} `json:"createSensorKey"`
+	}
+	key := new(createKey)
+	if err := json.Unmarshal(created.Data, key); err != nil || len(created.Errors) > 0 {
+		t.Fatalf("%v: %v", err, created)
+	}
+	if len(key.CreateSensorKey.SensorKey.Key) != 64 || !key.CreateSensorKey.SensorKey.IsActive {
+		t.Fatalf("Expected an active 64 character key but got: %s", created.Data)
+	}
+
+	t.Run("The key is not shown again", func(t *testing.T) {
+		result := worrywortSchema.Exec(userCtx, `query sensor($id: ID!) { sensor(id: $id) { keys { id key } } }`,
+			"", map[string]interface{}{"id": sensor.UUID})
+		expected := fmt.Sprintf(`{"sensor":{"keys":[{"id":"%s","key":null}]}}`, key.CreateSensorKey.SensorKey.ID)
+		if len(result.Errors) > 0 || string(result.Data) != expected {
+			t.Errorf("Expected: %s\nGot: %s %v", expected, result.Data, result.Errors)
+		}
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		revokeQuery := `mutation revokeSensorKey($input: RevokeSensorKeyInput!) {
+			revokeSensorKey(input: $input) { sensorKey { isActive } }
+		}`
+		revokeVariables := map[string]interface{}{"input": map[string]interface{}{
+			"id": key.CreateSensorKey.SensorKey.ID}}
+		if result := worrywortSchema.Exec(otherCtx, revokeQuery, "", revokeVariables); len(result.Errors) == 0 {
+			t.Errorf("Expected an error revoking another user's key but got: %s", result.Data)
+		}
+		revoked := worrywortSchema.Exec(userCtx, revokeQuery, "", revokeVariables)
+		if string(revoked.Data) != `{"revokeSensorKey":{"sensorKey":{"isActive":false}}}` {
+			t.Errorf("Unexpected result revoking: %s %v", revoked.Data, revoked.Errors)
+		}
+	})
+}
+
+func TestHandlerTokenScope(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	worrywortSchema := graphql.MustParseSchema(graphql_api.Schema, graphql_api.NewResolver(db))
+	u := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	if err := u.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := worrywort.Sensor{Name: "Test Sensor", UserId: u.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	h := &graphql_api.Handler{Db: db, Handler: &relay.Handler{Schema: worrywortSchema}}
+	body, _ := json.Marshal(map[string]interface{}{"query": `query { currentUser { id } }`})
+
+	for _, tc := range []struct {
+		name     string
+		token    worrywort.AuthToken
+		expected int
+	}{
+		{"Full scope token", worrywort.AuthToken{User: u, Scope: worrywort.TOKEN_SCOPE_ALL}, http.StatusOK},
+		{"Write temperatures token", worrywort.AuthToken{User: u, Scope: worrywort.TOKEN_SCOPE_WRITE_TEMPS},
+			http.StatusForbidden},
+		{"Sensor bound token", worrywort.AuthToken{User: u, Scope: worrywort.TOKEN_SCOPE_WRITE_TEMPS,
+			SensorId: sensor.Id}, http.StatusForbidden},
+		{"Client certificate", worrywort.AuthToken{User: u, Scope: worrywort.TOKEN_SCOPE_WRITE_TEMPS,
+			Type: worrywort.TOKEN_TYPE_CLIENT_CERTIFICATE}, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			token := tc.token
+			ctx := context.WithValue(context.Background(), middleware.DefaultUserKey, &u)
+			ctx = context.WithValue(ctx, middleware.DefaultTokenKey, &token)
+			req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req.WithContext(ctx))
+			if rr.Code != tc.expected {
+				t.Errorf("Expected status %d but got %d: %s", tc.expected, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	admin := worrywort.User{Email: "admin@example.com", FullName: "Admin User", Username: "admin", IsActive: true,
+		IsAdmin: true}
+	otherAdmin := worrywort.User{Email: "admin2@example.com", FullName: "Other Admin", Username: "admin2",
+		IsActive: true, IsAdmin: true}
+	u := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	for _, user := range []*worrywort.User{&admin, &otherAdmin, &u} {
+		if err := user.Save(db); err != nil {
+			t.Fatalf("failed to insert user: %s", err)
+		}
+	}
+
+	resolver := graphql_api.NewResolver(db)
+	worrywortSchema := graphql.MustParseSchema(graphql_api.Schema, resolver)
+	readOnlySchema := graphql.MustParseSchema(graphql_api.ReadOnlySchema, resolver)
+	ctx := context.WithValue(context.Background(), "db", db)
+	adminCtx := context.WithValue(ctx, middleware.DefaultUserKey, &admin)
+
+	startQuery := `
+		mutation adminStartImpersonation($input: AdminStartImpersonationInput!) {
+			adminStartImpersonation(input: $input) {
+				token { token }
+				adminUser { id }
+				userErrors { field error }
+			}
+		}`
+	type startResult struct {
+		AdminStartImpersonation struct {
+			Token *struct {
+				Token string `json:"token"`
+			} `json:"token"`
+		} `json:"adminStartImpersonation"`
+	}
+	// starts impersonating u and returns the token as the authentication middleware would put it in the context
+	startImpersonation := func(t *testing.T, allowWrites bool) (string, *worrywort.AuthToken) {
+		variables := map[string]interface{}{
+			"input": map[string]interface{}{"userId": u.UUID, "minutes": 5, "allowWrites": allowWrites}}
+		result := worrywortSchema.Exec(adminCtx, startQuery, "", variables)
+		started := new(startResult)
+		if err := json.Unmarshal(result.Data, started); err != nil || len(result.Errors) > 0 {
+			t.Fatalf("%v: %v", err, result)
+		}
+		if started.AdminStartImpersonation.Token == nil {
+			t.Fatalf("Expected a token but got %s", result.Data)
+		}
+		tokenStr := started.AdminStartImpersonation.Token.Token
+		token, err := worrywort.AuthenticateUserByToken(tokenStr, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return tokenStr, &token
+	}
+	impersonatingCtx := func(token *worrywort.AuthToken) context.Context {
+		c := context.WithValue(ctx, middleware.DefaultUserKey, &token.User)
+		return context.WithValue(c, middleware.DefaultTokenKey, token)
+	}
+	createSensorQuery := `
+		mutation createSensor($input: CreateSensorInput!) {
+			createSensor(input: $input) { sensor { id } }
+		}`
+	createSensorVars := map[string]interface{}{"input": map[string]interface{}{"name": "Impersonated Sensor"}}
+
+	t.Run("Token authenticates as the user", func(t *testing.T) {
+		_, token := startImpersonation(t, false)
+		if *token.User.Id != *u.Id || token.ImpersonatorId == nil || *token.ImpersonatorId != *admin.Id {
+			t.Errorf("Expected user %d impersonated by %d but got %v", *u.Id, *admin.Id, token)
+		}
+		if !token.IsReadOnly() {
+			t.Errorf("Expected a read-only token")
+		}
+		if !token.ExpiresAt.Valid || token.ExpiresAt.Time.After(time.Now().Add(5*time.Minute)) {
+			t.Errorf("Expected the token to expire within 5 minutes but got %v", token.ExpiresAt)
+		}
+	})
+
+	t.Run("Read-only impersonation cannot mutate", func(t *testing.T) {
+		_, token := startImpersonation(t, false)
+		result := readOnlySchema.Exec(impersonatingCtx(token), createSensorQuery, "", createSensorVars)
+		if len(result.Errors) == 0 {
+			t.Errorf("Expected an error but got %s", result.Data)
+		}
+		result = readOnlySchema.Exec(impersonatingCtx(token), `query { currentUser { id } }`, "", nil)
+		expected := fmt.Sprintf(`{"currentUser":{"id":"%s"}}`, u.UUID)
+		if len(result.Errors) != 0 || string(result.Data) != expected {
+			t.Errorf("Expected %s but got %s %v", expected, result.Data, result.Errors)
+		}
+	})
+
+	t.Run("Handler uses the read-only schema", func(t *testing.T) {
+		_, token := startImpersonation(t, false)
+		body, _ := json.Marshal(map[string]interface{}{"query": createSensorQuery, "variables": createSensorVars})
+		for _, tc := range []struct {
+			name     string
+			readOnly *relay.Handler
+			expected int
+		}{
+			{"Without a read-only handler", nil, http.StatusForbidden},
+			{"With a read-only handler", &relay.Handler{Schema: readOnlySchema}, http.StatusOK},
+		} {
+			h := &graphql_api.Handler{Db: db, Handler: &relay.Handler{Schema: worrywortSchema}, ReadOnly: tc.readOnly}
+			req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req.WithContext(impersonatingCtx(token)))
+			if rr.Code != tc.expected {
+				t.Errorf("%s: expected status %d but got %d", tc.name, tc.expected, rr.Code)
+			}
+			if rr.Code == http.StatusOK && !strings.Contains(rr.Body.String(), `"errors"`) {
+				t.Errorf("%s: expected the mutation to fail but got %s", tc.name, rr.Body.String())
+			}
+		}
+	})
+
+	t.Run("Writes are audited as impersonated", func(t *testing.T) {
+		_, token := startImpersonation(t, true)
+		if token.IsReadOnly() {
+			t.Fatalf("Expected a token which allows writes")
+		}
+		result := worrywortSchema.Exec(impersonatingCtx(token), createSensorQuery, "", createSensorVars)
+		if len(result.Errors) != 0 {
+			t.Fatalf("Unexpected errors: %v", result.Errors)
+		}
+		entries, err := worrywort.FindAuditLogEntries(map[string]interface{}{"user_id": *u.Id,
+			"action": worrywort.AUDIT_ACTION_CREATE, "entity_type": worrywort.AUDIT_ENTITY_SENSOR}, db)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("Expected 1 audit log entry but got %v, %v", entries, err)
+		}
+		if entries[0].ImpersonatorId == nil || *entries[0].ImpersonatorId != *admin.Id {
+			t.Errorf("Expected the entry to be impersonated by %d but got %v", *admin.Id, entries[0].ImpersonatorId)
+		}
+	})
+
+	t.Run("Admins cannot be impersonated", func(t *testing.T) {
+		variables := map[string]interface{}{"input": map[string]interface{}{"userId": otherAdmin.UUID}}
+		result := worrywortSchema.Exec(adminCtx, startQuery, "", variables)
+		expected := `{"adminStartImpersonation":{"token":null,"adminUser":null,"userErrors":[{"field":["userId"],` +
+			`"error":"That user cannot be impersonated."}]}}`
+		if len(result.Errors) != 0 || string(result.Data) != expected {
+			t.Errorf("Expected %s but got %s %v", expected, result.Data, result.Errors)
+		}
+	})
+
+	t.Run("Non-admin cannot impersonate", func(t *testing.T) {
+		userCtx := context.WithValue(ctx, middleware.DefaultUserKey, &u)
+		variables := map[string]interface{}{"input": map[string]interface{}{"userId": admin.UUID}}
+		result := worrywortSchema.Exec(userCtx, startQuery, "", variables)
+		if len(result.Errors) != 1 || result.Errors[0].Message != middleware.ErrAdminRequired.Error() {
+			t.Errorf("Expected error %v but got %v", middleware.ErrAdminRequired, result.Errors)
+		}
+	})
+
+	t.Run("Ending the impersonation invalidates the token", func(t *testing.T) {
+		tokenStr, _ := startImpersonation(t, false)
+		result := worrywortSchema.Exec(adminCtx, `
+			mutation adminEndImpersonation($input: AdminEndImpersonationInput!) {
+				adminEndImpersonation(input: $input) { adminUser { id } userErrors { field error } }
+			}`, "", map[string]interface{}{"input": map[string]interface{}{"token": tokenStr}})
+		expected := fmt.Sprintf(`{"adminEndImpersonation":{"adminUser":{"id":"%s"},"userErrors":[]}}`, u.UUID)
+		if len(result.Errors) != 0 || string(result.Data) != expected {
+			t.Errorf("Expected %s but got %s %v", expected, result.Data, result.Errors)
+		}
+		if _, err := worrywort.AuthenticateUserByToken(tokenStr, db); err != worrywort.ErrInvalidToken {
+			t.Errorf("Expected ErrInvalidToken but got %v", err)
+		}
+	})
+
+	t.Run("Token stops working if the admin is deactivated", func(t *testing.T) {
+		tokenStr, _ := startImpersonation(t, false)
+		admin.IsActive = false
+		if err := admin.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer func() {
+			admin.IsActive = true
+			admin.Save(db)
+		}()
+		if _, err := worrywort.AuthenticateUserByToken(tokenStr, db); err != worrywort.ErrInvalidToken {
+			t.Errorf("Expected ErrInvalidToken but got %v", err)
+		}
+	})
+}
@@ -2,17 +2,83 @@ package graphql_api
 
 import (
 	"context"
+	"encoding/json"
+	graphql "github.com/graph-gophers/graphql-go"
 	"github.com/graph-gophers/graphql-go/relay"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
 	"github.com/jmoiron/sqlx"
 	"net/http"
+	"strings"
 )
 
+// Schema for requests made with a read-only token, such as a read-only impersonation.  Its only mutation is a stub, so
+// any real mutation fails validation rather than each resolver having to check.  graphql-go panics on a mutation if
+// the schema has no mutation type at all.
+var ReadOnlySchema = strings.Replace(Schema, "mutation: Mutation", "mutation: ReadOnlyMutation", 1) + `
+	# The only mutation available with a read-only token
+	type ReadOnlyMutation {
+		# Always true
+		readOnly: Boolean!
+	}
+`
+
+// Resolves ReadOnlyMutation.readOnly
+func (r *Resolver) ReadOnly() bool { return true }
+
 type Handler struct {
 	Db *sqlx.DB
 	*relay.Handler
+	// Serves requests made with a read-only token, see ReadOnlySchema.  They get a 403 if this is nil.
+	ReadOnly *relay.Handler
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := context.WithValue(r.Context(), "db", h.Db)
-	h.Handler.ServeHTTP(w, r.WithContext(ctx))
+	ctx = context.WithValue(ctx, remoteIPKey, middleware.RemoteIP(r))
+	// Tokens limited to a scope, such as a device's TOKEN_SCOPE_WRITE_TEMPS, are only for the measurement endpoints
+	if t, _ := middleware.AuthTokenFromContext(ctx); t != nil && !t.AllowsScope(worrywort.TOKEN_SCOPE_ALL) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if middleware.IsReadOnly(ctx) {
+		if h.ReadOnly == nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		serveGraphQL(h.ReadOnly.Schema, w, r.WithContext(ctx))
+		return
+	}
+	serveGraphQL(h.Handler.Schema, w, r.WithContext(ctx))
+}
+
+// The same as relay.Handler, except that a resolver error such as a locked out login gets a 429 with Retry-After so
+// that clients back off the same as with the REST api.  The errors are still in the body as usual.
+func serveGraphQL(schema *graphql.Schema, w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := schema.Exec(r.Context(), params.Query, params.OperationName, params.Variables)
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	for _, e := range response.Errors {
+		if retryErr, ok := e.ResolverError.(middleware.RetryAfterError); ok {
+			middleware.SetRetryAfter(w, retryErr.RetryAfter())
+			w.WriteHeader(http.StatusTooManyRequests)
+			break
+		}
+	}
+	w.Write(responseJSON)
 }
@@ -0,0 +1,109 @@
+package graphql_api
+
+import (
+	"context"
+	"database/sql"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"log"
+	"strings"
+	"time"
+)
+
+// Input types
+type adminStartImpersonationInput struct {
+	UserId      graphql.ID
+	Minutes     *int32
+	AllowWrites *bool
+}
+
+type adminEndImpersonationInput struct {
+	Token string
+}
+
+// Mutation Payloads
+type adminImpersonationPayload struct {
+	token      *authTokenResolver
+	adminUser  *adminUserResolver
+	userErrors []*userErrorResolver
+}
+
+func (p adminImpersonationPayload) Token() *authTokenResolver         { return p.token }
+func (p adminImpersonationPayload) AdminUser() *adminUserResolver     { return p.adminUser }
+func (p adminImpersonationPayload) UserErrors() *[]*userErrorResolver { return &p.userErrors }
+
+func impersonationUserError(field, err string) *adminImpersonationPayload {
+	e := &userErrorResolver{f: []string{field}, err: err}
+	return &adminImpersonationPayload{userErrors: []*userErrorResolver{e}}
+}
+
+func (r *Resolver) AdminStartImpersonation(ctx context.Context, args *struct {
+	Input *adminStartImpersonationInput
+}) (*adminImpersonationPayload, error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	input := *args.Input
+	duration := worrywort.DEFAULT_IMPERSONATION_DURATION
+	if input.Minutes != nil {
+		duration = time.Duration(*input.Minutes) * time.Minute
+		if duration <= 0 || duration > worrywort.MAX_IMPERSONATION_DURATION {
+			return impersonationUserError("minutes", "Minutes must be between 1 and 240."), nil
+		}
+	}
+	allowWrites := input.AllowWrites != nil && *input.AllowWrites
+
+	user, err := worrywort.FindUser(map[string]interface{}{"uuid": string(input.UserId)}, r.db)
+	if err == sql.ErrNoRows {
+		return impersonationUserError("userId", "User does not exist."), nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+
+	token, err := worrywort.GenerateImpersonationToken(*admin, *user, duration, allowWrites)
+	if err == worrywort.ErrCannotImpersonateUser {
+		return impersonationUserError("userId", err.Error()), nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	if err := token.Save(r.db); err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, admin, worrywort.AUDIT_ACTION_IMPERSONATE_START, worrywort.AUDIT_ENTITY_USER, user.UUID, nil,
+		map[string]interface{}{"token_id": token.Id, "expires_at": token.ExpiresAt.Time, "writes_allowed": allowWrites})
+	return &adminImpersonationPayload{token: &authTokenResolver{t: token},
+		adminUser: &adminUserResolver{u: user, db: r.db}}, nil
+}
+
+func (r *Resolver) AdminEndImpersonation(ctx context.Context, args *struct {
+	Input *adminEndImpersonationInput
+}) (*adminImpersonationPayload, error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the token is given as returned by adminStartImpersonation, but only its id is needed to delete it
+	tokenId := strings.SplitN(args.Input.Token, ":", 2)[0]
+	userId, err := worrywort.DeleteImpersonationToken(tokenId, r.db)
+	if err == worrywort.ErrInvalidToken {
+		return impersonationUserError("token", "No impersonation has that token."), nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+
+	user, err := worrywort.FindUser(map[string]interface{}{"id": userId}, r.db)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, admin, worrywort.AUDIT_ACTION_IMPERSONATE_END, worrywort.AUDIT_ENTITY_USER, user.UUID,
+		map[string]interface{}{"token_id": tokenId}, nil)
+	return &adminImpersonationPayload{adminUser: &adminUserResolver{u: user, db: r.db}}, nil
+}
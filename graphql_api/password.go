@@ -0,0 +1,170 @@
+package graphql_api
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+)
+
+// Delivers a password reset token to a user, such as by email.
+type PasswordResetNotifier func(user worrywort.User, token string) error
+
+// The default PasswordResetNotifier.  It just logs the token, which is fine for development
+// but anything else should configure a real notifier.
+func LogPasswordResetNotifier(user worrywort.User, token string) error {
+	log.Printf("Password reset requested for %s. Reset token: %s", user.Email, token)
+	return nil
+}
+
+// Input types
+type resetPasswordInput struct {
+	Token       string
+	NewPassword string
+}
+
+type changePasswordInput struct {
+	CurrentPassword string
+	NewPassword     string
+}
+
+// Mutation Payloads
+type requestPasswordResetPayload struct{}
+
+// Always true so that the response does not reveal whether an account exists for the email
+func (p requestPasswordResetPayload) Ok() bool { return true }
+
+type resetPasswordPayload struct {
+	user       *userResolver
+	userErrors []*userErrorResolver
+}
+
+func (p resetPasswordPayload) User() *userResolver               { return p.user }
+func (p resetPasswordPayload) UserErrors() *[]*userErrorResolver { return &p.userErrors }
+
+type changePasswordPayload struct {
+	token      *authTokenResolver
+	user       *userResolver
+	userErrors []*userErrorResolver
+}
+
+func (p changePasswordPayload) Token() *authTokenResolver         { return p.token }
+func (p changePasswordPayload) User() *userResolver               { return p.user }
+func (p changePasswordPayload) UserErrors() *[]*userErrorResolver { return &p.userErrors }
+
+// One error on the newPassword field for each password policy rule broken
+func passwordPolicyErrors(problems []string) []*userErrorResolver {
+	userErrors := []*userErrorResolver{}
+	for _, problem := range problems {
+		userErrors = append(userErrors, &userErrorResolver{f: []string{"newPassword"}, err: problem})
+	}
+	return userErrors
+}
+
+// Mutations
+
+// Generates a password reset token for the user with the given email and sends it using the
+// configured PasswordResetNotifier.  The token is made and sent after responding, so that how long the response takes
+// does not reveal whether an account exists for the email.
+func (r *Resolver) RequestPasswordReset(ctx context.Context, args *struct{ Email string }) (
+	*requestPasswordResetPayload, error) {
+	user, err := worrywort.FindUser(map[string]interface{}{"email": args.Email}, r.db)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%v", err)
+			return nil, ErrServerError
+		}
+		return &requestPasswordResetPayload{}, nil
+	}
+	go r.sendPasswordReset(ctx, user)
+	return &requestPasswordResetPayload{}, nil
+}
+
+// Makes and sends the reset token for RequestPasswordReset.  Failures can only be logged since the response has
+// already gone.
+func (r *Resolver) sendPasswordReset(ctx context.Context, user *worrywort.User) {
+	token, err := worrywort.GeneratePasswordResetToken(*user, worrywort.DefaultPasswordResetTokenTTL)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	if err := token.Save(r.db); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	if err := r.passwordResetNotifier(*user, token.ForPasswordReset()); err != nil {
+		log.Printf("Failed to send password reset: %v", err)
+		return
+	}
+	r.audit(ctx, user, worrywort.AUDIT_ACTION_PASSWORD_RESET_REQUEST, worrywort.AUDIT_ENTITY_USER, user.UUID, nil,
+		nil)
+}
+
+// Sets a new password using a token from RequestPasswordReset
+func (r *Resolver) ResetPassword(ctx context.Context, args *struct {
+	Input *resetPasswordInput
+}) (*resetPasswordPayload, error) {
+	input := *args.Input
+	invalidToken := func(err error) *resetPasswordPayload {
+		e := &userErrorResolver{f: []string{"token"}, err: err.Error()}
+		return &resetPasswordPayload{userErrors: []*userErrorResolver{e}}
+	}
+	// the token is only looked at here so that the password can be checked against the user, it is used up by
+	// worrywort.ResetPassword() once the password is acceptable
+	user, err := worrywort.FindPasswordResetTokenUser(input.Token, r.db)
+	if err == worrywort.ErrInvalidPasswordResetToken {
+		return invalidToken(err), nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	if problems := r.passwordPolicy.Validate(input.NewPassword, user); len(problems) > 0 {
+		return &resetPasswordPayload{userErrors: passwordPolicyErrors(problems)}, nil
+	}
+
+	user, err = worrywort.ResetPassword(input.Token, input.NewPassword, r.passwordHashCost, r.db)
+	if err == worrywort.ErrInvalidPasswordResetToken {
+		return invalidToken(err), nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, user, worrywort.AUDIT_ACTION_PASSWORD_RESET, worrywort.AUDIT_ENTITY_USER, user.UUID, nil, nil)
+	return &resetPasswordPayload{user: &userResolver{u: user}}, nil
+}
+
+// Changes the authenticated user's password.  All of the user's interactive tokens are invalidated, so a new
+// token is returned for the current session to keep using.
+func (r *Resolver) ChangePassword(ctx context.Context, args *struct {
+	Input *changePasswordInput
+}) (*changePasswordPayload, error) {
+	ctxUser, _ := middleware.UserFromContext(ctx)
+	if ctxUser == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+	// the context user may be from a JWT, which does not have the password hash
+	u, err := worrywort.FindUser(map[string]interface{}{"id": *ctxUser.Id}, r.db)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+
+	input := *args.Input
+	if problems := r.passwordPolicy.Validate(input.NewPassword, u); len(problems) > 0 {
+		return &changePasswordPayload{userErrors: passwordPolicyErrors(problems)}, nil
+	}
+
+	token, err := worrywort.ChangeUserPassword(u, input.CurrentPassword, input.NewPassword, r.passwordHashCost, r.db)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		e := &userErrorResolver{f: []string{"currentPassword"}, err: "Current password is incorrect."}
+		return &changePasswordPayload{userErrors: []*userErrorResolver{e}}, nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_PASSWORD_CHANGE, worrywort.AUDIT_ENTITY_USER, u.UUID, nil, nil)
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_LOGIN, worrywort.AUDIT_ENTITY_AUTH_TOKEN, token.Id, nil, nil)
+	return &changePasswordPayload{token: &authTokenResolver{t: token}, user: &userResolver{u: u}}, nil
+}
@@ -5,6 +5,7 @@ import (
 	// "fmt"
 	graphql "github.com/graph-gophers/graphql-go"
 	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
 	"github.com/jmichalicek/worrywort-server-go/worrywort"
 	"github.com/jmoiron/sqlx"
 	"log"
@@ -38,14 +39,65 @@ type Resolver struct {
 	// but on context is considered "not good"... I could pass this around instead, but would then
 	// need to either attach a Resolver or db to every single data type, which also kind of sucks
 	db *sqlx.DB
+
+	// bcrypt cost used when a password is changed or reset
+	passwordHashCost      int
+	passwordResetNotifier PasswordResetNotifier
+	// nil unless JWT access tokens are enabled
+	jwtConfig *worrywort.JWTConfig
+	// nil unless failed logins lock the account
+	loginLockout *ratelimit.Lockout
+	// new passwords must follow this
+	passwordPolicy *worrywort.PasswordPolicy
+	// nil unless new measurements are published somewhere, such as to MQTT
+	measurementNotifier worrywort.TemperatureMeasurementNotifier
+}
+
+// Configures optional behavior of the root Resolver.
+// See https://dave.cheney.net/2014/10/17/functional-options-for-friendly-apis
+type ResolverOption func(*Resolver)
+
+// Sets the bcrypt cost used when hashing a changed or reset password
+func WithPasswordHashCost(cost int) ResolverOption {
+	return func(r *Resolver) { r.passwordHashCost = cost }
+}
+
+// Sets how password reset tokens are delivered to the user.  Defaults to LogPasswordResetNotifier.
+func WithPasswordResetNotifier(fn PasswordResetNotifier) ResolverOption {
+	return func(r *Resolver) { r.passwordResetNotifier = fn }
+}
+
+// Enables returning JWT access tokens from login
+func WithJWTConfig(config *worrywort.JWTConfig) ResolverOption {
+	return func(r *Resolver) { r.jwtConfig = config }
+}
+
+// Sets the rules new passwords must follow.  Defaults to worrywort.NewPasswordPolicy().
+func WithPasswordPolicy(p *worrywort.PasswordPolicy) ResolverOption {
+	return func(r *Resolver) { r.passwordPolicy = p }
+}
+
+// Locks an email out of the login mutation after too many failed attempts
+func WithLoginLockout(l *ratelimit.Lockout) ResolverOption {
+	return func(r *Resolver) { r.loginLockout = l }
+}
+
+// Tells n about each temperature measurement created through the api
+func WithTemperatureMeasurementNotifier(n worrywort.TemperatureMeasurementNotifier) ResolverOption {
+	return func(r *Resolver) { r.measurementNotifier = n }
 }
 
 /* This is the root resolver */
-func NewResolver(db *sqlx.DB) *Resolver {
+func NewResolver(db *sqlx.DB, opts ...ResolverOption) *Resolver {
 	// Lshortfile tells me too little - filename, but not which package it is in, etc.
 	// Llongfile tells me too much - the full path at build from the go root. I really just need from the project root dir.
 	log.SetFlags(log.LstdFlags | log.Llongfile)
-	return &Resolver{db: db}
+	r := &Resolver{db: db, passwordHashCost: worrywort.PasswordHashCost,
+		passwordResetNotifier: LogPasswordResetNotifier, passwordPolicy: worrywort.NewPasswordPolicy()}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
 func (r *Resolver) CurrentUser(ctx context.Context) (*userResolver, error) {
@@ -58,8 +110,14 @@ func (r *Resolver) CurrentUser(ctx context.Context) (*userResolver, error) {
 	if u == nil {
 		return nil, ErrUserNotAuthenticated
 	}
+	// The context user may have come from a JWT which only has the user's ids, so always look up the rest
+	user, err := worrywort.FindUser(map[string]interface{}{"id": *u.Id}, r.db)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
 	// log.Printf("User is: %s", spew.Sdump(u))
-	ur := userResolver{u: u}
+	ur := userResolver{u: user}
 	return &ur, nil
 }
 
@@ -74,7 +132,7 @@ func (r *Resolver) Batch(ctx context.Context, args struct{ ID graphql.ID }) (*ba
 
 	batchArgs := make(map[string]interface{})
 	// TODO: Or if batch is publicly readable by anyone?
-	batchArgs["user_id"] = u.Id
+	batchArgs["viewable_by"] = *u.Id
 	batchArgs["uuid"] = args.ID
 
 	batchPtr, err := worrywort.FindBatch(batchArgs, r.db)
@@ -113,7 +171,7 @@ func (r *Resolver) Batches(ctx context.Context, args struct {
 		*first = int(*args.First)
 	}
 
-	queryparams := map[string]interface{}{"user_id": u.Id}
+	queryparams := map[string]interface{}{"viewable_by": *u.Id}
 	offset := 0
 
 	if args.After != nil && *args.After != "" {
@@ -174,7 +232,7 @@ func (r *Resolver) BatchSensorAssociations(ctx context.Context, args struct {
 		return nil, ErrServerError
 	}
 	var offset int
-	queryparams := map[string]interface{}{"user_id": u.Id}
+	queryparams := map[string]interface{}{"viewable_by": *u.Id}
 
 	if args.After != nil && *args.After != "" {
 		if cursorData, err := DecodeCursor(*args.After); err == nil && cursorData.Offset != nil {
@@ -251,7 +309,8 @@ func (r *Resolver) Sensor(ctx context.Context, args struct{ ID graphql.ID }) (*s
 		return nil, ErrServerError
 	}
 
-	sensor, err := worrywort.FindSensor(map[string]interface{}{"uuid": string(args.ID), "user_id": *user.Id}, db)
+	sensor, err := worrywort.FindSensor(
+		map[string]interface{}{"uuid": string(args.ID), "viewable_by": *user.Id}, db)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Printf("%v", err)
@@ -284,7 +343,7 @@ func (r *Resolver) Sensors(ctx context.Context, args struct {
 
 	// TODO: Can I de-duplicate some of this and put it in a reusable function?
 	var offset int
-	queryparams := map[string]interface{}{"user_id": u.Id}
+	queryparams := map[string]interface{}{"viewable_by": *u.Id}
 
 	if args.After != nil && *args.After != "" {
 		if cursorData, err := DecodeCursor(*args.After); err == nil && cursorData.Offset != nil {
@@ -359,7 +418,7 @@ func (r *Resolver) TemperatureMeasurement(ctx context.Context, args struct{ ID g
 	var resolved *temperatureMeasurementResolver
 	measurementId := string(args.ID)
 	measurement, err := worrywort.FindTemperatureMeasurement(
-		map[string]interface{}{"id": measurementId, "user_id": *authUser.Id}, db)
+		map[string]interface{}{"id": measurementId, "viewable_by": *authUser.Id}, db)
 	if err != nil {
 		log.Printf("%v", err)
 	} else if measurement != nil {
@@ -385,7 +444,7 @@ func (r *Resolver) TemperatureMeasurements(ctx context.Context, args struct {
 		return nil, ErrServerError
 	}
 
-	queryparams := map[string]interface{}{"user_id": *authUser.Id}
+	queryparams := map[string]interface{}{"viewable_by": *authUser.Id}
 	offset := 0 // TODO: implement correct offset in return values.
 
 	if args.After != nil && *args.After != "" {
@@ -458,12 +517,13 @@ func (r *Resolver) TemperatureMeasurements(ctx context.Context, args struct {
 type createTemperatureMeasurementInput struct {
 	RecordedAt  string //time.Time
 	Temperature float64
-	SensorId    graphql.ID
-	Units       string // it seems this graphql server cannot handle mapping enum to struct inputs
+	SensorId    *graphql.ID // optional when the token is bound to a sensor
+	Units       string      // it seems this graphql server cannot handle mapping enum to struct inputs
 }
 
 type createSensorInput struct {
-	Name string
+	Name   string
+	TeamId *graphql.ID
 }
 
 type updateSensorInput struct {
@@ -499,17 +559,34 @@ func (p updateSensorPayload) UserErrors() *[]*userErrorResolver { return &p.user
 type loginPayload struct {
 	t *worrywort.AuthToken
 	u *worrywort.User
+	// set instead of t and u when the user still needs to enter a TOTP code
+	totpChallenge string
 	//ue *[]*userErrors
 }
 
 func (p *loginPayload) Token() *authTokenResolver {
+	if p.t == nil {
+		return nil
+	}
 	return &authTokenResolver{t: *p.t}
 }
 
 func (p *loginPayload) User() *userResolver {
+	if p.u == nil {
+		return nil
+	}
 	return &userResolver{u: p.u}
 }
 
+func (p *loginPayload) TOTPRequired() bool { return p.totpChallenge != "" }
+
+func (p *loginPayload) TOTPChallenge() *string {
+	if p.totpChallenge == "" {
+		return nil
+	}
+	return &p.totpChallenge
+}
+
 // Mutations
 
 // Create a temperature measurementId
@@ -542,7 +619,18 @@ func (r *Resolver) CreateTemperatureMeasurement(ctx context.Context, args *struc
 		unitType = worrywort.CELSIUS
 	}
 
-	sensorPtr, err := worrywort.FindSensor(map[string]interface{}{"uuid": input.SensorId, "user_id": u.Id}, db)
+	// A token bound to a sensor implies the sensor and may not be used for any other
+	token, _ := middleware.AuthTokenFromContext(ctx)
+	sensorParams := map[string]interface{}{"editable_by": *u.Id}
+	if input.SensorId != nil {
+		sensorParams["uuid"] = string(*input.SensorId)
+	} else if token != nil && token.SensorId != nil {
+		sensorParams["id"] = *token.SensorId
+	} else {
+		return nil, errors.New("sensorId is required.")
+	}
+
+	sensorPtr, err := worrywort.FindSensor(sensorParams, db)
 	if err != nil {
 		// TODO: Probably need a friendlier error here or for our payload to have a shopify style userErrors
 		// and then not ever return nil from this either way...maybe
@@ -553,6 +641,9 @@ func (r *Resolver) CreateTemperatureMeasurement(ctx context.Context, args *struc
 		// for other stuff
 		return nil, errors.New("Specified Sensor does not exist.")
 	}
+	if token != nil && !token.AllowsSensor(*sensorPtr) {
+		return nil, worrywort.ErrTokenNotAllowedForSensor
+	}
 
 	// for actual iso 8601, use "2006-01-02T15:04:05-0700"
 	// TODO: test parsing both
@@ -564,10 +655,15 @@ func (r *Resolver) CreateTemperatureMeasurement(ctx context.Context, args *struc
 
 	t := worrywort.TemperatureMeasurement{Sensor: sensorPtr, SensorId: sensorPtr.Id,
 		Temperature: input.Temperature, Units: unitType, RecordedAt: recordedAt, CreatedBy: u, UserId: u.Id}
-	if err := t.Save(db); err != nil {
+	// a retry of a measurement which was already saved gets the original back
+	if err := t.Save(db); err == worrywort.ErrDuplicateTemperatureMeasurement {
+		return &createTemperatureMeasurementPayload{t: &temperatureMeasurementResolver{m: &t}}, nil
+	} else if err != nil {
 		log.Printf("Failed to save TemperatureMeasurement: %v\n", err)
 		return nil, err
 	}
+	r.measurementNotifier.Created(&t)
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_CREATE, worrywort.AUDIT_ENTITY_TEMPERATURE_MEASUREMENT, t.Id, nil, t)
 	tr := temperatureMeasurementResolver{m: &t}
 	result := createTemperatureMeasurementPayload{t: &tr}
 	return &result, nil
@@ -594,10 +690,18 @@ func (r *Resolver) CreateSensor(ctx context.Context, args *struct {
 	var input createSensorInput = *inputPtr
 
 	s := worrywort.Sensor{Name: input.Name, CreatedBy: u, UserId: u.Id}
+	if input.TeamId != nil {
+		team, err := findMemberTeam(*input.TeamId, *u.Id, worrywort.TEAM_ROLE_BREWER, db)
+		if err != nil {
+			return nil, err
+		}
+		s.TeamId = team.Id
+	}
 	if err := s.Save(db); err != nil {
 		log.Printf("Failed to save Sensor: %v\n", err)
 		return nil, err
 	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_CREATE, worrywort.AUDIT_ENTITY_SENSOR, s.UUID, nil, s)
 	sr := sensorResolver{s: &s}
 	result := createSensorPayload{s: &sr}
 	return &result, nil
@@ -629,7 +733,8 @@ func (r *Resolver) UpdateSensor(ctx context.Context, args *struct {
 		return &updateSensorPayload{sensor: nil, userErrors: []*userErrorResolver{e}}, nil
 	}
 
-	sensor, err := worrywort.FindSensor(map[string]interface{}{"uuid": string(input.ID), "user_id": *user.Id}, db)
+	sensor, err := worrywort.FindSensor(
+		map[string]interface{}{"uuid": string(input.ID), "editable_by": *user.Id}, db)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Printf("%v", err)
@@ -641,6 +746,7 @@ func (r *Resolver) UpdateSensor(ctx context.Context, args *struct {
 		return nil, nil
 	}
 
+	before := *sensor
 	sensor.Name = *input.Name
 	if err := sensor.Save(db); err != nil {
 		log.Printf("Failed to save Sensor: %v\n", err)
@@ -649,22 +755,76 @@ func (r *Resolver) UpdateSensor(ctx context.Context, args *struct {
 		// return an http 500 error.
 		return nil, err
 	}
+	r.audit(ctx, user, worrywort.AUDIT_ACTION_UPDATE, worrywort.AUDIT_ENTITY_SENSOR, sensor.UUID, before, sensor)
 	sr := &sensorResolver{s: sensor}
 	result := &updateSensorPayload{sensor: sr}
 	return result, nil
 }
 
-func (r *Resolver) Login(args *struct {
-	Username string
-	Password string
+func (r *Resolver) Login(ctx context.Context, args *struct {
+	Username  string
+	Password  string
+	TokenType string
 }) (*loginPayload, error) {
-	user, err := worrywort.AuthenticateLogin(args.Username, args.Password, r.db)
+	login := func(email, password string) (*worrywort.User, error) {
+		return worrywort.AuthenticateLogin(email, password, r.db)
+	}
+	if r.loginLockout != nil {
+		login = r.loginLockout.Login(login)
+	}
+	user, err := login(args.Username, args.Password)
 	// TODO: Check for errors which should not be exposed?  Or for known good errors to expose
 	// and return something more generic + log if unexpected?
 	if err != nil {
+		r.auditFailedLogin(ctx, args.Username)
 		return nil, err
 	}
 
+	// the password alone is not enough, the user has to follow up with verifyLoginTOTP
+	if user.TOTPEnabled {
+		challenge, err := worrywort.GenerateTOTPChallenge(*user)
+		if err == nil {
+			err = challenge.Save(r.db)
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			return nil, ErrServerError
+		}
+		return &loginPayload{totpChallenge: challenge.ForAuthenticationHeader()}, nil
+	}
+	return r.issueLoginToken(ctx, user, args.TokenType)
+}
+
+// Records a failed login against the account for the email, if there is one, so that it shows in that user's
+// audit trail
+func (r *Resolver) auditFailedLogin(ctx context.Context, email string) {
+	user, err := worrywort.FindUser(map[string]interface{}{"email": email}, r.db)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("%v", err)
+	}
+	entityId := ""
+	if user != nil {
+		entityId = user.UUID
+	}
+	r.audit(ctx, user, worrywort.AUDIT_ACTION_LOGIN_FAILED, worrywort.AUDIT_ENTITY_USER, entityId, nil, nil)
+}
+
+// Creates the token for a user who has logged in
+func (r *Resolver) issueLoginToken(ctx context.Context, user *worrywort.User, tokenType string) (*loginPayload,
+	error) {
+	if tokenType == "JWT" {
+		if r.jwtConfig == nil {
+			return nil, worrywort.ErrJWTNotConfigured
+		}
+		token, err := r.jwtConfig.NewAccessToken(*user, worrywort.TOKEN_SCOPE_ALL)
+		if err != nil {
+			log.Printf("%v", err)
+			return nil, ErrServerError
+		}
+		r.audit(ctx, user, worrywort.AUDIT_ACTION_LOGIN, worrywort.AUDIT_ENTITY_AUTH_TOKEN, token.Id, nil, nil)
+		return &loginPayload{t: &token, u: user}, nil
+	}
+
 	token, err := worrywort.GenerateTokenForUser(*user, worrywort.TOKEN_SCOPE_ALL)
 	if err != nil {
 		log.Printf("*****ERRR*****\n%v\n", err)
@@ -677,6 +837,7 @@ func (r *Resolver) Login(args *struct {
 		log.Printf("%s", err)
 		return nil, err
 	}
+	r.audit(ctx, user, worrywort.AUDIT_ACTION_LOGIN, worrywort.AUDIT_ENTITY_AUTH_TOKEN, token.Id, nil, nil)
 	// TODO: should use tokenPtr.User and have THAT be a pointer to User
 	payload := &loginPayload{t: tokenPtr, u: user}
 	return payload, err
@@ -15,6 +15,11 @@ var Schema = `
 	}
 
 	type Query {
+		# Queries only available to admin users.  Null with an error for any other user.
+		admin: Admin
+		# The authenticated user's audit trail, newest first.  entityType and entityId match AuditLogEntry.  since
+		# and until limit it to entries created at or after since and before until.
+		auditLog(first: Int after: String entityType: String entityId: ID since: DateTime until: DateTime): AuditLogEntryConnection!
 		currentUser(): User
 		# Returns a Batch by id for the currently authenticated user
 		batch(id: ID!): Batch
@@ -25,21 +30,84 @@ var Schema = `
 		# is more appropriate?
 		sensor(id: ID!): Sensor
 		sensors(first: Int after: String): SensorConnection!
+		# The public view of a batch shared with createBatchShareLink.  Does not require authentication.  Null if the
+		# link does not exist, has expired, or was revoked.
+		sharedBatch(slug: String!): SharedBatch
 		temperatureMeasurement(id: ID!): TemperatureMeasurement
 		temperatureMeasurements(first: Int after: String sensorId: ID batchId: ID): TemperatureMeasurementConnection
+		# The teams the authenticated user is a member of
+		teams: [Team!]!
 	}
 
 	type Mutation {
+		# End an impersonation started with adminStartImpersonation by deleting its token.  Admin only.
+		adminEndImpersonation(input: AdminEndImpersonationInput!): AdminImpersonationPayload
+		# Delete every auth token for a user, logging them out everywhere.  Admin only.
+		adminResetUserTokens(input: AdminResetUserTokensInput!): AdminUserPayload
+		# Activate or deactivate a user.  Deactivated users cannot log in or use existing tokens.  Admin only.
+		adminSetUserActive(input: AdminSetUserActiveInput!): AdminUserPayload
+		# Get a token to act as another user, such as to see what they see when helping them.  The token expires
+		# after minutes, 30 by default and at most 240, and cannot change anything unless allowWrites is true.
+		# Everything done with it is recorded in the audit log as impersonated.  Other admins cannot be impersonated.
+		# Admin only.
+		adminStartImpersonation(input: AdminStartImpersonationInput!): AdminImpersonationPayload
+		# Approve a device using the code it displays, creating a Sensor for it.  The device can then get a token
+		# which can only write temperatures for that Sensor.
+		approveDevice(input: ApproveDeviceInput!): ApproveDevicePayload
 		associateSensorToBatch(input: AssociateSensorToBatchInput!): AssociateSensorToBatchPayload
-		login(username: String!, password: String!): LoginPayload
+		# Change the password of the authenticated user.  This logs out every other session.
+		changePassword(input: ChangePasswordInput!): ChangePasswordPayload
+		# Enable two-factor authentication with a code from the app set up with enrollTOTP.  Returns recovery codes
+		# which can be used instead of a code if the app is lost.  They are only shown this once.
+		confirmTOTP(input: ConfirmTOTPInput!): ConfirmTOTPPayload
+		# Create a team with the authenticated user as its owner
+		createTeam(input: CreateTeamInput!): TeamPayload
+		# Reject a device using the code it displays
+		denyDevice(input: DenyDeviceInput!): DenyDevicePayload
+		# Turn off two-factor authentication for the authenticated user
+		disableTOTP(input: DisableTOTPInput!): DisableTOTPPayload
+		# Start setting up two-factor authentication.  Add the provisioningUri to an authenticator app and then
+		# call confirmTOTP with a code from it.
+		enrollTOTP: EnrollTOTPPayload
+		# Log in and get a token.  tokenType JWT returns a short lived JWT to use as a Bearer token, if enabled.
+		# If the user has two-factor authentication enabled then only totpChallenge is returned, which must be
+		# passed to verifyLoginTOTP with a code to get the token.
+		login(username: String!, password: String!, tokenType: LoginTokenType = TOKEN): LoginPayload
+		# Send a single use password reset token to the user with the given email
+		requestPasswordReset(email: String!): RequestPasswordResetPayload
+		# Remove a user from a team.  Team owners only, although any member may remove themselves.
+		removeTeamMember(input: RemoveTeamMemberInput!): TeamPayload
+		# Stop a share link from working
+		revokeBatchShareLink(input: RevokeBatchShareLinkInput!): BatchShareLinkPayload
+		# Stop a sensor key from being accepted
+		revokeSensorKey(input: RevokeSensorKeyInput!): SensorKeyPayload
+		# Set a new password using a token from requestPasswordReset
+		resetPassword(input: ResetPasswordInput!): ResetPasswordPayload
+		# Add a user to a team by email or change their role.  Team owners only.
+		setTeamMember(input: SetTeamMemberInput!): TeamPayload
 		# Might remove createTemperatureMeasurement in favor of having those created via more IoT Friendly
 		# system such as mqtt.  Then system can look at relationships to attach to batch, fermenter, etc.
 		# but will definitely need an updateTemperatureMeasurement() to edit - ie. attach to a batch later, etc.
+		# If the sensor already has a measurement with the same recordedAt, such as when a device retries, that
+		# measurement is returned instead of creating another.
 		createTemperatureMeasurement(input: CreateTemperatureMeasurementInput!): CreateTemperatureMeasurementPayload
 		createBatch(input: CreateBatchInput!): CreateBatchPayload
+		# Make a link which lets anyone see a read-only view of the batch with sharedBatch
+		createBatchShareLink(input: CreateBatchShareLinkInput!): BatchShareLinkPayload
 		createSensor(input: CreateSensorInput!): CreateSensorPayload
+		# Make a key for a device to sign the sensor's measurements with when posting them over CoAP
+		createSensorKey(input: CreateSensorKeyInput!): SensorKeyPayload
 		updateBatchSensorAssociation(input: UpdateBatchSensorAssociationInput!): UpdateBatchSensorAssociationPayload
 		updateSensor(input: UpdateSensorInput!): UpdateSensorPayload
+		# Finish logging in with the totpChallenge from login and a code from an authenticator app or a recovery code
+		verifyLoginTOTP(challenge: String!, code: String!, tokenType: LoginTokenType = TOKEN): LoginPayload
+	}
+
+	enum LoginTokenType {
+		# A token stored by the server, used with "Authorization: token <token>"
+		TOKEN
+		# A signed JWT, used with "Authorization: Bearer <token>"
+		JWT
 	}
 
 	enum VolumeUnit {
@@ -52,12 +120,98 @@ var Schema = `
 		CELSIUS
 	}
 
+	enum TeamRole {
+		# Can see the team's batches, sensors, and measurements
+		VIEWER
+		# Can also change them and add new ones
+		BREWER
+		# Can also manage the team's members
+		OWNER
+	}
+
 	# RFC3339 formatted DateTime
 	scalar DateTime
 
+	type Admin {
+		# Search matches email, username, or full name
+		users(first: Int after: String search: String isActive: Boolean): AdminUserConnection!
+		user(id: ID!): AdminUser
+	}
+
+	# A User along with the details only admins may see
+	type AdminUser {
+		id: ID!
+		user: User!
+		isActive: Boolean!
+		isAdmin: Boolean!
+		batchCount: Int!
+		sensorCount: Int!
+		temperatureMeasurementCount: Int!
+	}
+
+	type AdminUserConnection {
+		pageInfo: PageInfo!
+		edges: [AdminUserEdge!]
+	}
+
+	type AdminUserEdge {
+		cursor: String!
+		node: AdminUser!
+	}
+
+	type AdminImpersonationPayload {
+		# The token to act as the user with.  Null when ending an impersonation.
+		token: AuthToken
+		# The impersonated user
+		adminUser: AdminUser
+		userErrors: [UserError!]
+	}
+
+	type AdminUserPayload {
+		adminUser: AdminUser
+		userErrors: [UserError!]
+	}
+
+	type ApproveDevicePayload {
+		# The Sensor created for the device
+		sensor: Sensor
+		userErrors: [UserError!]
+	}
+
+	# Something done by or to the user, such as logging in or updating a Sensor
+	type AuditLogEntry {
+		id: ID!
+		# Such as create, update, login, or login_failed
+		action: String!
+		# Such as batch, sensor, batch_sensor_association, user, or auth_token
+		entityType: String!
+		# The id of the entity as returned by this API
+		entityId: ID!
+		# JSON object of the fields which changed, as {"Field": {"before": ..., "after": ...}}
+		changes: String!
+		# The id of the AuthToken used.  Empty if there was none, such as when logging in.
+		tokenId: String!
+		# Whether this was done by an admin impersonating the user
+		impersonated: Boolean!
+		ip: String!
+		createdAt: DateTime!
+	}
+
+	type AuditLogEntryConnection {
+		pageInfo: PageInfo!
+		edges: [AuditLogEntryEdge!]
+	}
+
+	type AuditLogEntryEdge {
+		cursor: String!
+		node: AuditLogEntry!
+	}
+
 	type AuthToken {
 		id: ID!
 		token: String!
+		# When the token stops working.  Null if it does not expire.
+		expiresAt: DateTime
 	}
 
 	type Batch {
@@ -77,6 +231,27 @@ var Schema = `
 		createdAt: DateTime!
 		updatedAt: DateTime!
 		createdBy: User
+		# The team the batch is shared with.  Null if none or the authenticated user is not a member.
+		team: Team
+		# Newest first.  Null unless the authenticated user can change the batch.
+		shareLinks: [BatchShareLink!]
+	}
+
+	type BatchShareLink {
+		id: ID!
+		# Passed to sharedBatch
+		slug: String!
+		# Null if the link does not expire
+		expiresAt: DateTime
+		revokedAt: DateTime
+		# Whether the link can still be used
+		isActive: Boolean!
+		createdAt: DateTime!
+	}
+
+	type BatchShareLinkPayload {
+		shareLink: BatchShareLink
+		userErrors: [UserError!]
 	}
 
 	type BatchConnection {
@@ -129,9 +304,61 @@ var Schema = `
 		temperatureMeasurement: TemperatureMeasurement
 	}
 
+	type DenyDevicePayload {
+		ok: Boolean!
+		userErrors: [UserError!]
+	}
+
 	type LoginPayload {
 		token: AuthToken
 		user: User
+		# True if the user has to enter a two-factor authentication code with verifyLoginTOTP to get a token
+		totpRequired: Boolean!
+		totpChallenge: String
+	}
+
+	input ConfirmTOTPInput {
+		code: String!
+	}
+
+	type ConfirmTOTPPayload {
+		recoveryCodes: [String!]
+		userErrors: [UserError!]
+	}
+
+	input DisableTOTPInput {
+		password: String!
+	}
+
+	type DisableTOTPPayload {
+		user: User
+		userErrors: [UserError!]
+	}
+
+	type EnrollTOTPPayload {
+		# An otpauth:// uri, usually shown as a QR code for authenticator apps
+		provisioningUri: String
+		# The base32 secret, for apps which cannot scan the QR code
+		secret: String
+		userErrors: [UserError!]
+	}
+
+	# Data returned by the changePassword mutation
+	type ChangePasswordPayload {
+		# A new token to replace the one used to make the request, which is no longer valid
+		token: AuthToken
+		user: User
+		userErrors: [UserError!]
+	}
+
+	type RequestPasswordResetPayload {
+		# Always true.  Whether a user exists for the email is not revealed.
+		ok: Boolean!
+	}
+
+	type ResetPasswordPayload {
+		user: User
+		userErrors: [UserError!]
 	}
 
 	type Fermentor {
@@ -170,6 +397,26 @@ var Schema = `
 		createdBy: User
 		createdAt: DateTime!
 		updatedAt: DateTime!
+		# The team the sensor is shared with.  Null if none or the authenticated user is not a member.
+		team: Team
+		# Newest first.  Null unless the authenticated user can change the sensor.
+		keys: [SensorKey!]
+	}
+
+	type SensorKey {
+		# Sent by the device along with its signature
+		id: ID!
+		# The hex encoded key.  Only returned by createSensorKey.
+		key: String
+		revokedAt: DateTime
+		# Whether the key is still accepted
+		isActive: Boolean!
+		createdAt: DateTime!
+	}
+
+	type SensorKeyPayload {
+		sensorKey: SensorKey
+		userErrors: [UserError!]
 	}
 
 	type SensorConnection {
@@ -182,6 +429,75 @@ var Schema = `
 		node: Sensor!
 	}
 
+	# A group of users sharing batches and sensors, such as a brewing club
+	type Team {
+		id: ID!
+		name: String!
+		# The authenticated user's role in the team.  Null if they are not a member.
+		role: TeamRole
+		# Owners first
+		members: [TeamMember!]!
+		createdAt: DateTime!
+		updatedAt: DateTime!
+	}
+
+	type TeamMember {
+		user: User!
+		role: TeamRole!
+	}
+
+	type TeamPayload {
+		team: Team
+		userErrors: [UserError!]
+	}
+
+	# The read-only view of a Batch given by a share link
+	type SharedBatch {
+		name: String!
+		brewNotes: String!
+		tastingNotes: String!
+		brewedDate: DateTime
+		bottledDate: DateTime
+		volumeBoiled: Float
+		volumeInFermentor: Float
+		volumeUnits: VolumeUnit!
+		originalGravity: Float
+		finalGravity: Float
+		recipeURL: String!
+		createdBy: SharedUser
+		sensorAssociations: [SharedBatchSensorAssociation!]!
+		# Oldest first, at most 500 per page
+		temperatureMeasurements(first: Int after: String): SharedTemperatureMeasurementConnection!
+	}
+
+	type SharedBatchSensorAssociation {
+		sensorName: String!
+		description: String!
+		associatedAt: DateTime!
+		disassociatedAt: DateTime
+	}
+
+	type SharedTemperatureMeasurement {
+		temperature: Float!
+		units: TemperatureUnit!
+		recordedAt: DateTime!
+		sensorName: String!
+	}
+
+	type SharedTemperatureMeasurementConnection {
+		pageInfo: PageInfo!
+		edges: [SharedTemperatureMeasurementEdge!]
+	}
+
+	type SharedTemperatureMeasurementEdge {
+		cursor: String!
+		node: SharedTemperatureMeasurement!
+	}
+
+	type SharedUser {
+		username: String!
+	}
+
 	type PageInfo {
 		hasPreviousPage: Boolean!
 		hasNextPage: Boolean!
@@ -192,6 +508,8 @@ var Schema = `
 		fullName: String!
 		username: String!
 		email: String!
+		# Whether two-factor authentication is enabled
+		totpEnabled: Boolean!
 		createdAt: DateTime!
 		updatedAt: DateTime!
 	}
@@ -208,6 +526,37 @@ var Schema = `
 		error: String!
 	}
 
+	input ApproveDeviceInput {
+		# The code shown by the device, such as BCDF-GHJK
+		userCode: String!
+		# Name for the new Sensor.  Defaults to the name the device asked for.
+		sensorName: String
+	}
+
+	input DenyDeviceInput {
+		userCode: String!
+	}
+
+	input AdminEndImpersonationInput {
+		# The token returned by adminStartImpersonation
+		token: String!
+	}
+
+	input AdminResetUserTokensInput {
+		userId: ID!
+	}
+
+	input AdminSetUserActiveInput {
+		userId: ID!
+		isActive: Boolean!
+	}
+
+	input AdminStartImpersonationInput {
+		userId: ID!
+		minutes: Int
+		allowWrites: Boolean
+	}
+
 	# Input data to create a Batch
 	input CreateBatchInput {
 		# A name for the Batch
@@ -225,12 +574,63 @@ var Schema = `
 		// AverageTemperature *float64  not even sure this should be on the model...
 		recipeURL: String
 		tastingNotes: String
+		# Share the batch with a team the authenticated user is a brewer or owner of
+		teamId: ID
+	}
+
+	# Input data to change the authenticated user's password
+	input ChangePasswordInput {
+		currentPassword: String!
+		newPassword: String!
+	}
+
+	# Input data to reset a forgotten password
+	input ResetPasswordInput {
+		# The token sent by requestPasswordReset
+		token: String!
+		newPassword: String!
 	}
 
 	# Input data to create a sensor
 	input CreateSensorInput {
 		# A useful name for the sensor
 		name: String!
+		# Share the sensor with a team the authenticated user is a brewer or owner of
+		teamId: ID
+	}
+
+	input CreateBatchShareLinkInput {
+		batchId: ID!
+		# When the link stops working.  It works until revoked if not given.
+		expiresAt: DateTime
+	}
+
+	input RevokeBatchShareLinkInput {
+		id: ID!
+	}
+
+	input CreateSensorKeyInput {
+		sensorId: ID!
+	}
+
+	input RevokeSensorKeyInput {
+		id: ID!
+	}
+
+	input CreateTeamInput {
+		name: String!
+	}
+
+	input SetTeamMemberInput {
+		teamId: ID!
+		# The email of the user to add, or whose role to change
+		email: String!
+		role: TeamRole!
+	}
+
+	input RemoveTeamMemberInput {
+		teamId: ID!
+		userId: ID!
 	}
 
 	# Input data to create a TemperatureMeasurement
@@ -239,8 +639,8 @@ var Schema = `
 		temperature: Float!
 		# The date and time the temperature was recorded by the sensor
 		recordedAt: DateTime!
-		# The id of the Sensor which took the measurement
-		sensorId: ID!
+		# The id of the Sensor which took the measurement.  Optional if the token used is bound to a Sensor.
+		sensorId: ID
 		# The units the temperature was taken in
 		units: TemperatureUnit!
 	}
@@ -0,0 +1,152 @@
+package graphql_api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"strconv"
+)
+
+var ErrSensorKeyNotFound = errors.New("Specified sensor key does not exist.")
+
+type sensorKeyResolver struct {
+	k *worrywort.SensorKey
+	// only set when the key was just created, it is not shown again after that
+	showKey bool
+}
+
+func (r *sensorKeyResolver) ID() graphql.ID      { return graphql.ID(strconv.FormatInt(r.k.Id, 10)) }
+func (r *sensorKeyResolver) IsActive() bool      { return r.k.IsActive() }
+func (r *sensorKeyResolver) CreatedAt() DateTime { return DateTime{r.k.CreatedAt} }
+func (r *sensorKeyResolver) Key() *string {
+	if !r.showKey {
+		return nil
+	}
+	key := hex.EncodeToString(r.k.Key)
+	return &key
+}
+func (r *sensorKeyResolver) RevokedAt() *DateTime {
+	if r.k.RevokedAt == nil {
+		return nil
+	}
+	return &DateTime{*r.k.RevokedAt}
+}
+
+// The sensor's keys, if the authenticated user can change the sensor
+func (r *sensorResolver) Keys(ctx context.Context) (*[]*sensorKeyResolver, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	db, ok := ctx.Value("db").(*sqlx.DB)
+	if u == nil || !ok {
+		return nil, nil
+	}
+	if _, err := worrywort.FindSensor(map[string]interface{}{"id": *r.s.Id, "editable_by": *u.Id}, db); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%v", err)
+		}
+		return nil, nil
+	}
+	keys, err := worrywort.FindSensorKeys(map[string]interface{}{"sensor_id": *r.s.Id}, db)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	resolved := []*sensorKeyResolver{}
+	for _, k := range keys {
+		resolved = append(resolved, &sensorKeyResolver{k: k})
+	}
+	return &resolved, nil
+}
+
+// Input types
+type createSensorKeyInput struct {
+	SensorId graphql.ID
+}
+
+type revokeSensorKeyInput struct {
+	ID graphql.ID
+}
+
+// Mutation Payloads
+type sensorKeyPayload struct {
+	sensorKey  *sensorKeyResolver
+	userErrors []*userErrorResolver
+}
+
+func (p sensorKeyPayload) SensorKey() *sensorKeyResolver     { return p.sensorKey }
+func (p sensorKeyPayload) UserErrors() *[]*userErrorResolver { return &p.userErrors }
+
+// Mutations
+
+// Makes a key for a sensor the authenticated user can change
+func (r *Resolver) CreateSensorKey(ctx context.Context, args *struct {
+	Input *createSensorKeyInput
+}) (*sensorKeyPayload, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+	sensor, err := worrywort.FindSensor(
+		map[string]interface{}{"uuid": string(args.Input.SensorId), "editable_by": *u.Id}, r.db)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			// also an invalid uuid for the id
+			log.Printf("%v", err)
+		}
+		return nil, errors.New("Specified Sensor does not exist.")
+	}
+
+	key, err := worrywort.NewSensorKey(*sensor, *u)
+	if err == nil {
+		err = key.Save(r.db)
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	id := strconv.FormatInt(key.Id, 10)
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_CREATE, worrywort.AUDIT_ENTITY_SENSOR_KEY, id, nil,
+		map[string]interface{}{"sensor_id": sensor.UUID})
+	return &sensorKeyPayload{sensorKey: &sensorKeyResolver{k: &key, showKey: true}}, nil
+}
+
+// Stops a sensor key from being accepted.  Anyone who can change the sensor may revoke its keys.
+func (r *Resolver) RevokeSensorKey(ctx context.Context, args *struct {
+	Input *revokeSensorKeyInput
+}) (*sensorKeyPayload, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+	id, err := strconv.ParseInt(string(args.Input.ID), 10, 64)
+	if err != nil {
+		return nil, ErrSensorKeyNotFound
+	}
+	key, err := worrywort.FindSensorKey(map[string]interface{}{"id": id}, r.db)
+	if err == nil {
+		_, err = worrywort.FindSensor(map[string]interface{}{"id": *key.SensorId, "editable_by": *u.Id}, r.db)
+	}
+	if err == sql.ErrNoRows {
+		return nil, ErrSensorKeyNotFound
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+
+	switch err := key.Revoke(r.db); err {
+	case nil:
+	case worrywort.ErrSensorKeyRevoked:
+		e := &userErrorResolver{f: []string{"id"}, err: err.Error()}
+		return &sensorKeyPayload{sensorKey: &sensorKeyResolver{k: key}, userErrors: []*userErrorResolver{e}}, nil
+	default:
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_REVOKE, worrywort.AUDIT_ENTITY_SENSOR_KEY, string(args.Input.ID), nil, nil)
+	return &sensorKeyPayload{sensorKey: &sensorKeyResolver{k: key}}, nil
+}
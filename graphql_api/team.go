@@ -0,0 +1,277 @@
+package graphql_api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"strings"
+)
+
+var ErrTeamNotFound = errors.New("Specified Team does not exist.")
+
+// The TeamRole enum.  Like the other enums, inputs come in as the string.
+var teamRoleNames = map[worrywort.TeamRole]string{
+	worrywort.TEAM_ROLE_VIEWER: "VIEWER",
+	worrywort.TEAM_ROLE_BREWER: "BREWER",
+	worrywort.TEAM_ROLE_OWNER:  "OWNER",
+}
+
+func parseTeamRole(name string) (worrywort.TeamRole, bool) {
+	for role, n := range teamRoleNames {
+		if n == name {
+			return role, true
+		}
+	}
+	return worrywort.TEAM_ROLE_VIEWER, false
+}
+
+// Looks up a team by uuid which the user is at least minRole in.  Returns ErrTeamNotFound otherwise, so that
+// whether a team exists is not revealed to non-members.
+func findMemberTeam(teamId graphql.ID, userId int64, minRole worrywort.TeamRole, db *sqlx.DB) (*worrywort.Team,
+	error) {
+	team, err := worrywort.FindTeam(
+		map[string]interface{}{"uuid": string(teamId), "member_id": userId, "min_role": minRole}, db)
+	if err == sql.ErrNoRows {
+		return nil, ErrTeamNotFound
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	return team, nil
+}
+
+// Resolves a Batch's or Sensor's team.  Null if it does not have one or the authenticated user is not in it.
+func resolveTeam(ctx context.Context, teamId *int64) *teamResolver {
+	u, _ := middleware.UserFromContext(ctx)
+	db, ok := ctx.Value("db").(*sqlx.DB)
+	if teamId == nil || u == nil || !ok {
+		return nil
+	}
+	team, err := worrywort.FindTeam(map[string]interface{}{"id": *teamId, "member_id": *u.Id}, db)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%v", err)
+		}
+		return nil
+	}
+	return &teamResolver{t: team}
+}
+
+type teamResolver struct {
+	t *worrywort.Team
+}
+
+func (r *teamResolver) ID() graphql.ID      { return graphql.ID(r.t.UUID) }
+func (r *teamResolver) Name() string        { return r.t.Name }
+func (r *teamResolver) CreatedAt() DateTime { return DateTime{r.t.CreatedAt} }
+func (r *teamResolver) UpdatedAt() DateTime { return DateTime{r.t.UpdatedAt} }
+
+// The authenticated user's role in the team.  Null if they are not a member, such as after leaving it.
+func (r *teamResolver) Role(ctx context.Context) (*string, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+	db, ok := ctx.Value("db").(*sqlx.DB)
+	if !ok {
+		log.Printf("No database in context")
+		return nil, ErrServerError
+	}
+	role, err := r.t.MemberRole(*u.Id, db)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	name := teamRoleNames[role]
+	return &name, nil
+}
+
+func (r *teamResolver) Members(ctx context.Context) ([]*teamMemberResolver, error) {
+	db, ok := ctx.Value("db").(*sqlx.DB)
+	if !ok {
+		log.Printf("No database in context")
+		return nil, ErrServerError
+	}
+	members, err := r.t.Members(db)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	resolved := []*teamMemberResolver{}
+	for _, m := range members {
+		resolved = append(resolved, &teamMemberResolver{m: m})
+	}
+	return resolved, nil
+}
+
+type teamMemberResolver struct {
+	m *worrywort.TeamMember
+}
+
+func (r *teamMemberResolver) User() *userResolver { return &userResolver{u: r.m.User} }
+func (r *teamMemberResolver) Role() string        { return teamRoleNames[r.m.Role] }
+
+// The teams the authenticated user is a member of
+func (r *Resolver) Teams(ctx context.Context) ([]*teamResolver, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+	teams, err := worrywort.FindTeams(map[string]interface{}{"member_id": *u.Id}, r.db)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	resolved := []*teamResolver{}
+	for _, t := range teams {
+		resolved = append(resolved, &teamResolver{t: t})
+	}
+	return resolved, nil
+}
+
+// Input types
+type createTeamInput struct {
+	Name string
+}
+
+type setTeamMemberInput struct {
+	TeamId graphql.ID
+	Email  string
+	Role   string
+}
+
+type removeTeamMemberInput struct {
+	TeamId graphql.ID
+	UserId graphql.ID
+}
+
+// Mutation Payloads
+type teamPayload struct {
+	team       *teamResolver
+	userErrors []*userErrorResolver
+}
+
+func (p teamPayload) Team() *teamResolver               { return p.team }
+func (p teamPayload) UserErrors() *[]*userErrorResolver { return &p.userErrors }
+
+func teamUserError(field, err string) *teamPayload {
+	e := &userErrorResolver{f: []string{field}, err: err}
+	return &teamPayload{userErrors: []*userErrorResolver{e}}
+}
+
+// Mutations
+
+// Creates a team with the authenticated user as its owner
+func (r *Resolver) CreateTeam(ctx context.Context, args *struct {
+	Input *createTeamInput
+}) (*teamPayload, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+	name := strings.TrimSpace(args.Input.Name)
+	if name == "" {
+		return teamUserError("name", "Name must not be blank."), nil
+	}
+	team, err := worrywort.CreateTeam(name, *u, r.db)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_CREATE, worrywort.AUDIT_ENTITY_TEAM, team.UUID, nil, team)
+	return &teamPayload{team: &teamResolver{t: team}}, nil
+}
+
+// Adds the user with the email to a team or changes their role.  Team owners only.
+func (r *Resolver) SetTeamMember(ctx context.Context, args *struct {
+	Input *setTeamMemberInput
+}) (*teamPayload, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+	input := args.Input
+	team, err := findMemberTeam(input.TeamId, *u.Id, worrywort.TEAM_ROLE_OWNER, r.db)
+	if err != nil {
+		return nil, err
+	}
+	role, ok := parseTeamRole(input.Role)
+	if !ok {
+		return teamUserError("role", "Role must be OWNER, BREWER, or VIEWER."), nil
+	}
+	member, err := worrywort.FindUser(map[string]interface{}{"email": input.Email}, r.db)
+	if err == sql.ErrNoRows || (err == nil && !member.IsActive) {
+		return teamUserError("email", "No user has that email."), nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+
+	before, err := team.MemberRole(*member.Id, r.db)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	var beforeChanges interface{}
+	if err == nil {
+		beforeChanges = map[string]interface{}{"user_id": member.UUID, "role": teamRoleNames[before]}
+	}
+	switch err := team.SetMember(*member.Id, role, r.db); err {
+	case nil:
+	case worrywort.ErrLastTeamOwner:
+		return teamUserError("role", err.Error()), nil
+	default:
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_TEAM_MEMBER_SET, worrywort.AUDIT_ENTITY_TEAM, team.UUID, beforeChanges,
+		map[string]interface{}{"user_id": member.UUID, "role": teamRoleNames[role]})
+	return &teamPayload{team: &teamResolver{t: team}}, nil
+}
+
+// Removes a user from a team.  Team owners only, although any member may remove themselves.
+func (r *Resolver) RemoveTeamMember(ctx context.Context, args *struct {
+	Input *removeTeamMemberInput
+}) (*teamPayload, error) {
+	u, _ := middleware.UserFromContext(ctx)
+	if u == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+	input := args.Input
+	minRole := worrywort.TEAM_ROLE_OWNER
+	if string(input.UserId) == u.UUID {
+		minRole = worrywort.TEAM_ROLE_VIEWER
+	}
+	team, err := findMemberTeam(input.TeamId, *u.Id, minRole, r.db)
+	if err != nil {
+		return nil, err
+	}
+	member, err := worrywort.FindUser(map[string]interface{}{"uuid": string(input.UserId)}, r.db)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	if err == nil {
+		err = team.RemoveMember(*member.Id, r.db)
+	}
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return teamUserError("userId", "That user is not a member of the team."), nil
+	case worrywort.ErrLastTeamOwner:
+		return teamUserError("userId", err.Error()), nil
+	default:
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_TEAM_MEMBER_REMOVE, worrywort.AUDIT_ENTITY_TEAM, team.UUID,
+		map[string]interface{}{"user_id": member.UUID}, nil)
+	return &teamPayload{team: &teamResolver{t: team}}, nil
+}
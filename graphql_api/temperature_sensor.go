@@ -52,6 +52,9 @@ func (r *sensorResolver) CreatedBy(ctx context.Context) *userResolver {
 
 func (r *sensorResolver) Name() string { return r.s.Name }
 
+// The team the sensor is shared with, if the authenticated user is in it
+func (r *sensorResolver) Team(ctx context.Context) *teamResolver { return resolveTeam(ctx, r.s.TeamId) }
+
 type sensorEdge struct {
 	Cursor string
 	Node   *sensorResolver
@@ -0,0 +1,180 @@
+package graphql_api
+
+import (
+	"context"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"strings"
+)
+
+// Input types
+type confirmTOTPInput struct {
+	Code string
+}
+
+type disableTOTPInput struct {
+	Password string
+}
+
+// Mutation Payloads
+type enrollTOTPPayload struct {
+	provisioningURI *string
+	secret          *string
+	userErrors      []*userErrorResolver
+}
+
+func (p enrollTOTPPayload) ProvisioningURI() *string          { return p.provisioningURI }
+func (p enrollTOTPPayload) Secret() *string                   { return p.secret }
+func (p enrollTOTPPayload) UserErrors() *[]*userErrorResolver { return &p.userErrors }
+
+type confirmTOTPPayload struct {
+	recoveryCodes *[]string
+	userErrors    []*userErrorResolver
+}
+
+func (p confirmTOTPPayload) RecoveryCodes() *[]string          { return p.recoveryCodes }
+func (p confirmTOTPPayload) UserErrors() *[]*userErrorResolver { return &p.userErrors }
+
+type disableTOTPPayload struct {
+	user       *userResolver
+	userErrors []*userErrorResolver
+}
+
+func (p disableTOTPPayload) User() *userResolver               { return p.user }
+func (p disableTOTPPayload) UserErrors() *[]*userErrorResolver { return &p.userErrors }
+
+// The context user may be from a JWT, which does not have the TOTP fields, so reload it
+func totpUser(ctx context.Context, db *sqlx.DB) (*worrywort.User, error) {
+	ctxUser, _ := middleware.UserFromContext(ctx)
+	if ctxUser == nil {
+		return nil, ErrUserNotAuthenticated
+	}
+	u, err := worrywort.FindUser(map[string]interface{}{"id": *ctxUser.Id}, db)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	return u, nil
+}
+
+// Mutations
+
+// Starts setting up TOTP for the authenticated user
+func (r *Resolver) EnrollTOTP(ctx context.Context) (*enrollTOTPPayload, error) {
+	u, err := totpUser(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+	key, err := worrywort.EnrollTOTP(u, r.db)
+	if err == worrywort.ErrTOTPAlreadyEnabled {
+		e := &userErrorResolver{f: []string{}, err: err.Error()}
+		return &enrollTOTPPayload{userErrors: []*userErrorResolver{e}}, nil
+	} else if err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_TOTP_ENROLL, worrywort.AUDIT_ENTITY_USER, u.UUID, nil, nil)
+	uri := key.URL()
+	secret := key.Secret()
+	return &enrollTOTPPayload{provisioningURI: &uri, secret: &secret}, nil
+}
+
+// Enables TOTP once the user enters a code from their authenticator app
+func (r *Resolver) ConfirmTOTP(ctx context.Context, args *struct {
+	Input *confirmTOTPInput
+}) (*confirmTOTPPayload, error) {
+	u, err := totpUser(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+	codes, err := worrywort.ConfirmTOTP(u, args.Input.Code, r.db)
+	switch err {
+	case nil:
+		r.audit(ctx, u, worrywort.AUDIT_ACTION_TOTP_ENABLE, worrywort.AUDIT_ENTITY_USER, u.UUID, nil, nil)
+		return &confirmTOTPPayload{recoveryCodes: &codes}, nil
+	case worrywort.ErrInvalidTOTPCode:
+		e := &userErrorResolver{f: []string{"code"}, err: err.Error()}
+		return &confirmTOTPPayload{userErrors: []*userErrorResolver{e}}, nil
+	case worrywort.ErrTOTPAlreadyEnabled, worrywort.ErrTOTPNotEnrolled:
+		e := &userErrorResolver{f: []string{}, err: err.Error()}
+		return &confirmTOTPPayload{userErrors: []*userErrorResolver{e}}, nil
+	}
+	log.Printf("%v", err)
+	return nil, ErrServerError
+}
+
+// Turns off TOTP.  Requires the password so that a session left logged in cannot be used to remove it.
+func (r *Resolver) DisableTOTP(ctx context.Context, args *struct {
+	Input *disableTOTPInput
+}) (*disableTOTPPayload, error) {
+	u, err := totpUser(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(args.Input.Password)); err != nil {
+		e := &userErrorResolver{f: []string{"password"}, err: "Password is incorrect."}
+		return &disableTOTPPayload{userErrors: []*userErrorResolver{e}}, nil
+	}
+	if err := worrywort.DisableTOTP(u, r.db); err != nil {
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	r.audit(ctx, u, worrywort.AUDIT_ACTION_TOTP_DISABLE, worrywort.AUDIT_ENTITY_USER, u.UUID, nil, nil)
+	return &disableTOTPPayload{user: &userResolver{u: u}}, nil
+}
+
+// The second step of logging in for users with TOTP enabled.  Takes the totpChallenge from login and a code from
+// the user's authenticator app or a recovery code.
+func (r *Resolver) VerifyLoginTOTP(ctx context.Context, args *struct {
+	Challenge string
+	Code      string
+	TokenType string
+}) (*loginPayload, error) {
+	var lockout *ratelimit.Lockout
+	var lockoutKey string
+	if r.loginLockout != nil {
+		u, err := worrywort.FindTOTPChallengeUser(args.Challenge, r.db)
+		if err == worrywort.ErrInvalidTOTPChallenge {
+			return nil, err
+		} else if err != nil {
+			log.Printf("%v", err)
+			return nil, ErrServerError
+		}
+		// counted separately from passwords so that logging in again does not reset the failed codes
+		lockout, lockoutKey = r.loginLockout, "totp:"+strings.ToLower(u.Email)
+		if err := lockout.Check(lockoutKey); err != nil {
+			r.audit(ctx, u, worrywort.AUDIT_ACTION_LOGIN_FAILED, worrywort.AUDIT_ENTITY_USER, u.UUID, nil, nil)
+			return nil, err
+		}
+	}
+
+	user, err := worrywort.RedeemTOTPChallenge(args.Challenge, args.Code, r.db)
+	switch err {
+	case nil:
+		if lockout != nil {
+			if err := lockout.Reset(lockoutKey); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	case worrywort.ErrInvalidTOTPCode:
+		if lockout != nil {
+			if err := lockout.Fail(lockoutKey); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+		if u, err := worrywort.FindTOTPChallengeUser(args.Challenge, r.db); err == nil {
+			r.audit(ctx, u, worrywort.AUDIT_ACTION_LOGIN_FAILED, worrywort.AUDIT_ENTITY_USER, u.UUID, nil, nil)
+		}
+		return nil, err
+	case worrywort.ErrInvalidTOTPChallenge:
+		return nil, err
+	default:
+		log.Printf("%v", err)
+		return nil, ErrServerError
+	}
+	return r.issueLoginToken(ctx, user, args.TokenType)
+}
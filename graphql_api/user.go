@@ -24,5 +24,6 @@ func (r *userResolver) ID() graphql.ID {
 func (r *userResolver) FullName() string    { return r.u.FullName }
 func (r *userResolver) Username() string    { return r.u.Username }
 func (r *userResolver) Email() string       { return r.u.Email }
+func (r *userResolver) TOTPEnabled() bool   { return r.u.TOTPEnabled }
 func (r *userResolver) CreatedAt() DateTime { return DateTime{r.u.CreatedAt} }
 func (r *userResolver) UpdatedAt() DateTime { return DateTime{r.u.UpdatedAt} }
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"log"
+	"net/http"
+)
+
+// The context key the AuthToken used to authenticate the request is stored under, if there was one
+const DefaultTokenKey string = "authToken"
+
+// Returned by an Authenticator when the request does not have credentials for its scheme at all.
+// The chain moves on to the next Authenticator.
+var ErrNoCredentials = errors.New("No credentials for this authentication scheme")
+
+// Returned by an Authenticator when the request has credentials for its scheme but they are not valid,
+// such as an unknown token or the wrong password.
+var ErrInvalidCredentials = errors.New("Invalid credentials")
+
+// Authenticates a request using a single scheme, such as a token in the Authorization header.
+// The AuthToken may be nil for schemes which do not use one, such as HTTP Basic.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*worrywort.User, *worrywort.AuthToken, error)
+}
+
+// Looks up the user and token for a token string, such as worrywort.AuthenticateUserByToken().
+// Shared by the Authenticators which take a token from different parts of the request.
+type TokenLookupFunc func(token string) (*worrywort.User, *worrywort.AuthToken, error)
+
+// Type safe function to get the AuthToken the request was authenticated with from context
+func AuthTokenFromContext(ctx context.Context) (*worrywort.AuthToken, error) {
+	t, ok := ctx.Value(DefaultTokenKey).(*worrywort.AuthToken)
+	if !ok {
+		return nil, errors.New("Could not get worrywort.AuthToken from context")
+	}
+	return t, nil
+}
+
+// A middleware which tries each Authenticator in order until one finds credentials on the request.
+// Only the first Authenticator with credentials is used, so invalid credentials for one scheme do not fall
+// through to the next.  As with the other middleware, the request continues unauthenticated if no user is found
+// and NewLoginRequiredHandler() should be used where a user is required.  An Authenticator error with a
+// RetryAfter(), such as a locked out login, gets a 429 response.
+func NewAuthenticatorChainHandler(authenticators ...Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			ctx := req.Context()
+			// only update context if user is not already populated.
+			if u, _ := UserFromContext(ctx); u != nil {
+				next.ServeHTTP(rw, req)
+				return
+			}
+
+			for _, a := range authenticators {
+				user, token, err := a.Authenticate(req)
+				if err == ErrNoCredentials {
+					continue
+				}
+				if retryErr, ok := err.(RetryAfterError); ok {
+					TooManyRequests(rw, retryErr.RetryAfter())
+					return
+				}
+				if err != nil {
+					if err != ErrInvalidCredentials {
+						log.Printf("%v", err)
+					}
+					break
+				}
+				ctx = context.WithValue(ctx, DefaultUserKey, user)
+				if token != nil {
+					ctx = context.WithValue(ctx, DefaultTokenKey, token)
+				}
+				break
+			}
+			next.ServeHTTP(rw, req.WithContext(ctx))
+		})
+	}
+}
+
+// Converts the errors from looking up a token or user to ErrInvalidCredentials where they just mean the
+// credentials were wrong so that the chain does not log them.
+func credentialsError(err error) error {
+	switch err {
+	case worrywort.ErrInvalidToken, worrywort.ErrBadTokenFormat, worrywort.ErrUserNotFound, worrywort.ErrUserInactive,
+		worrywort.ErrClientCertificateNotFound:
+		return ErrInvalidCredentials
+	}
+	return err
+}
@@ -0,0 +1,240 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testRetryAfterError struct {
+	wait time.Duration
+}
+
+func (e *testRetryAfterError) Error() string             { return "locked out" }
+func (e *testRetryAfterError) RetryAfter() time.Duration { return e.wait }
+
+func TestAuthenticatorChain(t *testing.T) {
+	uid := int64(1)
+	expectedUser := worrywort.User{Id: &uid, Email: "user@example.com", IsActive: true}
+	expectedToken := worrywort.AuthToken{Id: "tokenid", User: expectedUser}
+	lookup := func(token string) (*worrywort.User, *worrywort.AuthToken, error) {
+		if token == "tokenid:secret" {
+			return &expectedUser, &expectedToken, nil
+		}
+		return nil, nil, worrywort.ErrInvalidToken
+	}
+	totpUser := worrywort.User{Id: &uid, Email: "totp@example.com", IsActive: true, TOTPEnabled: true}
+	login := func(email, password string) (*worrywort.User, error) {
+		if email == totpUser.Email {
+			return &totpUser, nil
+		}
+		if email != expectedUser.Email {
+			return nil, worrywort.ErrUserNotFound
+		}
+		if password != "password" {
+			return nil, bcrypt.ErrMismatchedHashAndPassword
+		}
+		return &expectedUser, nil
+	}
+	chain := NewAuthenticatorChainHandler(
+		&TokenHeaderAuthenticator{Lookup: lookup},
+		&BearerAuthenticator{Lookup: lookup},
+		&BasicAuthenticator{Login: login},
+		&QueryParamAuthenticator{Lookup: lookup},
+		&PathTokenAuthenticator{Lookup: lookup, Token: func(req *http.Request) string {
+			if !strings.HasPrefix(req.URL.Path, "/device/") {
+				return ""
+			}
+			return strings.TrimPrefix(req.URL.Path, "/device/")
+		}},
+	)
+
+	// makes the request and returns the user and token which ended up in the context
+	doRequest := func(req *http.Request) (*worrywort.User, *worrywort.AuthToken) {
+		var user *worrywort.User
+		var token *worrywort.AuthToken
+		handler := chain(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			user, _ = UserFromContext(req.Context())
+			token, _ = AuthTokenFromContext(req.Context())
+			rw.WriteHeader(http.StatusOK)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return user, token
+	}
+
+	var tests = []struct {
+		name          string
+		setup         func(req *http.Request)
+		expectedUser  *worrywort.User
+		expectedToken *worrywort.AuthToken
+	}{
+		{"Token header", func(req *http.Request) { req.Header.Set("Authorization", "token tokenid:secret") },
+			&expectedUser, &expectedToken},
+		{"Bearer header", func(req *http.Request) { req.Header.Set("Authorization", "Bearer tokenid:secret") },
+			&expectedUser, &expectedToken},
+		{"Basic auth", func(req *http.Request) { req.SetBasicAuth("user@example.com", "password") },
+			&expectedUser, nil},
+		{"Basic auth wrong password", func(req *http.Request) { req.SetBasicAuth("user@example.com", "wrong") },
+			nil, nil},
+		{"Basic auth with two-factor authentication enabled", func(req *http.Request) {
+			req.SetBasicAuth("totp@example.com", "password")
+		}, nil, nil},
+		{"Query param", func(req *http.Request) { req.URL.RawQuery = "access_token=tokenid:secret" },
+			&expectedUser, &expectedToken},
+		{"Invalid token header does not fall through to query param", func(req *http.Request) {
+			req.Header.Set("Authorization", "token tokenid:wrong")
+			req.URL.RawQuery = "access_token=tokenid:secret"
+		}, nil, nil},
+		{"Path token", func(req *http.Request) { req.URL.Path = "/device/tokenid:secret" },
+			&expectedUser, &expectedToken},
+		{"Invalid path token", func(req *http.Request) { req.URL.Path = "/device/tokenid:wrong" }, nil, nil},
+		{"No credentials", func(req *http.Request) {}, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			tt.setup(req)
+			user, token := doRequest(req)
+			if !cmp.Equal(tt.expectedUser, user) {
+				t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(tt.expectedUser, user))
+			}
+			if !cmp.Equal(tt.expectedToken, token, cmp.AllowUnexported(worrywort.AuthToken{})) {
+				t.Errorf("Expected token %v but got %v", tt.expectedToken, token)
+			}
+		})
+	}
+
+	t.Run("Retry after error responds with 429", func(t *testing.T) {
+		locked := NewAuthenticatorChainHandler(&BasicAuthenticator{
+			Login: func(email, password string) (*worrywort.User, error) {
+				return nil, &testRetryAfterError{wait: 90 * time.Second}
+			}})
+		handler := locked(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			t.Errorf("Expected the request to stop at the authenticator")
+		}))
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth("user@example.com", "password")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "90" {
+			t.Errorf("Expected 429 with Retry-After: 90, got %d %q", w.Code, w.Header().Get("Retry-After"))
+		}
+	})
+
+	t.Run("Existing user in context is not replaced", func(t *testing.T) {
+		otherId := int64(2)
+		other := worrywort.User{Id: &otherId, Email: "other@example.com"}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "token tokenid:secret")
+		req = req.WithContext(context.WithValue(req.Context(), DefaultUserKey, &other))
+		user, _ := doRequest(req)
+		if user != &other {
+			t.Errorf("Expected user %v but got %v", other, user)
+		}
+	})
+}
+
+func TestJWTBearerAuthenticator(t *testing.T) {
+	uid := int64(1)
+	user := worrywort.User{Id: &uid, UUID: "9a2a1f5e-3f8e-4a27-9e51-6f3b1c2d4e5f", IsActive: true}
+	config := &worrywort.JWTConfig{Secret: []byte("01234567890123456789012345678901")}
+	token, err := config.NewAccessToken(user, worrywort.TOKEN_SCOPE_ALL)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	a := &JWTBearerAuthenticator{Config: config}
+
+	t.Run("Valid JWT", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token.ForAuthenticationHeader())
+		u, tok, err := a.Authenticate(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !cmp.Equal(&user, u) {
+			t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(&user, u))
+		}
+		if tok == nil || tok.Type != worrywort.TOKEN_TYPE_JWT {
+			t.Errorf("Expected a JWT AuthToken but got %v", tok)
+		}
+	})
+
+	t.Run("Opaque bearer token is left for the next authenticator", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer tokenid:secret")
+		if _, _, err := a.Authenticate(req); err != ErrNoCredentials {
+			t.Errorf("Expected error: %v\nGot: %v", ErrNoCredentials, err)
+		}
+	})
+
+	t.Run("Invalid JWT", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token.ForAuthenticationHeader()+"x")
+		if _, _, err := a.Authenticate(req); err != ErrInvalidCredentials {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidCredentials, err)
+		}
+	})
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	uid := int64(1)
+	sensorId := int64(2)
+	user := worrywort.User{Id: &uid, Email: "user@example.com", IsActive: true}
+	registered := &x509.Certificate{Raw: []byte("registered"), Subject: pkix.Name{CommonName: "gateway-1"}}
+	lookup := func(cert *x509.Certificate) (*worrywort.User, *worrywort.AuthToken, error) {
+		if cert != registered {
+			return nil, nil, worrywort.ErrClientCertificateNotFound
+		}
+		return &user, &worrywort.AuthToken{User: user, SensorId: &sensorId}, nil
+	}
+	a := &ClientCertAuthenticator{Lookup: lookup}
+
+	t.Run("Registered certificate", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{registered}}}
+		u, tok, err := a.Authenticate(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !cmp.Equal(&user, u) {
+			t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(&user, u))
+		}
+		if tok == nil || tok.SensorId == nil || *tok.SensorId != sensorId {
+			t.Errorf("Expected a token bound to sensor %d but got %v", sensorId, tok)
+		}
+	})
+
+	t.Run("Unregistered certificate", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		other := &x509.Certificate{Raw: []byte("other")}
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{other}}}
+		if _, _, err := a.Authenticate(req); err != ErrInvalidCredentials {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidCredentials, err)
+		}
+	})
+
+	t.Run("Unverified certificate is ignored", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{registered}}
+		if _, _, err := a.Authenticate(req); err != ErrNoCredentials {
+			t.Errorf("Expected error: %v\nGot: %v", ErrNoCredentials, err)
+		}
+	})
+
+	t.Run("No TLS", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if _, _, err := a.Authenticate(req); err != ErrNoCredentials {
+			t.Errorf("Expected error: %v\nGot: %v", ErrNoCredentials, err)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+)
+
+// Authenticates using HTTP Basic auth with the user's email and password.  Mostly useful for scripts
+// and simple clients which cannot go through login to get a token first.  Users with two-factor authentication
+// enabled cannot use it since there is nowhere to put the code.
+type BasicAuthenticator struct {
+	// Checks the email and password, such as worrywort.AuthenticateLogin()
+	Login func(email, password string) (*worrywort.User, error)
+}
+
+func (a *BasicAuthenticator) Authenticate(req *http.Request) (*worrywort.User, *worrywort.AuthToken, error) {
+	email, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, nil, ErrNoCredentials
+	}
+	user, err := a.Login(email, password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return nil, nil, ErrInvalidCredentials
+	}
+	if err == nil && user.TOTPEnabled {
+		return nil, nil, ErrInvalidCredentials
+	}
+	return user, nil, credentialsError(err)
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"net/http"
+	"strings"
+)
+
+// Authenticates using `Authorization: Bearer <token>` as described in RFC 6750
+type BearerAuthenticator struct {
+	Lookup TokenLookupFunc
+}
+
+func (a *BearerAuthenticator) Authenticate(req *http.Request) (*worrywort.User, *worrywort.AuthToken, error) {
+	headerParts := strings.Fields(req.Header.Get("Authorization"))
+	if len(headerParts) != 2 || strings.ToLower(headerParts[0]) != "bearer" {
+		return nil, nil, ErrNoCredentials
+	}
+	user, token, err := a.Lookup(headerParts[1])
+	return user, token, credentialsError(err)
+}
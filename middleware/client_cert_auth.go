@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"net/http"
+)
+
+// Looks up the user for a verified TLS client certificate
+type CertificateLookupFunc func(cert *x509.Certificate) (*worrywort.User, *worrywort.AuthToken, error)
+
+// Authenticates using the TLS client certificate.  Only certificates which the server verified against the client CA
+// are used, so the server must request them with tls.VerifyClientCertIfGiven or tls.RequireAndVerifyClientCert.
+type ClientCertAuthenticator struct {
+	Lookup CertificateLookupFunc
+}
+
+func (a *ClientCertAuthenticator) Authenticate(req *http.Request) (*worrywort.User, *worrywort.AuthToken, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil, ErrNoCredentials
+	}
+	// the first certificate of a verified chain is the client's own certificate
+	user, token, err := a.Lookup(req.TLS.VerifiedChains[0][0])
+	return user, token, credentialsError(err)
+}
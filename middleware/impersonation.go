@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+// When an admin impersonates a user the request is authenticated with a worrywort.TOKEN_TYPE_IMPERSONATION token,
+// so UserFromContext() returns the impersonated user.  These get at the admin behind it.
+
+// The id of the admin acting as the authenticated user, or nil if the request is not impersonating anyone
+func ImpersonatorIdFromContext(ctx context.Context) *int64 {
+	t, _ := AuthTokenFromContext(ctx)
+	if t == nil {
+		return nil
+	}
+	return t.ImpersonatorId
+}
+
+// Whether the request was authenticated with a token which may not change anything, such as a read-only
+// impersonation token
+func IsReadOnly(ctx context.Context) bool {
+	t, _ := AuthTokenFromContext(ctx)
+	return t != nil && t.IsReadOnly()
+}
+
+// A middleware which returns a 403 for any request other than GET, HEAD, or OPTIONS made with a read-only token.
+// Must come after the authentication middleware.
+func NewReadOnlyHandler() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			switch req.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				if IsReadOnly(req.Context()) {
+					http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
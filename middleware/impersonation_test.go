@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewReadOnlyHandler(t *testing.T) {
+	adminId := int64(1)
+	okHandler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler := NewReadOnlyHandler()(okHandler)
+
+	var tests = []struct {
+		name     string
+		token    *worrywort.AuthToken
+		method   string
+		expected int
+	}{
+		{"No token", nil, http.MethodPost, http.StatusOK},
+		{"Login token", &worrywort.AuthToken{Type: worrywort.TOKEN_TYPE_LOGIN}, http.MethodPost, http.StatusOK},
+		{"Read-only impersonation GET",
+			&worrywort.AuthToken{Type: worrywort.TOKEN_TYPE_IMPERSONATION, ImpersonatorId: &adminId},
+			http.MethodGet, http.StatusOK},
+		{"Read-only impersonation POST",
+			&worrywort.AuthToken{Type: worrywort.TOKEN_TYPE_IMPERSONATION, ImpersonatorId: &adminId},
+			http.MethodPost, http.StatusForbidden},
+		{"Impersonation with writes POST",
+			&worrywort.AuthToken{Type: worrywort.TOKEN_TYPE_IMPERSONATION, ImpersonatorId: &adminId, WritesAllowed: true},
+			http.MethodPost, http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/api/v1/measurement", nil)
+			if tc.token != nil {
+				req = req.WithContext(context.WithValue(req.Context(), DefaultTokenKey, tc.token))
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tc.expected {
+				t.Errorf("Expected status %d but got %d", tc.expected, rr.Code)
+			}
+		})
+	}
+}
+
+func TestImpersonatorIdFromContext(t *testing.T) {
+	adminId := int64(1)
+	if id := ImpersonatorIdFromContext(context.Background()); id != nil {
+		t.Errorf("Expected nil without a token but got %d", *id)
+	}
+	token := &worrywort.AuthToken{Type: worrywort.TOKEN_TYPE_IMPERSONATION, ImpersonatorId: &adminId}
+	ctx := context.WithValue(context.Background(), DefaultTokenKey, token)
+	if id := ImpersonatorIdFromContext(ctx); id == nil || *id != adminId {
+		t.Errorf("Expected impersonator %d but got %v", adminId, id)
+	}
+}
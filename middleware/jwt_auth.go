@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strings"
+)
+
+// Authenticates using a JWT access token in `Authorization: Bearer <jwt>`.  If Db is set the user is looked up so
+// that JWTs stop working once the user is deactivated or changes their password, otherwise the database is not hit
+// and the User in the context only has what the JWT carries.  See worrywort.JWTConfig.ParseAccessToken().
+// Bearer tokens which are not JWTs are left for the BearerAuthenticator, so put this one first in the chain.
+type JWTBearerAuthenticator struct {
+	Config *worrywort.JWTConfig
+	Db     *sqlx.DB
+}
+
+func (a *JWTBearerAuthenticator) Authenticate(req *http.Request) (*worrywort.User, *worrywort.AuthToken, error) {
+	headerParts := strings.Fields(req.Header.Get("Authorization"))
+	if len(headerParts) != 2 || strings.ToLower(headerParts[0]) != "bearer" || strings.Count(headerParts[1], ".") != 2 {
+		return nil, nil, ErrNoCredentials
+	}
+	token, err := a.Config.ParseAccessToken(headerParts[1])
+	if err != nil {
+		return nil, nil, credentialsError(err)
+	}
+	if a.Db != nil {
+		user, err := worrywort.AuthenticateJWTUser(token, a.Db)
+		if err != nil {
+			return nil, nil, credentialsError(err)
+		}
+		token.User = *user
+	}
+	return &token.User, &token, nil
+}
@@ -1,6 +1,9 @@
 package middleware
 
 import (
+	"context"
+	"errors"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
 	"net/http"
 	// "log"
 	// "github.com/davecgh/go-spew/spew"
@@ -25,3 +28,18 @@ func NewLoginRequiredHandler() func(http.Handler) http.Handler {
 		})
 	}
 }
+
+var ErrAdminRequired = errors.New("Admin user required")
+
+// Returns the user from the context if it is an admin.  For use in handlers and resolvers which
+// only admins are allowed to use.
+func RequireAdmin(ctx context.Context) (*worrywort.User, error) {
+	u, err := UserFromContext(ctx)
+	if err != nil || u == nil {
+		return nil, ErrUserNotInContext
+	}
+	if !u.IsAdmin {
+		return nil, ErrAdminRequired
+	}
+	return u, nil
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"context"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"testing"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	uid := int64(1)
+
+	t.Run("Admin user", func(t *testing.T) {
+		user := &worrywort.User{Id: &uid, IsActive: true, IsAdmin: true}
+		ctx := context.WithValue(context.Background(), DefaultUserKey, user)
+		u, err := RequireAdmin(ctx)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if u != user {
+			t.Errorf("Expected user %v but got %v", user, u)
+		}
+	})
+
+	t.Run("Non-admin user", func(t *testing.T) {
+		user := &worrywort.User{Id: &uid, IsActive: true}
+		ctx := context.WithValue(context.Background(), DefaultUserKey, user)
+		u, err := RequireAdmin(ctx)
+		if err != ErrAdminRequired {
+			t.Errorf("Expected error %v but got %v", ErrAdminRequired, err)
+		}
+		if u != nil {
+			t.Errorf("Expected nil user but got %v", u)
+		}
+	})
+
+	t.Run("No user", func(t *testing.T) {
+		u, err := RequireAdmin(context.Background())
+		if err != ErrUserNotInContext {
+			t.Errorf("Expected error %v but got %v", ErrUserNotInContext, err)
+		}
+		if u != nil {
+			t.Errorf("Expected nil user but got %v", u)
+		}
+	})
+}
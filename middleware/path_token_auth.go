@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"net/http"
+)
+
+// Authenticates using a token which is part of the URL path, such as `/api/v1/ispindel/<token>`, for devices which
+// can only be given a URL.  Token gets it from the request, such as with the router's URL parameters, so that this
+// does not depend on a particular router.  Log requests with NewRequestLogger so that the token is not in the
+// access logs.
+type PathTokenAuthenticator struct {
+	Token  func(req *http.Request) string
+	Lookup TokenLookupFunc
+}
+
+func (a *PathTokenAuthenticator) Authenticate(req *http.Request) (*worrywort.User, *worrywort.AuthToken, error) {
+	tokenStr := a.Token(req)
+	if tokenStr == "" {
+		return nil, nil, ErrNoCredentials
+	}
+	user, token, err := a.Lookup(tokenStr)
+	return user, token, credentialsError(err)
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"net/http"
+)
+
+// The query parameter QueryParamAuthenticator uses if Param is not set
+const DefaultTokenQueryParam string = "access_token"
+
+// Authenticates using a token in the query string, such as `?access_token=<token>`, for devices which
+// cannot set headers.  The token may end up in access logs, so only enable this where it is needed.
+type QueryParamAuthenticator struct {
+	Param  string
+	Lookup TokenLookupFunc
+}
+
+func (a *QueryParamAuthenticator) Authenticate(req *http.Request) (*worrywort.User, *worrywort.AuthToken, error) {
+	param := a.Param
+	if param == "" {
+		param = DefaultTokenQueryParam
+	}
+	tokenStr := req.URL.Query().Get(param)
+	if tokenStr == "" {
+		return nil, nil, ErrNoCredentials
+	}
+	user, token, err := a.Lookup(tokenStr)
+	return user, token, credentialsError(err)
+}
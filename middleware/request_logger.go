@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"net/http"
+	"strings"
+)
+
+// Logged in place of a token in the path
+const redactedPathToken = "REDACTED"
+
+// chi's request logger, except that the path segment after any of tokenPrefixes, such as `/api/v1/ispindel/`, is
+// logged as REDACTED.  Those are the routes which use PathTokenAuthenticator, so the segment is a token.
+func NewRequestLogger(logger chimiddleware.LoggerInterface, tokenPrefixes ...string) func(http.Handler) http.Handler {
+	return chimiddleware.RequestLogger(&redactingLogFormatter{
+		LogFormatter: &chimiddleware.DefaultLogFormatter{Logger: logger}, prefixes: tokenPrefixes})
+}
+
+type redactingLogFormatter struct {
+	chimiddleware.LogFormatter
+	prefixes []string
+}
+
+func (f *redactingLogFormatter) NewLogEntry(r *http.Request) chimiddleware.LogEntry {
+	for _, prefix := range f.prefixes {
+		if !strings.HasPrefix(r.RequestURI, prefix) {
+			continue
+		}
+		// only the copy given to the formatter is changed, the request being handled keeps its token
+		redacted := *r
+		rest := r.RequestURI[len(prefix):]
+		if i := strings.IndexAny(rest, "/?"); i >= 0 {
+			redacted.RequestURI = prefix + redactedPathToken + rest[i:]
+		} else {
+			redacted.RequestURI = prefix + redactedPathToken
+		}
+		return f.LogFormatter.NewLogEntry(&redacted)
+	}
+	return f.LogFormatter.NewLogEntry(r)
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewRequestLogger(t *testing.T) {
+	var tests = []struct {
+		name     string
+		uri      string
+		expected string
+	}{
+		{"Token", "/api/v1/ispindel/abc:secret", "/api/v1/ispindel/REDACTED"},
+		{"Token with query", "/api/v1/tilt/abc:secret?x=1", "/api/v1/tilt/REDACTED?x=1"},
+		{"Other path", "/api/v1/measurement", "/api/v1/measurement"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			var handledURI string
+			handler := NewRequestLogger(log.New(buf, "", 0), "/api/v1/ispindel/", "/api/v1/tilt/")(
+				http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { handledURI = req.RequestURI }))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, tc.uri, nil))
+
+			logged := buf.String()
+			if !strings.Contains(logged, tc.expected) {
+				t.Errorf("Expected %s to be logged but got %s", tc.expected, logged)
+			}
+			if strings.Contains(logged, "secret") {
+				t.Errorf("Token was logged: %s", logged)
+			}
+			if handledURI != tc.uri {
+				t.Errorf("Expected the handler to get %s but got %s", tc.uri, handledURI)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"net/http"
+)
+
+// A middleware which returns a 403 if the request was authenticated with a token which does not have the scope, such
+// as a device's TOKEN_SCOPE_WRITE_TEMPS token being used for anything other than saving measurements.  Requests
+// without a token, such as with HTTP Basic, are left alone.  Must come after the authentication middleware.
+func NewScopeRequiredHandler(scope worrywort.AuthTokenScopeType) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if t, _ := AuthTokenFromContext(req.Context()); t != nil && !t.AllowsScope(scope) {
+				http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"context"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewScopeRequiredHandler(t *testing.T) {
+	okHandler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	var tests = []struct {
+		name     string
+		required worrywort.AuthTokenScopeType
+		token    *worrywort.AuthToken
+		expected int
+	}{
+		{"No token", worrywort.TOKEN_SCOPE_ALL, nil, http.StatusOK},
+		{"All for all", worrywort.TOKEN_SCOPE_ALL, &worrywort.AuthToken{Scope: worrywort.TOKEN_SCOPE_ALL},
+			http.StatusOK},
+		{"Write temps for all", worrywort.TOKEN_SCOPE_ALL,
+			&worrywort.AuthToken{Scope: worrywort.TOKEN_SCOPE_WRITE_TEMPS}, http.StatusForbidden},
+		{"Read all for all", worrywort.TOKEN_SCOPE_ALL, &worrywort.AuthToken{Scope: worrywort.TOKEN_SCOPE_READ_ALL},
+			http.StatusForbidden},
+		{"All for write temps", worrywort.TOKEN_SCOPE_WRITE_TEMPS,
+			&worrywort.AuthToken{Scope: worrywort.TOKEN_SCOPE_ALL}, http.StatusOK},
+		{"Write temps for write temps", worrywort.TOKEN_SCOPE_WRITE_TEMPS,
+			&worrywort.AuthToken{Scope: worrywort.TOKEN_SCOPE_WRITE_TEMPS}, http.StatusOK},
+		{"Read temps for write temps", worrywort.TOKEN_SCOPE_WRITE_TEMPS,
+			&worrywort.AuthToken{Scope: worrywort.TOKEN_SCOPE_READ_TEMPS}, http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+			if tc.token != nil {
+				req = req.WithContext(context.WithValue(req.Context(), DefaultTokenKey, tc.token))
+			}
+			rr := httptest.NewRecorder()
+			NewScopeRequiredHandler(tc.required)(okHandler).ServeHTTP(rr, req)
+			if rr.Code != tc.expected {
+				t.Errorf("Expected status %d but got %d", tc.expected, rr.Code)
+			}
+		})
+	}
+}
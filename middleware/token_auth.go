@@ -8,7 +8,6 @@ import (
 	"context"
 	"errors"
 	"github.com/jmichalicek/worrywort-server-go/worrywort"
-	"log"
 	"net/http"
 	"strings"
 	// "github.com/davecgh/go-spew/spew"
@@ -32,41 +31,29 @@ func UserFromContext(ctx context.Context) (*worrywort.User, error) {
 	return u, nil
 }
 
-func newContextWithUser(ctx context.Context, req *http.Request, lookupFn func(string) (*worrywort.User, error)) context.Context {
-	authHeader := req.Header.Get("Authorization")
-	headerParts := strings.Fields(authHeader)
-	if len(headerParts) > 1 {
-		if strings.ToLower(headerParts[0]) == "token" {
-			// TODO: Handle error here.  If it's no rows returned, then no big deal
-			// but anything else may need handled or logged
-			user, err := lookupFn(headerParts[1])
-			if err != nil {
-				if err != worrywort.ErrInvalidToken {
-					log.Printf("%v", err)
-				}
-				return ctx
-			} else {
-				return context.WithValue(ctx, DefaultUserKey, user)
-			}
-		}
+// Authenticates using `Authorization: token <token>`
+type TokenHeaderAuthenticator struct {
+	Lookup TokenLookupFunc
+}
+
+func (a *TokenHeaderAuthenticator) Authenticate(req *http.Request) (*worrywort.User, *worrywort.AuthToken, error) {
+	headerParts := strings.Fields(req.Header.Get("Authorization"))
+	if len(headerParts) != 2 || strings.ToLower(headerParts[0]) != "token" {
+		return nil, nil, ErrNoCredentials
 	}
-	return ctx
+	user, token, err := a.Lookup(headerParts[1])
+	return user, token, credentialsError(err)
 }
 
 // a middleware to handle token auth
 // This is really overkill - the injected function could just live here since this is not really intended
 // to be a generic, reusable thing.  This does make testing easier, though, since I can inject a function which
 // just returns what I need and not mock out a db connection.
+// This is now just a NewAuthenticatorChainHandler() with only a TokenHeaderAuthenticator.
 func NewTokenAuthHandler(lookupFn func(string) (*worrywort.User, error)) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-			ctx := req.Context()
-			u, _ := UserFromContext(ctx)
-			// only update context if user is not already populated.
-			if u == nil {
-				ctx = newContextWithUser(ctx, req, lookupFn)
-			}
-			next.ServeHTTP(rw, req.WithContext(ctx))
-		})
+	lookup := func(token string) (*worrywort.User, *worrywort.AuthToken, error) {
+		u, err := lookupFn(token)
+		return u, nil, err
 	}
+	return NewAuthenticatorChainHandler(&TokenHeaderAuthenticator{Lookup: lookup})
 }
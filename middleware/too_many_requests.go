@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Implemented by errors which mean the client should wait before trying again, such as ratelimit.LockedOutError.
+// The authenticator chain responds with a 429 when an Authenticator returns one.
+type RetryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// Writes a 429 Too Many Requests response with the Retry-After header set to the wait rounded up to whole seconds
+func TooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	SetRetryAfter(w, wait)
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// Sets the Retry-After header to the wait rounded up to whole seconds, for responses with their own body
+func SetRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,209 @@
+package mqtt_api
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+// ACL checks ask about `acc`, which is 1 to read, 2 to write, and 4 to subscribe
+const accWrite = 2
+
+// Answers an MQTT broker's authentication and ACL checks, in the form used by the HTTP backend of mosquitto-go-auth.
+// The broker's `http_getuser_uri`, `http_superuser_uri`, and `http_aclcheck_uri` should be the `/user`, `/superuser`
+// and `/acl` paths of wherever this is routed.  Each responds 200 if allowed and 403 otherwise.
+//
+// Devices connect with an AuthToken's id as the username and its secret as the password.  They may publish to the
+// topics in Pattern for their own user and the sensors they are allowed to write to, and read their own user's
+// topics.  If worrywortd publishes measurements, the same Publisher settings allow tokens to read their own user's
+// topics in PublishPattern and BatchTopic and the discovery configs of the sensors they may view, but never to write
+// to them.  worrywortd's own Subscriber and Publisher connect with ServiceUsername and ServicePassword and may use any
+// topic.
+type BrokerAuthHandler struct {
+	Db      *sqlx.DB
+	Pattern TopicPattern
+	// the Publisher's topics, which are left unset if measurements are not published
+	PublishPattern  TopicPattern
+	BatchTopic      string
+	DiscoveryPrefix string
+	ServiceUsername string
+	ServicePassword string
+}
+
+// The broker sends JSON or a form depending on its `http_params_mode`
+func brokerRequestValues(r *http.Request) (url.Values, error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != "application/json" {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return r.PostForm, nil
+	}
+
+	body := map[string]interface{}{}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 1<<16))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	for k, v := range body {
+		values.Set(k, fmt.Sprintf("%v", v))
+	}
+	return values, nil
+}
+
+func (h *BrokerAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	values, err := brokerRequestValues(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+		return
+	}
+
+	var allowed bool
+	switch path.Base(r.URL.Path) {
+	case "user":
+		allowed, err = h.authenticate(values.Get("username"), values.Get("password"))
+	case "superuser":
+		allowed = h.isService(values.Get("username"))
+	case "acl":
+		acc, _ := strconv.Atoi(values.Get("acc"))
+		allowed, err = h.allowTopic(values.Get("username"), values.Get("topic"), acc)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	} else if allowed {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+func (h *BrokerAuthHandler) isService(username string) bool {
+	return h.ServiceUsername != "" &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(h.ServiceUsername)) == 1
+}
+
+func (h *BrokerAuthHandler) authenticate(username, password string) (bool, error) {
+	if h.isService(username) {
+		return h.ServicePassword != "" &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(h.ServicePassword)) == 1, nil
+	}
+	// token ids are uuids, anything else cannot be one
+	if _, err := uuid.Parse(username); err != nil {
+		return false, nil
+	}
+	_, err := worrywort.AuthenticateUserByToken(username+":"+password, h.Db)
+	if err == worrywort.ErrInvalidToken || err == worrywort.ErrBadTokenFormat {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BrokerAuthHandler) allowTopic(username, topic string, acc int) (bool, error) {
+	if h.isService(username) {
+		return true, nil
+	}
+	if _, err := uuid.Parse(username); err != nil {
+		return false, nil
+	}
+	token, err := worrywort.FindAuthToken(username, h.Db)
+	if err == worrywort.ErrInvalidToken {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	write := acc&accWrite != 0
+	if userUUID, sensorUUID, ok := h.Pattern.Match(topic); ok {
+		if userUUID != token.User.UUID {
+			return false, nil
+		}
+		if write && (token.IsReadOnly() || !token.AllowsScope(worrywort.TOKEN_SCOPE_WRITE_TEMPS)) {
+			return false, nil
+		}
+		return h.allowSensor(token, sensorUUID, write)
+	}
+
+	// only worrywortd publishes the rest
+	if write {
+		return false, nil
+	}
+	if userUUID, sensorUUID, ok := h.PublishPattern.Match(topic); ok {
+		if userUUID != token.User.UUID {
+			return false, nil
+		}
+		return h.allowSensor(token, sensorUUID, false)
+	}
+	if h.BatchTopic != "" {
+		if userUUID, batchUUID, ok := matchBatchTopic(h.BatchTopic, topic); ok {
+			return h.allowBatch(token, userUUID, batchUUID)
+		}
+	}
+	if h.DiscoveryPrefix != "" {
+		// there is no user in a discovery topic, so there is no wildcard for only the user's own sensors
+		if sensorUUID, ok := matchDiscoveryTopic(h.DiscoveryPrefix, topic); ok && sensorUUID != "+" {
+			return h.allowSensor(token, sensorUUID, false)
+		}
+	}
+	return false, nil
+}
+
+// Whether the token may use a topic for the sensor, which may be the `+` wildcard when reading
+func (h *BrokerAuthHandler) allowSensor(token worrywort.AuthToken, sensorUUID string, write bool) (bool, error) {
+	// reading every sensor with a wildcard, unless the token only has the one sensor
+	if sensorUUID == "+" {
+		return !write && token.SensorId == nil, nil
+	} else if _, err := uuid.Parse(sensorUUID); err != nil {
+		return false, nil
+	}
+
+	params := map[string]interface{}{"uuid": sensorUUID, "viewable_by": *token.User.Id}
+	if write {
+		params = map[string]interface{}{"uuid": sensorUUID, "editable_by": *token.User.Id}
+	}
+	sensor, err := worrywort.FindSensor(params, h.Db)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return token.AllowsSensor(*sensor), nil
+}
+
+// Whether the token may read the state of a batch, or of all of its user's batches with the `+` wildcard.  A token for
+// a single sensor may not read any.
+func (h *BrokerAuthHandler) allowBatch(token worrywort.AuthToken, userUUID, batchUUID string) (bool, error) {
+	if userUUID != token.User.UUID || token.SensorId != nil {
+		return false, nil
+	}
+	if batchUUID == "+" {
+		return true, nil
+	} else if _, err := uuid.Parse(batchUUID); err != nil {
+		return false, nil
+	}
+	_, err := worrywort.FindBatch(map[string]interface{}{"uuid": batchUUID, "viewable_by": *token.User.Id}, h.Db)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,534 @@
+package mqtt_api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	txdb "github.com/DATA-DOG/go-txdb"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	dbUser, _ := os.LookupEnv("DATABASE_USER")
+	dbPassword, _ := os.LookupEnv("DATABASE_PASSWORD")
+	dbHost, _ := os.LookupEnv("DATABASE_HOST")
+	// we register an sql driver txdb
+	connString := fmt.Sprintf("host=%s port=5432 user=%s dbname=worrywort_test sslmode=disable", dbHost,
+		dbUser)
+	if dbPassword != "" {
+		connString += fmt.Sprintf(" password=%s", dbPassword)
+	}
+	txdb.Register("txdb", "postgres", connString)
+	retCode := m.Run()
+	os.Exit(retCode)
+}
+
+func setUpTestDb() (*sqlx.DB, error) {
+	_db, err := sql.Open("txdb", "one")
+	if err != nil {
+		return nil, err
+	}
+	return sqlx.NewDb(_db, "postgres"), nil
+}
+
+func TestTopicPattern(t *testing.T) {
+	for _, pattern := range []string{"worrywort/{user}/temperature", "worrywort/{user}/{sensor}/{sensor}",
+		"worrywort/+/{user}/{sensor}", "worrywort/{user}/{sensor}/#"} {
+		if _, err := ParseTopicPattern(pattern); err != ErrInvalidTopicPattern {
+			t.Errorf("Expected %s to be invalid but got %v", pattern, err)
+		}
+	}
+
+	pattern, err := ParseTopicPattern(DefaultTopicPattern)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s := pattern.Subscription(); s != "worrywort/+/+/temperature" {
+		t.Errorf("Unexpected subscription %s", s)
+	}
+	var tests = []struct {
+		topic  string
+		user   string
+		sensor string
+		ok     bool
+	}{
+		{"worrywort/u1/s1/temperature", "u1", "s1", true},
+		{"worrywort/u1/s1/gravity", "", "", false},
+		{"worrywort/u1/temperature", "", "", false},
+		{"worrywort/u1/s1/temperature/extra", "", "", false},
+		{"worrywort//s1/temperature", "", "s1", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.topic, func(t *testing.T) {
+			user, sensor, ok := pattern.Match(tc.topic)
+			if user != tc.user || sensor != tc.sensor || ok != tc.ok {
+				t.Errorf("Expected %q, %q, %v but got %q, %q, %v", tc.user, tc.sensor, tc.ok, user, sensor, ok)
+			}
+		})
+	}
+}
+
+func TestBatchTopic(t *testing.T) {
+	for _, topic := range []string{"worrywort/{user}/state", "worrywort/{batch}/{batch}/{user}",
+		"worrywort/+/{user}/{batch}", "worrywort/{user}/{batch}/#"} {
+		if err := ValidateBatchTopic(topic); err != ErrInvalidBatchTopic {
+			t.Errorf("Expected %s to be invalid but got %v", topic, err)
+		}
+	}
+	if err := ValidateBatchTopic(DefaultBatchTopic); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if topic := batchTopic(DefaultBatchTopic, "u1", "b1"); topic != "worrywort/u1/batches/b1/state" {
+		t.Errorf("Unexpected topic %s", topic)
+	}
+	if user, batch, ok := matchBatchTopic(DefaultBatchTopic, "worrywort/u1/batches/b1/state"); user != "u1" ||
+		batch != "b1" || !ok {
+		t.Errorf("Expected u1, b1 but got %q, %q, %v", user, batch, ok)
+	}
+	if _, _, ok := matchBatchTopic(DefaultBatchTopic, "worrywort/u1/b1/measurement"); ok {
+		t.Errorf("Expected a measurement topic not to match")
+	}
+	if sensor, ok := matchDiscoveryTopic("homeassistant", discoveryTopic("homeassistant", "s1")); sensor != "s1" || !ok {
+		t.Errorf("Expected s1 but got %q, %v", sensor, ok)
+	}
+	if _, ok := matchDiscoveryTopic("homeassistant", "homeassistant/sensor/worrywort/s1/extra/config"); ok {
+		t.Errorf("Expected a longer topic not to match")
+	}
+}
+
+func TestBatchStatus(t *testing.T) {
+	now := time.Date(2019, 4, 21, 11, 30, 33, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+	var tests = []struct {
+		name    string
+		bottled *time.Time
+		status  string
+	}{
+		{"not bottled", nil, "fermenting"},
+		{"bottling later", &future, "fermenting"},
+		{"bottled", &past, "bottled"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if status := batchStatus(worrywort.Batch{BottledDate: tc.bottled}, now); status != tc.status {
+				t.Errorf("Expected %s but got %s", tc.status, status)
+			}
+		})
+	}
+}
+
+func TestParsePayload(t *testing.T) {
+	now := time.Date(2019, 4, 21, 12, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		payload    string
+		value      float64
+		units      worrywort.TemperatureUnitType
+		recordedAt time.Time
+		err        error
+	}{
+		{"20.5", 20.5, worrywort.CELSIUS, now, nil},
+		{" 20.5\n", 20.5, worrywort.CELSIUS, now, nil},
+		{`{"value": 65.2, "units": "FAHRENHEIT", "recorded_at": 1555846233}`, 65.2, worrywort.FAHRENHEIT,
+			time.Unix(1555846233, 0).UTC(), nil},
+		{`{"value": 18, "units": "c", "recorded_at": "2019-04-21T11:30:33Z"}`, 18, worrywort.CELSIUS,
+			time.Date(2019, 4, 21, 11, 30, 33, 0, time.UTC), nil},
+		{`{"value": 18}`, 18, worrywort.CELSIUS, now, nil},
+		{"warm", 0, worrywort.CELSIUS, now, ErrInvalidPayload},
+		{`{"value": "warm"}`, 0, worrywort.CELSIUS, now, ErrInvalidPayload},
+		{`{"value": 18, "units": "KELVIN"}`, 0, worrywort.CELSIUS, now, ErrInvalidPayload},
+		{`{"value": 18, "recorded_at": "yesterday"}`, 0, worrywort.CELSIUS, now, ErrInvalidPayload},
+		{`{"value": 18`, 0, worrywort.CELSIUS, now, ErrInvalidPayload},
+	}
+	for _, tc := range tests {
+		t.Run(tc.payload, func(t *testing.T) {
+			value, units, recordedAt, err := parsePayload([]byte(tc.payload), now)
+			if err != tc.err {
+				t.Fatalf("Expected error %v but got %v", tc.err, err)
+			}
+			if value != tc.value || units != tc.units || !recordedAt.Equal(tc.recordedAt) {
+				t.Errorf("Expected %v %v at %v but got %v %v at %v", tc.value, tc.units, tc.recordedAt, value, units,
+					recordedAt)
+			}
+		})
+	}
+}
+
+func TestSubscriberHandleMessage(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	// the subscriber only saves measurements for active users
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := worrywort.Sensor{Name: "Test Sensor", UserId: user.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	otherUser := worrywort.User{Email: "other@example.com", FullName: "Other User", Username: "other"}
+	if err := otherUser.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	pattern, _ := ParseTopicPattern(DefaultTopicPattern)
+	notified := []string{}
+	subscriber := &Subscriber{Db: db, Pattern: pattern,
+		Notifier: func(tm worrywort.TemperatureMeasurement) { notified = append(notified, tm.Id) }}
+
+	t.Run("Saves the measurement", func(t *testing.T) {
+		payload := `{"value": 65.2, "units": "FAHRENHEIT", "recorded_at": "2019-04-21T11:30:33Z"}`
+		tm, err := subscriber.HandleMessage(pattern.Topic(user.UUID, sensor.UUID), []byte(payload))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		saved, err := worrywort.FindTemperatureMeasurement(
+			map[string]interface{}{"uuid": tm.Id, "sensor_id": *sensor.Id, "user_id": *user.Id}, db)
+		if err != nil {
+			t.Fatalf("Expected TemperatureMeasurement not found in database: %v", err)
+		}
+		if saved.Temperature != 65.2 || saved.Units != worrywort.FAHRENHEIT ||
+			!saved.RecordedAt.Equal(time.Date(2019, 4, 21, 11, 30, 33, 0, time.UTC)) {
+			t.Errorf("Unexpected measurement %v", saved)
+		}
+
+		// QoS 1 may deliver the message again
+		again, err := subscriber.HandleMessage(pattern.Topic(user.UUID, sensor.UUID), []byte(payload))
+		if err != nil || again.Id != tm.Id {
+			t.Errorf("Expected the original measurement %s but got %v, %v", tm.Id, again, err)
+		}
+		// only once, the second delivery was a duplicate
+		if len(notified) != 1 || notified[0] != tm.Id {
+			t.Errorf("Expected only %s to be notified but got %v", tm.Id, notified)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for _, topic := range []string{"worrywort/elsewhere", pattern.Topic("not-a-uuid", sensor.UUID),
+			pattern.Topic(otherUser.UUID, sensor.UUID)} {
+			if _, err := subscriber.HandleMessage(topic, []byte("20")); err == nil {
+				t.Errorf("Expected an error for %s", topic)
+			}
+		}
+		if _, err := subscriber.HandleMessage(pattern.Topic(user.UUID, sensor.UUID), []byte("warm")); err !=
+			ErrInvalidPayload {
+			t.Errorf("Expected %v but got %v", ErrInvalidPayload, err)
+		}
+	})
+}
+
+type publishedMessage struct {
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+
+// Records what is published rather than sending it to a broker
+type recordingClient struct {
+	mqtt.Client
+	published []publishedMessage
+}
+
+func (c *recordingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.published = append(c.published, publishedMessage{topic: topic, retained: retained, payload: payload.([]byte)})
+	return doneToken{}
+}
+
+func TestPublisher(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := worrywort.Sensor{Name: "Test Sensor", UserId: user.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	brewedAt := time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)
+	batch := worrywort.Batch{Name: "Test Batch", UserId: user.Id, BrewedDate: brewedAt}
+	if err := batch.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := worrywort.AssociateBatchToSensor(&batch, &sensor, "", &brewedAt, db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	pattern, _ := ParseTopicPattern(DefaultPublishTopicPattern)
+	client := &recordingClient{}
+	publisher := &Publisher{Client: client, Db: db, MeasurementPattern: pattern, BatchTopic: DefaultBatchTopic,
+		DiscoveryPrefix: "homeassistant"}
+	recordedAt := time.Date(2019, 4, 21, 11, 30, 33, 0, time.UTC)
+	tm := worrywort.TemperatureMeasurement{Id: "c5f2ed6b-4c8d-4b3a-9d2f-0c1f7a0e3f1a", SensorId: sensor.Id,
+		UserId: user.Id, Temperature: 65.2, Units: worrywort.FAHRENHEIT, RecordedAt: recordedAt}
+
+	t.Run("Publishes the measurement, discovery config, and batch state", func(t *testing.T) {
+		if err := publisher.Publish(tm); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(client.published) != 3 {
+			t.Fatalf("Expected 3 messages but got %v", client.published)
+		}
+
+		stateTopic := pattern.Topic(user.UUID, sensor.UUID)
+		measurement := client.published[0]
+		expected := fmt.Sprintf(
+			`{"id":"%s","sensor_id":"%s","temperature":65.2,"units":"FAHRENHEIT","recorded_at":"2019-04-21T11:30:33Z"}`,
+			tm.Id, sensor.UUID)
+		if measurement.topic != stateTopic || measurement.retained || string(measurement.payload) != expected {
+			t.Errorf("Unexpected measurement message %s %v %s", measurement.topic, measurement.retained,
+				measurement.payload)
+		}
+
+		discovery := client.published[1]
+		config := discoveryConfig{}
+		if err := json.Unmarshal(discovery.payload, &config); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if discovery.topic != "homeassistant/sensor/worrywort/"+sensor.UUID+"/config" || !discovery.retained ||
+			config.StateTopic != stateTopic || config.UnitOfMeasurement != "°F" ||
+			config.UniqueId != "worrywort_"+sensor.UUID {
+			t.Errorf("Unexpected discovery message %s %v %s", discovery.topic, discovery.retained, discovery.payload)
+		}
+
+		state := client.published[2]
+		expected = fmt.Sprintf(`{"batch_id":"%s","name":"Test Batch","sensor_id":"%s","temperature":65.2,`+
+			`"units":"FAHRENHEIT","status":"fermenting","last_seen":"2019-04-21T11:30:33Z"}`, batch.UUID, sensor.UUID)
+		if state.topic != batchTopic(DefaultBatchTopic, user.UUID, batch.UUID) || !state.retained ||
+			string(state.payload) != expected {
+			t.Errorf("Unexpected batch state %s %v %s", state.topic, state.retained, state.payload)
+		}
+	})
+
+	t.Run("Older measurements do not replace the batch state", func(t *testing.T) {
+		client.published = nil
+		older := tm
+		older.RecordedAt = recordedAt.Add(-time.Hour)
+		if err := publisher.Publish(older); err != nil {
+			t.Fatalf("%v", err)
+		}
+		// the discovery config is unchanged so is not sent again
+		if len(client.published) != 1 || client.published[0].topic != pattern.Topic(user.UUID, sensor.UUID) {
+			t.Errorf("Expected only the measurement but got %v", client.published)
+		}
+	})
+}
+
+func TestBrokerAuthHandler(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := worrywort.Sensor{Name: "Test Sensor", UserId: user.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	otherSensor := worrywort.Sensor{Name: "Other Sensor", UserId: user.Id}
+	if err := otherSensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	token, err := worrywort.GenerateTokenForUser(user, worrywort.TOKEN_SCOPE_ALL)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := token.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	sensorToken, err := worrywort.GenerateSensorToken(user, *sensor.Id, worrywort.TOKEN_SCOPE_WRITE_TEMPS)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := sensorToken.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	batch := worrywort.Batch{Name: "Test Batch", UserId: user.Id, BrewedDate: time.Now()}
+	if err := batch.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	secret := func(t worrywort.AuthToken) string {
+		return strings.SplitN(t.ForAuthenticationHeader(), ":", 2)[1]
+	}
+
+	pattern, _ := ParseTopicPattern(DefaultTopicPattern)
+	published, _ := ParseTopicPattern(DefaultPublishTopicPattern)
+	handler := &BrokerAuthHandler{Db: db, Pattern: pattern, PublishPattern: published, BatchTopic: DefaultBatchTopic,
+		DiscoveryPrefix: "homeassistant", ServiceUsername: "worrywortd", ServicePassword: "secret"}
+	check := func(path string, values url.Values, contentType string) int {
+		body := values.Encode()
+		if contentType == "application/json" {
+			fields := []string{}
+			for k := range values {
+				fields = append(fields, fmt.Sprintf("%q: %q", k, values.Get(k)))
+			}
+			body = "{" + strings.Join(fields, ", ") + "}"
+		}
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Add("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	var tests = []struct {
+		name     string
+		path     string
+		values   url.Values
+		expected int
+	}{
+		{"Token login", "/mqtt/user", url.Values{"username": {token.Id}, "password": {secret(token)}}, http.StatusOK},
+		{"Wrong secret", "/mqtt/user", url.Values{"username": {token.Id}, "password": {"wrong"}},
+			http.StatusForbidden},
+		{"Not a token", "/mqtt/user", url.Values{"username": {"someone"}, "password": {"wrong"}},
+			http.StatusForbidden},
+		{"Service login", "/mqtt/user", url.Values{"username": {"worrywortd"}, "password": {"secret"}},
+			http.StatusOK},
+		{"Service wrong password", "/mqtt/user", url.Values{"username": {"worrywortd"}, "password": {"wrong"}},
+			http.StatusForbidden},
+		{"Service is superuser", "/mqtt/superuser", url.Values{"username": {"worrywortd"}}, http.StatusOK},
+		{"Token is not superuser", "/mqtt/superuser", url.Values{"username": {token.Id}}, http.StatusForbidden},
+		{"Publish to own sensor", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {pattern.Topic(user.UUID, sensor.UUID)}, "acc": {"2"}}, http.StatusOK},
+		{"Subscribe to own sensors", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {pattern.Topic(user.UUID, "+")}, "acc": {"4"}}, http.StatusOK},
+		{"Publish to all sensors", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {pattern.Topic(user.UUID, "+")}, "acc": {"2"}}, http.StatusForbidden},
+		{"Publish for another user", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {pattern.Topic("00000000-0000-0000-0000-000000000000", sensor.UUID)}, "acc": {"2"}}, http.StatusForbidden},
+		{"Publish to another topic", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {"elsewhere/" + user.UUID}, "acc": {"2"}}, http.StatusForbidden},
+		{"Sensor token to its sensor", "/mqtt/acl", url.Values{"username": {sensorToken.Id},
+			"topic": {pattern.Topic(user.UUID, sensor.UUID)}, "acc": {"2"}}, http.StatusOK},
+		{"Sensor token to another sensor", "/mqtt/acl", url.Values{"username": {sensorToken.Id},
+			"topic": {pattern.Topic(user.UUID, otherSensor.UUID)}, "acc": {"2"}}, http.StatusForbidden},
+		{"Sensor token subscribing to all sensors", "/mqtt/acl", url.Values{"username": {sensorToken.Id},
+			"topic": {pattern.Topic(user.UUID, "+")}, "acc": {"4"}}, http.StatusForbidden},
+		{"Service to any topic", "/mqtt/acl", url.Values{"username": {"worrywortd"},
+			"topic": {pattern.Subscription()}, "acc": {"4"}}, http.StatusOK},
+		{"Read own published measurements", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {published.Topic(user.UUID, sensor.UUID)}, "acc": {"1"}}, http.StatusOK},
+		{"Subscribe to own published measurements", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {published.Topic(user.UUID, "+")}, "acc": {"4"}}, http.StatusOK},
+		{"Publish to the published measurements", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {published.Topic(user.UUID, sensor.UUID)}, "acc": {"2"}}, http.StatusForbidden},
+		{"Sensor token reading another sensor's measurements", "/mqtt/acl", url.Values{"username": {sensorToken.Id},
+			"topic": {published.Topic(user.UUID, otherSensor.UUID)}, "acc": {"1"}}, http.StatusForbidden},
+		{"Read own batch state", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {batchTopic(DefaultBatchTopic, user.UUID, batch.UUID)}, "acc": {"1"}}, http.StatusOK},
+		{"Subscribe to own batch states", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {batchTopic(DefaultBatchTopic, user.UUID, "+")}, "acc": {"4"}}, http.StatusOK},
+		{"Batch state for another user", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {batchTopic(DefaultBatchTopic, "00000000-0000-0000-0000-000000000000", "+")}, "acc": {"4"}},
+			http.StatusForbidden},
+		{"Sensor token reading batch state", "/mqtt/acl", url.Values{"username": {sensorToken.Id},
+			"topic": {batchTopic(DefaultBatchTopic, user.UUID, batch.UUID)}, "acc": {"1"}}, http.StatusForbidden},
+		{"Read discovery config", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {discoveryTopic("homeassistant", sensor.UUID)}, "acc": {"1"}}, http.StatusOK},
+		{"Subscribe to every discovery config", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {discoveryTopic("homeassistant", "+")}, "acc": {"4"}}, http.StatusForbidden},
+		{"Publish a discovery config", "/mqtt/acl", url.Values{"username": {token.Id},
+			"topic": {discoveryTopic("homeassistant", sensor.UUID)}, "acc": {"2"}}, http.StatusForbidden},
+	}
+	for _, contentType := range []string{"application/x-www-form-urlencoded", "application/json"} {
+		for _, tc := range tests {
+			t.Run(contentType+" "+tc.name, func(t *testing.T) {
+				if code := check(tc.path, tc.values, contentType); code != tc.expected {
+					t.Errorf("Expected %d but got %d", tc.expected, code)
+				}
+			})
+		}
+	}
+}
+
+// Only runs when there is a broker to test against, such as mosquitto in docker-compose
+func TestSubscriberWithBroker(t *testing.T) {
+	host, ok := os.LookupEnv("MQTT_HOST")
+	if !ok {
+		t.Skip("MQTT_HOST not set")
+	}
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	// the subscriber only saves measurements for active users
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := worrywort.Sensor{Name: "Test Sensor", UserId: user.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// a topic of its own so that other runs against the same broker do not interfere
+	prefix := fmt.Sprintf("worrywort-test-%d", time.Now().UnixNano())
+	pattern, err := ParseTopicPattern(prefix + "/{user}/{sensor}/temperature")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	subscriber := &Subscriber{Db: db, Pattern: pattern, QoS: 1}
+	connect := func(clientId string) mqtt.Client {
+		client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://" + host + ":1883").SetClientID(clientId))
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			t.Fatalf("%v", token.Error())
+		}
+		return client
+	}
+	subscriberClient := connect(prefix + "-subscriber")
+	defer subscriberClient.Disconnect(250)
+	if err := subscriber.Subscribe(subscriberClient); err != nil {
+		t.Fatalf("%v", err)
+	}
+	publisher := connect(prefix + "-publisher")
+	defer publisher.Disconnect(250)
+	if token := publisher.Publish(pattern.Topic(user.UUID, sensor.UUID), 1, false, "20.5"); token.Wait() &&
+		token.Error() != nil {
+		t.Fatalf("%v", token.Error())
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		measurements, err := worrywort.FindTemperatureMeasurements(
+			map[string]interface{}{"sensor_id": *sensor.Id, "user_id": *user.Id}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(measurements) == 1 {
+			if measurements[0].Temperature != 20.5 || measurements[0].Units != worrywort.CELSIUS {
+				t.Errorf("Unexpected measurement %v", measurements[0])
+			}
+			return
+		}
+	}
+	t.Errorf("The published measurement was not saved")
+}
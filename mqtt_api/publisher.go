@@ -0,0 +1,291 @@
+package mqtt_api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"strings"
+	"sync"
+	"time"
+)
+
+const batchSegment = "{batch}"
+
+// The topic saved measurements are published to unless WORRYWORTD_MQTT_PUBLISH_TOPIC says otherwise.  It must differ
+// from the topic the Subscriber saves measurements from.
+const DefaultPublishTopicPattern = "worrywort/{user}/{sensor}/measurement"
+
+// The topic each batch's state is retained on unless WORRYWORTD_MQTT_BATCH_TOPIC says otherwise
+const DefaultBatchTopic = "worrywort/{user}/batches/{batch}/state"
+
+var ErrInvalidBatchTopic = errors.New("The batch topic must have one {user} and one {batch} segment and no wildcards")
+
+// How long to wait for the broker to accept a message
+const publishTimeout = 10 * time.Second
+
+// A saved measurement as it is published
+type measurementMessage struct {
+	Id          string    `json:"id"`
+	SensorId    string    `json:"sensor_id"`
+	Temperature float64   `json:"temperature"`
+	Units       string    `json:"units"`
+	RecordedAt  time.Time `json:"recorded_at"`
+}
+
+// The retained state of a batch, from the most recent measurement of a sensor associated with it
+type batchState struct {
+	BatchId     string    `json:"batch_id"`
+	Name        string    `json:"name"`
+	SensorId    string    `json:"sensor_id"`
+	Temperature float64   `json:"temperature"`
+	Units       string    `json:"units"`
+	Status      string    `json:"status"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// Home Assistant MQTT discovery config for a sensor, see https://www.home-assistant.io/docs/mqtt/discovery/
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueId          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	ValueTemplate     string          `json:"value_template"`
+	UnitOfMeasurement string          `json:"unit_of_measurement"`
+	DeviceClass       string          `json:"device_class"`
+	Device            discoveryDevice `json:"device"`
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+}
+
+// Checks that a batch topic has one `{user}` and one `{batch}` segment, such as
+// `worrywort/{user}/batches/{batch}/state`
+func ValidateBatchTopic(topic string) error {
+	users, batches := 0, 0
+	for _, s := range strings.Split(topic, "/") {
+		switch {
+		case s == userSegment:
+			users++
+		case s == batchSegment:
+			batches++
+		case strings.ContainsAny(s, "+#"):
+			return ErrInvalidBatchTopic
+		}
+	}
+	if users != 1 || batches != 1 {
+		return ErrInvalidBatchTopic
+	}
+	return nil
+}
+
+func batchTopic(topic, userUUID, batchUUID string) string {
+	segments := strings.Split(topic, "/")
+	for i, s := range segments {
+		switch s {
+		case userSegment:
+			segments[i] = userUUID
+		case batchSegment:
+			segments[i] = batchUUID
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// Gets the user and batch uuids out of a topic.  ok is false if the topic does not match the batch topic.
+func matchBatchTopic(batchTopic, topic string) (userUUID, batchUUID string, ok bool) {
+	pattern := strings.Split(batchTopic, "/")
+	segments := strings.Split(topic, "/")
+	if len(segments) != len(pattern) {
+		return "", "", false
+	}
+	for i, s := range pattern {
+		switch s {
+		case userSegment:
+			userUUID = segments[i]
+		case batchSegment:
+			batchUUID = segments[i]
+		default:
+			if segments[i] != s {
+				return "", "", false
+			}
+		}
+	}
+	return userUUID, batchUUID, userUUID != "" && batchUUID != ""
+}
+
+// A batch is fermenting until its bottled date has passed
+func batchStatus(b worrywort.Batch, now time.Time) string {
+	if b.BottledDate != nil && !b.BottledDate.After(now) {
+		return "bottled"
+	}
+	return "fermenting"
+}
+
+func unitOfMeasurement(units worrywort.TemperatureUnitType) string {
+	if units == worrywort.FAHRENHEIT {
+		return "°F"
+	}
+	return "°C"
+}
+
+func discoveryTopic(prefix, sensorUUID string) string {
+	return fmt.Sprintf("%s/sensor/worrywort/%s/config", prefix, sensorUUID)
+}
+
+// Gets the sensor uuid out of a discovery topic.  ok is false if the topic is not one.
+func matchDiscoveryTopic(prefix, topic string) (sensorUUID string, ok bool) {
+	rest := strings.TrimPrefix(topic, prefix+"/sensor/worrywort/")
+	if rest == topic || !strings.HasSuffix(rest, "/config") {
+		return "", false
+	}
+	sensorUUID = strings.TrimSuffix(rest, "/config")
+	return sensorUUID, sensorUUID != "" && !strings.Contains(sensorUUID, "/")
+}
+
+func newDiscoveryConfig(sensor worrywort.Sensor, stateTopic string, units worrywort.TemperatureUnitType) discoveryConfig {
+	return discoveryConfig{
+		Name:              sensor.Name,
+		UniqueId:          "worrywort_" + sensor.UUID,
+		StateTopic:        stateTopic,
+		ValueTemplate:     "{{ value_json.temperature }}",
+		UnitOfMeasurement: unitOfMeasurement(units),
+		DeviceClass:       "temperature",
+		Device: discoveryDevice{Identifiers: []string{"worrywort_" + sensor.UUID}, Name: sensor.Name,
+			Manufacturer: "worrywort", Model: sensor.DeviceId},
+	}
+}
+
+// Publishes each saved measurement to the topics in MeasurementPattern, for the user who owns the sensor.  If
+// BatchTopic is set, the state of the batches the sensor is monitoring is retained there, and if DiscoveryPrefix is set,
+// such as `homeassistant`, Home Assistant discovery configs for the sensors are retained under it.
+//
+// A BrokerAuthHandler configured with the same topics lets each user's tokens read the topics for their own sensors and
+// batches, such as for Home Assistant connecting with a token of its own.
+type Publisher struct {
+	Client             mqtt.Client
+	Db                 *sqlx.DB
+	MeasurementPattern TopicPattern
+	BatchTopic         string
+	DiscoveryPrefix    string
+	QoS                byte
+
+	mu sync.Mutex
+	// the units each sensor's discovery config was published with
+	discovered map[int64]worrywort.TemperatureUnitType
+	// when the state of each batch was last seen, so that older measurements, such as from a bulk import, do not
+	// replace it
+	batchLastSeen map[int64]time.Time
+}
+
+func (p *Publisher) publish(topic string, retained bool, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	token := p.Client.Publish(topic, p.QoS, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("Timed out publishing to %s", topic)
+	}
+	return token.Error()
+}
+
+// Publishes a newly saved measurement.  This is meant to be called from the worrywort.TemperatureMeasurementNotifier
+// given to the apis which save measurements.
+func (p *Publisher) Publish(tm worrywort.TemperatureMeasurement) error {
+	if tm.SensorId == nil {
+		return nil
+	}
+	// the measurement's sensor may not have its owner loaded
+	sensor, err := worrywort.FindSensor(map[string]interface{}{"id": *tm.SensorId}, p.Db)
+	if err != nil {
+		return fmt.Errorf("Finding sensor %d: %v", *tm.SensorId, err)
+	}
+	if sensor.CreatedBy == nil || sensor.CreatedBy.UUID == "" {
+		return fmt.Errorf("Sensor %s has no user", sensor.UUID)
+	}
+
+	stateTopic := p.MeasurementPattern.Topic(sensor.CreatedBy.UUID, sensor.UUID)
+	err = p.publish(stateTopic, false, measurementMessage{Id: tm.Id, SensorId: sensor.UUID,
+		Temperature: tm.Temperature, Units: tm.Units.String(), RecordedAt: tm.RecordedAt})
+	if err != nil {
+		return err
+	}
+	if p.DiscoveryPrefix != "" {
+		if err := p.publishDiscovery(*sensor, stateTopic, tm.Units); err != nil {
+			return err
+		}
+	}
+	if p.BatchTopic != "" {
+		return p.publishBatchStates(*sensor, tm)
+	}
+	return nil
+}
+
+// Home Assistant only needs the config again if the units have changed
+func (p *Publisher) publishDiscovery(sensor worrywort.Sensor, stateTopic string, units worrywort.TemperatureUnitType) error {
+	p.mu.Lock()
+	published, ok := p.discovered[*sensor.Id]
+	p.mu.Unlock()
+	if ok && published == units {
+		return nil
+	}
+	err := p.publish(discoveryTopic(p.DiscoveryPrefix, sensor.UUID), true, newDiscoveryConfig(sensor, stateTopic, units))
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if p.discovered == nil {
+		p.discovered = map[int64]worrywort.TemperatureUnitType{}
+	}
+	p.discovered[*sensor.Id] = units
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Publisher) publishBatchStates(sensor worrywort.Sensor, tm worrywort.TemperatureMeasurement) error {
+	associations, err := worrywort.FindBatchSensorAssociations(
+		map[string]interface{}{"sensor_id": *sensor.Id, "disassociated_at": nil}, p.Db)
+	if err != nil {
+		return err
+	}
+	for _, association := range associations {
+		batch := association.Batch
+		if tm.RecordedAt.Before(association.AssociatedAt) || !p.newerThanBatchState(*batch.Id, tm.RecordedAt) {
+			continue
+		}
+		userUUID := sensor.CreatedBy.UUID
+		if batch.UserId != nil && (sensor.UserId == nil || *batch.UserId != *sensor.UserId) {
+			user, err := worrywort.FindUser(map[string]interface{}{"id": *batch.UserId}, p.Db)
+			if err != nil {
+				return fmt.Errorf("Finding user %d: %v", *batch.UserId, err)
+			}
+			userUUID = user.UUID
+		}
+		state := batchState{BatchId: batch.UUID, Name: batch.Name, SensorId: sensor.UUID, Temperature: tm.Temperature,
+			Units: tm.Units.String(), Status: batchStatus(*batch, time.Now()), LastSeen: tm.RecordedAt}
+		if err := p.publish(batchTopic(p.BatchTopic, userUUID, batch.UUID), true, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records recordedAt as the batch's last seen time if it is newer than the last one published
+func (p *Publisher) newerThanBatchState(batchId int64, recordedAt time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if lastSeen, ok := p.batchLastSeen[batchId]; ok && recordedAt.Before(lastSeen) {
+		return false
+	}
+	if p.batchLastSeen == nil {
+		p.batchLastSeen = map[int64]time.Time{}
+	}
+	p.batchLastSeen[batchId] = recordedAt
+	return true
+}
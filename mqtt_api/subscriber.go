@@ -0,0 +1,145 @@
+package mqtt_api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrUnknownTopic = errors.New("The topic does not match the topic pattern")
+var ErrInvalidPayload = errors.New(
+	"The payload must be a number or a JSON object with a numeric value and optional units and recorded_at")
+var ErrSensorRateLimited = errors.New("The sensor has sent too many measurements")
+
+var temperatureUnits = map[string]worrywort.TemperatureUnitType{
+	"FAHRENHEIT": worrywort.FAHRENHEIT,
+	"F":          worrywort.FAHRENHEIT,
+	"CELSIUS":    worrywort.CELSIUS,
+	"C":          worrywort.CELSIUS,
+}
+
+// Saves the temperature measurements published to topics matching Pattern.  Which user and sensor a measurement is
+// for comes from the topic, so the broker must only let clients publish to their own user's topics, see
+// BrokerAuthHandler.
+type Subscriber struct {
+	Db      *sqlx.DB
+	Pattern TopicPattern
+	QoS     byte
+	// Optional limit on how often each sensor may publish, the same as for the REST api
+	SensorLimiter *ratelimit.Limiter
+	Notifier      worrywort.TemperatureMeasurementNotifier
+}
+
+// Subscribes to the pattern's topics.  This should be called from the client's OnConnectHandler so that the
+// subscription is made again after reconnecting.
+func (s *Subscriber) Subscribe(client mqtt.Client) error {
+	token := client.Subscribe(s.Pattern.Subscription(), s.QoS, func(client mqtt.Client, msg mqtt.Message) {
+		if _, err := s.HandleMessage(msg.Topic(), msg.Payload()); err != nil {
+			log.Printf("MQTT message to %s: %v", msg.Topic(), err)
+		}
+	})
+	token.Wait()
+	return token.Error()
+}
+
+// Parses a plain number, which is Celsius recorded now, or a JSON object such as
+// `{"value": 65.2, "units": "FAHRENHEIT", "recorded_at": 1555846233}` where units and recorded_at are optional.
+func parsePayload(payload []byte, now time.Time) (float64, worrywort.TemperatureUnitType, time.Time, error) {
+	payload = bytes.TrimSpace(payload)
+	if !bytes.HasPrefix(payload, []byte("{")) {
+		value, err := strconv.ParseFloat(string(payload), 64)
+		if err != nil {
+			return 0, worrywort.CELSIUS, now, ErrInvalidPayload
+		}
+		return value, worrywort.CELSIUS, now, nil
+	}
+
+	body := struct {
+		Value      json.Number `json:"value"`
+		Units      string      `json:"units"`
+		RecordedAt interface{} `json:"recorded_at"`
+	}{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return 0, worrywort.CELSIUS, now, ErrInvalidPayload
+	}
+	value, err := body.Value.Float64()
+	if err != nil {
+		return 0, worrywort.CELSIUS, now, ErrInvalidPayload
+	}
+	units := worrywort.CELSIUS
+	if body.Units != "" {
+		var ok bool
+		if units, ok = temperatureUnits[strings.ToUpper(body.Units)]; !ok {
+			return 0, worrywort.CELSIUS, now, ErrInvalidPayload
+		}
+	}
+	recordedAt := now
+	switch v := body.RecordedAt.(type) {
+	case nil:
+	case string:
+		recordedAt, err = worrywort.ParseTimestamp(v)
+	case json.Number:
+		recordedAt, err = worrywort.ParseTimestamp(v.String())
+	default:
+		err = ErrInvalidPayload
+	}
+	if err != nil {
+		return 0, worrywort.CELSIUS, now, ErrInvalidPayload
+	}
+	return value, units, recordedAt, nil
+}
+
+// Saves the measurement published to topic.  A measurement the sensor already has, such as from a QoS 1 message
+// being delivered twice, is not saved again and the original is returned.
+func (s *Subscriber) HandleMessage(topic string, payload []byte) (*worrywort.TemperatureMeasurement, error) {
+	userUUID, sensorUUID, ok := s.Pattern.Match(topic)
+	if !ok {
+		return nil, ErrUnknownTopic
+	}
+	for _, id := range []string{userUUID, sensorUUID} {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, ErrUnknownTopic
+		}
+	}
+	user, err := worrywort.FindUser(map[string]interface{}{"uuid": userUUID, "is_active": true}, s.Db)
+	if err != nil {
+		return nil, fmt.Errorf("Finding user %s: %v", userUUID, err)
+	}
+	sensor, err := worrywort.FindSensor(map[string]interface{}{"uuid": sensorUUID, "editable_by": *user.Id}, s.Db)
+	if err != nil {
+		return nil, fmt.Errorf("Finding sensor %s: %v", sensorUUID, err)
+	}
+	if s.SensorLimiter != nil {
+		allowed, _, err := s.SensorLimiter.Allow(fmt.Sprintf("%d", *sensor.Id))
+		if err != nil {
+			log.Printf("%v", err)
+		} else if !allowed {
+			return nil, ErrSensorRateLimited
+		}
+	}
+
+	value, units, recordedAt, err := parsePayload(payload, time.Now().UTC().Round(time.Microsecond))
+	if err != nil {
+		return nil, err
+	}
+	tm := &worrywort.TemperatureMeasurement{Sensor: sensor, SensorId: sensor.Id, CreatedBy: user, UserId: user.Id,
+		Temperature: value, Units: units, RecordedAt: recordedAt}
+	if err := tm.Save(s.Db); err == nil {
+		s.Notifier.Created(tm)
+	} else if err != worrywort.ErrDuplicateTemperatureMeasurement {
+		return nil, err
+	}
+	return tm, nil
+}
@@ -0,0 +1,88 @@
+package mqtt_api
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	userSegment   = "{user}"
+	sensorSegment = "{sensor}"
+)
+
+// The topic measurements are published to unless WORRYWORTD_MQTT_TOPIC says otherwise
+const DefaultTopicPattern = "worrywort/{user}/{sensor}/temperature"
+
+var ErrInvalidTopicPattern = errors.New(
+	"The topic pattern must have one {user} and one {sensor} segment and no wildcards")
+
+// A topic with `{user}` and `{sensor}` segments, such as `worrywort/{user}/{sensor}/temperature`, which are the uuids
+// of the user and sensor a message is for.
+type TopicPattern struct {
+	segments []string
+}
+
+func ParseTopicPattern(pattern string) (TopicPattern, error) {
+	segments := strings.Split(pattern, "/")
+	users, sensors := 0, 0
+	for _, s := range segments {
+		switch {
+		case s == userSegment:
+			users++
+		case s == sensorSegment:
+			sensors++
+		case strings.ContainsAny(s, "+#"):
+			return TopicPattern{}, ErrInvalidTopicPattern
+		}
+	}
+	if users != 1 || sensors != 1 {
+		return TopicPattern{}, ErrInvalidTopicPattern
+	}
+	return TopicPattern{segments: segments}, nil
+}
+
+func (p TopicPattern) String() string {
+	return strings.Join(p.segments, "/")
+}
+
+// The topic for a user and sensor.  Either may be the `+` wildcard.
+func (p TopicPattern) Topic(userUUID, sensorUUID string) string {
+	segments := make([]string, len(p.segments))
+	for i, s := range p.segments {
+		switch s {
+		case userSegment:
+			segments[i] = userUUID
+		case sensorSegment:
+			segments[i] = sensorUUID
+		default:
+			segments[i] = s
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// The topic filter to subscribe to for every user and sensor
+func (p TopicPattern) Subscription() string {
+	return p.Topic("+", "+")
+}
+
+// Gets the user and sensor uuids out of a topic.  ok is false if the topic does not match the pattern.
+func (p TopicPattern) Match(topic string) (userUUID, sensorUUID string, ok bool) {
+	segments := strings.Split(topic, "/")
+	if len(segments) != len(p.segments) {
+		return "", "", false
+	}
+	for i, s := range p.segments {
+		switch s {
+		case userSegment:
+			userUUID = segments[i]
+		case sensorSegment:
+			sensorUUID = segments[i]
+		default:
+			if segments[i] != s {
+				return "", "", false
+			}
+		}
+	}
+	return userUUID, sensorUUID, userUUID != "" && sensorUUID != ""
+}
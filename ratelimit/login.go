@@ -0,0 +1,36 @@
+package ratelimit
+
+import (
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"strings"
+)
+
+// Checks an email and password, such as worrywort.AuthenticateLogin()
+type LoginFunc func(email, password string) (*worrywort.User, error)
+
+// Wraps login so that an email is locked out after too many wrong passwords.  While locked out the password is not
+// checked at all and a *LockedOutError is returned.  A successful login clears the failures.
+func (l *Lockout) Login(login LoginFunc) LoginFunc {
+	return func(email, password string) (*worrywort.User, error) {
+		key := strings.ToLower(strings.TrimSpace(email))
+		if err := l.Check(key); err != nil {
+			return nil, err
+		}
+
+		user, err := login(email, password)
+		switch err {
+		case nil:
+			if err := l.Reset(key); err != nil {
+				log.Printf("%v", err)
+			}
+		case worrywort.ErrUserNotFound, bcrypt.ErrMismatchedHashAndPassword:
+			// unknown emails count too so that the lockout does not reveal which emails have accounts
+			if err := l.Fail(key); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+		return user, err
+	}
+}
@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"fmt"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"log"
+	"net/http"
+)
+
+// Picks the key a request is limited by.  An empty key skips limiting the request.
+type KeyFunc func(r *http.Request) string
+
+// Limits by the remote address of the request, see middleware.RemoteIP
+func KeyByIP(r *http.Request) string {
+	return middleware.RemoteIP(r)
+}
+
+// Limits by the authenticated user.  Unauthenticated requests are not limited, so this needs to come after the
+// authentication middleware and is usually paired with KeyByIP.
+func KeyByUser(r *http.Request) string {
+	u, _ := middleware.UserFromContext(r.Context())
+	if u == nil || u.Id == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d", *u.Id)
+}
+
+// A middleware which responds with a 429 and Retry-After once the key for a request has used up its tokens.
+// If the Store fails the request is let through rather than taking the site down with it.
+func NewRateLimitHandler(l *Limiter, keyFn KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keyFn(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			allowed, wait, err := l.Allow(key)
+			if err != nil {
+				log.Printf("%v", err)
+			} else if !allowed {
+				middleware.TooManyRequests(w, wait)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// Token bucket rate limiting and temporary lockouts.  State lives in a Store, which is in memory by default
+// or in Redis when several worrywortd processes need to share limits.
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// A token bucket.  Burst tokens may be used at once, after which tokens are added back at Rate per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// A Limit allowing n requests per minute, all of which may be used at once
+func PerMinute(n int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: n}
+}
+
+// How long until a bucket which has tokens left, possibly a fraction of one, has a whole token again
+func (l Limit) wait(tokens float64) time.Duration {
+	if tokens >= 1 || l.Rate <= 0 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+}
+
+// Holds limiter state.  Keys are shared between everything using the Store, so callers should prefix them.
+type Store interface {
+	// Takes a token from the bucket for key.  If there are none it returns false and how long until there will be.
+	Take(key string, limit Limit) (bool, time.Duration, error)
+	// Increments the counter for key, which expires ttl after it is first incremented.  Returns the new count and
+	// how long until it expires.
+	Incr(key string, ttl time.Duration) (int64, time.Duration, error)
+	// The current count for key and how long until it expires.  0 if it does not exist.
+	Count(key string) (int64, time.Duration, error)
+	// Removes the bucket or counter for key
+	Reset(key string) error
+}
+
+// Limits something, such as requests from an IP address, with a token bucket per key
+type Limiter struct {
+	Store  Store
+	Limit  Limit
+	Prefix string // namespaces this Limiter's keys in the Store, such as "ip:"
+}
+
+// Whether something identified by key may go ahead.  If not, also returns how long it should wait.
+func (l *Limiter) Allow(key string) (bool, time.Duration, error) {
+	return l.Store.Take(l.Prefix+key, l.Limit)
+}
+
+// Returned when a key is locked out.  Implements RetryAfter() so that middleware can respond with a 429.
+type LockedOutError struct {
+	Wait time.Duration
+}
+
+func (e *LockedOutError) Error() string {
+	return fmt.Sprintf("Too many failed attempts. Try again in %v.", e.Wait.Round(time.Second))
+}
+
+func (e *LockedOutError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// Locks a key, such as a user's email address, for Duration after MaxFailures failures within Duration of the first
+type Lockout struct {
+	Store       Store
+	MaxFailures int
+	Duration    time.Duration
+	Prefix      string
+}
+
+// Returns a *LockedOutError if key is locked out
+func (l *Lockout) Check(key string) error {
+	count, ttl, err := l.Store.Count(l.Prefix + key)
+	if err != nil {
+		return err
+	}
+	if count >= int64(l.MaxFailures) {
+		return &LockedOutError{Wait: ttl}
+	}
+	return nil
+}
+
+// Records a failure for key
+func (l *Lockout) Fail(key string) error {
+	_, _, err := l.Store.Incr(l.Prefix+key, l.Duration)
+	return err
+}
+
+// Clears the failures for key, such as after a successful login
+func (l *Lockout) Reset(key string) error {
+	return l.Store.Reset(l.Prefix + key)
+}
@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/go-redis/redis"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// Runs the tests every Store should pass
+func testStore(t *testing.T, store Store, advance func(time.Duration)) {
+	t.Run("Take", func(t *testing.T) {
+		limit := Limit{Rate: 1, Burst: 2}
+		for i := 0; i < 2; i++ {
+			if allowed, _, err := store.Take("take", limit); err != nil || !allowed {
+				t.Fatalf("Expected token %d to be allowed, got %v %v", i, allowed, err)
+			}
+		}
+		allowed, wait, err := store.Take("take", limit)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if allowed || wait <= 0 || wait > time.Second {
+			t.Errorf("Expected to be limited for up to 1s but got allowed: %v, wait: %v", allowed, wait)
+		}
+		advance(1100 * time.Millisecond)
+		if allowed, _, err := store.Take("take", limit); err != nil || !allowed {
+			t.Errorf("Expected a token after waiting, got %v %v", allowed, err)
+		}
+	})
+
+	t.Run("Incr and Count", func(t *testing.T) {
+		if count, _, err := store.Count("counter"); err != nil || count != 0 {
+			t.Errorf("Expected 0 for a missing counter, got %d %v", count, err)
+		}
+		store.Incr("counter", time.Minute)
+		count, ttl, err := store.Incr("counter", time.Minute)
+		if err != nil || count != 2 || ttl <= 0 || ttl > time.Minute {
+			t.Errorf("Unexpected count %d, ttl %v, err %v", count, ttl, err)
+		}
+		if err := store.Reset("counter"); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if count, _, err := store.Count("counter"); err != nil || count != 0 {
+			t.Errorf("Expected 0 after reset, got %d %v", count, err)
+		}
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	testStore(t, store, func(d time.Duration) { now = now.Add(d) })
+
+	t.Run("Counter expires", func(t *testing.T) {
+		store.Incr("expires", time.Minute)
+		now = now.Add(time.Minute)
+		if count, _, _ := store.Count("expires"); count != 0 {
+			t.Errorf("Expected expired counter to be 0, got %d", count)
+		}
+	})
+}
+
+// Only runs when there is a redis to test against, such as in docker-compose
+func TestRedisStore(t *testing.T) {
+	host, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		t.Skip("REDIS_HOST not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: host + ":6379"})
+	defer client.Close()
+	store := &RedisStore{Client: client, Prefix: "worrywort:test:" + time.Now().Format(time.RFC3339Nano) + ":"}
+	testStore(t, store, time.Sleep)
+}
+
+func TestLockout(t *testing.T) {
+	lockout := &Lockout{Store: NewMemoryStore(), MaxFailures: 2, Duration: time.Minute, Prefix: "login:"}
+	user := &worrywort.User{Email: "user@example.com"}
+	calls := 0
+	login := lockout.Login(func(email, password string) (*worrywort.User, error) {
+		calls++
+		if password != "password" {
+			return nil, bcrypt.ErrMismatchedHashAndPassword
+		}
+		return user, nil
+	})
+
+	if _, err := login("user@example.com", "password"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	login("user@example.com", "wrong")
+	// email case does not get around the lockout
+	login("User@Example.com", "wrong")
+
+	_, err := login("user@example.com", "password")
+	lockedOut, ok := err.(*LockedOutError)
+	if !ok {
+		t.Fatalf("Expected a *LockedOutError, got %v", err)
+	}
+	if lockedOut.RetryAfter() <= 0 || lockedOut.RetryAfter() > time.Minute {
+		t.Errorf("Unexpected RetryAfter %v", lockedOut.RetryAfter())
+	}
+	if calls != 3 {
+		t.Errorf("Expected the password not to be checked while locked out, but login was called %d times", calls)
+	}
+
+	if err := lockout.Reset("user@example.com"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := login("user@example.com", "password"); err != nil {
+		t.Errorf("Expected login to work after reset, got %v", err)
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	limiter := &Limiter{Store: NewMemoryStore(), Limit: Limit{Rate: 0.1, Burst: 1}, Prefix: "ip:"}
+	handler := NewRateLimitHandler(limiter, KeyByIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("192.0.2.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+	w := request("192.0.2.1:5678")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "10" {
+		t.Errorf("Expected Retry-After: 10, got %q", w.Header().Get("Retry-After"))
+	}
+	if w := request("192.0.2.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("Expected a different IP to have its own limit, got %d", w.Code)
+	}
+
+	t.Run("KeyByUser", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if key := KeyByUser(req); key != "" {
+			t.Errorf("Expected no key for an unauthenticated request, got %q", key)
+		}
+		uid := int64(5)
+		req = req.WithContext(context.WithValue(req.Context(), middleware.DefaultUserKey, &worrywort.User{Id: &uid}))
+		if key := KeyByUser(req); key != "5" {
+			t.Errorf("Expected key 5, got %q", key)
+		}
+	})
+}
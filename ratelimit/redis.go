@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"github.com/go-redis/redis"
+	"strconv"
+	"time"
+)
+
+// Refills and takes from a bucket stored as a hash in a single step so that processes sharing the bucket do not race.
+// Returns whether a token was taken and the tokens left as a string since Lua numbers are truncated to integers.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(b[1]) or burst
+local updated = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, tostring(tokens)}
+`)
+
+// Only sets the expiration on the first increment so that the counter expires ttl after the first failure
+var incrScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return {count, redis.call('PTTL', KEYS[1])}
+`)
+
+// A Store shared by every process using the same Redis.  Keys are prefixed with Prefix.
+type RedisStore struct {
+	Client redis.UniversalClient
+	Prefix string
+}
+
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{Client: client, Prefix: "worrywort:ratelimit:"}
+}
+
+func (s *RedisStore) Take(key string, limit Limit) (bool, time.Duration, error) {
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	result, err := takeScript.Run(s.Client, []string{s.Prefix + key}, limit.Rate, limit.Burst, now).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	values := result.([]interface{})
+	tokens, err := strconv.ParseFloat(values[1].(string), 64)
+	if err != nil {
+		return false, 0, err
+	}
+	if values[0].(int64) != 1 {
+		return false, limit.wait(tokens), nil
+	}
+	return true, 0, nil
+}
+
+func (s *RedisStore) Incr(key string, ttl time.Duration) (int64, time.Duration, error) {
+	result, err := incrScript.Run(s.Client, []string{s.Prefix + key}, int64(ttl/time.Millisecond)).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	values := result.([]interface{})
+	return values[0].(int64), time.Duration(values[1].(int64)) * time.Millisecond, nil
+}
+
+func (s *RedisStore) Count(key string) (int64, time.Duration, error) {
+	pipe := s.Client.Pipeline()
+	get := pipe.Get(s.Prefix + key)
+	pttl := pipe.PTTL(s.Prefix + key)
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return 0, 0, err
+	}
+	count, err := get.Int64()
+	if err == redis.Nil {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	return count, pttl.Val(), nil
+}
+
+func (s *RedisStore) Reset(key string) error {
+	return s.Client.Del(s.Prefix + key).Err()
+}
@@ -0,0 +1,194 @@
+package rest_api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Gateways which were offline upload everything they buffered at once, so these are much larger than for a single
+// measurement.
+const (
+	maxBulkBodyBytes = 10 << 20
+	maxBulkRows      = 5000
+)
+
+// Accepts many measurements in one request as either a JSON array of objects or newline delimited JSON, one object
+// per line.  Each object has the same fields as a single measurement posted to MeasurementHandler.  Every row is
+// validated and the valid ones are saved together, so one bad reading does not lose the rest of the upload.
+type BulkMeasurementHandler struct {
+	Db *sqlx.DB
+	// Optional limit on how often each sensor may post.  A bulk upload counts once for each sensor in it.
+	SensorLimiter *ratelimit.Limiter
+	Notifier      worrywort.TemperatureMeasurementNotifier
+}
+
+type bulkAcceptedRow struct {
+	Index int    `json:"index"`
+	Id    string `json:"id"`
+	// the sensor already had a measurement at the same time, such as from an earlier attempt at the upload
+	Duplicate bool `json:"duplicate"`
+}
+
+type bulkRowError struct {
+	Index int `json:"index"`
+	// a TemperatureMeasurementForm, or {"row": [...]} if the row could not be read at all
+	Errors interface{} `json:"errors"`
+}
+
+type bulkMeasurementResponse struct {
+	Accepted []bulkAcceptedRow `json:"accepted"`
+	Errors   []bulkRowError    `json:"errors"`
+}
+
+func (h *BulkMeasurementHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, err := middleware.UserFromContext(r.Context())
+	if u == nil || err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		h.InsertMeasurements(w, r, u)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Splits the body into the raw JSON for each row.  Whether it is an array or NDJSON is decided by the first character
+// rather than the Content-Type since gateways are not consistent about what they send.
+func bulkRows(body []byte) ([]json.RawMessage, error) {
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		rows := []json.RawMessage{}
+		if err := json.Unmarshal(body, &rows); err != nil {
+			return nil, fmt.Errorf("Invalid JSON: %v", err)
+		}
+		return rows, nil
+	}
+
+	// blank lines are skipped, so they do not count towards a row's index
+	rows := []json.RawMessage{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBulkBodyBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		rows = append(rows, json.RawMessage(append([]byte{}, line...)))
+	}
+	return rows, scanner.Err()
+}
+
+func bulkRowValues(row json.RawMessage) (url.Values, error) {
+	decoder := json.NewDecoder(bytes.NewReader(row))
+	decoder.UseNumber()
+	body := map[string]interface{}{}
+	if err := decoder.Decode(&body); err != nil {
+		return nil, fmt.Errorf("Invalid JSON: %v", err)
+	}
+	return jsonObjectValues(body)
+}
+
+func (h *BulkMeasurementHandler) InsertMeasurements(w http.ResponseWriter, r *http.Request, user *worrywort.User) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBulkBodyBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	rows, err := bulkRows(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+		return
+	}
+	if len(rows) > maxBulkRows {
+		http.Error(w, fmt.Sprintf("At most %d measurements may be sent at once", maxBulkRows),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	token, _ := middleware.AuthTokenFromContext(r.Context())
+	// uploads usually have many rows for a few sensors, so each sensor is only looked up once
+	sensors := map[string]*worrywort.Sensor{}
+	response := bulkMeasurementResponse{Accepted: []bulkAcceptedRow{}, Errors: []bulkRowError{}}
+	measurements := []*worrywort.TemperatureMeasurement{}
+	indexes := []int{}
+	for i, row := range rows {
+		values, err := bulkRowValues(row)
+		if err != nil {
+			response.Errors = append(response.Errors,
+				bulkRowError{Index: i, Errors: map[string][]string{"row": {err.Error()}}})
+			continue
+		}
+		form := NewTemperatureMeasurementForm(user, token, h.Db)
+		form.sensors = sensors
+		form.Validate(values)
+		if !form.IsValid() {
+			response.Errors = append(response.Errors, bulkRowError{Index: i, Errors: form})
+			continue
+		}
+		measurements = append(measurements, form.CleanedMeasurement)
+		indexes = append(indexes, i)
+	}
+
+	if allowed, wait := allowSensors(h.SensorLimiter, measurements); !allowed {
+		middleware.TooManyRequests(w, wait)
+		return
+	}
+
+	created := []bool{}
+	if len(measurements) > 0 {
+		if created, err = worrywort.InsertTemperatureMeasurements(h.Db, measurements); err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Error saving measurements", http.StatusInternalServerError)
+			return
+		}
+	}
+	for i, m := range measurements {
+		if created[i] {
+			h.Notifier.Created(m)
+		}
+		response.Accepted = append(response.Accepted,
+			bulkAcceptedRow{Index: indexes[i], Id: m.Id, Duplicate: !created[i]})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// Counts a request against the limit of each sensor the measurements are for, once per sensor.  Returns false and how
+// long to wait if any of them is over its limit.  limiter may be nil if sensors are not limited.  Errors from the
+// limiter are only logged so that an outage of its store does not stop measurements being saved.
+func allowSensors(limiter *ratelimit.Limiter, measurements []*worrywort.TemperatureMeasurement) (bool,
+	time.Duration) {
+	if limiter == nil {
+		return true, 0
+	}
+	checked := map[int64]bool{}
+	for _, m := range measurements {
+		if checked[*m.SensorId] {
+			continue
+		}
+		checked[*m.SensorId] = true
+		allowed, wait, err := limiter.Allow(fmt.Sprintf("%d", *m.SensorId))
+		if err != nil {
+			log.Printf("%v", err)
+		} else if !allowed {
+			return false, wait
+		}
+	}
+	return true, 0
+}
@@ -0,0 +1,150 @@
+package rest_api
+
+import (
+	"encoding/json"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Endpoints for the OAuth 2.0 device authorization grant, RFC 8628.  See worrywort.DeviceCode.
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// The scope string returned with a device token.  worrywort.DeviceTokenScope
+const deviceTokenScope = "write:temperatures"
+
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+	SensorId    string `json:"sensor_id"`
+}
+
+// RFC 6749 5.2 error response
+type oauthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func writeOAuthJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// Starts the device flow.  Expects a form POST with `client_id` and optionally `name` to use as the name of the
+// Sensor which is created when the device is approved.
+type DeviceAuthorizationHandler struct {
+	Db *sqlx.DB
+	// The page where the user enters the user code to approve the device
+	VerificationURI string
+}
+
+func (h *DeviceAuthorizationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthJSON(w, http.StatusBadRequest, oauthErrorResponse{Error: "invalid_request"})
+		return
+	}
+	clientId := strings.TrimSpace(r.PostForm.Get("client_id"))
+	if clientId == "" {
+		writeOAuthJSON(w, http.StatusBadRequest,
+			oauthErrorResponse{Error: "invalid_request", ErrorDescription: "client_id is required"})
+		return
+	}
+
+	d, err := worrywort.NewDeviceCode(clientId, strings.TrimSpace(r.PostForm.Get("name")),
+		worrywort.DefaultDeviceCodeTTL)
+	if err == nil {
+		err = d.Save(h.Db)
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	complete := h.VerificationURI
+	if u, err := url.Parse(h.VerificationURI); err == nil {
+		q := u.Query()
+		q.Set("user_code", d.UserCodeForDisplay())
+		u.RawQuery = q.Encode()
+		complete = u.String()
+	}
+	writeOAuthJSON(w, http.StatusOK, deviceAuthorizationResponse{
+		DeviceCode:              d.ForDevice(),
+		UserCode:                d.UserCodeForDisplay(),
+		VerificationURI:         h.VerificationURI,
+		VerificationURIComplete: complete,
+		ExpiresIn:               int(worrywort.DefaultDeviceCodeTTL.Seconds()),
+		Interval:                d.PollInterval,
+	})
+}
+
+// The token endpoint the device polls with its device code
+type DeviceTokenHandler struct {
+	Db *sqlx.DB
+}
+
+func (h *DeviceTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthJSON(w, http.StatusBadRequest, oauthErrorResponse{Error: "invalid_request"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != deviceCodeGrantType {
+		writeOAuthJSON(w, http.StatusBadRequest, oauthErrorResponse{Error: "unsupported_grant_type"})
+		return
+	}
+
+	token, err := worrywort.RedeemDeviceCode(r.PostForm.Get("device_code"), r.PostForm.Get("client_id"), h.Db)
+	switch err {
+	case nil:
+	case worrywort.ErrDeviceAuthorizationPending, worrywort.ErrDeviceSlowDown, worrywort.ErrDeviceAccessDenied,
+		worrywort.ErrDeviceCodeExpired, worrywort.ErrInvalidDeviceCode:
+		// these errors are the RFC 8628 error codes
+		writeOAuthJSON(w, http.StatusBadRequest, oauthErrorResponse{Error: err.Error()})
+		return
+	default:
+		log.Printf("%v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	sensor, err := worrywort.FindSensor(map[string]interface{}{"id": *token.SensorId}, h.Db)
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	entry := worrywort.AuditLogEntry{UserId: sensor.UserId, Action: worrywort.AUDIT_ACTION_CREATE,
+		EntityType: worrywort.AUDIT_ENTITY_AUTH_TOKEN, EntityId: token.Id, IP: middleware.RemoteIP(r)}
+	if err := entry.Save(h.Db); err != nil {
+		log.Printf("Failed to record device token in the audit log: %v", err)
+	}
+	writeOAuthJSON(w, http.StatusOK, deviceTokenResponse{AccessToken: token.ForAuthenticationHeader(),
+		TokenType: "Bearer", Scope: deviceTokenScope, SensorId: sensor.UUID})
+}
@@ -0,0 +1,294 @@
+package rest_api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The JSON Fermentrack's generic push target sends.  Probes which are not connected are null.
+type fermentrackPayload struct {
+	BrewPiDevices  []fermentrackDevice        `json:"brewpi_devices"`
+	GravitySensors []fermentrackGravitySensor `json:"gravity_sensors"`
+}
+
+// A BrewPi controller.  The settings are the controller's targets, which are not measurements, so they are not saved.
+type fermentrackDevice struct {
+	InternalId    json.Number `json:"internal_id"`
+	Name          string      `json:"name"`
+	TempFormat    string      `json:"temp_format"`
+	BeerTemp      *float64    `json:"beer_temp"`
+	BeerSetting   *float64    `json:"beer_setting"`
+	FridgeTemp    *float64    `json:"fridge_temp"`
+	FridgeSetting *float64    `json:"fridge_setting"`
+	RoomTemp      *float64    `json:"room_temp"`
+	ControlMode   string      `json:"control_mode"`
+}
+
+// A hydrometer, such as a Tilt or iSpindel, which Fermentrack collects readings from
+type fermentrackGravitySensor struct {
+	InternalId json.Number `json:"internal_id"`
+	Name       string      `json:"name"`
+	Gravity    *float64    `json:"gravity"`
+	Temp       *float64    `json:"temp"`
+	TempFormat string      `json:"temp_format"`
+}
+
+// One reading from the payload, each of which is saved for its own sensor
+type fermentrackProbe struct {
+	// identifies the probe in the response, such as `brewpi:1:beer`
+	Key string
+	// the BrewPi's beer probe for its fridge probe, so that they are associated with the same batch
+	BeerKey     string
+	Name        string
+	Temperature *float64
+	TempFormat  string
+	Gravity     *float64
+}
+
+func (p fermentrackProbe) deviceId() string {
+	return "fermentrack:" + p.Key
+}
+
+// The probes in the payload, in the order they were sent.  Each BrewPi has separate beer, fridge, and room probes.
+// The beer probe's sensor is associated with the batch as usual and the fridge probe's sensor follows it to the same
+// batch, while the room probe's sensor may be in a room shared by several batches so it is left alone.
+func (p fermentrackPayload) probes() []fermentrackProbe {
+	probes := []fermentrackProbe{}
+	for _, d := range p.BrewPiDevices {
+		for _, probe := range []struct {
+			name        string
+			temperature *float64
+		}{{"beer", d.BeerTemp}, {"fridge", d.FridgeTemp}, {"room", d.RoomTemp}} {
+			if probe.temperature == nil {
+				continue
+			}
+			fp := fermentrackProbe{
+				Key:         fmt.Sprintf("brewpi:%s:%s", d.InternalId, probe.name),
+				Name:        fmt.Sprintf("%s %s", d.Name, strings.Title(probe.name)),
+				Temperature: probe.temperature, TempFormat: d.TempFormat}
+			if probe.name == "fridge" {
+				fp.BeerKey = fmt.Sprintf("brewpi:%s:beer", d.InternalId)
+			}
+			probes = append(probes, fp)
+		}
+	}
+	for _, g := range p.GravitySensors {
+		if g.Gravity == nil && g.Temp == nil {
+			continue
+		}
+		probes = append(probes, fermentrackProbe{Key: fmt.Sprintf("gravity:%s", g.InternalId), Name: g.Name,
+			Temperature: g.Temp, TempFormat: g.TempFormat, Gravity: g.Gravity})
+	}
+	return probes
+}
+
+// Accepts the pushes from Fermentrack's generic push target.  Each probe is saved to its own sensor, matched by the
+// Fermentrack id of its device and which probe it is, see worrywort.FindDeviceSensor().  As with the other devices
+// which can only be given a URL, the token is part of the path.  A token bound to a sensor may only push the probe
+// for that sensor.
+type FermentrackHandler struct {
+	Db *sqlx.DB
+	// Make a sensor for a probe which does not match one yet, rather than rejecting its readings
+	CreateSensors bool
+	SensorLimiter *ratelimit.Limiter
+	Notifier      worrywort.TemperatureMeasurementNotifier
+}
+
+type fermentrackAcceptedProbe struct {
+	Probe                    string `json:"probe"`
+	SensorId                 string `json:"sensor_id"`
+	TemperatureMeasurementId string `json:"temperature_measurement_id,omitempty"`
+	HydrometerMeasurementId  string `json:"hydrometer_measurement_id,omitempty"`
+	// the batch a fridge probe's sensor was associated with, the same as the beer probe's
+	BatchId string `json:"batch_id,omitempty"`
+}
+
+type fermentrackProbeError struct {
+	Probe  string   `json:"probe"`
+	Errors []string `json:"errors"`
+}
+
+type fermentrackResponse struct {
+	Accepted []fermentrackAcceptedProbe `json:"accepted"`
+	Errors   []fermentrackProbeError    `json:"errors"`
+}
+
+func (h *FermentrackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, err := middleware.UserFromContext(r.Context())
+	if u == nil || err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		h.InsertMeasurements(w, r, u)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Finds the sensor for one probe.  The returned string is an error to show for the probe, other errors are returned
+// as err.  bound is the sensor the token is bound to, if it is, and the probe is rejected before anything is looked up
+// or created unless it is the probe for that sensor.
+func (h *FermentrackHandler) probeSensor(probe fermentrackProbe, user *worrywort.User, bound *worrywort.Sensor) (
+	sensor *worrywort.Sensor, probeErr string, err error) {
+	if probe.Temperature != nil {
+		if _, _, ok := deviceTemperature(*probe.Temperature, probe.TempFormat); !ok {
+			return nil, fmt.Sprintf("%s is not a valid temp_format", probe.TempFormat), nil
+		}
+	}
+	if bound != nil {
+		// the same as worrywort.FindDeviceSensor() would find or claim, but only ever the bound sensor
+		if bound.DeviceId == probe.deviceId() {
+			return bound, "", nil
+		} else if bound.DeviceId == "" && bound.Name == probe.Name {
+			bound.DeviceId = probe.deviceId()
+			return bound, "", bound.Save(h.Db)
+		}
+		return nil, worrywort.ErrTokenNotAllowedForSensor.Error(), nil
+	}
+
+	sensor, err = worrywort.FindDeviceSensor(*user, probe.deviceId(), probe.Name, h.CreateSensors, h.Db)
+	if err == sql.ErrNoRows {
+		return nil, "No sensor matches this probe", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	return sensor, "", nil
+}
+
+// Saves one probe's reading to its sensor.  A fridge probe's sensor is first associated with the batch its beer probe's
+// sensor is, so that the measurement is part of the batch.
+func (h *FermentrackHandler) insertProbe(probe fermentrackProbe, sensor *worrywort.Sensor, user *worrywort.User,
+	recordedAt time.Time) (*fermentrackAcceptedProbe, error) {
+	accepted := &fermentrackAcceptedProbe{Probe: probe.Key, SensorId: sensor.UUID}
+	if probe.BeerKey != "" {
+		beer, err := worrywort.FindSensor(map[string]interface{}{"device_id": "fermentrack:" + probe.BeerKey,
+			"editable_by": *user.Id}, h.Db)
+		if err == nil {
+			association, err := worrywort.EnsureSameBatchSensorAssociation(sensor, beer, "Fridge", recordedAt, h.Db)
+			if err == nil {
+				accepted.BatchId = association.Batch.UUID
+			} else if err != sql.ErrNoRows {
+				return nil, err
+			}
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	var tm *worrywort.TemperatureMeasurement
+	var hm *worrywort.HydrometerMeasurement
+	if probe.Temperature != nil {
+		temperature, units, _ := deviceTemperature(*probe.Temperature, probe.TempFormat)
+		tm = &worrywort.TemperatureMeasurement{Sensor: sensor, SensorId: sensor.Id, CreatedBy: user,
+			UserId: user.Id, Temperature: temperature, Units: units, RecordedAt: recordedAt}
+	}
+	if probe.Gravity != nil {
+		hm = &worrywort.HydrometerMeasurement{SensorId: sensor.Id, UserId: user.Id, Gravity: *probe.Gravity,
+			RecordedAt: recordedAt}
+	}
+	created := false
+	if tm != nil && hm != nil {
+		var err error
+		if created, err = worrywort.InsertHydrometerReading(h.Db, tm, hm); err != nil {
+			return nil, err
+		}
+	} else if tm != nil {
+		err := tm.Save(h.Db)
+		if err != nil && err != worrywort.ErrDuplicateTemperatureMeasurement {
+			return nil, err
+		}
+		created = err == nil
+	} else if err := hm.Save(h.Db); err != nil && err != worrywort.ErrDuplicateHydrometerMeasurement {
+		return nil, err
+	}
+	if created {
+		h.Notifier.Created(tm)
+	}
+	if tm != nil {
+		accepted.TemperatureMeasurementId = tm.Id
+	}
+	if hm != nil {
+		accepted.HydrometerMeasurementId = hm.Id
+	}
+	return accepted, nil
+}
+
+func (h *FermentrackHandler) InsertMeasurements(w http.ResponseWriter, r *http.Request, user *worrywort.User) {
+	payload := fermentrackPayload{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	token, _ := middleware.AuthTokenFromContext(r.Context())
+	var bound *worrywort.Sensor
+	if token != nil && token.SensorId != nil {
+		var err error
+		bound, err = worrywort.FindSensor(map[string]interface{}{"id": *token.SensorId, "editable_by": *user.Id},
+			h.Db)
+		if err == sql.ErrNoRows {
+			http.Error(w, worrywort.ErrTokenNotAllowedForSensor.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Error saving measurements", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := fermentrackResponse{Accepted: []fermentrackAcceptedProbe{}, Errors: []fermentrackProbeError{}}
+	probes := []fermentrackProbe{}
+	sensors := []*worrywort.Sensor{}
+	for _, probe := range payload.probes() {
+		sensor, probeErr, err := h.probeSensor(probe, user, bound)
+		if err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Error saving measurements", http.StatusInternalServerError)
+			return
+		} else if sensor == nil {
+			response.Errors = append(response.Errors, fermentrackProbeError{Probe: probe.Key, Errors: []string{probeErr}})
+			continue
+		}
+		probes = append(probes, probe)
+		sensors = append(sensors, sensor)
+	}
+
+	// the same as a bulk upload, nothing is saved if any of the sensors is over its limit
+	if h.SensorLimiter != nil {
+		for _, sensor := range sensors {
+			allowed, wait, err := h.SensorLimiter.Allow(fmt.Sprintf("%d", *sensor.Id))
+			if err != nil {
+				log.Printf("%v", err)
+			} else if !allowed {
+				middleware.TooManyRequests(w, wait)
+				return
+			}
+		}
+	}
+
+	// Fermentrack sends the latest reading of each probe, so they were all recorded as of now
+	recordedAt := time.Now().UTC().Round(time.Microsecond)
+	for i, probe := range probes {
+		accepted, err := h.insertProbe(probe, sensors[i], user, recordedAt)
+		if err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Error saving measurements", http.StatusInternalServerError)
+			return
+		}
+		response.Accepted = append(response.Accepted, *accepted)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
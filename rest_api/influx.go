@@ -0,0 +1,381 @@
+package rest_api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidPrecision = errors.New("precision must be one of ns, n, us, u, ms, s, m or h")
+
+// The precision parameter of InfluxDB 1.x and 2.x writes.  Nanoseconds if it is not given.
+var influxPrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"µ":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// A field of a line protocol point.  Numeric is false for strings and booleans, which cannot be measurements.
+type influxField struct {
+	Key     string
+	Value   string
+	Numeric bool
+}
+
+// A single point of InfluxDB line protocol, such as
+// `temperature,sensor_id=<uuid>,units=FAHRENHEIT value=65.2 1555846233000000000`
+type influxPoint struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      []influxField
+	// nil if the line had no timestamp, in which case it was recorded when it arrived
+	Timestamp *time.Time
+}
+
+// Accepts InfluxDB line protocol, as written to the `/write` endpoint of InfluxDB 1.x or `/api/v2/write` of 2.x, for
+// Telegraf and other loggers which can only send that.  Each field of each point becomes a TemperatureMeasurement
+// validated the same way as one posted to MeasurementHandler:
+//
+//   - The sensor is the `sensor_id` tag, or the measurement name if it is a sensor's uuid.  If neither is given the
+//     token must be bound to a sensor.
+//   - The metric is the field's key, except for a field named `value` which takes the `metric` tag or the measurement
+//     name, or is a temperature if the measurement name is the sensor.
+//   - The units are the `units` tag, and Celsius if there is none.
+//
+// As with InfluxDB, a successful write responds 204 with no body and a write with invalid points still saves the
+// valid ones and responds 400 with the errors.
+type InfluxWriteHandler struct {
+	Db *sqlx.DB
+	// Optional limit on how often each sensor may post.  A write counts once for each sensor in it.
+	SensorLimiter *ratelimit.Limiter
+	Notifier      worrywort.TemperatureMeasurementNotifier
+}
+
+type influxLineError struct {
+	Line int `json:"line"`
+	// a TemperatureMeasurementForm, or {"line": [...]} if the line could not be parsed
+	Errors interface{} `json:"errors"`
+}
+
+// Influx clients show `error` (1.x) or `message` (2.x)
+type influxErrorResponse struct {
+	Code    string            `json:"code"`
+	Error   string            `json:"error"`
+	Message string            `json:"message"`
+	Errors  []influxLineError `json:"errors"`
+}
+
+// Finds the first of stops in s which is not escaped with a backslash or, if quotes is true, inside double quotes
+func indexUnescaped(s string, stops string, quotes bool) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case !quoted && strings.IndexByte(stops, s[i]) >= 0:
+			return i
+		}
+	}
+	return -1
+}
+
+// Splits s on sep where it is not escaped or quoted
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	parts := []string{}
+	for {
+		i := indexUnescaped(s, string(sep), quotes)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+var lineProtocolUnescaper = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\"`, `"`, `\\`, `\`)
+
+func unescapeLineProtocol(s string) string {
+	return lineProtocolUnescaper.Replace(s)
+}
+
+func parseInfluxField(s string) (influxField, error) {
+	i := indexUnescaped(s, "=", false)
+	if i <= 0 {
+		return influxField{}, fmt.Errorf("Invalid field %q", s)
+	}
+	field := influxField{Key: unescapeLineProtocol(s[:i])}
+	value := s[i+1:]
+	switch {
+	case strings.HasPrefix(value, `"`):
+		if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+			return field, fmt.Errorf("Unterminated string in field %s", field.Key)
+		}
+		field.Value = unescapeLineProtocol(value[1 : len(value)-1])
+		return field, nil
+	case strings.HasSuffix(value, "i") || strings.HasSuffix(value, "u"):
+		if _, err := strconv.ParseInt(value[:len(value)-1], 10, 64); err != nil {
+			return field, fmt.Errorf("Invalid integer in field %s", field.Key)
+		}
+		field.Value, field.Numeric = value[:len(value)-1], true
+		return field, nil
+	}
+	switch strings.ToLower(value) {
+	case "t", "true", "f", "false":
+		field.Value = value
+		return field, nil
+	}
+	if f, err := strconv.ParseFloat(value, 64); err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return field, fmt.Errorf("Invalid value in field %s", field.Key)
+	}
+	field.Value, field.Numeric = value, true
+	return field, nil
+}
+
+func parseInfluxTimestamp(s string, precision time.Duration) (time.Time, error) {
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid timestamp %q", s)
+	}
+	if ts > math.MaxInt64/int64(precision) || ts < math.MinInt64/int64(precision) {
+		return time.Time{}, fmt.Errorf("Timestamp %s is out of range", s)
+	}
+	return time.Unix(0, ts*int64(precision)).UTC(), nil
+}
+
+// Parses one line of line protocol
+func parseInfluxLine(line string, precision time.Duration) (influxPoint, error) {
+	point := influxPoint{Tags: map[string]string{}}
+	end := indexUnescaped(line, " ", false)
+	if end < 0 {
+		return point, errors.New("A point must have fields")
+	}
+	series := splitUnescaped(line[:end], ',', false)
+	point.Measurement = unescapeLineProtocol(series[0])
+	if point.Measurement == "" {
+		return point, errors.New("A point must have a measurement name")
+	}
+	for _, tag := range series[1:] {
+		i := indexUnescaped(tag, "=", false)
+		if i <= 0 {
+			return point, fmt.Errorf("Invalid tag %q", tag)
+		}
+		point.Tags[unescapeLineProtocol(tag[:i])] = unescapeLineProtocol(tag[i+1:])
+	}
+
+	rest := strings.TrimLeft(line[end+1:], " ")
+	end = indexUnescaped(rest, " ", true)
+	fields := rest
+	timestamp := ""
+	if end >= 0 {
+		fields, timestamp = rest[:end], strings.TrimSpace(rest[end+1:])
+	}
+	if fields == "" {
+		return point, errors.New("A point must have fields")
+	}
+	for _, f := range splitUnescaped(fields, ',', true) {
+		field, err := parseInfluxField(f)
+		if err != nil {
+			return point, err
+		}
+		point.Fields = append(point.Fields, field)
+	}
+	if timestamp != "" {
+		t, err := parseInfluxTimestamp(timestamp, precision)
+		if err != nil {
+			return point, err
+		}
+		point.Timestamp = &t
+	}
+	return point, nil
+}
+
+// The values to validate with TemperatureMeasurementForm for each field of a point
+func (p influxPoint) measurementValues(now time.Time) []url.Values {
+	sensorId, ok := p.Tags["sensor_id"]
+	measurementIsSensor := false
+	if !ok {
+		if _, err := uuid.Parse(p.Measurement); err == nil {
+			sensorId, measurementIsSensor = p.Measurement, true
+		}
+	}
+	units, ok := p.Tags["units"]
+	if !ok {
+		units = "CELSIUS"
+	}
+	recordedAt := now
+	if p.Timestamp != nil {
+		recordedAt = *p.Timestamp
+	}
+
+	rows := []url.Values{}
+	for _, field := range p.Fields {
+		metric := field.Key
+		if metric == "value" {
+			metric, ok = p.Tags["metric"]
+			if !ok && !measurementIsSensor {
+				metric = p.Measurement
+			} else if !ok {
+				metric = "temperature"
+			}
+		}
+		value := field.Value
+		if !field.Numeric {
+			// TemperatureMeasurementForm would otherwise accept a string of digits
+			value = `"` + value + `"`
+		}
+		rows = append(rows, url.Values{"sensor_id": {sensorId}, "metric": {metric}, "value": {value},
+			"units": {units}, "recorded_at": {recordedAt.Round(time.Microsecond).Format(time.RFC3339Nano)}})
+	}
+	return rows
+}
+
+func (h *InfluxWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, err := middleware.UserFromContext(r.Context())
+	if u == nil || err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		h.Write(w, r, u)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func writeInfluxError(w http.ResponseWriter, status int, code, message string, lineErrors []influxLineError) {
+	if lineErrors == nil {
+		lineErrors = []influxLineError{}
+	}
+	writeJSON(w, status, influxErrorResponse{Code: code, Error: message, Message: message, Errors: lineErrors})
+}
+
+var errInfluxBodyTooLarge = errors.New("http: request body too large")
+
+// Telegraf's InfluxDB 2.x output gzips what it sends by default.  The uncompressed body is limited as well.
+func influxBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBulkBodyBytes))
+	if err != nil {
+		return nil, errInfluxBodyTooLarge
+	}
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return body, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	body, err = ioutil.ReadAll(io.LimitReader(gz, maxBulkBodyBytes+1))
+	if err == nil && len(body) > maxBulkBodyBytes {
+		err = errInfluxBodyTooLarge
+	}
+	return body, err
+}
+
+func (h *InfluxWriteHandler) Write(w http.ResponseWriter, r *http.Request, user *worrywort.User) {
+	precision, ok := influxPrecisions[r.URL.Query().Get("precision")]
+	if !ok {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", errInvalidPrecision.Error(), nil)
+		return
+	}
+	body, err := influxBody(w, r)
+	if err == errInfluxBodyTooLarge {
+		writeInfluxError(w, http.StatusRequestEntityTooLarge, "request too large", err.Error(), nil)
+		return
+	} else if err != nil {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err.Error(), nil)
+		return
+	}
+
+	now := time.Now().UTC()
+	token, _ := middleware.AuthTokenFromContext(r.Context())
+	sensors := map[string]*worrywort.Sensor{}
+	lineErrors := []influxLineError{}
+	measurements := []*worrywort.TemperatureMeasurement{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBulkBodyBytes)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := parseInfluxLine(line, precision)
+		if err != nil {
+			lineErrors = append(lineErrors,
+				influxLineError{Line: lineNumber, Errors: map[string][]string{"line": {err.Error()}}})
+			continue
+		}
+		for _, values := range point.measurementValues(now) {
+			form := NewTemperatureMeasurementForm(user, token, h.Db)
+			form.sensors = sensors
+			form.Validate(values)
+			if !form.IsValid() {
+				lineErrors = append(lineErrors, influxLineError{Line: lineNumber, Errors: form})
+				continue
+			}
+			measurements = append(measurements, form.CleanedMeasurement)
+		}
+		if len(measurements) > maxBulkRows {
+			writeInfluxError(w, http.StatusRequestEntityTooLarge, "request too large",
+				fmt.Sprintf("At most %d measurements may be sent at once", maxBulkRows), nil)
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err.Error(), nil)
+		return
+	}
+
+	if allowed, wait := allowSensors(h.SensorLimiter, measurements); !allowed {
+		middleware.TooManyRequests(w, wait)
+		return
+	}
+	if len(measurements) > 0 {
+		created, err := worrywort.InsertTemperatureMeasurements(h.Db, measurements)
+		if err != nil {
+			log.Printf("%v", err)
+			writeInfluxError(w, http.StatusInternalServerError, "internal error", "Error saving measurements", nil)
+			return
+		}
+		for i, m := range measurements {
+			if created[i] {
+				h.Notifier.Created(m)
+			}
+		}
+	}
+
+	if len(lineErrors) > 0 {
+		first, _ := json.Marshal(lineErrors[0].Errors)
+		writeInfluxError(w, http.StatusBadRequest, "invalid", fmt.Sprintf("partial write: line %d: %s dropped=%d",
+			lineErrors[0].Line, first, len(lineErrors)), lineErrors)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
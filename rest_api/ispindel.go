@@ -0,0 +1,191 @@
+package rest_api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The JSON the iSpindel firmware posts with its "HTTP" service.  The firmware cannot be changed to send anything
+// else, so this takes the payload as is.  ID is the ESP8266 chip id, which is a number, but some forks send a string.
+type iSpindelPayload struct {
+	Name        string      `json:"name"`
+	ID          interface{} `json:"ID"`
+	Angle       *float64    `json:"angle"`
+	Temperature *float64    `json:"temperature"`
+	TempUnits   string      `json:"temp_units"`
+	Battery     *float64    `json:"battery"`
+	Gravity     *float64    `json:"gravity"`
+	Interval    *int        `json:"interval"`
+	RSSI        *int        `json:"RSSI"`
+}
+
+// Field errors, in the same style as TemperatureMeasurementForm
+type iSpindelErrors struct {
+	NameErrors        []string `json:"name,omitempty"`
+	TemperatureErrors []string `json:"temperature,omitempty"`
+	TempUnitsErrors   []string `json:"temp_units,omitempty"`
+	GravityErrors     []string `json:"gravity,omitempty"`
+}
+
+// Accepts measurements from an iSpindel hydrometer.  The firmware can only be given a URL, so it is authenticated by
+// a token in the path rather than a header, see middleware.PathTokenAuthenticator.  The device is matched to one of
+// the user's sensors by its chip id, or by its name the first time, see worrywort.FindDeviceSensor().
+type ISpindelHandler struct {
+	Db *sqlx.DB
+	// Make a sensor for an iSpindel which does not match one yet, rather than rejecting its measurements
+	CreateSensors bool
+	SensorLimiter *ratelimit.Limiter
+	Notifier      worrywort.TemperatureMeasurementNotifier
+}
+
+type iSpindelResponse struct {
+	SensorId                 string `json:"sensor_id"`
+	TemperatureMeasurementId string `json:"temperature_measurement_id"`
+	HydrometerMeasurementId  string `json:"hydrometer_measurement_id"`
+}
+
+func (h *ISpindelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, err := middleware.UserFromContext(r.Context())
+	if u == nil || err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		h.InsertMeasurement(w, r, u)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Converts a device's temperature to units WorryWort has.  An iSpindel may also be set to Kelvin.
+func deviceTemperature(temperature float64, units string) (float64, worrywort.TemperatureUnitType, bool) {
+	switch strings.ToUpper(units) {
+	case "C", "":
+		return temperature, worrywort.CELSIUS, true
+	case "F":
+		return temperature, worrywort.FAHRENHEIT, true
+	case "K":
+		return temperature - 273.15, worrywort.CELSIUS, true
+	}
+	return 0, worrywort.CELSIUS, false
+}
+
+// The chip id as a string, or "" if it was not sent
+func (p iSpindelPayload) chipId() string {
+	switch id := p.ID.(type) {
+	case json.Number:
+		return id.String()
+	case string:
+		return strings.TrimSpace(id)
+	}
+	return ""
+}
+
+func (p iSpindelPayload) validate() (iSpindelErrors, bool) {
+	errs := iSpindelErrors{}
+	valid := true
+	if strings.TrimSpace(p.Name) == "" && p.chipId() == "" {
+		errs.NameErrors = append(errs.NameErrors, "name or ID is required")
+		valid = false
+	}
+	if p.Temperature == nil {
+		errs.TemperatureErrors = append(errs.TemperatureErrors, "temperature is required")
+		valid = false
+	}
+	if _, _, ok := deviceTemperature(0, p.TempUnits); !ok {
+		errs.TempUnitsErrors = append(errs.TempUnitsErrors, fmt.Sprintf("%s is not a valid unit", p.TempUnits))
+		valid = false
+	}
+	if p.Gravity == nil {
+		errs.GravityErrors = append(errs.GravityErrors, "gravity is required")
+		valid = false
+	}
+	return errs, valid
+}
+
+func (h *ISpindelHandler) InsertMeasurement(w http.ResponseWriter, r *http.Request, user *worrywort.User) {
+	payload := iSpindelPayload{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if errs, ok := payload.validate(); !ok {
+		writeJSON(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	// a token bound to a sensor already says which sensor this is
+	token, _ := middleware.AuthTokenFromContext(r.Context())
+	var sensor *worrywort.Sensor
+	var err error
+	if token != nil && token.SensorId != nil {
+		sensor, err = worrywort.FindSensor(
+			map[string]interface{}{"id": *token.SensorId, "editable_by": *user.Id}, h.Db)
+	} else {
+		// the chip id when there is one, since the name can be changed in the iSpindel's settings
+		deviceId := "ispindel:" + payload.chipId()
+		if payload.chipId() == "" {
+			deviceId = "ispindel:" + payload.Name
+		}
+		sensor, err = worrywort.FindDeviceSensor(*user, deviceId, payload.Name, h.CreateSensors, h.Db)
+	}
+	if err == sql.ErrNoRows {
+		writeJSON(w, http.StatusBadRequest, iSpindelErrors{
+			NameErrors: []string{"No sensor matches this iSpindel's name or ID"}})
+		return
+	} else if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "Error saving measurement", http.StatusInternalServerError)
+		return
+	}
+
+	if h.SensorLimiter != nil {
+		allowed, wait, err := h.SensorLimiter.Allow(fmt.Sprintf("%d", *sensor.Id))
+		if err != nil {
+			log.Printf("%v", err)
+		} else if !allowed {
+			middleware.TooManyRequests(w, wait)
+			return
+		}
+	}
+
+	// the firmware does not send a time, so it was recorded now
+	recordedAt := time.Now().UTC().Round(time.Microsecond)
+	temperature, units, _ := deviceTemperature(*payload.Temperature, payload.TempUnits)
+	tm := &worrywort.TemperatureMeasurement{Sensor: sensor, SensorId: sensor.Id, CreatedBy: user, UserId: user.Id,
+		Temperature: temperature, Units: units, RecordedAt: recordedAt}
+	hm := &worrywort.HydrometerMeasurement{SensorId: sensor.Id, UserId: user.Id, Gravity: *payload.Gravity,
+		Angle: payload.Angle, Battery: payload.Battery, RSSI: payload.RSSI, IntervalSeconds: payload.Interval,
+		RecordedAt: recordedAt}
+	created, err := worrywort.InsertHydrometerReading(h.Db, tm, hm)
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "Error saving measurement", http.StatusInternalServerError)
+		return
+	} else if created {
+		h.Notifier.Created(tm)
+	}
+
+	writeJSON(w, http.StatusCreated, iSpindelResponse{SensorId: sensor.UUID, TemperatureMeasurementId: tm.Id,
+		HydrometerMeasurementId: hm.Id})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("%v", err)
+	}
+}
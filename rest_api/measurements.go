@@ -6,14 +6,15 @@ import (
 	"fmt"
 	// "github.com/davecgh/go-spew/spew"
 	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
 	"github.com/jmichalicek/worrywort-server-go/worrywort"
 	"github.com/jmoiron/sqlx"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
-	"time"
 	// "github.com/google/uuid"
 )
 
@@ -25,6 +26,9 @@ var temperatureUnits = map[string]worrywort.TemperatureUnitType{
 	"CELSIUS":    worrywort.CELSIUS,
 }
 
+// Limit on JSON request bodies.  Form bodies are already limited by http.Request.ParseForm().
+const maxJSONBodyBytes = 1 << 20
+
 type TemperatureMeasurementSerializer struct {
 	*worrywort.TemperatureMeasurement
 }
@@ -58,7 +62,20 @@ type TemperatureMeasurementForm struct {
 	// but that would require a bunch of extra nonsense which is not worthwhile for a specific use case
 	// ie. pass in a sqrl SELECT/set as a struct member and then execute it in the validation
 	user *worrywort.User
-	db   *sqlx.DB
+	// the token the request was authenticated with, if any.  A token bound to a sensor may only write for that sensor.
+	token *worrywort.AuthToken
+	db    *sqlx.DB
+	// optional sensors already looked up by sensor_id, shared by every form in a bulk upload so that each sensor is
+	// only looked up once rather than once per row.  A nil sensor is one which was not found.
+	sensors map[string]*worrywort.Sensor
+}
+
+// A form for saving a measurement as user, for other apis such as CoAP which validate measurements the same way.  token
+// may be nil.
+func NewTemperatureMeasurementForm(user *worrywort.User, token *worrywort.AuthToken, db *sqlx.DB) *TemperatureMeasurementForm {
+	return &TemperatureMeasurementForm{
+		CleanedMeasurement: &worrywort.TemperatureMeasurement{CreatedBy: user, UserId: user.Id},
+		db:                 db, user: user, token: token}
 }
 
 func (f *TemperatureMeasurementForm) IsValid() bool {
@@ -85,22 +102,31 @@ func (f *TemperatureMeasurementForm) Validate(values url.Values) {
 		f.MetricErrors = append(f.MetricErrors, fmt.Sprintf("%s is not a known metric", metric))
 	}
 
-	if recordedAt, err := time.Parse(time.RFC3339, timestamp); err == nil {
+	if recordedAt, err := worrywort.ParseTimestamp(timestamp); err == nil {
 		f.CleanedMeasurement.RecordedAt = recordedAt
 	} else {
 		isValid = false
-		f.RecordedAtErrors = append(f.RecordedAtErrors, "recorded_at must be a valid RFC3339 timestamp")
+		f.RecordedAtErrors = append(f.RecordedAtErrors,
+			"recorded_at must be a valid RFC3339 timestamp or seconds since the Unix epoch")
 	}
 
-	if sensor, err := worrywort.FindSensor(map[string]interface{}{"uuid": sensorUUID, "user_id": *f.user.Id}, f.db); err == nil {
-		f.CleanedMeasurement.Sensor = sensor
-		f.CleanedMeasurement.SensorId = sensor.Id
-	} else {
+	// sensor_id may be left off when the token is bound to a sensor
+	sensorParams := map[string]interface{}{"uuid": sensorUUID, "editable_by": *f.user.Id}
+	if sensorUUID == "" && f.token != nil && f.token.SensorId != nil {
+		sensorParams = map[string]interface{}{"id": *f.token.SensorId, "editable_by": *f.user.Id}
+	}
+	if sensor, err := f.findSensor(sensorUUID, sensorParams); err != nil {
 		isValid = false
 		if err != sql.ErrNoRows {
 			log.Printf("%v", err)
 		}
 		f.SensorIdErrors = append(f.SensorIdErrors, "Invalid sensor_id")
+	} else if f.token != nil && !f.token.AllowsSensor(*sensor) {
+		isValid = false
+		f.SensorIdErrors = append(f.SensorIdErrors, worrywort.ErrTokenNotAllowedForSensor.Error())
+	} else {
+		f.CleanedMeasurement.Sensor = sensor
+		f.CleanedMeasurement.SensorId = sensor.Id
 	}
 
 	if temperature, err := strconv.ParseFloat(val, 64); err == nil {
@@ -115,11 +141,70 @@ func (f *TemperatureMeasurementForm) Validate(values url.Values) {
 		f.CleanedMeasurement.Units = unitType
 	} else {
 		isValid = false
-		f.UnitsErrors = append(f.UnitsErrors, "%s is not a valid unit")
+		f.UnitsErrors = append(f.UnitsErrors, fmt.Sprintf("%s is not a valid unit", units))
 	}
 	f.valid = isValid
 }
 
+// Looks up the sensor for sensor_id, using f.sensors if it is set
+func (f *TemperatureMeasurementForm) findSensor(sensorUUID string, params map[string]interface{}) (
+	*worrywort.Sensor, error) {
+	if f.sensors == nil {
+		return worrywort.FindSensor(params, f.db)
+	}
+	if sensor, ok := f.sensors[sensorUUID]; ok {
+		if sensor == nil {
+			return nil, sql.ErrNoRows
+		}
+		return sensor, nil
+	}
+	sensor, err := worrywort.FindSensor(params, f.db)
+	if err == nil {
+		f.sensors[sensorUUID] = sensor
+	} else if err == sql.ErrNoRows {
+		f.sensors[sensorUUID] = nil
+	}
+	return sensor, err
+}
+
+// Gets the submitted values from a JSON object or a form, depending on the Content-Type, so that both are validated
+// the same way.  JSON values must be strings or numbers, with numbers kept as written.
+func requestValues(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != "application/json" {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return r.Form, nil
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes))
+	decoder.UseNumber()
+	body := map[string]interface{}{}
+	if err := decoder.Decode(&body); err != nil {
+		return nil, fmt.Errorf("Invalid JSON: %v", err)
+	}
+	return jsonObjectValues(body)
+}
+
+// The fields of a decoded JSON object as url.Values for TemperatureMeasurementForm.Validate().  The object must have
+// been decoded with json.Decoder.UseNumber() so that numbers are kept as written.
+func jsonObjectValues(body map[string]interface{}) (url.Values, error) {
+	values := url.Values{}
+	for k, v := range body {
+		switch v := v.(type) {
+		case string:
+			values.Set(k, v)
+		case json.Number:
+			values.Set(k, v.String())
+		case nil:
+		default:
+			return nil, fmt.Errorf("%s must be a string or number", k)
+		}
+	}
+	return values, nil
+}
+
 func (t *TemperatureMeasurementSerializer) MarshalJSON() ([]byte, error) {
 	// type Copy TemperatureMeasurementRest
 	return json.Marshal(&struct {
@@ -139,6 +224,9 @@ func (t *TemperatureMeasurementSerializer) MarshalJSON() ([]byte, error) {
 
 type MeasurementHandler struct {
 	Db *sqlx.DB
+	// Optional limit on how often each sensor may post measurements, so one runaway device cannot flood the db
+	SensorLimiter *ratelimit.Limiter
+	Notifier      worrywort.TemperatureMeasurementNotifier
 }
 
 func (h *MeasurementHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -164,13 +252,15 @@ func (h *MeasurementHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (h *MeasurementHandler) InsertMeasurement(w http.ResponseWriter, r *http.Request, user *worrywort.User) {
 	db := h.Db
-	if err := r.ParseForm(); err != nil {
+	values, err := requestValues(w, r)
+	if err != nil {
 		http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
 		return
 	}
 
-	form := TemperatureMeasurementForm{CleanedMeasurement: &worrywort.TemperatureMeasurement{CreatedBy: user, UserId: user.Id}, db: db, user: user}
-	form.Validate(r.Form)
+	token, _ := middleware.AuthTokenFromContext(r.Context())
+	form := NewTemperatureMeasurementForm(user, token, db)
+	form.Validate(values)
 	if !form.IsValid() {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusBadRequest)
@@ -181,15 +271,37 @@ func (h *MeasurementHandler) InsertMeasurement(w http.ResponseWriter, r *http.Re
 	}
 
 	m := form.CleanedMeasurement
-	if err := m.Save(db); err != nil {
+	if h.SensorLimiter != nil {
+		allowed, wait, err := h.SensorLimiter.Allow(fmt.Sprintf("%d", *m.SensorId))
+		if err != nil {
+			log.Printf("%v", err)
+		} else if !allowed {
+			middleware.TooManyRequests(w, wait)
+			return
+		}
+	}
+	// a retry of a measurement which was already saved gets the original back
+	status := http.StatusCreated
+	if err := m.Save(db); err == worrywort.ErrDuplicateTemperatureMeasurement {
+		status = http.StatusOK
+		if m.CreatedBy == nil {
+			if m.CreatedBy, err = worrywort.FindUser(map[string]interface{}{"id": *m.UserId}, db); err != nil {
+				log.Printf("%v", err)
+				http.Error(w, "Error saving measurement", http.StatusInternalServerError)
+				return
+			}
+		}
+	} else if err != nil {
 		log.Printf("%v", err)
 		http.Error(w, "Error saving measurement", http.StatusInternalServerError)
 		return
+	} else {
+		h.Notifier.Created(m)
 	}
 	serializer := &TemperatureMeasurementSerializer{m}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(serializer); err != nil {
 		panic(err)
 	}
@@ -10,9 +10,11 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	// "github.com/davecgh/go-spew/spew"
 	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
 	"github.com/jmichalicek/worrywort-server-go/worrywort"
 	"github.com/jmoiron/sqlx"
 	// "log"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -173,6 +175,33 @@ func TestMeasurementSerializer(t *testing.T) {
 	})
 }
 
+func TestTemperatureMeasurementFormSensorCache(t *testing.T) {
+	userId := int64(1)
+	sensorId := int64(2)
+	user := worrywort.User{Id: &userId}
+	sensor := worrywort.Sensor{Id: &sensorId, UUID: "cached"}
+	// no db, so anything not in the cache would panic
+	sensors := map[string]*worrywort.Sensor{"cached": &sensor, "missing": nil}
+	values := url.Values{"value": {"65.2"}, "metric": {"temperature"}, "units": {"FAHRENHEIT"},
+		"recorded_at": {"2019-04-21T13:00:00Z"}}
+
+	for _, tc := range []struct {
+		sensorUUID string
+		valid      bool
+	}{{"cached", true}, {"missing", false}} {
+		form := NewTemperatureMeasurementForm(&user, nil, nil)
+		form.sensors = sensors
+		values.Set("sensor_id", tc.sensorUUID)
+		form.Validate(values)
+		if form.IsValid() != tc.valid {
+			t.Errorf("%s: expected valid %v but got errors %v", tc.sensorUUID, tc.valid, form.SensorIdErrors)
+		}
+		if tc.valid && form.CleanedMeasurement.Sensor != &sensor {
+			t.Errorf("%s: expected the cached sensor but got %v", tc.sensorUUID, form.CleanedMeasurement.Sensor)
+		}
+	}
+}
+
 func TestMeasurementHandler(t *testing.T) {
 	db, err := setUpTestDb()
 	if err != nil {
@@ -265,6 +294,110 @@ func TestMeasurementHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("POST valid JSON", func(t *testing.T) {
+		body := fmt.Sprintf(`{"value": 65.2, "metric": "temperature", "sensor_id": "%s", "units": "FAHRENHEIT",
+			"recorded_at": 1555846293.32838}`, sensor.UUID)
+		req, _ := http.NewRequest("POST", "", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/json; charset=UTF-8")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.DefaultUserKey, &user))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected %d but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		cmpOpts := []cmp.Option{cmpopts.IgnoreFields(successResponse{}, "CreatedAt", "UpdatedAt", "Id")}
+		target := &successResponse{}
+		json.NewDecoder(w.Body).Decode(target)
+		expectedResponse := &successResponse{Temperature: 65.2, SensorId: sensor.UUID, Units: "FAHRENHEIT",
+			RecordedAt: time.Unix(1555846293, 328380000).UTC(), UserId: user.UUID}
+		if !cmp.Equal(expectedResponse, target, cmpOpts...) {
+			t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(expectedResponse, target, cmpOpts...))
+		}
+	})
+
+	t.Run("POST retry returns the original", func(t *testing.T) {
+		post := func(value string) (int, *successResponse) {
+			form := url.Values{"value": {value}, "metric": {"temperature"}, "sensor_id": {sensor.UUID},
+				"units": {"FAHRENHEIT"}, "recorded_at": {"2019-04-21T13:00:00Z"}}
+			req, _ := http.NewRequest("POST", "", strings.NewReader(form.Encode()))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			req = req.WithContext(context.WithValue(req.Context(), middleware.DefaultUserKey, &user))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			target := &successResponse{}
+			json.NewDecoder(w.Body).Decode(target)
+			return w.Code, target
+		}
+		code, original := post("65.2")
+		if code != http.StatusCreated {
+			t.Fatalf("Expected %d but got %d", http.StatusCreated, code)
+		}
+		code, retried := post("65.3")
+		if code != http.StatusOK {
+			t.Errorf("Expected %d but got %d", http.StatusOK, code)
+		}
+		if retried.Id != original.Id || retried.Temperature != 65.2 {
+			t.Errorf("Expected the original measurement %v but got %v", original, retried)
+		}
+	})
+
+	t.Run("POST JSON errors match form errors", func(t *testing.T) {
+		form := url.Values{"value": {"asdf"}, "metric": {"temperature"}, "sensor_id": {sensor.UUID},
+			"units": {"FAHRENHEIT"}, "recorded_at": {"yesterday"}}
+		formReq, _ := http.NewRequest("POST", "", strings.NewReader(form.Encode()))
+		formReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		jsonReq, _ := http.NewRequest("POST", "", strings.NewReader(fmt.Sprintf(
+			`{"value": "asdf", "metric": "temperature", "sensor_id": "%s", "units": "FAHRENHEIT",
+			"recorded_at": "yesterday"}`, sensor.UUID)))
+		jsonReq.Header.Add("Content-Type", "application/json")
+
+		responses := []string{}
+		for _, req := range []*http.Request{formReq, jsonReq} {
+			req = req.WithContext(context.WithValue(req.Context(), middleware.DefaultUserKey, &user))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected %d but got %d", http.StatusBadRequest, w.Code)
+			}
+			responses = append(responses, w.Body.String())
+		}
+		if responses[0] != responses[1] {
+			t.Errorf("Expected the same errors but got form: %s json: %s", responses[0], responses[1])
+		}
+	})
+
+	t.Run("POST invalid units", func(t *testing.T) {
+		form := url.Values{"value": {"65.2"}, "metric": {"temperature"}, "sensor_id": {sensor.UUID},
+			"units": {"KELVIN"}, "recorded_at": {"2019-04-21T13:00:00Z"}}
+		req, _ := http.NewRequest("POST", "", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.DefaultUserKey, &user))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %d but got %d", http.StatusBadRequest, w.Code)
+		}
+		errs := TemperatureMeasurementForm{}
+		json.NewDecoder(w.Body).Decode(&errs)
+		if expected := []string{"KELVIN is not a valid unit"}; !cmp.Equal(expected, errs.UnitsErrors) {
+			t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(expected, errs.UnitsErrors))
+		}
+	})
+
+	t.Run("POST invalid JSON", func(t *testing.T) {
+		for _, body := range []string{`{"value": `, `{"value": [65.2]}`, `[]`} {
+			req, _ := http.NewRequest("POST", "", strings.NewReader(body))
+			req.Header.Add("Content-Type", "application/json")
+			req = req.WithContext(context.WithValue(req.Context(), middleware.DefaultUserKey, &user))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected %d but got %d", body, http.StatusBadRequest, w.Code)
+			}
+		}
+	})
+
 	t.Run("POST unauthenticated", func(t *testing.T) {
 		req, _ := http.NewRequest("POST", "", nil)
 		w := httptest.NewRecorder()
@@ -298,4 +431,939 @@ func TestMeasurementHandler(t *testing.T) {
 
 		// TODO: make sure it did not save, validate the response errors
 	})
+
+	t.Run("POST with sensor bound token", func(t *testing.T) {
+		otherSensor := worrywort.Sensor{Name: "Other Sensor", UserId: user.Id}
+		if err := otherSensor.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		token, err := worrywort.GenerateSensorToken(user, *sensor.Id, worrywort.TOKEN_SCOPE_WRITE_TEMPS)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		var tests = []struct {
+			name     string
+			sensorId string
+			expected int
+		}{
+			{"implied sensor", "", http.StatusCreated},
+			{"bound sensor", sensor.UUID, http.StatusCreated},
+			{"other sensor", otherSensor.UUID, http.StatusBadRequest},
+		}
+		for i, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				form := url.Values{}
+				form.Add("value", "65.2")
+				form.Add("metric", "temperature")
+				form.Add("sensor_id", tc.sensorId)
+				form.Add("units", "FAHRENHEIT")
+				// each at a different time so that they are not duplicates of each other or "POST valid"
+				form.Add("recorded_at", time.Date(2019, 4, 21, 12, i, 33, 0, time.UTC).Format(time.RFC3339))
+				req, _ := http.NewRequest("POST", "", strings.NewReader(form.Encode()))
+				req.PostForm = form
+				req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+				ctx := req.Context()
+				ctx = context.WithValue(ctx, middleware.DefaultUserKey, &user)
+				ctx = context.WithValue(ctx, middleware.DefaultTokenKey, &token)
+				req = req.WithContext(ctx)
+
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				if w.Code != tc.expected {
+					t.Errorf("Expected %v, returned %v", tc.expected, w.Code)
+				}
+				if tc.expected == http.StatusCreated {
+					target := &successResponse{}
+					json.NewDecoder(w.Body).Decode(target)
+					if target.SensorId != sensor.UUID {
+						t.Errorf("Expected sensor_id %s, got %s", sensor.UUID, target.SensorId)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestBulkRows(t *testing.T) {
+	var tests = []struct {
+		name     string
+		body     string
+		expected int
+		valid    bool
+	}{
+		{"Array", `[{"value": 1}, {"value": 2}]`, 2, true},
+		{"NDJSON", "{\"value\": 1}\n\n{\"value\": 2}\r\n{\"value\": 3}\n", 3, true},
+		{"Invalid array", `[{"value": 1},`, 0, false},
+		{"Empty", "", 0, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := bulkRows([]byte(tc.body))
+			if (err == nil) != tc.valid {
+				t.Fatalf("Expected valid %v but got error %v", tc.valid, err)
+			}
+			if len(rows) != tc.expected {
+				t.Errorf("Expected %d rows but got %d", tc.expected, len(rows))
+			}
+		})
+	}
+}
+
+func TestBulkMeasurementHandler(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := worrywort.Sensor{Name: "Test Sensor", UserId: user.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	handler := BulkMeasurementHandler{Db: db}
+
+	post := func(body, contentType string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "", strings.NewReader(body))
+		req.Header.Add("Content-Type", contentType)
+		req = req.WithContext(context.WithValue(req.Context(), middleware.DefaultUserKey, &user))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	row := func(value, recordedAt string) string {
+		return fmt.Sprintf(`{"value": %s, "metric": "temperature", "sensor_id": "%s", "units": "FAHRENHEIT",
+			"recorded_at": %s}`, value, sensor.UUID, recordedAt)
+	}
+
+	var tests = []struct {
+		name        string
+		body        string
+		contentType string
+	}{
+		{"Array", "[" + strings.Join([]string{row("65.2", "1555846233"), row(`"warm"`, "1555846234"),
+			`"not an object"`, row("65.4", `"2019-04-21T11:30:35Z"`)}, ",") + "]", "application/json"},
+		{"NDJSON", strings.Join([]string{row("65.2", "1555846233"), row(`"warm"`, "1555846234"), `{"value": `,
+			row("65.4", `"2019-04-21T11:30:35Z"`)}, "\n"), "application/x-ndjson"},
+	}
+	// the NDJSON rows are the same measurements as the array, so the second upload is all duplicates of the first
+	firstIds := []string{}
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// newlines inside a row would split it for NDJSON
+			body := strings.Replace(tc.body, "\n\t\t\t", " ", -1)
+			w := post(body, tc.contentType)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			response := struct {
+				Accepted []struct {
+					Index     int    `json:"index"`
+					Id        string `json:"id"`
+					Duplicate bool   `json:"duplicate"`
+				} `json:"accepted"`
+				Errors []struct {
+					Index  int                 `json:"index"`
+					Errors map[string][]string `json:"errors"`
+				} `json:"errors"`
+			}{}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if len(response.Accepted) != 2 || response.Accepted[0].Index != 0 || response.Accepted[1].Index != 3 {
+				t.Errorf("Expected rows 0 and 3 to be accepted but got %v", response.Accepted)
+			}
+			if len(response.Errors) != 2 || response.Errors[0].Index != 1 || response.Errors[1].Index != 2 {
+				t.Fatalf("Expected errors for rows 1 and 2 but got %v", response.Errors)
+			}
+			if len(response.Errors[0].Errors["value"]) != 1 || len(response.Errors[1].Errors["row"]) != 1 {
+				t.Errorf("Expected a value error and a row error but got %v", response.Errors)
+			}
+			for j, accepted := range response.Accepted {
+				if _, err := worrywort.FindTemperatureMeasurement(
+					map[string]interface{}{"uuid": accepted.Id, "user_id": *user.Id}, db); err != nil {
+					t.Errorf("Accepted row %d not found in database: %v", accepted.Index, err)
+				}
+				if i == 0 {
+					firstIds = append(firstIds, accepted.Id)
+				} else if !accepted.Duplicate || accepted.Id != firstIds[j] {
+					t.Errorf("Expected row %d to be a duplicate of %s but got %v", accepted.Index, firstIds[j],
+						accepted)
+				}
+			}
+		})
+	}
+
+	t.Run("Too many rows", func(t *testing.T) {
+		rows := make([]string, maxBulkRows+1)
+		for i := range rows {
+			rows[i] = `{}`
+		}
+		w := post("["+strings.Join(rows, ",")+"]", "application/json")
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected %d but got %d", http.StatusRequestEntityTooLarge, w.Code)
+		}
+	})
+}
+
+func TestISpindelPayload(t *testing.T) {
+	var tests = []struct {
+		body        string
+		chipId      string
+		temperature float64
+		units       worrywort.TemperatureUnitType
+		valid       bool
+	}{
+		{`{"name": "iSpindel000", "ID": 1234567, "angle": 76.2, "temperature": 20.5, "temp_units": "C",
+			"battery": 4.1, "gravity": 1.052, "interval": 900, "RSSI": -71}`, "1234567", 20.5, worrywort.CELSIUS, true},
+		{`{"name": "iSpindel000", "ID": "abc", "temperature": 68.9, "temp_units": "F", "gravity": 1.052}`, "abc",
+			68.9, worrywort.FAHRENHEIT, true},
+		{`{"name": "iSpindel000", "temperature": 293.65, "temp_units": "K", "gravity": 1.052}`, "", 20.5,
+			worrywort.CELSIUS, true},
+		{`{"name": "iSpindel000", "temperature": 20.5, "temp_units": "R", "gravity": 1.052}`, "", 0,
+			worrywort.CELSIUS, false},
+		{`{"ID": 1234567, "temperature": 20.5}`, "1234567", 20.5, worrywort.CELSIUS, false},
+		{`{"temperature": 20.5, "gravity": 1.052}`, "", 20.5, worrywort.CELSIUS, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.body, func(t *testing.T) {
+			payload := iSpindelPayload{}
+			decoder := json.NewDecoder(strings.NewReader(tc.body))
+			decoder.UseNumber()
+			if err := decoder.Decode(&payload); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if payload.chipId() != tc.chipId {
+				t.Errorf("Expected chip id %q but got %q", tc.chipId, payload.chipId())
+			}
+			if _, valid := payload.validate(); valid != tc.valid {
+				t.Fatalf("Expected valid to be %v", tc.valid)
+			}
+			if !tc.valid {
+				return
+			}
+			temperature, units, _ := deviceTemperature(*payload.Temperature, payload.TempUnits)
+			if math.Abs(temperature-tc.temperature) > 0.0001 || units != tc.units {
+				t.Errorf("Expected %v %v but got %v %v", tc.temperature, tc.units, temperature, units)
+			}
+		})
+	}
+}
+
+func TestISpindelHandler(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	named := worrywort.Sensor{Name: "Named iSpindel", UserId: user.Id}
+	if err := named.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	post := func(handler *ISpindelHandler, body string) (*httptest.ResponseRecorder, *iSpindelResponse) {
+		req, _ := http.NewRequest("POST", "", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/json")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.DefaultUserKey, &user))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		response := &iSpindelResponse{}
+		json.Unmarshal(w.Body.Bytes(), response)
+		return w, response
+	}
+
+	t.Run("Unknown device without creating sensors", func(t *testing.T) {
+		w, _ := post(&ISpindelHandler{Db: db}, `{"name": "Unknown", "ID": 1, "temperature": 20.5, "gravity": 1.05}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %d but got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Claims a sensor by name", func(t *testing.T) {
+		body := `{"name": "Named iSpindel", "ID": 2, "angle": 60.5, "temperature": 68.9, "temp_units": "F",
+			"battery": 4.05, "gravity": 1.048, "interval": 900, "RSSI": -70}`
+		w, response := post(&ISpindelHandler{Db: db}, body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected %d but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		if response.SensorId != named.UUID {
+			t.Errorf("Expected sensor %s but got %s", named.UUID, response.SensorId)
+		}
+		if s, err := worrywort.FindSensor(map[string]interface{}{"uuid": named.UUID}, db); err != nil {
+			t.Fatalf("%v", err)
+		} else if s.DeviceId != "ispindel:2" {
+			t.Errorf("Expected the sensor to be claimed as ispindel:2 but got %q", s.DeviceId)
+		}
+		tm, err := worrywort.FindTemperatureMeasurement(
+			map[string]interface{}{"uuid": response.TemperatureMeasurementId, "user_id": *user.Id}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if tm.Temperature != 68.9 || tm.Units != worrywort.FAHRENHEIT || *tm.SensorId != *named.Id {
+			t.Errorf("Unexpected temperature measurement %v", tm)
+		}
+		hm, err := worrywort.FindHydrometerMeasurement(
+			map[string]interface{}{"id": response.HydrometerMeasurementId, "user_id": *user.Id}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if hm.Gravity != 1.048 || *hm.Angle != 60.5 || *hm.Battery != 4.05 || *hm.RSSI != -70 ||
+			*hm.IntervalSeconds != 900 || !hm.RecordedAt.Equal(tm.RecordedAt) {
+			t.Errorf("Unexpected hydrometer measurement %v", hm)
+		}
+
+		// renaming the iSpindel does not lose its sensor
+		w, response = post(&ISpindelHandler{Db: db}, `{"name": "Renamed", "ID": 2, "temperature": 20, "gravity": 1.04}`)
+		if w.Code != http.StatusCreated || response.SensorId != named.UUID {
+			t.Errorf("Expected sensor %s but got %d: %s", named.UUID, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Creates a sensor", func(t *testing.T) {
+		handler := &ISpindelHandler{Db: db, CreateSensors: true}
+		body := `{"name": "New iSpindel", "ID": 3, "temperature": 20.5, "temp_units": "C", "gravity": 1.05}`
+		w, first := post(handler, body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected %d but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		s, err := worrywort.FindSensor(map[string]interface{}{"uuid": first.SensorId, "user_id": *user.Id}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if s.Name != "New iSpindel" || s.DeviceId != "ispindel:3" {
+			t.Errorf("Unexpected sensor %v", s)
+		}
+		if _, second := post(handler, body); second.SensorId != first.SensorId {
+			t.Errorf("Expected the second measurement to use sensor %s but got %s", first.SensorId, second.SensorId)
+		}
+	})
+
+	t.Run("Does not use a team member's sensor", func(t *testing.T) {
+		teammate := worrywort.User{Email: "teammate@example.com", FullName: "Team Mate", Username: "teammate"}
+		if err := teammate.Save(db); err != nil {
+			t.Fatalf("failed to insert user: %s", err)
+		}
+		team, err := worrywort.CreateTeam("Brewers", teammate, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := team.SetMember(*user.Id, worrywort.TEAM_ROLE_BREWER, db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		// the teammate's iSpindels have the same name and chip id as the user's
+		byName := worrywort.Sensor{Name: "Shared iSpindel", UserId: teammate.Id, TeamId: team.Id}
+		if err := byName.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		byId := worrywort.Sensor{Name: "Other iSpindel", DeviceId: "ispindel:5", UserId: teammate.Id, TeamId: team.Id}
+		if err := byId.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		handler := &ISpindelHandler{Db: db, CreateSensors: true}
+		for _, body := range []string{`{"name": "Shared iSpindel", "ID": 4, "temperature": 20.5, "gravity": 1.05}`,
+			`{"name": "Mine", "ID": 5, "temperature": 20.5, "gravity": 1.05}`} {
+			w, response := post(handler, body)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("Expected %d but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+			}
+			s, err := worrywort.FindSensor(map[string]interface{}{"uuid": response.SensorId}, db)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if *s.UserId != *user.Id {
+				t.Errorf("Expected a new sensor for the user but got %v", s)
+			}
+		}
+		if s, err := worrywort.FindSensor(map[string]interface{}{"id": *byName.Id}, db); err != nil {
+			t.Fatalf("%v", err)
+		} else if s.DeviceId != "" {
+			t.Errorf("Expected the team member's sensor to not be claimed but it is %q", s.DeviceId)
+		}
+	})
+}
+
+func TestExcelTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No timezone data: %v", err)
+	}
+	var tests = []struct {
+		days     float64
+		loc      *time.Location
+		expected time.Time
+	}{
+		{43831, time.UTC, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{43831.5, time.UTC, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)},
+		// 2019-04-21 11:30:33, with the float not quite landing on the second
+		{43576.479548611, time.UTC, time.Date(2019, 4, 21, 11, 30, 33, 0, time.UTC)},
+		{43831.5, newYork, time.Date(2020, 1, 1, 17, 0, 0, 0, time.UTC)},
+		{43576.479548611, newYork, time.Date(2019, 4, 21, 15, 30, 33, 0, time.UTC)},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%v %s", tc.days, tc.loc), func(t *testing.T) {
+			if got := excelTime(tc.days, tc.loc); !got.Equal(tc.expected) {
+				t.Errorf("Expected %v but got %v", tc.expected, got.UTC())
+			}
+		})
+	}
+}
+
+func TestTiltTimepoint(t *testing.T) {
+	handler := &TiltHandler{}
+	for _, timepoint := range []string{"NaN", "Inf", "-Inf", "1e300", "109575", "0.5"} {
+		t.Run(timepoint, func(t *testing.T) {
+			values := url.Values{"Color": {"Red"}, "SG": {"1.052"}, "Temp": {"68.5"}, "Timepoint": {timepoint}}
+			if _, errs, ok := handler.parseReading(values); ok || len(errs.TimepointErrors) != 1 {
+				t.Errorf("Expected a Timepoint error but got %v", errs)
+			}
+		})
+	}
+	values := url.Values{"Color": {"Red"}, "SG": {"NaN"}, "Temp": {"Inf"}, "Timepoint": {"43576.479548611"}}
+	if _, errs, ok := handler.parseReading(values); ok || len(errs.GravityErrors) != 1 || len(errs.TempErrors) != 1 {
+		t.Errorf("Expected SG and Temp errors but got %v", errs)
+	}
+}
+
+func TestTiltHandler(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+
+	post := func(handler *TiltHandler, form url.Values) (*httptest.ResponseRecorder, *tiltResponse) {
+		req, _ := http.NewRequest("POST", "", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.DefaultUserKey, &user))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		response := &tiltResponse{}
+		json.Unmarshal(w.Body.Bytes(), response)
+		return w, response
+	}
+	reading := func(color, timepoint, beer string) url.Values {
+		return url.Values{"Color": {color}, "SG": {"1.052"}, "Temp": {"68.5"}, "Timepoint": {timepoint},
+			"Beer": {beer}, "Comment": {""}}
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		w, _ := post(&TiltHandler{Db: db, CreateSensors: true},
+			url.Values{"Color": {"PLAID"}, "SG": {"heavy"}, "Temp": {""}, "Timepoint": {"yesterday"}})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %d but got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+		}
+		errs := map[string][]string{}
+		json.Unmarshal(w.Body.Bytes(), &errs)
+		for _, k := range []string{"Color", "SG", "Temp", "Timepoint"} {
+			if len(errs[k]) != 1 {
+				t.Errorf("Expected an error for %s but got %v", k, errs)
+			}
+		}
+	})
+
+	t.Run("Unknown color without creating sensors", func(t *testing.T) {
+		w, _ := post(&TiltHandler{Db: db}, reading("Red", "43576.479548611", "Pale Ale"))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %d but got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Creates a sensor and batch", func(t *testing.T) {
+		handler := &TiltHandler{Db: db, CreateSensors: true}
+		w, response := post(handler, reading("Red", "43576.479548611", "Pale Ale"))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected %d but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		sensor, err := worrywort.FindSensor(map[string]interface{}{"uuid": response.SensorId, "user_id": *user.Id}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if sensor.Name != "Red Tilt" || sensor.DeviceId != "tilt:RED" {
+			t.Errorf("Unexpected sensor %v", sensor)
+		}
+		recordedAt := time.Date(2019, 4, 21, 11, 30, 33, 0, time.UTC)
+		association, err := worrywort.FindBatchSensorAssociation(
+			map[string]interface{}{"sensor_id": *sensor.Id, "disassociated_at": nil}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if association.Batch.UUID != response.BatchId || association.Batch.Name != "Pale Ale" ||
+			!association.AssociatedAt.Equal(recordedAt) {
+			t.Errorf("Unexpected association %v", association)
+		}
+		tm, err := worrywort.FindTemperatureMeasurement(
+			map[string]interface{}{"uuid": response.TemperatureMeasurementId, "user_id": *user.Id}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if tm.Temperature != 68.5 || tm.Units != worrywort.FAHRENHEIT || !tm.RecordedAt.Equal(recordedAt) {
+			t.Errorf("Unexpected temperature measurement %v", tm)
+		}
+		hm, err := worrywort.FindHydrometerMeasurement(
+			map[string]interface{}{"id": response.HydrometerMeasurementId, "user_id": *user.Id}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if hm.Gravity != 1.052 || !hm.RecordedAt.Equal(recordedAt) {
+			t.Errorf("Unexpected hydrometer measurement %v", hm)
+		}
+
+		// the next reading stays with the same sensor and batch
+		w, next := post(handler, reading("RED", "43576.48649", "Pale Ale"))
+		if w.Code != http.StatusCreated || next.SensorId != response.SensorId || next.BatchId != response.BatchId {
+			t.Errorf("Expected sensor %s and batch %s but got %d: %s", response.SensorId, response.BatchId, w.Code,
+				w.Body.String())
+		}
+		// and a retry returns the original
+		if _, retry := post(handler, reading("Red", "43576.479548611", "Pale Ale")); retry.TemperatureMeasurementId !=
+			response.TemperatureMeasurementId {
+			t.Errorf("Expected the original measurement %s but got %s", response.TemperatureMeasurementId,
+				retry.TemperatureMeasurementId)
+		}
+	})
+
+	t.Run("Does not use a team member's sensor", func(t *testing.T) {
+		teammate := worrywort.User{Email: "teammate@example.com", FullName: "Team Mate", Username: "teammate"}
+		if err := teammate.Save(db); err != nil {
+			t.Fatalf("failed to insert user: %s", err)
+		}
+		team, err := worrywort.CreateTeam("Brewers", teammate, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := team.SetMember(*user.Id, worrywort.TEAM_ROLE_BREWER, db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		// the teammate has their own Tilts of the same colors
+		blue := worrywort.Sensor{Name: "Blue Tilt", DeviceId: "tilt:BLUE", UserId: teammate.Id, TeamId: team.Id}
+		if err := blue.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		green := worrywort.Sensor{Name: "Green Tilt", UserId: teammate.Id, TeamId: team.Id}
+		if err := green.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		handler := &TiltHandler{Db: db, CreateSensors: true}
+		for _, color := range []string{"Blue", "Green"} {
+			w, response := post(handler, reading(color, "43576.479548611", "Stout"))
+			if w.Code != http.StatusCreated {
+				t.Fatalf("Expected %d but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+			}
+			s, err := worrywort.FindSensor(map[string]interface{}{"uuid": response.SensorId}, db)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if *s.UserId != *user.Id {
+				t.Errorf("Expected a new %s sensor for the user but got %v", color, s)
+			}
+		}
+		if s, err := worrywort.FindSensor(map[string]interface{}{"id": *green.Id}, db); err != nil {
+			t.Fatalf("%v", err)
+		} else if s.DeviceId != "" {
+			t.Errorf("Expected the team member's sensor to not be claimed but it is %q", s.DeviceId)
+		}
+	})
+}
+
+const testFermentrackPayload = `{
+	"api_key": "ignored",
+	"brewpi_devices": [{"internal_id": 1, "name": "Fermenter 1", "temp_format": "F", "beer_temp": 66.2,
+		"beer_setting": 66.0, "fridge_temp": 62.1, "fridge_setting": null, "room_temp": null, "control_mode": "b"}],
+	"gravity_sensors": [{"internal_id": 2, "name": "Red Tilt", "gravity": 1.041, "temp": 66.5, "temp_format": "F"},
+		{"internal_id": 3, "name": "Unplugged", "gravity": null, "temp": null, "temp_format": "F"}]
+}`
+
+func TestFermentrackProbes(t *testing.T) {
+	payload := fermentrackPayload{}
+	decoder := json.NewDecoder(strings.NewReader(testFermentrackPayload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		t.Fatalf("%v", err)
+	}
+	beer, fridge, gravity := 66.2, 62.1, 1.041
+	tilt := 66.5
+	expected := []fermentrackProbe{
+		{Key: "brewpi:1:beer", Name: "Fermenter 1 Beer", Temperature: &beer, TempFormat: "F"},
+		{Key: "brewpi:1:fridge", BeerKey: "brewpi:1:beer", Name: "Fermenter 1 Fridge", Temperature: &fridge, TempFormat: "F"},
+		{Key: "gravity:2", Name: "Red Tilt", Temperature: &tilt, TempFormat: "F", Gravity: &gravity},
+	}
+	if probes := payload.probes(); !cmp.Equal(expected, probes) {
+		t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(expected, probes))
+	}
+}
+
+func TestFermentrackHandler(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	// the beer probe claims the sensor the user already made for it
+	beerSensor := worrywort.Sensor{Name: "Fermenter 1 Beer", UserId: user.Id}
+	if err := beerSensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	post := func(handler *FermentrackHandler, token *worrywort.AuthToken) (*httptest.ResponseRecorder,
+		*fermentrackResponse) {
+		req, _ := http.NewRequest("POST", "", strings.NewReader(testFermentrackPayload))
+		req.Header.Add("Content-Type", "application/json")
+		ctx := context.WithValue(req.Context(), middleware.DefaultUserKey, &user)
+		if token != nil {
+			ctx = context.WithValue(ctx, middleware.DefaultTokenKey, token)
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		response := &fermentrackResponse{}
+		json.Unmarshal(w.Body.Bytes(), response)
+		return w, response
+	}
+
+	t.Run("Without creating sensors", func(t *testing.T) {
+		w, response := post(&FermentrackHandler{Db: db}, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if len(response.Accepted) != 1 || response.Accepted[0].SensorId != beerSensor.UUID {
+			t.Errorf("Expected only the beer probe to be accepted but got %v", response.Accepted)
+		}
+		if len(response.Errors) != 2 || response.Errors[0].Probe != "brewpi:1:fridge" ||
+			response.Errors[1].Probe != "gravity:2" {
+			t.Errorf("Expected errors for the fridge and gravity probes but got %v", response.Errors)
+		}
+	})
+
+	t.Run("Sensor-bound token", func(t *testing.T) {
+		token, err := worrywort.GenerateSensorToken(user, *beerSensor.Id, worrywort.TOKEN_SCOPE_WRITE_TEMPS)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		w, response := post(&FermentrackHandler{Db: db, CreateSensors: true}, &token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if len(response.Accepted) != 1 || response.Accepted[0].SensorId != beerSensor.UUID {
+			t.Errorf("Expected only the beer probe to be accepted but got %v", response.Accepted)
+		}
+		if len(response.Errors) != 2 ||
+			response.Errors[0].Errors[0] != worrywort.ErrTokenNotAllowedForSensor.Error() {
+			t.Errorf("Expected the other probes to be rejected but got %v", response.Errors)
+		}
+		// rejected before a sensor was made for them
+		_, err = worrywort.FindSensor(map[string]interface{}{"device_id": "fermentrack:brewpi:1:fridge"}, db)
+		if err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows for the fridge sensor but got %v", err)
+		}
+	})
+
+	t.Run("Creating sensors", func(t *testing.T) {
+		// the fridge sensor follows the beer sensor to its batch
+		batch := worrywort.Batch{UserId: user.Id, CreatedBy: &user, Name: "Test batch", BrewedDate: time.Now()}
+		if err := batch.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		associatedAt := time.Now().Add(-time.Hour)
+		if _, err := worrywort.AssociateBatchToSensor(&batch, &beerSensor, "Beer", &associatedAt, db); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		w, response := post(&FermentrackHandler{Db: db, CreateSensors: true}, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if len(response.Accepted) != 3 || len(response.Errors) != 0 {
+			t.Fatalf("Expected all 3 probes to be accepted but got %v", response)
+		}
+		sensorIds := map[string]bool{}
+		for _, accepted := range response.Accepted {
+			sensorIds[accepted.SensorId] = true
+		}
+		if len(sensorIds) != 3 || !sensorIds[beerSensor.UUID] {
+			t.Errorf("Expected each probe to have its own sensor but got %v", response.Accepted)
+		}
+
+		fridge := response.Accepted[1]
+		tm, err := worrywort.FindTemperatureMeasurement(
+			map[string]interface{}{"uuid": fridge.TemperatureMeasurementId, "user_id": *user.Id}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if tm.Temperature != 62.1 || tm.Units != worrywort.FAHRENHEIT {
+			t.Errorf("Unexpected fridge measurement %v", tm)
+		}
+		if fridge.BatchId != batch.UUID {
+			t.Errorf("Expected the fridge sensor to be associated with batch %s but got %s", batch.UUID,
+				fridge.BatchId)
+		}
+		gravity := response.Accepted[2]
+		if hm, err := worrywort.FindHydrometerMeasurement(
+			map[string]interface{}{"id": gravity.HydrometerMeasurementId, "user_id": *user.Id}, db); err != nil {
+			t.Fatalf("%v", err)
+		} else if hm.Gravity != 1.041 {
+			t.Errorf("Unexpected hydrometer measurement %v", hm)
+		}
+	})
+
+	t.Run("Rate limited", func(t *testing.T) {
+		limiter := &ratelimit.Limiter{Store: ratelimit.NewMemoryStore(),
+			Limit: ratelimit.Limit{Rate: 0.1, Burst: 1}, Prefix: "sensor:"}
+		handler := &FermentrackHandler{Db: db, SensorLimiter: limiter}
+		if w, _ := post(handler, nil); w.Code != http.StatusOK {
+			t.Fatalf("Expected %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		w, _ := post(handler, nil)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected %d with Retry-After but got %d %v", http.StatusTooManyRequests, w.Code, w.Header())
+		}
+	})
+}
+
+func TestDeviceAuthorizationHandlers(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort",
+		IsActive: true}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+
+	codeHandler := &DeviceAuthorizationHandler{Db: db, VerificationURI: "https://example.com/device"}
+	tokenHandler := &DeviceTokenHandler{Db: db}
+
+	post := func(handler http.Handler, form url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(codeHandler, url.Values{"client_id": {"esp32-thermometer"}, "name": {"Chamber"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	codeResponse := deviceAuthorizationResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&codeResponse); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if codeResponse.VerificationURIComplete !=
+		"https://example.com/device?user_code="+url.QueryEscape(codeResponse.UserCode) {
+		t.Errorf("Unexpected verification_uri_complete %s", codeResponse.VerificationURIComplete)
+	}
+
+	tokenForm := url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {codeResponse.DeviceCode},
+		"client_id": {"esp32-thermometer"}}
+
+	t.Run("Pending", func(t *testing.T) {
+		w := post(tokenHandler, tokenForm)
+		expected := oauthErrorResponse{Error: "authorization_pending"}
+		actual := oauthErrorResponse{}
+		json.NewDecoder(w.Body).Decode(&actual)
+		if w.Code != http.StatusBadRequest || expected != actual {
+			t.Errorf("Expected %d %v but got %d %v", http.StatusBadRequest, expected, w.Code, actual)
+		}
+	})
+
+	t.Run("Unsupported grant type", func(t *testing.T) {
+		w := post(tokenHandler, url.Values{"grant_type": {"password"}})
+		expected := oauthErrorResponse{Error: "unsupported_grant_type"}
+		actual := oauthErrorResponse{}
+		json.NewDecoder(w.Body).Decode(&actual)
+		if w.Code != http.StatusBadRequest || expected != actual {
+			t.Errorf("Expected %d %v but got %d %v", http.StatusBadRequest, expected, w.Code, actual)
+		}
+	})
+
+	t.Run("Approved", func(t *testing.T) {
+		sensor, err := worrywort.ApproveDeviceCode(codeResponse.UserCode, user, "", db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := db.Exec(`UPDATE oauth_device_codes SET last_polled_at = NULL`); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		w := post(tokenHandler, tokenForm)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		actual := deviceTokenResponse{}
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if actual.SensorId != sensor.UUID || actual.TokenType != "Bearer" || actual.Scope != deviceTokenScope {
+			t.Errorf("Unexpected response %v", actual)
+		}
+		if _, err := worrywort.AuthenticateUserByToken(actual.AccessToken, db); err != nil {
+			t.Errorf("Returned access token does not authenticate: %v", err)
+		}
+	})
+}
+
+func TestParseInfluxLine(t *testing.T) {
+	ts := time.Date(2019, 4, 21, 11, 30, 33, 0, time.UTC)
+	var tests = []struct {
+		name      string
+		line      string
+		precision time.Duration
+		expected  influxPoint
+		valid     bool
+	}{
+		{"Tags and timestamp", `temperature,sensor_id=abc,units=FAHRENHEIT value=65.2 1555846233000000000`,
+			time.Nanosecond, influxPoint{Measurement: "temperature",
+				Tags:      map[string]string{"sensor_id": "abc", "units": "FAHRENHEIT"},
+				Fields:    []influxField{{Key: "value", Value: "65.2", Numeric: true}},
+				Timestamp: &ts}, true},
+		{"Seconds", `temperature value=65i 1555846233`, time.Second, influxPoint{Measurement: "temperature",
+			Tags: map[string]string{}, Fields: []influxField{{Key: "value", Value: "65", Numeric: true}},
+			Timestamp: &ts}, true},
+		{"No timestamp", `my\ sensor,room=brew\,house temperature=18.4,note="in the \"cellar\""`, time.Nanosecond,
+			influxPoint{Measurement: "my sensor", Tags: map[string]string{"room": "brew,house"},
+				Fields: []influxField{{Key: "temperature", Value: "18.4", Numeric: true},
+					{Key: "note", Value: `in the "cellar"`}}}, true},
+		{"String with spaces", `temperature note="a, b=c d",value=1 1555846233`, time.Second,
+			influxPoint{Measurement: "temperature", Tags: map[string]string{},
+				Fields:    []influxField{{Key: "note", Value: "a, b=c d"}, {Key: "value", Value: "1", Numeric: true}},
+				Timestamp: &ts}, true},
+		{"No fields", `temperature,sensor_id=abc`, time.Nanosecond, influxPoint{}, false},
+		{"Bad field", `temperature value=warm`, time.Nanosecond, influxPoint{}, false},
+		{"Infinite", `temperature value=inf`, time.Nanosecond, influxPoint{}, false},
+		{"Bad timestamp", `temperature value=1 yesterday`, time.Nanosecond, influxPoint{}, false},
+		{"Out of range", `temperature value=1 9223372036854775807`, time.Second, influxPoint{}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			point, err := parseInfluxLine(tc.line, tc.precision)
+			if (err == nil) != tc.valid {
+				t.Fatalf("Expected valid %v but got error %v", tc.valid, err)
+			}
+			if tc.valid && !cmp.Equal(tc.expected, point) {
+				t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(tc.expected, point))
+			}
+		})
+	}
+}
+
+func TestInfluxWriteHandler(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := worrywort.User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := worrywort.Sensor{Name: "Test Sensor", UserId: user.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	handler := InfluxWriteHandler{Db: db}
+
+	post := func(query, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/influx/write?"+query, strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), middleware.DefaultUserKey, &user))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	find := func(recordedAt time.Time) (*worrywort.TemperatureMeasurement, error) {
+		return worrywort.FindTemperatureMeasurement(
+			map[string]interface{}{"sensor_id": *sensor.Id, "recorded_at": recordedAt, "user_id": *user.Id}, db)
+	}
+
+	t.Run("Writes each field", func(t *testing.T) {
+		body := strings.Join([]string{
+			"# comment",
+			fmt.Sprintf("temperature,sensor_id=%s,units=FAHRENHEIT value=65.2 1555846233000", sensor.UUID),
+			"",
+			fmt.Sprintf("%s temperature=18.4 1555846234000", sensor.UUID),
+		}, "\n")
+		w := post("precision=ms", body)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected %d but got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		for _, expected := range []worrywort.TemperatureMeasurement{
+			{Temperature: 65.2, Units: worrywort.FAHRENHEIT, RecordedAt: time.Unix(1555846233, 0)},
+			{Temperature: 18.4, Units: worrywort.CELSIUS, RecordedAt: time.Unix(1555846234, 0)},
+		} {
+			saved, err := find(expected.RecordedAt)
+			if err != nil {
+				t.Fatalf("Expected measurement at %v not found in database: %v", expected.RecordedAt, err)
+			}
+			if saved.Temperature != expected.Temperature || saved.Units != expected.Units {
+				t.Errorf("Expected %v but got %v", expected, saved)
+			}
+		}
+
+		// Telegraf resends a batch it is not sure was written
+		if w := post("precision=ms", body); w.Code != http.StatusNoContent {
+			t.Errorf("Expected %d but got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Partial write", func(t *testing.T) {
+		body := strings.Join([]string{
+			fmt.Sprintf("temperature,sensor_id=%s value=20.5 1555846235", sensor.UUID),
+			fmt.Sprintf("climate,sensor_id=%s temperature=20.5,humidity=40 1555846236", sensor.UUID),
+			"temperature value=",
+		}, "\n")
+		w := post("precision=s", body)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %d but got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+		}
+		response := struct {
+			Error  string `json:"error"`
+			Errors []struct {
+				Line   int                 `json:"line"`
+				Errors map[string][]string `json:"errors"`
+			} `json:"errors"`
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !strings.HasPrefix(response.Error, "partial write") || len(response.Errors) != 2 ||
+			response.Errors[0].Line != 2 || len(response.Errors[0].Errors["metric"]) != 1 ||
+			response.Errors[1].Line != 3 || len(response.Errors[1].Errors["line"]) != 1 {
+			t.Errorf("Unexpected errors %v", response)
+		}
+		for _, ts := range []int64{1555846235, 1555846236} {
+			if _, err := find(time.Unix(ts, 0)); err != nil {
+				t.Errorf("Expected measurement at %d not found in database: %v", ts, err)
+			}
+		}
+	})
+
+	t.Run("Invalid precision", func(t *testing.T) {
+		if w := post("precision=fortnight", "temperature value=1"); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %d but got %d", http.StatusBadRequest, w.Code)
+		}
+	})
 }
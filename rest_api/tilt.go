@@ -0,0 +1,196 @@
+package rest_api
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmichalicek/worrywort-server-go/middleware"
+	"github.com/jmichalicek/worrywort-server-go/ratelimit"
+	"github.com/jmichalicek/worrywort-server-go/worrywort"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Tilt colors, each of which is a separate hydrometer that can be in use at once
+var tiltColors = map[string]bool{"RED": true, "GREEN": true, "BLACK": true, "PURPLE": true, "ORANGE": true,
+	"BLUE": true, "YELLOW": true, "PINK": true}
+
+// Accepts readings from the Tilt app or a TiltPi configured with this endpoint as its "Cloud URL".  They post form
+// data with `Color`, `SG`, `Temp` in Fahrenheit, `Timepoint` as an Excel date, and `Beer`.  Each color is matched to
+// one of the user's sensors, see worrywort.FindDeviceSensor(), and the sensor is associated with the user's batch named
+// by `Beer`, see worrywort.EnsureBatchSensorAssociation().  The URL cannot have headers, so the token is part of the
+// path as it is for ISpindelHandler.
+type TiltHandler struct {
+	Db *sqlx.DB
+	// Make a sensor for a Tilt color which does not match one yet, rather than rejecting its readings
+	CreateSensors bool
+	// The timezone of the device posting readings.  Timepoint is the device's local time without an offset.
+	// Defaults to UTC.
+	Location      *time.Location
+	SensorLimiter *ratelimit.Limiter
+	Notifier      worrywort.TemperatureMeasurementNotifier
+}
+
+// A Tilt reading from the form data after it has been validated
+type tiltReading struct {
+	Color       string
+	Gravity     float64
+	Temperature float64
+	RecordedAt  time.Time
+	Beer        string
+}
+
+// Field errors, in the same style as TemperatureMeasurementForm
+type tiltErrors struct {
+	ColorErrors     []string `json:"Color,omitempty"`
+	GravityErrors   []string `json:"SG,omitempty"`
+	TempErrors      []string `json:"Temp,omitempty"`
+	TimepointErrors []string `json:"Timepoint,omitempty"`
+}
+
+type tiltResponse struct {
+	SensorId                 string `json:"sensor_id"`
+	BatchId                  string `json:"batch_id,omitempty"`
+	TemperatureMeasurementId string `json:"temperature_measurement_id"`
+	HydrometerMeasurementId  string `json:"hydrometer_measurement_id"`
+}
+
+func (h *TiltHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, err := middleware.UserFromContext(r.Context())
+	if u == nil || err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		h.InsertMeasurement(w, r, u)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// The Excel date for 2200-01-01.  Later timepoints are refused so that a garbage number cannot overflow excelTime.
+const maxExcelDays = 109575
+
+// Converts an Excel date, the number of days since 1899-12-30 with the time of day as the fraction, to a time in
+// loc.  It is rounded to the second since that is all the precision Tilt sends, which keeps retries identical.
+func excelTime(days float64, loc *time.Location) time.Time {
+	whole := math.Floor(days)
+	seconds := int(math.Round((days - whole) * 24 * 60 * 60))
+	// time.Date normalizes the overflowing day and seconds, keeping the wall clock time across DST changes
+	return time.Date(1899, time.December, 30+int(whole), 0, 0, seconds, 0, loc)
+}
+
+func (h *TiltHandler) parseReading(values url.Values) (*tiltReading, tiltErrors, bool) {
+	errs := tiltErrors{}
+	valid := true
+	reading := &tiltReading{Color: strings.ToUpper(strings.TrimSpace(values.Get("Color"))),
+		Beer: strings.TrimSpace(values.Get("Beer"))}
+	if !tiltColors[reading.Color] {
+		errs.ColorErrors = append(errs.ColorErrors, fmt.Sprintf("%s is not a Tilt color", values.Get("Color")))
+		valid = false
+	}
+
+	var err error
+	if reading.Gravity, err = strconv.ParseFloat(values.Get("SG"), 64); err != nil ||
+		math.IsInf(reading.Gravity, 0) || math.IsNaN(reading.Gravity) {
+		errs.GravityErrors = append(errs.GravityErrors, "SG must be a number")
+		valid = false
+	}
+	if reading.Temperature, err = strconv.ParseFloat(values.Get("Temp"), 64); err != nil ||
+		math.IsInf(reading.Temperature, 0) || math.IsNaN(reading.Temperature) {
+		errs.TempErrors = append(errs.TempErrors, "Temp must be a number")
+		valid = false
+	}
+
+	loc := h.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	// the days since 1900 should be more than plenty to reject anything which is not an Excel date.  Written so that
+	// NaN fails the comparison too.
+	if timepoint, err := strconv.ParseFloat(values.Get("Timepoint"), 64); err != nil ||
+		!(timepoint >= 1 && timepoint < maxExcelDays) {
+		errs.TimepointErrors = append(errs.TimepointErrors, "Timepoint must be an Excel date")
+		valid = false
+	} else {
+		reading.RecordedAt = excelTime(timepoint, loc).UTC()
+	}
+	return reading, errs, valid
+}
+
+func (h *TiltHandler) InsertMeasurement(w http.ResponseWriter, r *http.Request, user *worrywort.User) {
+	values, err := requestValues(w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+		return
+	}
+	reading, errs, ok := h.parseReading(values)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	token, _ := middleware.AuthTokenFromContext(r.Context())
+	var sensor *worrywort.Sensor
+	if token != nil && token.SensorId != nil {
+		sensor, err = worrywort.FindSensor(
+			map[string]interface{}{"id": *token.SensorId, "editable_by": *user.Id}, h.Db)
+	} else {
+		name := strings.Title(strings.ToLower(reading.Color)) + " Tilt"
+		sensor, err = worrywort.FindDeviceSensor(*user, "tilt:"+reading.Color, name, h.CreateSensors, h.Db)
+	}
+	if err == sql.ErrNoRows {
+		writeJSON(w, http.StatusBadRequest, tiltErrors{ColorErrors: []string{"No sensor matches this Tilt's color"}})
+		return
+	} else if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "Error saving measurement", http.StatusInternalServerError)
+		return
+	}
+
+	if h.SensorLimiter != nil {
+		allowed, wait, err := h.SensorLimiter.Allow(fmt.Sprintf("%d", *sensor.Id))
+		if err != nil {
+			log.Printf("%v", err)
+		} else if !allowed {
+			middleware.TooManyRequests(w, wait)
+			return
+		}
+	}
+
+	response := tiltResponse{SensorId: sensor.UUID}
+	// associate before saving so that the measurement is part of the batch from its first reading
+	if reading.Beer != "" {
+		association, err := worrywort.EnsureBatchSensorAssociation(*user, sensor, reading.Beer, reading.RecordedAt,
+			h.Db)
+		if err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Error saving measurement", http.StatusInternalServerError)
+			return
+		}
+		response.BatchId = association.Batch.UUID
+	}
+
+	tm := &worrywort.TemperatureMeasurement{Sensor: sensor, SensorId: sensor.Id, CreatedBy: user, UserId: user.Id,
+		Temperature: reading.Temperature, Units: worrywort.FAHRENHEIT, RecordedAt: reading.RecordedAt}
+	hm := &worrywort.HydrometerMeasurement{SensorId: sensor.Id, UserId: user.Id, Gravity: reading.Gravity,
+		RecordedAt: reading.RecordedAt}
+	created, err := worrywort.InsertHydrometerReading(h.Db, tm, hm)
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "Error saving measurement", http.StatusInternalServerError)
+		return
+	} else if created {
+		h.Notifier.Created(tm)
+	}
+
+	response.TemperatureMeasurementId = tm.Id
+	response.HydrometerMeasurementId = hm.Id
+	writeJSON(w, http.StatusCreated, response)
+}
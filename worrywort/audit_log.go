@@ -0,0 +1,182 @@
+package worrywort
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/elgris/sqrl"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+	"reflect"
+	"time"
+)
+
+// An append-only log of who did what, to what, and from where.  Entries are only ever inserted, the table refuses
+// updates and deletes.
+
+// Actions
+const (
+	AUDIT_ACTION_CREATE                 = "create"
+	AUDIT_ACTION_UPDATE                 = "update"
+	AUDIT_ACTION_LOGIN                  = "login"
+	AUDIT_ACTION_LOGIN_FAILED           = "login_failed"
+	AUDIT_ACTION_PASSWORD_CHANGE        = "password_change"
+	AUDIT_ACTION_PASSWORD_RESET_REQUEST = "password_reset_request"
+	AUDIT_ACTION_PASSWORD_RESET         = "password_reset"
+	AUDIT_ACTION_TOTP_ENROLL            = "totp_enroll"
+	AUDIT_ACTION_TOTP_ENABLE            = "totp_enable"
+	AUDIT_ACTION_TOTP_DISABLE           = "totp_disable"
+	AUDIT_ACTION_DEVICE_APPROVE         = "device_approve"
+	AUDIT_ACTION_DEVICE_DENY            = "device_deny"
+	AUDIT_ACTION_SET_ACTIVE             = "set_active"
+	AUDIT_ACTION_RESET_TOKENS           = "reset_tokens"
+	AUDIT_ACTION_TEAM_MEMBER_SET        = "team_member_set"
+	AUDIT_ACTION_TEAM_MEMBER_REMOVE     = "team_member_remove"
+	AUDIT_ACTION_REVOKE                 = "revoke"
+	AUDIT_ACTION_IMPERSONATE_START      = "impersonate_start"
+	AUDIT_ACTION_IMPERSONATE_END        = "impersonate_end"
+)
+
+// Entity types
+const (
+	AUDIT_ENTITY_AUTH_TOKEN               = "auth_token"
+	AUDIT_ENTITY_BATCH                    = "batch"
+	AUDIT_ENTITY_BATCH_SENSOR_ASSOCIATION = "batch_sensor_association"
+	AUDIT_ENTITY_BATCH_SHARE_LINK         = "batch_share_link"
+	AUDIT_ENTITY_DEVICE_CODE              = "device_code"
+	AUDIT_ENTITY_SENSOR                   = "sensor"
+	AUDIT_ENTITY_SENSOR_KEY               = "sensor_key"
+	AUDIT_ENTITY_TEAM                     = "team"
+	AUDIT_ENTITY_TEMPERATURE_MEASUREMENT  = "temperature_measurement"
+	AUDIT_ENTITY_USER                     = "user"
+)
+
+type AuditLogEntry struct {
+	Id *int64 `db:"id"`
+	// The user who acted.  For logins, the user whose account was logged in to, or attempted.
+	UserId  *int64 `db:"user_id"`
+	TokenId string `db:"token_id"` // the AuthToken used, if any
+	// The admin who was acting as UserId, if the action was taken while impersonating
+	ImpersonatorId *int64 `db:"impersonator_id"`
+	Action         string `db:"action"`
+	EntityType     string `db:"entity_type"`
+	// Whatever id the API exposes the entity by, usually its uuid
+	EntityId  string         `db:"entity_id"`
+	Changes   types.JSONText `db:"changes"` // see AuditChanges
+	IP        string         `db:"ip"`
+	CreatedAt time.Time      `db:"created_at"`
+}
+
+func (e AuditLogEntry) queryColumns() []string {
+	return []string{"id", "user_id", "token_id", "impersonator_id", "action", "entity_type", "entity_id", "changes", "ip", "created_at"}
+}
+
+// Inserts the entry.  Entries cannot be changed once saved.
+func (e *AuditLogEntry) Save(db *sqlx.DB) error {
+	if e.Id != nil {
+		return nil
+	}
+	if len(e.Changes) == 0 {
+		e.Changes = types.JSONText("{}")
+	}
+	query := db.Rebind(`INSERT INTO audit_log (user_id, token_id, impersonator_id, action, entity_type, entity_id,
+		changes, ip) VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id, created_at`)
+	return db.QueryRow(query, e.UserId, e.TokenId, e.ImpersonatorId, e.Action, e.EntityType, e.EntityId, e.Changes, e.IP).Scan(
+		&e.Id, &e.CreatedAt)
+}
+
+// Top level fields of v as JSON.  Nested objects such as a Batch's CreatedBy are left out since the related entity's
+// id is its own field.
+func auditFields(v interface{}) (map[string]json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return fields, nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+	for k, field := range fields {
+		if bytes.HasPrefix(field, []byte("{")) {
+			delete(fields, k)
+		}
+	}
+	return fields, nil
+}
+
+// Builds Changes from an entity before and after it was changed.  Either may be nil, such as before for a newly
+// created entity.  Only fields which differ are included, as {"Field": {"before": ..., "after": ...}}.  Fields are
+// named as they marshal to JSON, so fields tagged `json:"-"` such as User.Password are never recorded.
+func AuditChanges(before, after interface{}) (types.JSONText, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	type change struct {
+		Before json.RawMessage `json:"before"`
+		After  json.RawMessage `json:"after"`
+	}
+	null := json.RawMessage("null")
+	changes := map[string]change{}
+	// a field missing from one side, such as every field when creating, is treated as null
+	for k, v := range afterFields {
+		old, ok := beforeFields[k]
+		if !ok {
+			old = null
+		}
+		if !bytes.Equal(old, v) {
+			changes[k] = change{Before: old, After: v}
+		}
+	}
+	for k, v := range beforeFields {
+		if _, ok := afterFields[k]; !ok && !bytes.Equal(v, null) {
+			changes[k] = change{Before: v, After: null}
+		}
+	}
+	encoded, err := json.Marshal(changes)
+	return types.JSONText(encoded), err
+}
+
+func buildAuditLogQuery(params map[string]interface{}) *sqrl.SelectBuilder {
+	query := sqrl.Select().From("audit_log a")
+	for _, k := range []string{"user_id", "action", "entity_type", "entity_id"} {
+		if v, ok := params[k]; ok {
+			query = query.Where(sqrl.Eq{fmt.Sprintf("a.%s", k): v})
+		}
+	}
+	if v, ok := params["since"]; ok {
+		query = query.Where(sqrl.GtOrEq{"a.created_at": v})
+	}
+	if v, ok := params["until"]; ok {
+		query = query.Where(sqrl.Lt{"a.created_at": v})
+	}
+	if v, ok := params["limit"]; ok {
+		query = query.Limit(uint64(v.(int)))
+	}
+	if v, ok := params["offset"]; ok {
+		query = query.Offset(uint64(v.(int)))
+	}
+	for _, k := range (AuditLogEntry{}).queryColumns() {
+		query = query.Column(fmt.Sprintf("a.%s", k))
+	}
+	return query.OrderBy("a.created_at DESC", "a.id DESC")
+}
+
+// Returns audit log entries, newest first.  Accepts `user_id`, `action`, `entity_type`, `entity_id`, `since` and
+// `until` as time.Time, `limit`, and `offset`.
+func FindAuditLogEntries(params map[string]interface{}, db *sqlx.DB) ([]*AuditLogEntry, error) {
+	entries := []*AuditLogEntry{}
+	query, values, err := buildAuditLogQuery(params).ToSql()
+	if err == nil {
+		err = db.Select(&entries, db.Rebind(query), values...)
+	}
+	return entries, err
+}
@@ -0,0 +1,119 @@
+package worrywort
+
+import (
+	"encoding/json"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+	"time"
+)
+
+func TestAuditChanges(t *testing.T) {
+	userId := int64(1)
+	before := Sensor{UUID: "abc", Name: "Old Name", UserId: &userId, CreatedBy: &User{Email: "user@example.com"}}
+	after := before
+	after.Name = "New Name"
+
+	var tests = []struct {
+		name     string
+		before   interface{}
+		after    interface{}
+		expected string
+	}{
+		{"Only changed fields", before, after, `{"Name":{"before":"Old Name","after":"New Name"}}`},
+		{"Nothing changed", before, before, `{}`},
+		{"Nil pointer", (*Sensor)(nil), nil, `{}`},
+		{"Created", nil, Sensor{Name: "New Name"},
+			`{"CreatedAt":{"before":null,"after":"0001-01-01T00:00:00Z"},"DeviceId":{"before":null,"after":""},` +
+				`"Name":{"before":null,"after":"New Name"},"UUID":{"before":null,"after":""},` +
+				`"UpdatedAt":{"before":null,"after":"0001-01-01T00:00:00Z"}}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			changes, err := AuditChanges(tc.before, tc.after)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if string(changes) != tc.expected {
+				t.Errorf("Expected: %s\nGot: %s", tc.expected, changes)
+			}
+		})
+	}
+
+	t.Run("Fields not marshalled are left out", func(t *testing.T) {
+		changes, err := AuditChanges(User{Password: "old"}, User{Password: "new"})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if string(changes) != `{}` {
+			t.Errorf("Expected no changes but got: %s", changes)
+		}
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort", IsActive: true}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	changes, _ := AuditChanges(nil, Sensor{Name: "Sensor"})
+	entry := AuditLogEntry{UserId: user.Id, TokenId: "token", Action: AUDIT_ACTION_CREATE,
+		EntityType: AUDIT_ENTITY_SENSOR, EntityId: "sensor-uuid", Changes: changes, IP: "192.0.2.1"}
+	if err := entry.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	other := AuditLogEntry{UserId: user.Id, Action: AUDIT_ACTION_LOGIN, EntityType: AUDIT_ENTITY_AUTH_TOKEN}
+	if err := other.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	t.Run("Find by entity", func(t *testing.T) {
+		entries, err := FindAuditLogEntries(map[string]interface{}{"user_id": *user.Id,
+			"entity_type": AUDIT_ENTITY_SENSOR, "entity_id": "sensor-uuid"}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(entries) != 1 || *entries[0].Id != *entry.Id {
+			t.Fatalf("Unexpected entries: %v", entries)
+		}
+		var expected, actual interface{}
+		json.Unmarshal(changes, &expected)
+		json.Unmarshal(entries[0].Changes, &actual)
+		if !cmp.Equal(expected, actual) {
+			t.Errorf("Changes did not match: %s", cmp.Diff(expected, actual))
+		}
+	})
+
+	t.Run("Find by time", func(t *testing.T) {
+		entries, err := FindAuditLogEntries(map[string]interface{}{"user_id": *user.Id,
+			"since": time.Now().Add(-time.Hour), "until": time.Now().Add(time.Hour)}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("Expected 2 entries but got %d", len(entries))
+		}
+		entries, err = FindAuditLogEntries(map[string]interface{}{"user_id": *user.Id,
+			"since": time.Now().Add(time.Hour)}, db)
+		if err != nil || len(entries) != 0 {
+			t.Errorf("Expected no entries but got %v, %v", entries, err)
+		}
+	})
+
+	t.Run("Append only", func(t *testing.T) {
+		tx, err := db.Beginx()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(tx.Rebind(`UPDATE audit_log SET action = ? WHERE id = ?`), "changed",
+			*entry.Id); err == nil {
+			t.Errorf("Expected updating an entry to fail")
+		}
+	})
+}
@@ -2,20 +2,22 @@ package worrywort
 
 import (
 	"crypto/sha512"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
 	"errors"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"log"
 	"strings"
 	"time"
-	// "log"
 )
 
 var ErrInvalidToken error = errors.New("Invalid token. Not found.")
 
 var ErrBadTokenFormat = errors.New("Token should be formatted as `tokenId:secret` but was not")
+var ErrTokenNotAllowedForSensor = errors.New("This token may only be used with the sensor it was issued for.")
 
 // TODO: Possibly move authToken stuff to its own package so that scope stuff will be
 // authToken.READ_ALL, etc.
@@ -33,6 +35,10 @@ type AuthTokenType int
 const (
 	TOKEN_TYPE_LOGIN AuthTokenType = iota
 	TOKEN_TYPE_PERSONAL_ACCESS
+	TOKEN_TYPE_JWT                // never stored, see JWTConfig
+	TOKEN_TYPE_CLIENT_CERTIFICATE // never stored, see ClientCertificate
+	TOKEN_TYPE_TOTP_CHALLENGE     // only proves the password was right, see GenerateTOTPChallenge
+	TOKEN_TYPE_IMPERSONATION      // an admin acting as User, see GenerateImpersonationToken
 )
 
 // Simplified auth tokens.  May eventually be replaced with proper OAuth 2.
@@ -42,34 +48,52 @@ type AuthToken struct {
 	// TODO: For now we store both short lived login and long lived personal access tokens. Arguably the login tokens
 	// could be handled purely in memory JWT style, but couldn't easily expire them early then still to force a logout of just
 	// a single device/instance.
-	Id         string             `db:"id"`
-	Token      string             `db:"token"`
-	User       User               `db:"user"`
-	ExpiresAt  pq.NullTime        `db:"expires_at"` // TODO: just make a *time.Time
-	CreatedAt  time.Time          `db:"created_at"`
-	UpdatedAt  time.Time          `db:"updated_at"`
-	Scope      AuthTokenScopeType `db:"scope"`
-	Type       AuthTokenType      `db:"type"`
-	fromString string             // usually empty, the string this token was generated from
+	Id        string             `db:"id"`
+	Token     string             `db:"token"`
+	User      User               `db:"user"`
+	ExpiresAt pq.NullTime        `db:"expires_at"` // TODO: just make a *time.Time
+	CreatedAt time.Time          `db:"created_at"`
+	UpdatedAt time.Time          `db:"updated_at"`
+	Scope     AuthTokenScopeType `db:"scope"`
+	Type      AuthTokenType      `db:"type"`
+	// If set, the token may only be used for this sensor, such as one issued by the device authorization flow
+	SensorId *int64 `db:"sensor_id"`
+	// The TokenPeppers version Token was hashed with
+	HashVersion int `db:"hash_version"`
+	// The admin acting as User, for TOKEN_TYPE_IMPERSONATION
+	ImpersonatorId *int64 `db:"impersonator_id"`
+	// Impersonation tokens are read-only unless this is set
+	WritesAllowed bool   `db:"writes_allowed"`
+	fromString    string // usually empty, the string this token was generated from
 }
 
 func (t AuthToken) ForAuthenticationHeader() string {
+	// a JWT is already everything needed to authenticate
+	if t.Type == TOKEN_TYPE_JWT {
+		return t.fromString
+	}
 	// TODO: Base64 encode this?
 	// "encoding/base64"
 	return t.Id + ":" + t.fromString
 }
 func (t *AuthToken) Save(db *sqlx.DB) error {
+	if t.Id != "" {
+		return nil
+	}
+	return insertAuthToken(db, t)
+}
+
+// Inserts the token with either a DB or a Tx
+func insertAuthToken(db sqlx.Ext, t *AuthToken) error {
 	// TODO: May change the name of this table as it suggests a joining table.
 	tokenId := new(string)
 	createdAt := new(time.Time)
 	updatedAt := new(time.Time)
-	if t.Id != "" {
-		return nil
-	}
-	query := db.Rebind(`INSERT INTO user_authtokens (token, expires_at, updated_at, scope, user_id, type)
-		VALUES (?, ?, NOW(), ?, ?, ?) RETURNING id, created_at, updated_at`)
-	err := db.QueryRow(
-		query, t.Token, t.ExpiresAt, t.Scope, t.User.Id, t.Type).Scan(tokenId, createdAt, updatedAt)
+	query := db.Rebind(`INSERT INTO user_authtokens (token, expires_at, updated_at, scope, user_id, type, sensor_id,
+		hash_version, impersonator_id, writes_allowed) VALUES (?, ?, NOW(), ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, created_at, updated_at`)
+	err := db.QueryRowx(query, t.Token, t.ExpiresAt, t.Scope, t.User.Id, t.Type, t.SensorId,
+		t.HashVersion, t.ImpersonatorId, t.WritesAllowed).Scan(tokenId, createdAt, updatedAt)
 	if err == nil {
 		t.Id = *tokenId
 		t.CreatedAt = *createdAt
@@ -78,12 +102,53 @@ func (t *AuthToken) Save(db *sqlx.DB) error {
 	return err
 }
 
+// Whether the token may only be used to look at data, such as an impersonation token which was not allowed writes.
+func (t AuthToken) IsReadOnly() bool {
+	return t.Type == TOKEN_TYPE_IMPERSONATION && !t.WritesAllowed
+}
+
+// Whether the token may be used for something which needs scope.  TOKEN_SCOPE_ALL allows everything, any other scope
+// only allows itself.
+func (t AuthToken) AllowsScope(scope AuthTokenScopeType) bool {
+	return t.Scope == TOKEN_SCOPE_ALL || t.Scope == scope
+}
+
+// Whether the token may be used to write data for the sensor.  Tokens not bound to a sensor may be used with any of
+// the user's sensors.
+func (t AuthToken) AllowsSensor(sensor Sensor) bool {
+	return t.SensorId == nil || (sensor.Id != nil && *sensor.Id == *t.SensorId)
+}
+
 func (t AuthToken) Compare(token string) bool {
-	tokenHash := MakeTokenHash(token)
-	return tokenHash == t.Token
+	tokenHash, err := HashToken(token, t.HashVersion)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(tokenHash), []byte(t.Token)) == 1
+}
+
+// Re-hashes the token with the current pepper if it was hashed with an older one.  token must already have been
+// checked with Compare.  Failures are only logged since the token is still valid with its old hash.
+func (t *AuthToken) upgradeHash(token string, db *sqlx.DB) {
+	version := CurrentTokenHashVersion()
+	if t.HashVersion == version {
+		return
+	}
+	tokenHash, err := HashToken(token, version)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	query := db.Rebind(`UPDATE user_authtokens SET token = ?, hash_version = ? WHERE id = ? AND hash_version = ?`)
+	if _, err := db.Exec(query, tokenHash, version, t.Id, t.HashVersion); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	t.Token = tokenHash
+	t.HashVersion = version
 }
 
-// Make a hashed token from string.  May rename
+// Make an unkeyed hash of a token string.  Auth tokens use HashToken instead, this is version 0 of it.  May rename
 func MakeTokenHash(tokenStr string) string {
 	tokenBytes := sha512.Sum512([]byte(tokenStr))
 	// tokenBytes is a byte array, which cannot be directly cast to a string.  Instead make it a
@@ -94,8 +159,10 @@ func MakeTokenHash(tokenStr string) string {
 
 // TODO: rename to NewAuthToken
 func NewToken(token string, user User, scope AuthTokenScopeType, t AuthTokenType) AuthToken {
-	tokenString := MakeTokenHash(token)
-	return AuthToken{Token: tokenString, User: user, Scope: scope, fromString: token, Type: t}
+	version := CurrentTokenHashVersion()
+	// cannot fail, the current version always has a pepper
+	tokenString, _ := HashToken(token, version)
+	return AuthToken{Token: tokenString, User: user, Scope: scope, fromString: token, Type: t, HashVersion: version}
 }
 
 // Returns an AuthToken with a hashed token for a given tokenId and token string
@@ -118,6 +185,18 @@ func GenerateTokenForUser(user User, scope AuthTokenScopeType) (AuthToken, error
 	return NewLoginToken(tokenb64, user, scope), nil
 }
 
+// Generate a personal access token which may only be used with a single sensor, such as for the device itself
+func GenerateSensorToken(user User, sensorId int64, scope AuthTokenScopeType) (AuthToken, error) {
+	token, err := uuid.NewRandom()
+	if err != nil {
+		return AuthToken{}, err
+	}
+	tokenb64 := base64.URLEncoding.EncodeToString([]byte(token.String()))
+	t := NewToken(tokenb64, user, scope, TOKEN_TYPE_PERSONAL_ACCESS)
+	t.SensorId = &sensorId
+	return t, nil
+}
+
 func AuthenticateUserByToken(tokenStr string, db *sqlx.DB) (AuthToken, error) {
 	// TODO: Is there a good way to abstract this so that token data could optionally
 	// be stored in redis while other data is in postgres?  If two separate lookups
@@ -133,20 +212,65 @@ func AuthenticateUserByToken(tokenStr string, db *sqlx.DB) (AuthToken, error) {
 
 	tokenId := tokenParts[0]
 	tokenSecret := tokenParts[1]
+	token, err := FindAuthToken(tokenId, db)
+	if err != nil {
+		return token, err
+	}
+
+	// could do this in the sql, but it keeps the hashing code all closer together
+	if !token.Compare(tokenSecret) {
+		return AuthToken{}, ErrInvalidToken
+	}
+	token.upgradeHash(tokenSecret, db)
+	return token, nil
+}
+
+// Looks up a usable token by its id alone, without checking the secret.  This is only for checks made after the
+// token was authenticated with AuthenticateUserByToken(), such as an MQTT broker asking whether a connected client may
+// use a topic, which only knows the client's username.
+func FindAuthToken(tokenId string, db *sqlx.DB) (AuthToken, error) {
+	token := AuthToken{}
 	// TODO: sqrl
 	query := db.Rebind(
-		`SELECT t.id, t.token, t.scope, t.expires_at, t.created_at, t.updated_at, u.id "user.id", u.uuid "user.uuid",
+		`SELECT t.id, t.token, t.hash_version, t.scope, t.type, t.sensor_id, t.expires_at, t.created_at, t.updated_at,
+			t.impersonator_id, t.writes_allowed, u.id "user.id",
+			u.uuid "user.uuid",
 			u.full_name "user.full_name", u.username "user.username", u.email "user.email", u.created_at "user.created_at",
-			u.updated_at "user.updated_at", u.password "user.password" FROM user_authtokens t
+			u.updated_at "user.updated_at", u.password "user.password", u.is_active "user.is_active",
+			u.is_admin "user.is_admin" FROM user_authtokens t
 			JOIN users u ON t.user_id = u.id
-			WHERE t.id = ? AND (t.expires_at IS NULL OR t.expires_at > ?)`)
-	err := db.Get(&token, query, tokenId, time.Now())
+			WHERE t.id = ? AND (t.expires_at IS NULL OR t.expires_at > ?) AND u.is_active AND t.type <> ?
+			AND (t.impersonator_id IS NULL OR EXISTS (
+				SELECT 1 FROM users i WHERE i.id = t.impersonator_id AND i.is_active AND i.is_admin))`)
+	err := db.Get(&token, query, tokenId, time.Now(), TOKEN_TYPE_TOTP_CHALLENGE)
 	if err == sql.ErrNoRows {
-		err = ErrInvalidToken
-	}
-	if !token.Compare(tokenSecret) {
-		err = ErrInvalidToken
+		return AuthToken{}, ErrInvalidToken
+	} else if err != nil {
+		return AuthToken{}, err
 	}
+	return token, nil
+}
+
+// Deletes all of a user's tokens of the given type, such as to log out every session after a password change.
+func DeleteUserAuthTokens(userId int64, tokenType AuthTokenType, db *sqlx.DB) error {
+	query := db.Rebind(`DELETE FROM user_authtokens WHERE user_id = ? AND type = ?`)
+	_, err := db.Exec(query, userId, tokenType)
+	return err
+}
+
+// Deletes the tokens a user signs in with, which are login, TOTP challenge, and impersonation tokens, other than
+// keepTokenId, which may be empty.  Personal access tokens, such as those used by sensors, are left alone.
+func deleteInteractiveAuthTokens(userId int64, keepTokenId string, db sqlx.Ext) error {
+	query := db.Rebind(`DELETE FROM user_authtokens WHERE user_id = ? AND type IN (?, ?, ?) AND id::text <> ?`)
+	_, err := db.Exec(query, userId, TOKEN_TYPE_LOGIN, TOKEN_TYPE_TOTP_CHALLENGE, TOKEN_TYPE_IMPERSONATION,
+		keepTokenId)
+	return err
+}
 
-	return token, err
+// Deletes every token for a user regardless of type, such as when an admin needs to force a user to log in again
+// and re-create any personal access tokens.
+func DeleteAllUserAuthTokens(userId int64, db *sqlx.DB) error {
+	query := db.Rebind(`DELETE FROM user_authtokens WHERE user_id = ?`)
+	_, err := db.Exec(query, userId)
+	return err
 }
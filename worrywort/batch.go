@@ -3,6 +3,7 @@ package worrywort
 // Models and functions for brew batch management
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	// "github.com/davecgh/go-spew/spew"
@@ -42,6 +43,7 @@ type Batch struct {
 	UUID              string         `db:"uuid"`
 	CreatedBy         *User          `db:"created_by,prefix=u"` // TODO: think I will change this to User
 	UserId            *int64         `db:"user_id"`
+	TeamId            *int64         `db:"team_id"`
 	Name              string         `db:"name"`
 	BrewNotes         string         `db:"brew_notes"`
 	TastingNotes      string         `db:"tasting_notes"`
@@ -75,7 +77,7 @@ func (b Batch) queryColumns() []string {
 	// TODO: Way to dynamically build this using the `db` tag and reflection/introspection
 	return []string{"id", "name", "brew_notes", "tasting_notes", "brewed_date", "bottled_date",
 		"volume_boiled", "volume_in_fermentor", "volume_units", "original_gravity", "final_gravity", "recipe_url",
-		"max_temperature", "min_temperature", "average_temperature", "created_at", "updated_at", "user_id"}
+		"max_temperature", "min_temperature", "average_temperature", "created_at", "updated_at", "user_id", "team_id"}
 }
 
 // Performs a comparison of all attributes of the Batches.  Related structs have only their Id compared.
@@ -100,19 +102,20 @@ func (b Batch) StrictEqual(other Batch) bool {
 // and does it need to return the []interface{} for values?
 func buildBatchesQuery(params map[string]interface{}, db *sqlx.DB) *sqrl.SelectBuilder {
 	query := sqrl.Select().From("batches b")
-	for _, k := range []string{"id", "user_id", "uuid"} {
+	for _, k := range []string{"id", "user_id", "uuid", "name"} {
 		// TODO: return error if not ok?
 		if v, ok := params[k]; ok {
 			query = query.Where(sqrl.Eq{fmt.Sprintf("b.%s", k): v})
 		}
 	}
+	query = whereTeamAccess(query, "b.user_id", "b.team_id", params)
 
 	// TODO: JOIN THE USER HERE!!!
 	// probably more efficient to use Columns() here but I am planning on moving all of the columns names somewhere
 	// more central for easier management across querying in multiple places.
 	queryCols := []string{"id", "name", "brew_notes", "tasting_notes", "brewed_date", "bottled_date",
 		"volume_boiled", "volume_in_fermentor", "volume_units", "original_gravity", "final_gravity", "recipe_url",
-		"max_temperature", "min_temperature", "average_temperature", "created_at", "updated_at", "user_id", "uuid"}
+		"max_temperature", "min_temperature", "average_temperature", "created_at", "updated_at", "user_id", "team_id", "uuid"}
 	for _, k := range queryCols {
 		query = query.Column(fmt.Sprintf("b.%s", k))
 	}
@@ -163,6 +166,11 @@ func (b *Batch) Save(db *sqlx.DB) error {
 // Returns a new copy of the user with any updated values set upon success.
 // Returns the same, unmodified User and errors on error
 func InsertBatch(db *sqlx.DB, b *Batch) error {
+	return insertBatch(db, b)
+}
+
+// Inserts the batch with either a DB or a Tx
+func insertBatch(db sqlx.Ext, b *Batch) error {
 	// TODO: TEST CASE
 	var updatedAt time.Time
 	var createdAt time.Time
@@ -170,13 +178,13 @@ func InsertBatch(db *sqlx.DB, b *Batch) error {
 	batchUUID := new(string)
 
 	// TODO: use sqrl
-	query := db.Rebind(`INSERT INTO batches (user_id, name, brew_notes, tasting_notes, brewed_date, bottled_date,
+	query := db.Rebind(`INSERT INTO batches (user_id, team_id, name, brew_notes, tasting_notes, brewed_date, bottled_date,
 		volume_boiled, volume_in_fermentor, volume_units, original_gravity, final_gravity, recipe_url, max_temperature,
 		min_temperature, average_temperature, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW()) RETURNING id, created_at, updated_at, uuid`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW()) RETURNING id, created_at, updated_at, uuid`)
 
-	err := db.QueryRow(
-		query, b.UserId, b.Name, b.BrewNotes, b.TastingNotes, b.BrewedDate, b.BottledDate,
+	err := db.QueryRowx(
+		query, b.UserId, b.TeamId, b.Name, b.BrewNotes, b.TastingNotes, b.BrewedDate, b.BottledDate,
 		b.VolumeBoiled, b.VolumeInFermentor, b.VolumeUnits, b.OriginalGravity, b.FinalGravity, b.RecipeURL,
 		b.MaxTemperature, b.MinTemperature, b.AverageTemperature).Scan(batchId, &createdAt, &updatedAt, batchUUID)
 
@@ -200,12 +208,12 @@ func UpdateBatch(db *sqlx.DB, b *Batch) error {
 
 	// TODO: Use introspection and reflection to set these rather than manually managing this?
 	// TODO: use sqrl
-	query := db.Rebind(`UPDATE batches SET user_id = ?, name = ?, brew_notes = ?, tasting_notes = ?,
+	query := db.Rebind(`UPDATE batches SET user_id = ?, team_id = ?, name = ?, brew_notes = ?, tasting_notes = ?,
 		brewed_date = ?, bottled_date = ?, volume_boiled = ?, volume_in_fermentor = ?, volume_units = ?,
 		original_gravity = ?, final_gravity = ?, recipe_url = ?, max_temperature = ?, min_temperature = ?,
 		average_temperature = ?, updated_at = (NOW() at time zone 'utc') WHERE id = ? RETURNING updated_at`)
 	err := db.QueryRow(
-		query, b.UserId, b.Name, b.BrewNotes, b.TastingNotes, b.BrewedDate, b.BottledDate,
+		query, b.UserId, b.TeamId, b.Name, b.BrewNotes, b.TastingNotes, b.BrewedDate, b.BottledDate,
 		b.VolumeBoiled, b.VolumeInFermentor, b.VolumeUnits, b.OriginalGravity, b.FinalGravity, b.RecipeURL,
 		b.MaxTemperature, b.MinTemperature, b.AverageTemperature, b.Id).Scan(&updatedAt)
 
@@ -242,6 +250,11 @@ type BatchSensor struct {
 // If I pass in pointers, I can safely attach them as well...
 // TODO: Why not follow same pattern as other structs with insert, save, etc.?
 func AssociateBatchToSensor(batch *Batch, sensor *Sensor, description string, associatedAt *time.Time, db *sqlx.DB) (*BatchSensor, error) {
+	return associateBatchToSensor(batch, sensor, description, associatedAt, db)
+}
+
+// Creates the association with either a DB or a Tx
+func associateBatchToSensor(batch *Batch, sensor *Sensor, description string, associatedAt *time.Time, db sqlx.Ext) (*BatchSensor, error) {
 	var updatedAt time.Time
 	var createdAt time.Time
 	var assocTime time.Time
@@ -270,7 +283,7 @@ func AssociateBatchToSensor(batch *Batch, sensor *Sensor, description string, as
 
 	// This overwrites associatedAt with the db's value because otherwise we run into precision differences on input
 	// and output which gets weird when comparing
-	err := db.QueryRow(
+	err := db.QueryRowx(
 		query, batch.Id, sensor.Id, description, assocTime).Scan(&assocId, &createdAt, &updatedAt, &assocTime)
 
 	if err != nil {
@@ -284,6 +297,11 @@ func AssociateBatchToSensor(batch *Batch, sensor *Sensor, description string, as
 }
 
 func UpdateBatchSensorAssociation(b BatchSensor, db *sqlx.DB) (*BatchSensor, error) {
+	return updateBatchSensorAssociation(b, db)
+}
+
+// Updates the association with either a DB or a Tx
+func updateBatchSensorAssociation(b BatchSensor, db sqlx.Ext) (*BatchSensor, error) {
 	// TODO: Tempted to make these take a BatchSensor to modify and a dict of changes... maybe. sort of elixir/ecto style.
 	// TODO: not sure how I feel about taking struct, returning pointer to the struct... maybe just take the pointer?
 	var updatedAt time.Time
@@ -292,7 +310,7 @@ func UpdateBatchSensorAssociation(b BatchSensor, db *sqlx.DB) (*BatchSensor, err
 	// TODO: use sqrl
 	query := db.Rebind(`UPDATE batch_sensor_association SET batch_id = ?, sensor_id = ?, description = ?, associated_at = ?, disassociated_at = ?,
 		updated_at = NOW() WHERE id = ? RETURNING updated_at`)
-	err := db.QueryRow(query, b.BatchId, b.SensorId, b.Description, b.AssociatedAt, b.DisassociatedAt, b.Id).Scan(&updatedAt)
+	err := db.QueryRowx(query, b.BatchId, b.SensorId, b.Description, b.AssociatedAt, b.DisassociatedAt, b.Id).Scan(&updatedAt)
 	if err != nil {
 		return &b, err
 	}
@@ -313,13 +331,13 @@ func buildBatchSensorAssociationsQuery(params map[string]interface{}, db *sqlx.D
 
 	batchQueryCols := []string{"id", "name", "brew_notes", "tasting_notes", "brewed_date", "bottled_date",
 		"volume_boiled", "volume_in_fermentor", "volume_units", "original_gravity", "final_gravity", "recipe_url",
-		"max_temperature", "min_temperature", "average_temperature", "created_at", "updated_at", "user_id", "uuid"}
+		"max_temperature", "min_temperature", "average_temperature", "created_at", "updated_at", "user_id", "team_id", "uuid"}
 	for _, k := range batchQueryCols {
 		query = query.Column(fmt.Sprintf("b.%s AS \"b.%s\"", k, k))
 
 	}
 
-	sensorQueryCols := []string{"id", "name", "created_at", "updated_at", "user_id", "uuid"}
+	sensorQueryCols := []string{"id", "name", "created_at", "updated_at", "user_id", "team_id", "uuid", "device_id"}
 	for _, k := range sensorQueryCols {
 		query = query.Column(fmt.Sprintf("s.%s AS \"s.%s\"", k, k))
 	}
@@ -348,6 +366,9 @@ func buildBatchSensorAssociationsQuery(params map[string]interface{}, db *sqlx.D
 		query = query.Where(sqrl.Eq{"b.user_id": userId})
 		query = query.Where(sqrl.Eq{"s.user_id": userId})
 	}
+	// both the batch and the sensor must be accessible
+	query = whereTeamAccess(query, "b.user_id", "b.team_id", params)
+	query = whereTeamAccess(query, "s.user_id", "s.team_id", params)
 
 	if v, ok := params["limit"]; ok {
 		query = query.Limit(uint64(v.(int)))
@@ -376,3 +397,114 @@ func FindBatchSensorAssociations(params map[string]interface{}, db *sqlx.DB) ([]
 	}
 	return *associations, err
 }
+
+// Makes sure sensor is associated with the user's batch named batchName as of `at`, for devices such as a Tilt which
+// only know the name of the beer.  An existing association with a different batch is ended at `at`, since the device
+// has been moved to a new beer, or when it started if `at` is earlier.  If the user has no batch by that name one is
+// created, brewed at `at`.  If there are several, the most recently brewed is used.
+func EnsureBatchSensorAssociation(user User, sensor *Sensor, batchName string, at time.Time, db *sqlx.DB) (*BatchSensor, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	current, err := lockCurrentBatchSensorAssociation(sensor, tx)
+	if err == nil && current.Batch.Name == batchName {
+		return current, tx.Commit()
+	} else if err == nil {
+		if err := endBatchSensorAssociation(current, at, tx); err != nil {
+			return nil, err
+		}
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	batches := []*Batch{}
+	query, values, err := buildBatchesQuery(map[string]interface{}{"name": batchName, "editable_by": *user.Id},
+		nil).ToSql()
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Select(&batches, tx.Rebind(query), values...); err != nil {
+		return nil, err
+	}
+	var batch *Batch
+	for _, b := range batches {
+		if batch == nil || b.BrewedDate.After(batch.BrewedDate) {
+			batch = b
+		}
+	}
+	if batch == nil {
+		batch = &Batch{Name: batchName, BrewedDate: at, UserId: user.Id, CreatedBy: &user}
+		if err := insertBatch(tx, batch); err != nil {
+			return nil, err
+		}
+	}
+	association, err := associateBatchToSensor(batch, sensor, "", &at, tx)
+	if err != nil {
+		return nil, err
+	}
+	return association, tx.Commit()
+}
+
+// Makes sure sensor is associated with the batch leader is currently associated with as of `at`, such as a BrewPi's
+// fridge sensor following its beer sensor to each new batch.  An existing association with a different batch is ended
+// the same as EnsureBatchSensorAssociation() does.  Returns sql.ErrNoRows if leader is not associated with a batch.
+func EnsureSameBatchSensorAssociation(sensor, leader *Sensor, description string, at time.Time, db *sqlx.DB) (
+	*BatchSensor, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	leading := new(BatchSensor)
+	query, values, err := buildBatchSensorAssociationsQuery(
+		map[string]interface{}{"sensor_id": *leader.Id, "disassociated_at": nil}, nil).ToSql()
+	if err == nil {
+		err = tx.Get(leading, tx.Rebind(query), values...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := lockCurrentBatchSensorAssociation(sensor, tx)
+	if err == nil && *current.BatchId == *leading.BatchId {
+		return current, tx.Commit()
+	} else if err == nil {
+		if err := endBatchSensorAssociation(current, at, tx); err != nil {
+			return nil, err
+		}
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	association, err := associateBatchToSensor(leading.Batch, sensor, description, &at, tx)
+	if err != nil {
+		return nil, err
+	}
+	return association, tx.Commit()
+}
+
+// Locks the sensor and returns its current association, or sql.ErrNoRows if it has none.  Locking keeps two readings
+// which arrive at the same time from both ending the current association and starting a new one.
+func lockCurrentBatchSensorAssociation(sensor *Sensor, tx *sqlx.Tx) (*BatchSensor, error) {
+	if _, err := tx.Exec(tx.Rebind(`SELECT id FROM sensors WHERE id = ? FOR UPDATE`), *sensor.Id); err != nil {
+		return nil, err
+	}
+	current := new(BatchSensor)
+	query, values, err := buildBatchSensorAssociationsQuery(
+		map[string]interface{}{"sensor_id": *sensor.Id, "disassociated_at": nil}, nil).ToSql()
+	if err == nil {
+		err = tx.Get(current, tx.Rebind(query), values...)
+	}
+	return current, err
+}
+
+// Ends the association at `at`.  Readings can arrive out of order, but an association cannot end before it started.
+func endBatchSensorAssociation(b *BatchSensor, at time.Time, tx *sqlx.Tx) error {
+	if at.Before(b.AssociatedAt) {
+		at = b.AssociatedAt
+	}
+	b.DisassociatedAt = &at
+	_, err := updateBatchSensorAssociation(*b, tx)
+	return err
+}
@@ -0,0 +1,115 @@
+package worrywort
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/elgris/sqrl"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// Share links give anyone with the link a read-only view of a batch, without an account.  Only the parts of the batch
+// which are safe to show publicly should be exposed through them.
+
+var ErrShareLinkRevoked = errors.New("Share link has already been revoked.")
+
+type BatchShareLink struct {
+	Id        string     `db:"id"`
+	BatchId   *int64     `db:"batch_id"`
+	UserId    *int64     `db:"user_id"` // who shared it
+	Slug      string     `db:"slug"`
+	ExpiresAt *time.Time `db:"expires_at"` // nil for a link which does not expire
+	RevokedAt *time.Time `db:"revoked_at"`
+	CreatedAt time.Time  `db:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at"`
+}
+
+func (l BatchShareLink) queryColumns() []string {
+	return []string{"id", "batch_id", "user_id", "slug", "expires_at", "revoked_at", "created_at", "updated_at"}
+}
+
+// Whether the link can still be used to view the batch
+func (l BatchShareLink) IsActive() bool {
+	return l.RevokedAt == nil && (l.ExpiresAt == nil || l.ExpiresAt.After(time.Now()))
+}
+
+// Makes a new share link with an unguessable slug.  expiresAt may be nil for a link which lasts until revoked.
+func NewBatchShareLink(batch Batch, user User, expiresAt *time.Time) (BatchShareLink, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return BatchShareLink{}, err
+	}
+	slug := base64.RawURLEncoding.EncodeToString(b)
+	return BatchShareLink{BatchId: batch.Id, UserId: user.Id, Slug: slug, ExpiresAt: expiresAt}, nil
+}
+
+// Inserts the link.  Links are never updated other than to revoke them, see Revoke().
+func (l *BatchShareLink) Save(db *sqlx.DB) error {
+	if l.Id != "" {
+		return nil
+	}
+	query := db.Rebind(`INSERT INTO batch_share_links (batch_id, user_id, slug, expires_at, updated_at)
+		VALUES (?, ?, ?, ?, NOW()) RETURNING id, created_at, updated_at`)
+	return db.QueryRow(query, l.BatchId, l.UserId, l.Slug, l.ExpiresAt).Scan(&l.Id, &l.CreatedAt, &l.UpdatedAt)
+}
+
+// Stops the link from working.  It is kept, rather than deleted, so that the owner can see what was shared.
+func (l *BatchShareLink) Revoke(db *sqlx.DB) error {
+	query := db.Rebind(`UPDATE batch_share_links SET revoked_at = NOW(), updated_at = NOW()
+		WHERE id = ? AND revoked_at IS NULL RETURNING revoked_at, updated_at`)
+	err := db.QueryRow(query, l.Id).Scan(&l.RevokedAt, &l.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return ErrShareLinkRevoked
+	}
+	return err
+}
+
+func buildBatchShareLinksQuery(params map[string]interface{}) *sqrl.SelectBuilder {
+	query := sqrl.Select().From("batch_share_links l")
+	for _, k := range []string{"id", "batch_id", "user_id", "slug"} {
+		if v, ok := params[k]; ok {
+			query = query.Where(sqrl.Eq{fmt.Sprintf("l.%s", k): v})
+		}
+	}
+	// only links which can still be used
+	if v, ok := params["active"]; ok && v.(bool) {
+		query = query.Where("l.revoked_at IS NULL AND (l.expires_at IS NULL OR l.expires_at > ?)", time.Now())
+	}
+	for _, k := range (BatchShareLink{}).queryColumns() {
+		query = query.Column(fmt.Sprintf("l.%s", k))
+	}
+	return query.OrderBy("l.created_at DESC")
+}
+
+// Look up a share link.  Accepts `id`, `batch_id`, `user_id`, `slug`, and `active` to only find links which have not
+// expired or been revoked.
+func FindBatchShareLink(params map[string]interface{}, db *sqlx.DB) (*BatchShareLink, error) {
+	link := new(BatchShareLink)
+	query, values, err := buildBatchShareLinksQuery(params).ToSql()
+	if err == nil {
+		err = db.Get(link, db.Rebind(query), values...)
+	}
+	return link, err
+}
+
+func FindBatchShareLinks(params map[string]interface{}, db *sqlx.DB) ([]*BatchShareLink, error) {
+	links := []*BatchShareLink{}
+	query, values, err := buildBatchShareLinksQuery(params).ToSql()
+	if err == nil {
+		err = db.Select(&links, db.Rebind(query), values...)
+	}
+	return links, err
+}
+
+// Looks up the batch for an active share link's slug.  Returns sql.ErrNoRows if there is no such link or it is no
+// longer active.
+func FindSharedBatch(slug string, db *sqlx.DB) (*Batch, error) {
+	link, err := FindBatchShareLink(map[string]interface{}{"slug": slug, "active": true}, db)
+	if err != nil {
+		return nil, err
+	}
+	return FindBatch(map[string]interface{}{"id": *link.BatchId}, db)
+}
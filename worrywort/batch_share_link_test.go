@@ -0,0 +1,82 @@
+package worrywort
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestBatchShareLinks(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	u := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := u.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	batch := makeTestBatch(&u, true)
+	if err := batch.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	t.Run("Slugs are unique", func(t *testing.T) {
+		l1, err := NewBatchShareLink(batch, u, nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		l2, _ := NewBatchShareLink(batch, u, nil)
+		if len(l1.Slug) != 32 || l1.Slug == l2.Slug {
+			t.Errorf("Expected two different 32 character slugs but got %s and %s", l1.Slug, l2.Slug)
+		}
+	})
+
+	t.Run("Active link finds the batch", func(t *testing.T) {
+		link, _ := NewBatchShareLink(batch, u, nil)
+		if err := link.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		shared, err := FindSharedBatch(link.Slug, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if *shared.Id != *batch.Id {
+			t.Errorf("Expected batch %d but got %d", *batch.Id, *shared.Id)
+		}
+	})
+
+	t.Run("Expired link", func(t *testing.T) {
+		expired := time.Now().Add(-time.Minute)
+		link, _ := NewBatchShareLink(batch, u, &expired)
+		if err := link.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if link.IsActive() {
+			t.Errorf("Expected expired link to be inactive")
+		}
+		if _, err := FindSharedBatch(link.Slug, db); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows but got %v", err)
+		}
+	})
+
+	t.Run("Revoked link", func(t *testing.T) {
+		link, _ := NewBatchShareLink(batch, u, nil)
+		if err := link.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := link.Revoke(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if link.RevokedAt == nil || link.IsActive() {
+			t.Errorf("Expected RevokedAt to be set")
+		}
+		if _, err := FindSharedBatch(link.Slug, db); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows but got %v", err)
+		}
+		if err := link.Revoke(db); err != ErrShareLinkRevoked {
+			t.Errorf("Expected ErrShareLinkRevoked but got %v", err)
+		}
+	})
+}
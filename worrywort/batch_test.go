@@ -385,6 +385,78 @@ func TestTemperatureMeasurementModel(t *testing.T) {
 			t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(&m, updated, cmpOpts...))
 		}
 	})
+
+	t.Run("Save() duplicate", func(t *testing.T) {
+		recordedAt := time.Now().Add(-time.Hour).Round(time.Microsecond)
+		m := TemperatureMeasurement{UserId: u.Id, SensorId: sensor.Id, Temperature: 70.0, Units: FAHRENHEIT,
+			RecordedAt: recordedAt}
+		if err := m.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		retry := TemperatureMeasurement{UserId: u.Id, SensorId: sensor.Id, Temperature: 71.0, Units: FAHRENHEIT,
+			RecordedAt: recordedAt}
+		if err := retry.Save(db); err != ErrDuplicateTemperatureMeasurement {
+			t.Fatalf("Expected ErrDuplicateTemperatureMeasurement but got %v", err)
+		}
+		if retry.Id != m.Id || retry.Temperature != m.Temperature {
+			t.Errorf("Expected the original measurement %v but got %v", m, retry)
+		}
+	})
+
+	t.Run("InsertTemperatureMeasurements()", func(t *testing.T) {
+		measurements := []*TemperatureMeasurement{}
+		for i := 0; i < 3; i++ {
+			measurements = append(measurements, &TemperatureMeasurement{UserId: u.Id, SensorId: sensor.Id,
+				Temperature: float64(60 + i), Units: FAHRENHEIT,
+				RecordedAt: time.Now().Add(time.Duration(-i) * time.Minute).Round(time.Microsecond)})
+		}
+		// the last is a retry of the first
+		retry := *measurements[0]
+		measurements = append(measurements, &retry)
+		created, err := InsertTemperatureMeasurements(db, measurements)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !cmp.Equal([]bool{true, true, true, false}, created) {
+			t.Errorf("Expected only the retry to not be created but got %v", created)
+		}
+		if retry.Id != measurements[0].Id {
+			t.Errorf("Expected the retry to have the original id %s but got %s", measurements[0].Id, retry.Id)
+		}
+		for _, m := range measurements {
+			if m.Id == "" {
+				t.Fatalf("InsertTemperatureMeasurements() did not set id")
+			}
+			saved, err := FindTemperatureMeasurement(map[string]interface{}{"id": m.Id}, db)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if saved.Temperature != m.Temperature || !saved.RecordedAt.Equal(m.RecordedAt) {
+				t.Errorf("Expected %v but got %v", m, saved)
+			}
+		}
+	})
+
+	t.Run("Created", func(t *testing.T) {
+		recordedAt := time.Now().Add(-2 * time.Hour).Round(time.Microsecond)
+		m := TemperatureMeasurement{UserId: u.Id, SensorId: sensor.Id, Temperature: 70.0, Units: FAHRENHEIT,
+			RecordedAt: recordedAt}
+		if err := m.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		other := &TemperatureMeasurement{UserId: u.Id, SensorId: sensor.Id, Temperature: 71.0, Units: FAHRENHEIT,
+			RecordedAt: recordedAt.Add(time.Minute)}
+		retry := m
+		retry.Id = ""
+		created, err := InsertTemperatureMeasurements(db, []*TemperatureMeasurement{other, &retry})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		// only the new measurement is passed on to a TemperatureMeasurementNotifier
+		if !cmp.Equal([]bool{true, false}, created) || retry.Id != m.Id {
+			t.Errorf("Expected only %s to be created but got %v", other.Id, created)
+		}
+	})
 }
 
 func TestFindBatch(t *testing.T) {
@@ -709,6 +781,58 @@ func TestBatchSensorAssociations(t *testing.T) {
 				spew.Sdump(updated))
 		}
 	})
+
+	t.Run("EnsureBatchSensorAssociation()", func(t *testing.T) {
+		at := time.Now().Round(time.Microsecond)
+		first, err := EnsureBatchSensorAssociation(u, &sensor, "Testing", at, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if *first.BatchId != *batch.Id || !first.AssociatedAt.Equal(at) {
+			t.Errorf("Expected an association with batch %d at %v but got %s", *batch.Id, at, spew.Sdump(first))
+		}
+		again, err := EnsureBatchSensorAssociation(u, &sensor, "Testing", at.Add(time.Minute), db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if again.Id != first.Id {
+			t.Errorf("Expected the existing association %s but got %s", first.Id, again.Id)
+		}
+
+		// a new name ends the old association and makes a new batch
+		later := at.Add(time.Hour)
+		moved, err := EnsureBatchSensorAssociation(u, &sensor, "Next Beer", later, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		newBatch, err := FindBatch(map[string]interface{}{"id": *moved.BatchId}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if newBatch.Name != "Next Beer" || *newBatch.UserId != *u.Id || !newBatch.BrewedDate.Equal(later) {
+			t.Errorf("Unexpected batch %s", spew.Sdump(newBatch))
+		}
+		old, err := FindBatchSensorAssociation(map[string]interface{}{"id": first.Id}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if old.DisassociatedAt == nil || !old.DisassociatedAt.Equal(later) {
+			t.Errorf("Expected the old association to end at %v but got %v", later, old.DisassociatedAt)
+		}
+
+		// a reading from before the current association started ends it when it started rather than before
+		earlier := later.Add(-time.Minute)
+		if _, err := EnsureBatchSensorAssociation(u, &sensor, "Testing", earlier, db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		ended, err := FindBatchSensorAssociation(map[string]interface{}{"id": moved.Id}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if ended.DisassociatedAt == nil || !ended.DisassociatedAt.Equal(moved.AssociatedAt) {
+			t.Errorf("Expected the association to end at %v but got %v", moved.AssociatedAt, ended.DisassociatedAt)
+		}
+	})
 }
 
 func TestFindBatchSensorAssociations(t *testing.T) {
@@ -886,3 +1010,31 @@ func TestFindTemperatureMeasurements(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTimestamp(t *testing.T) {
+	var tests = []struct {
+		timestamp string
+		expected  time.Time
+		valid     bool
+	}{
+		{"2019-04-21T11:30:33.32838Z", time.Date(2019, 4, 21, 11, 30, 33, 328380000, time.UTC), true},
+		{"1555846233", time.Unix(1555846233, 0).UTC(), true},
+		{"1555846233.32838", time.Unix(1555846233, 328380000).UTC(), true},
+		{"1555846233.1234567891", time.Unix(1555846233, 123456789).UTC(), true},
+		{"", time.Time{}, false},
+		{"-1", time.Time{}, false},
+		{"1555846233.abc", time.Time{}, false},
+		{"yesterday", time.Time{}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.timestamp, func(t *testing.T) {
+			actual, err := ParseTimestamp(tc.timestamp)
+			if (err == nil) != tc.valid {
+				t.Fatalf("Expected valid %v but got error %v", tc.valid, err)
+			}
+			if !actual.Equal(tc.expected) {
+				t.Errorf("Expected %v but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package worrywort
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/elgris/sqrl"
+	"github.com/jmoiron/sqlx"
+	"strings"
+	"time"
+)
+
+// TLS client certificates for devices which can hold a certificate but not a token.  The certificate chain is
+// verified against the client CA by the TLS server, this only maps an already verified certificate to a user and,
+// optionally, the one sensor the certificate may write for.
+
+var ErrClientCertificateNotFound = errors.New("Client certificate not registered.")
+
+type ClientCertificate struct {
+	Id          *int64     `db:"id"`
+	Fingerprint string     `db:"fingerprint"` // see CertificateFingerprint. Empty when matched by Subject.
+	Subject     string     `db:"subject"`     // the subject common name
+	UserId      *int64     `db:"user_id"`
+	SensorId    *int64     `db:"sensor_id"`
+	RevokedAt   *time.Time `db:"revoked_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at"`
+}
+
+func (c ClientCertificate) queryColumns() []string {
+	return []string{"id", "fingerprint", "subject", "user_id", "sensor_id", "revoked_at", "created_at", "updated_at"}
+}
+
+// The lower case hex sha256 of the DER encoded certificate
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Normalizes a fingerprint as printed by tools such as `openssl x509 -fingerprint -sha256`, which uses upper case
+// and colons, so that it can be compared with CertificateFingerprint()
+func NormalizeCertificateFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimSpace(fingerprint)
+	if i := strings.LastIndex(fingerprint, "="); i != -1 {
+		fingerprint = fingerprint[i+1:]
+	}
+	return strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+}
+
+// Inserts the ClientCertificate.  Registered certificates are only ever revoked, never changed.
+func (c *ClientCertificate) Save(db *sqlx.DB) error {
+	if c.Id != nil {
+		return nil
+	}
+	c.Fingerprint = NormalizeCertificateFingerprint(c.Fingerprint)
+	query := db.Rebind(`INSERT INTO client_certificates (fingerprint, subject, user_id, sensor_id, updated_at)
+		VALUES (?, ?, ?, ?, NOW()) RETURNING id, created_at, updated_at`)
+	return db.QueryRow(query, c.Fingerprint, c.Subject, c.UserId, c.SensorId).Scan(&c.Id, &c.CreatedAt, &c.UpdatedAt)
+}
+
+// Revokes the certificate.  It will no longer authenticate and the fingerprint or subject may be registered again.
+func (c *ClientCertificate) Revoke(db *sqlx.DB) error {
+	now := time.Now()
+	query := db.Rebind(`UPDATE client_certificates SET revoked_at = ?, updated_at = NOW() WHERE id = ?`)
+	if _, err := db.Exec(query, now, c.Id); err != nil {
+		return err
+	}
+	c.RevokedAt = &now
+	return nil
+}
+
+func buildClientCertificatesQuery(params map[string]interface{}) *sqrl.SelectBuilder {
+	query := sqrl.Select().From("client_certificates c")
+	for _, k := range []string{"id", "subject", "user_id", "sensor_id"} {
+		if v, ok := params[k]; ok {
+			query = query.Where(sqrl.Eq{fmt.Sprintf("c.%s", k): v})
+		}
+	}
+	if v, ok := params["fingerprint"]; ok {
+		query = query.Where(sqrl.Eq{"c.fingerprint": NormalizeCertificateFingerprint(v.(string))})
+	}
+	if v, ok := params["revoked"]; ok {
+		if v.(bool) {
+			query = query.Where("c.revoked_at IS NOT NULL")
+		} else {
+			query = query.Where("c.revoked_at IS NULL")
+		}
+	}
+	for _, k := range (ClientCertificate{}).queryColumns() {
+		query = query.Column(fmt.Sprintf("c.%s", k))
+	}
+	return query
+}
+
+// Look up a registered certificate.  Accepts `id`, `fingerprint`, `subject`, `user_id`, `sensor_id`, and `revoked`.
+func FindClientCertificate(params map[string]interface{}, db *sqlx.DB) (*ClientCertificate, error) {
+	c := ClientCertificate{}
+	query, values, err := buildClientCertificatesQuery(params).ToSql()
+	if err == nil {
+		err = db.Get(&c, db.Rebind(query), values...)
+	}
+	if err == sql.ErrNoRows {
+		return nil, ErrClientCertificateNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Looks up the active user for a verified client certificate.  A certificate registered by fingerprint takes
+// precedence over one registered by subject.  The returned AuthToken is never stored and only carries the user,
+// scope, and sensor binding so that certificates are handled the same as tokens everywhere else.
+func AuthenticateClientCertificate(cert *x509.Certificate, db *sqlx.DB) (AuthToken, error) {
+	query := sqrl.Select("c.sensor_id").From("client_certificates c").Join("users u ON c.user_id = u.id").
+		Where("c.revoked_at IS NULL AND u.is_active").
+		Where("(c.fingerprint = ? OR (c.fingerprint = '' AND c.subject <> '' AND c.subject = ?))",
+			CertificateFingerprint(cert), cert.Subject.CommonName).
+		OrderBy("c.fingerprint DESC").Limit(1)
+	for _, k := range (User{}).queryColumns() {
+		query = query.Column(fmt.Sprintf("u.%s \"user.%s\"", k, k))
+	}
+
+	token := AuthToken{}
+	q, values, err := query.ToSql()
+	if err == nil {
+		err = db.Get(&token, db.Rebind(q), values...)
+	}
+	if err == sql.ErrNoRows {
+		return AuthToken{}, ErrClientCertificateNotFound
+	} else if err != nil {
+		return AuthToken{}, err
+	}
+	token.Scope = TOKEN_SCOPE_WRITE_TEMPS
+	token.Type = TOKEN_TYPE_CLIENT_CERTIFICATE
+	return token, nil
+}
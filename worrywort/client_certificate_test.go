@@ -0,0 +1,101 @@
+package worrywort
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeCertificateFingerprint(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("certificate")}
+	fingerprint := CertificateFingerprint(cert)
+	var tests = []struct {
+		name  string
+		input string
+	}{
+		{"As returned", fingerprint},
+		{"openssl output", "SHA256 Fingerprint=" + strings.ToUpper(fingerprint[0:2]+":"+fingerprint[2:])},
+		{"Whitespace", " " + fingerprint + "\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := NormalizeCertificateFingerprint(tc.input); actual != fingerprint {
+				t.Errorf("Expected: %s\nGot: %s", fingerprint, actual)
+			}
+		})
+	}
+}
+
+func TestAuthenticateClientCertificate(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort", IsActive: true}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := Sensor{Name: "Gateway Sensor", UserId: user.Id, CreatedBy: &user}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	byFingerprint := &x509.Certificate{Raw: []byte("fingerprint cert"), Subject: pkix.Name{CommonName: "gateway-1"}}
+	bySubject := &x509.Certificate{Raw: []byte("subject cert"), Subject: pkix.Name{CommonName: "gateway-2"}}
+	unregistered := &x509.Certificate{Raw: []byte("unregistered cert"), Subject: pkix.Name{CommonName: "gateway-3"}}
+
+	fingerprintCert := ClientCertificate{Fingerprint: CertificateFingerprint(byFingerprint), UserId: user.Id,
+		SensorId: sensor.Id}
+	if err := fingerprintCert.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	subjectCert := ClientCertificate{Subject: "gateway-2", UserId: user.Id}
+	if err := subjectCert.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	t.Run("By fingerprint", func(t *testing.T) {
+		token, err := AuthenticateClientCertificate(byFingerprint, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if *token.User.Id != *user.Id || token.SensorId == nil || *token.SensorId != *sensor.Id {
+			t.Errorf("Unexpected token %v", token)
+		}
+		if token.Type != TOKEN_TYPE_CLIENT_CERTIFICATE || token.Scope != TOKEN_SCOPE_WRITE_TEMPS {
+			t.Errorf("Unexpected token type %v or scope %v", token.Type, token.Scope)
+		}
+	})
+
+	t.Run("By subject", func(t *testing.T) {
+		token, err := AuthenticateClientCertificate(bySubject, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if *token.User.Id != *user.Id || token.SensorId != nil {
+			t.Errorf("Unexpected token %v", token)
+		}
+	})
+
+	t.Run("Unregistered", func(t *testing.T) {
+		if _, err := AuthenticateClientCertificate(unregistered, db); err != ErrClientCertificateNotFound {
+			t.Errorf("Expected error: %v\nGot: %v", ErrClientCertificateNotFound, err)
+		}
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		found, err := FindClientCertificate(map[string]interface{}{"subject": "gateway-2", "revoked": false}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := found.Revoke(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := AuthenticateClientCertificate(bySubject, db); err != ErrClientCertificateNotFound {
+			t.Errorf("Expected error: %v\nGot: %v", ErrClientCertificateNotFound, err)
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package worrywort
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// OAuth 2.0 device authorization grant, RFC 8628.  A sensor requests a device code and gets a short user code
+// to show to the user.  The user approves it, which creates a Sensor, and the device polls with its device code
+// until it gets a personal access token bound to that Sensor and only able to write temperatures.
+
+type DeviceCodeStatus int
+
+const (
+	DEVICE_CODE_PENDING DeviceCodeStatus = iota
+	DEVICE_CODE_APPROVED
+	DEVICE_CODE_DENIED
+	DEVICE_CODE_REDEEMED // a token has been issued, the device code cannot be used again
+)
+
+// How long a device has to be approved if no other duration is specified
+const DefaultDeviceCodeTTL = 10 * time.Minute
+
+// Seconds a device should wait between polls.  Increased each time a device polls too quickly.
+const DefaultDevicePollInterval = 5
+
+// What the device is allowed to do with the token it is issued
+const DeviceTokenScope = TOKEN_SCOPE_WRITE_TEMPS
+
+// Consonants only so that user codes do not spell words and are hard to mistype, as suggested in RFC 8628 6.1
+const userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+const userCodeLength = 8
+
+// These map to the error codes in RFC 8628 3.5
+var ErrDeviceAuthorizationPending = errors.New("authorization_pending")
+var ErrDeviceSlowDown = errors.New("slow_down")
+var ErrDeviceAccessDenied = errors.New("access_denied")
+var ErrDeviceCodeExpired = errors.New("expired_token")
+var ErrInvalidDeviceCode = errors.New("invalid_grant")
+
+var ErrInvalidUserCode = errors.New("Invalid or expired code.")
+
+type DeviceCode struct {
+	Id           string           `db:"id"`
+	DeviceCode   string           `db:"device_code"` // hashed, the same as AuthToken.Token
+	HashVersion  int              `db:"hash_version"`
+	UserCode     string           `db:"user_code"`
+	ClientId     string           `db:"client_id"`
+	SensorName   string           `db:"sensor_name"`
+	Status       DeviceCodeStatus `db:"status"`
+	UserId       *int64           `db:"user_id"`
+	SensorId     *int64           `db:"sensor_id"`
+	PollInterval int              `db:"poll_interval"`
+	LastPolledAt *time.Time       `db:"last_polled_at"`
+	ExpiresAt    time.Time        `db:"expires_at"`
+	CreatedAt    time.Time        `db:"created_at"`
+	UpdatedAt    time.Time        `db:"updated_at"`
+
+	fromString string // usually empty, the string the device code was generated from
+}
+
+func (d DeviceCode) queryColumns() []string {
+	return []string{"id", "device_code", "hash_version", "user_code", "client_id", "sensor_name", "status", "user_id", "sensor_id",
+		"poll_interval", "last_polled_at", "expires_at", "created_at", "updated_at"}
+}
+
+// The device code as it should be given to the device.  Only available on a newly generated code.
+func (d DeviceCode) ForDevice() string {
+	return d.Id + ":" + d.fromString
+}
+
+func (d DeviceCode) compare(secret string) bool {
+	secretHash, err := HashToken(secret, d.HashVersion)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secretHash), []byte(d.DeviceCode)) == 1
+}
+
+// The user code formatted for display, such as BCDF-GHJK
+func (d DeviceCode) UserCodeForDisplay() string {
+	return d.UserCode[:userCodeLength/2] + "-" + d.UserCode[userCodeLength/2:]
+}
+
+// Uppercases and removes the separators people tend to type in so that user codes can be compared
+func NormalizeUserCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(code))
+}
+
+func generateUserCode() (string, error) {
+	max := big.NewInt(int64(len(userCodeCharset)))
+	code := make([]byte, userCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeCharset[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// Generate a new device code.  sensorName is the name the Sensor will be created with if the user
+// does not give it a different one when approving.  The code must be saved before ForDevice() is usable.
+func NewDeviceCode(clientId, sensorName string, ttl time.Duration) (DeviceCode, error) {
+	secret, err := uuid.NewRandom()
+	if err != nil {
+		return DeviceCode{}, err
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return DeviceCode{}, err
+	}
+	secretb64 := base64.URLEncoding.EncodeToString([]byte(secret.String()))
+	version := CurrentTokenHashVersion()
+	// cannot fail, the current version always has a pepper
+	secretHash, _ := HashToken(secretb64, version)
+	return DeviceCode{DeviceCode: secretHash, HashVersion: version, UserCode: userCode, ClientId: clientId,
+		SensorName: sensorName, Status: DEVICE_CODE_PENDING, PollInterval: DefaultDevicePollInterval,
+		ExpiresAt: time.Now().Add(ttl), fromString: secretb64}, nil
+}
+
+// Inserts the DeviceCode.  Device codes are only changed by approving, denying, and redeeming them.
+func (d *DeviceCode) Save(db *sqlx.DB) error {
+	if d.Id != "" {
+		return nil
+	}
+	query := db.Rebind(`INSERT INTO oauth_device_codes (device_code, hash_version, user_code, client_id, sensor_name,
+		status, poll_interval, expires_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW())
+		RETURNING id, created_at, updated_at`)
+	return db.QueryRow(query, d.DeviceCode, d.HashVersion, d.UserCode, d.ClientId, d.SensorName, d.Status, d.PollInterval,
+		d.ExpiresAt).Scan(&d.Id, &d.CreatedAt, &d.UpdatedAt)
+}
+
+// Look up a pending, unexpired device code by the code the user typed in
+func FindPendingDeviceCode(userCode string, db *sqlx.DB) (*DeviceCode, error) {
+	d := DeviceCode{}
+	query := db.Rebind(`SELECT ` + strings.Join(DeviceCode{}.queryColumns(), ", ") + ` FROM oauth_device_codes
+		WHERE user_code = ? AND status = ? AND expires_at > ?`)
+	err := db.Get(&d, query, NormalizeUserCode(userCode), DEVICE_CODE_PENDING, time.Now())
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidUserCode
+	} else if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Changes a pending device code's status.  Checking the status in the UPDATE keeps two requests racing on the same
+// code from both succeeding.
+func updatePendingDeviceCode(d *DeviceCode, status DeviceCodeStatus, userId *int64, db sqlx.Ext) error {
+	query := db.Rebind(`UPDATE oauth_device_codes SET status = ?, user_id = ?, updated_at = NOW()
+		WHERE id = ? AND status = ?`)
+	result, err := db.Exec(query, status, userId, d.Id, DEVICE_CODE_PENDING)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated != 1 {
+		return ErrInvalidUserCode
+	}
+	d.Status = status
+	d.UserId = userId
+	return nil
+}
+
+// Approves the device with the given user code for user and creates the Sensor the device's token will be
+// bound to.  If sensorName is empty then the name the device asked for is used.
+func ApproveDeviceCode(userCode string, user User, sensorName string, db *sqlx.DB) (*Sensor, error) {
+	d, err := FindPendingDeviceCode(userCode, db)
+	if err != nil {
+		return nil, err
+	}
+	if sensorName == "" {
+		sensorName = d.SensorName
+	}
+	if sensorName == "" {
+		sensorName = d.ClientId
+	}
+
+	// All in one transaction so that a failure part way through leaves the code pending rather than approved
+	// without a sensor, which the device would poll until the code expires
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := updatePendingDeviceCode(d, DEVICE_CODE_APPROVED, user.Id, tx); err != nil {
+		return nil, err
+	}
+	sensor := Sensor{Name: sensorName, UserId: user.Id, CreatedBy: &user}
+	if err := insertSensor(tx, &sensor); err != nil {
+		return nil, err
+	}
+	// The device keeps getting authorization_pending until this is set
+	query := tx.Rebind(`UPDATE oauth_device_codes SET sensor_id = ?, updated_at = NOW() WHERE id = ?`)
+	if _, err := tx.Exec(query, sensor.Id, d.Id); err != nil {
+		return nil, err
+	}
+	return &sensor, tx.Commit()
+}
+
+func DenyDeviceCode(userCode string, user User, db *sqlx.DB) error {
+	d, err := FindPendingDeviceCode(userCode, db)
+	if err != nil {
+		return err
+	}
+	return updatePendingDeviceCode(d, DEVICE_CODE_DENIED, user.Id, db)
+}
+
+// Called by the device when polling.  Returns the personal access token for the device once the user has approved
+// it, otherwise one of the RFC 8628 errors, such as ErrDeviceAuthorizationPending.
+func RedeemDeviceCode(deviceCode, clientId string, db *sqlx.DB) (AuthToken, error) {
+	parts := strings.SplitN(deviceCode, ":", 2)
+	if len(parts) != 2 {
+		return AuthToken{}, ErrInvalidDeviceCode
+	}
+
+	d := DeviceCode{}
+	query := db.Rebind(`SELECT ` + strings.Join(DeviceCode{}.queryColumns(), ", ") + ` FROM oauth_device_codes
+		WHERE id = ?`)
+	if err := db.Get(&d, query, parts[0]); err == sql.ErrNoRows {
+		return AuthToken{}, ErrInvalidDeviceCode
+	} else if err != nil {
+		return AuthToken{}, err
+	}
+	if !d.compare(parts[1]) || d.ClientId != clientId {
+		return AuthToken{}, ErrInvalidDeviceCode
+	}
+
+	switch d.Status {
+	case DEVICE_CODE_DENIED:
+		return AuthToken{}, ErrDeviceAccessDenied
+	case DEVICE_CODE_REDEEMED:
+		return AuthToken{}, ErrInvalidDeviceCode
+	}
+	now := time.Now()
+	if now.After(d.ExpiresAt) {
+		return AuthToken{}, ErrDeviceCodeExpired
+	}
+
+	// RFC 8628 3.5 says to add 5 seconds to the interval every time a device polls too fast
+	if d.LastPolledAt != nil && now.Sub(*d.LastPolledAt) < time.Duration(d.PollInterval)*time.Second {
+		query = db.Rebind(`UPDATE oauth_device_codes SET poll_interval = poll_interval + 5, last_polled_at = ?,
+			updated_at = NOW() WHERE id = ?`)
+		if _, err := db.Exec(query, now, d.Id); err != nil {
+			return AuthToken{}, err
+		}
+		return AuthToken{}, ErrDeviceSlowDown
+	}
+	query = db.Rebind(`UPDATE oauth_device_codes SET last_polled_at = ?, updated_at = NOW() WHERE id = ?`)
+	if _, err := db.Exec(query, now, d.Id); err != nil {
+		return AuthToken{}, err
+	}
+
+	if d.Status != DEVICE_CODE_APPROVED || d.SensorId == nil {
+		return AuthToken{}, ErrDeviceAuthorizationPending
+	}
+
+	user, err := FindUser(map[string]interface{}{"id": *d.UserId}, db)
+	if err != nil {
+		return AuthToken{}, err
+	}
+	token, err := GenerateSensorToken(*user, *d.SensorId, DeviceTokenScope)
+	if err != nil {
+		return AuthToken{}, err
+	}
+
+	// The code is only used up if the token is saved, so that the device can poll again after a failure
+	tx, err := db.Beginx()
+	if err != nil {
+		return AuthToken{}, err
+	}
+	defer tx.Rollback()
+	// As with approving, the status is checked in the UPDATE so that only one poll gets a token
+	query = tx.Rebind(`UPDATE oauth_device_codes SET status = ?, updated_at = NOW() WHERE id = ? AND status = ?`)
+	result, err := tx.Exec(query, DEVICE_CODE_REDEEMED, d.Id, DEVICE_CODE_APPROVED)
+	if err != nil {
+		return AuthToken{}, err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return AuthToken{}, err
+	} else if updated != 1 {
+		return AuthToken{}, ErrInvalidDeviceCode
+	}
+	if err := insertAuthToken(tx, &token); err != nil {
+		return AuthToken{}, err
+	}
+	return token, tx.Commit()
+}
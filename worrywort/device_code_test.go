@@ -0,0 +1,131 @@
+package worrywort
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceCodeFlow(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort", IsActive: true}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+
+	newCode := func(t *testing.T) DeviceCode {
+		d, err := NewDeviceCode("esp32-thermometer", "Fermentation Chamber", DefaultDeviceCodeTTL)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := d.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		return d
+	}
+
+	// lets the next poll through without tripping slow_down
+	resetPolledAt := func(t *testing.T, d DeviceCode) {
+		if _, err := db.Exec(db.Rebind(`UPDATE oauth_device_codes SET last_polled_at = NULL WHERE id = ?`), d.Id); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	t.Run("Approve and redeem", func(t *testing.T) {
+		d := newCode(t)
+		if _, err := RedeemDeviceCode(d.ForDevice(), d.ClientId, db); err != ErrDeviceAuthorizationPending {
+			t.Errorf("Expected error: %v\nGot: %v", ErrDeviceAuthorizationPending, err)
+		}
+		if _, err := RedeemDeviceCode(d.ForDevice(), d.ClientId, db); err != ErrDeviceSlowDown {
+			t.Errorf("Expected error: %v\nGot: %v", ErrDeviceSlowDown, err)
+		}
+
+		// lower case and without the dash, the way people actually type it
+		sensor, err := ApproveDeviceCode(NormalizeUserCode(d.UserCode), user, "", db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if sensor.Name != "Fermentation Chamber" || *sensor.UserId != *user.Id {
+			t.Errorf("Unexpected sensor %v", sensor)
+		}
+
+		resetPolledAt(t, d)
+		token, err := RedeemDeviceCode(d.ForDevice(), d.ClientId, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if token.SensorId == nil || *token.SensorId != *sensor.Id || token.Scope != DeviceTokenScope ||
+			token.Type != TOKEN_TYPE_PERSONAL_ACCESS {
+			t.Errorf("Unexpected token %v", token)
+		}
+
+		authenticated, err := AuthenticateUserByToken(token.ForAuthenticationHeader(), db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if authenticated.SensorId == nil || *authenticated.SensorId != *sensor.Id {
+			t.Errorf("Expected token bound to sensor %d but got %v", *sensor.Id, authenticated.SensorId)
+		}
+
+		resetPolledAt(t, d)
+		if _, err := RedeemDeviceCode(d.ForDevice(), d.ClientId, db); err != ErrInvalidDeviceCode {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidDeviceCode, err)
+		}
+	})
+
+	t.Run("Deny", func(t *testing.T) {
+		d := newCode(t)
+		if err := DenyDeviceCode(d.UserCodeForDisplay(), user, db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := ApproveDeviceCode(d.UserCode, user, "", db); err != ErrInvalidUserCode {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidUserCode, err)
+		}
+		if _, err := RedeemDeviceCode(d.ForDevice(), d.ClientId, db); err != ErrDeviceAccessDenied {
+			t.Errorf("Expected error: %v\nGot: %v", ErrDeviceAccessDenied, err)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		d, err := NewDeviceCode("esp32-thermometer", "", -1*time.Minute)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := d.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := ApproveDeviceCode(d.UserCode, user, "", db); err != ErrInvalidUserCode {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidUserCode, err)
+		}
+		if _, err := RedeemDeviceCode(d.ForDevice(), d.ClientId, db); err != ErrDeviceCodeExpired {
+			t.Errorf("Expected error: %v\nGot: %v", ErrDeviceCodeExpired, err)
+		}
+	})
+
+	t.Run("Peppered", func(t *testing.T) {
+		defer setTokenPeppers(map[int][]byte{1: []byte(testPepper)})()
+		d := newCode(t)
+		if d.HashVersion != 1 {
+			t.Errorf("Expected hash version 1 but got %d", d.HashVersion)
+		}
+		// still checked with the pepper it was made with after a new one is added
+		TokenPeppers = map[int][]byte{1: []byte(testPepper), 2: []byte(testPepper + "x")}
+		if _, err := RedeemDeviceCode(d.ForDevice(), d.ClientId, db); err != ErrDeviceAuthorizationPending {
+			t.Errorf("Expected error: %v\nGot: %v", ErrDeviceAuthorizationPending, err)
+		}
+	})
+
+	t.Run("Wrong client id or secret", func(t *testing.T) {
+		d := newCode(t)
+		if _, err := RedeemDeviceCode(d.ForDevice(), "other-client", db); err != ErrInvalidDeviceCode {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidDeviceCode, err)
+		}
+		if _, err := RedeemDeviceCode(d.Id+":wrong", d.ClientId, db); err != ErrInvalidDeviceCode {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidDeviceCode, err)
+		}
+	})
+}
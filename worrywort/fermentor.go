@@ -30,6 +30,7 @@ type Fermentor struct {
 	IsAvailable   bool               `db:"is_available"`
 	CreatedBy     *User              `db:"created_by,prefix=u"`
 	UserId        *int64             `db:"user_id"`
+	TeamId        *int64             `db:"team_id"`
 	Batch         *Batch
 	BatchId       *int64 `db:"batch_id"`
 
@@ -49,9 +50,16 @@ func FindFermentor(params map[string]interface{}, db *sqlx.DB) (*Fermentor, erro
 			where = append(where, fmt.Sprintf("f.%s = ?", k))
 		}
 	}
+	for k, minRole := range map[string]TeamRole{"viewable_by": TEAM_ROLE_VIEWER, "editable_by": TEAM_ROLE_BREWER} {
+		if v, ok := params[k]; ok {
+			clause, args, _ := teamAccess("f.user_id", "f.team_id", v, minRole).ToSql()
+			where = append(where, clause)
+			values = append(values, args...)
+		}
+	}
 
 	q := `SELECT f.id, f.name, f.description, f.volume, f.volume_units, f.fermentor_type, f.is_active, f.is_available,
-		f.user_id, f.batch_id, f.created_at, f.updated_at FROM fermentors f WHERE ` + strings.Join(where, " AND ")
+		f.user_id, f.team_id, f.batch_id, f.created_at, f.updated_at FROM fermentors f WHERE ` + strings.Join(where, " AND ")
 	query := db.Rebind(q)
 	err := db.Get(&f, query, values...)
 
@@ -76,10 +84,10 @@ func InsertFermentor(db *sqlx.DB, f *Fermentor) error {
 	var createdAt time.Time
 	fermentorId := new(int64)
 
-	query := db.Rebind(`INSERT INTO fermentors (user_id, name, description, volume, volume_units, fermentor_type,
-		is_active, is_available, batch_id, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NOW()) RETURNING id, created_at, updated_at`)
-	err := db.QueryRow(query, f.UserId, f.Name, f.Description, f.Volume, f.VolumeUnits, f.FermentorType,
-		f.IsActive, f.IsAvailable, f.BatchId).Scan(fermentorId, &createdAt, &updatedAt)
+	query := db.Rebind(`INSERT INTO fermentors (user_id, team_id, name, description, volume, volume_units,
+		fermentor_type, is_active, is_available, batch_id, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW()) RETURNING id, created_at, updated_at`)
+	err := db.QueryRow(query, f.UserId, f.TeamId, f.Name, f.Description, f.Volume, f.VolumeUnits,
+		f.FermentorType, f.IsActive, f.IsAvailable, f.BatchId).Scan(fermentorId, &createdAt, &updatedAt)
 	if err == nil {
 		f.Id = fermentorId
 		f.CreatedAt = createdAt
@@ -92,10 +100,10 @@ func UpdateFermentor(db *sqlx.DB, f *Fermentor) error {
 	// TODO: TEST CASE
 	var updatedAt time.Time
 	// TODO: Use introspection and reflection to set these rather than manually managing this?
-	query := db.Rebind(`UPDATE fermentors SET user_id = ?, name = ?, description = ?, volume = ?, volume_units = ?,
+	query := db.Rebind(`UPDATE fermentors SET user_id = ?, team_id = ?, name = ?, description = ?, volume = ?, volume_units = ?,
 		fermentor_type = ?, is_active = ?, is_available = ?, batch_id = ?, updated_at = NOW() WHERE id = ? RETURNING updated_at`)
-	err := db.QueryRow(query, f.UserId, f.Name, f.Description, f.Volume, f.VolumeUnits, f.FermentorType,
-		f.IsActive, f.IsAvailable, f.BatchId, f.Id).Scan(&updatedAt)
+	err := db.QueryRow(query, f.UserId, f.TeamId, f.Name, f.Description, f.Volume, f.VolumeUnits,
+		f.FermentorType, f.IsActive, f.IsAvailable, f.BatchId, f.Id).Scan(&updatedAt)
 	if err == nil {
 		f.UpdatedAt = updatedAt
 	}
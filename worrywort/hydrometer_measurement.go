@@ -0,0 +1,133 @@
+package worrywort
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/elgris/sqrl"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+var ErrDuplicateHydrometerMeasurement = errors.New("The sensor already has a hydrometer measurement recorded at that time.")
+
+// A gravity reading from a hydrometer such as an iSpindel or Tilt.  The temperature it reports is saved as a
+// TemperatureMeasurement for the same sensor and time.
+type HydrometerMeasurement struct {
+	Id       string  `db:"id"`
+	UserId   *int64  `db:"user_id"`
+	SensorId *int64  `db:"sensor_id"`
+	Gravity  float64 `db:"gravity"`
+	// The rest are only reported by some devices
+	Angle           *float64 `db:"angle"`   // tilt in degrees
+	Battery         *float64 `db:"battery"` // volts
+	RSSI            *int     `db:"rssi"`
+	IntervalSeconds *int     `db:"interval_seconds"`
+
+	RecordedAt time.Time `db:"recorded_at"`
+	CreatedAt  time.Time `db:"created_at"`
+	UpdatedAt  time.Time `db:"updated_at"`
+}
+
+func (m HydrometerMeasurement) queryColumns() []string {
+	return []string{"id", "user_id", "sensor_id", "gravity", "angle", "battery", "rssi", "interval_seconds",
+		"recorded_at", "created_at", "updated_at"}
+}
+
+// Inserts the measurement.  Like TemperatureMeasurement, returns ErrDuplicateHydrometerMeasurement with m filled in
+// from the original if the sensor already has one recorded at the same time.
+func (m *HydrometerMeasurement) Save(db *sqlx.DB) error {
+	if m.Id != "" {
+		return nil
+	}
+	return insertHydrometerMeasurement(db, m)
+}
+
+// Inserts the measurement with either a DB or a Tx
+func insertHydrometerMeasurement(db sqlx.Ext, m *HydrometerMeasurement) error {
+	query := db.Rebind(`INSERT INTO hydrometer_measurements (user_id, sensor_id, gravity, angle, battery, rssi,
+		interval_seconds, recorded_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW())
+		ON CONFLICT (sensor_id, recorded_at) DO NOTHING RETURNING id, created_at, updated_at`)
+	err := db.QueryRowx(query, m.UserId, m.SensorId, m.Gravity, m.Angle, m.Battery, m.RSSI, m.IntervalSeconds,
+		m.RecordedAt).Scan(&m.Id, &m.CreatedAt, &m.UpdatedAt)
+	if err == sql.ErrNoRows {
+		query, values, err := buildHydrometerMeasurementsQuery(
+			map[string]interface{}{"sensor_id": *m.SensorId, "recorded_at": m.RecordedAt}).ToSql()
+		if err != nil {
+			return err
+		}
+		if err := sqlx.Get(db, m, db.Rebind(query), values...); err != nil {
+			return err
+		}
+		return ErrDuplicateHydrometerMeasurement
+	}
+	return err
+}
+
+// Saves the temperature and gravity a hydrometer such as an iSpindel reported together in one transaction, so that
+// one is never saved without the other.  Either may already exist, such as when the device retries, in which case it
+// is filled in from the original the same as Save() does, rather than being an error.  Returns whether the temperature
+// was newly created.
+func InsertHydrometerReading(db *sqlx.DB, tm *TemperatureMeasurement, hm *HydrometerMeasurement) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	err = insertTemperatureMeasurement(tx, tm)
+	if err != nil && err != ErrDuplicateTemperatureMeasurement {
+		return false, err
+	}
+	created := err == nil
+	if err := insertHydrometerMeasurement(tx, hm); err != nil && err != ErrDuplicateHydrometerMeasurement {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+func buildHydrometerMeasurementsQuery(params map[string]interface{}) *sqrl.SelectBuilder {
+	query := sqrl.Select().From("hydrometer_measurements hm")
+	for _, k := range []string{"id", "user_id", "sensor_id", "recorded_at"} {
+		if v, ok := params[k]; ok {
+			query = query.Where(sqrl.Eq{fmt.Sprintf("hm.%s", k): v})
+		}
+	}
+	// shared along with the sensor which took them, like temperature measurements
+	query = query.LeftJoin("sensors s ON s.id = hm.sensor_id")
+	query = whereTeamAccess(query, "hm.user_id", "s.team_id", params)
+	if v, ok := params["limit"]; ok {
+		query = query.Limit(uint64(v.(int)))
+	}
+	if v, ok := params["offset"]; ok {
+		query = query.Offset(uint64(v.(int)))
+	}
+	for _, k := range (HydrometerMeasurement{}).queryColumns() {
+		query = query.Column(fmt.Sprintf("hm.%s", k))
+	}
+	return query.OrderBy("hm.recorded_at DESC")
+}
+
+// Look up a hydrometer measurement.  Accepts `id`, `user_id`, `sensor_id`, `recorded_at`, `viewable_by`, and
+// `editable_by`.
+func FindHydrometerMeasurement(params map[string]interface{}, db *sqlx.DB) (*HydrometerMeasurement, error) {
+	m := new(HydrometerMeasurement)
+	query, values, err := buildHydrometerMeasurementsQuery(params).ToSql()
+	if err == nil {
+		err = db.Get(m, db.Rebind(query), values...)
+	}
+	return m, err
+}
+
+// Look up hydrometer measurements, newest first.  Accepts the same params as FindHydrometerMeasurement plus `limit`
+// and `offset`.
+func FindHydrometerMeasurements(params map[string]interface{}, db *sqlx.DB) ([]*HydrometerMeasurement, error) {
+	measurements := []*HydrometerMeasurement{}
+	query, values, err := buildHydrometerMeasurementsQuery(params).ToSql()
+	if err == nil {
+		err = db.Select(&measurements, db.Rebind(query), values...)
+	}
+	return measurements, err
+}
@@ -0,0 +1,49 @@
+package worrywort
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInsertHydrometerReading(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	u := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := u.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := Sensor{Name: "iSpindel", UserId: u.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	recordedAt := time.Now().UTC().Round(time.Microsecond)
+
+	t.Run("Both saved", func(t *testing.T) {
+		tm := &TemperatureMeasurement{UserId: u.Id, SensorId: sensor.Id, Temperature: 20.5, Units: CELSIUS,
+			RecordedAt: recordedAt}
+		hm := &HydrometerMeasurement{UserId: u.Id, SensorId: sensor.Id, Gravity: 1.048, RecordedAt: recordedAt}
+		created, err := InsertHydrometerReading(db, tm, hm)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !created || tm.Id == "" || hm.Id == "" {
+			t.Errorf("Expected both measurements to be saved but got %v and %v", tm, hm)
+		}
+
+		// a retry gets the originals back
+		retryTm := &TemperatureMeasurement{UserId: u.Id, SensorId: sensor.Id, Temperature: 21, Units: CELSIUS,
+			RecordedAt: recordedAt}
+		retryHm := &HydrometerMeasurement{UserId: u.Id, SensorId: sensor.Id, Gravity: 1.040, RecordedAt: recordedAt}
+		created, err = InsertHydrometerReading(db, retryTm, retryHm)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if created || retryTm.Id != tm.Id || retryHm.Id != hm.Id || retryHm.Gravity != 1.048 {
+			t.Errorf("Expected the original measurements but got %v and %v", retryTm, retryHm)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package worrywort
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"time"
+)
+
+// Impersonation lets an admin see what another user sees, such as to help with "my sensor isn't showing data".  The
+// token is the impersonated user's, so everything treats the admin as that user, but it keeps the admin's id so that
+// the audit log shows who really acted.
+
+const (
+	DEFAULT_IMPERSONATION_DURATION = 30 * time.Minute
+	MAX_IMPERSONATION_DURATION     = 4 * time.Hour
+)
+
+var ErrImpersonationNotAllowed = errors.New("Only admins may impersonate other users.")
+var ErrCannotImpersonateUser = errors.New("That user cannot be impersonated.")
+
+// Makes a token for admin to act as target for the given duration, which is limited to MAX_IMPERSONATION_DURATION.
+// Other admins cannot be impersonated, since that would let an admin act with another admin's access.  The token is
+// read-only unless allowWrites is set.
+func GenerateImpersonationToken(admin, target User, duration time.Duration, allowWrites bool) (AuthToken, error) {
+	if !admin.IsAdmin || !admin.IsActive || admin.Id == nil {
+		return AuthToken{}, ErrImpersonationNotAllowed
+	}
+	if target.Id == nil || *target.Id == *admin.Id || target.IsAdmin || !target.IsActive {
+		return AuthToken{}, ErrCannotImpersonateUser
+	}
+	if duration <= 0 {
+		duration = DEFAULT_IMPERSONATION_DURATION
+	} else if duration > MAX_IMPERSONATION_DURATION {
+		duration = MAX_IMPERSONATION_DURATION
+	}
+
+	token, err := uuid.NewRandom()
+	if err != nil {
+		return AuthToken{}, err
+	}
+	tokenb64 := base64.URLEncoding.EncodeToString([]byte(token.String()))
+	t := NewToken(tokenb64, target, TOKEN_SCOPE_ALL, TOKEN_TYPE_IMPERSONATION)
+	t.ExpiresAt = pq.NullTime{Time: time.Now().Add(duration), Valid: true}
+	t.ImpersonatorId = admin.Id
+	t.WritesAllowed = allowWrites
+	return t, nil
+}
+
+// Ends an impersonation session early by deleting its token.  Returns the impersonated user's id, or ErrInvalidToken
+// if there is no such impersonation token.
+func DeleteImpersonationToken(tokenId string, db *sqlx.DB) (int64, error) {
+	var userId int64
+	if _, err := uuid.Parse(tokenId); err != nil {
+		return userId, ErrInvalidToken
+	}
+	query := db.Rebind(`DELETE FROM user_authtokens WHERE id = ? AND type = ? RETURNING user_id`)
+	err := db.QueryRow(query, tokenId, TOKEN_TYPE_IMPERSONATION).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return userId, ErrInvalidToken
+	}
+	return userId, err
+}
@@ -0,0 +1,61 @@
+package worrywort
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGenerateImpersonationToken(t *testing.T) {
+	adminId, userId, otherAdminId := int64(1), int64(2), int64(3)
+	admin := User{Id: &adminId, IsActive: true, IsAdmin: true}
+	user := User{Id: &userId, IsActive: true}
+
+	t.Run("Token is for the target", func(t *testing.T) {
+		token, err := GenerateImpersonationToken(admin, user, 0, false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if *token.User.Id != userId || *token.ImpersonatorId != adminId || token.Type != TOKEN_TYPE_IMPERSONATION {
+			t.Errorf("Expected an impersonation token for user %d by %d but got %v", userId, adminId, token)
+		}
+		if !token.IsReadOnly() {
+			t.Errorf("Expected a read-only token")
+		}
+		if !token.ExpiresAt.Valid || token.ExpiresAt.Time.After(time.Now().Add(DEFAULT_IMPERSONATION_DURATION)) {
+			t.Errorf("Expected the default expiration but got %v", token.ExpiresAt)
+		}
+	})
+
+	t.Run("Duration is limited", func(t *testing.T) {
+		token, err := GenerateImpersonationToken(admin, user, 24*time.Hour, true)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if token.ExpiresAt.Time.After(time.Now().Add(MAX_IMPERSONATION_DURATION)) {
+			t.Errorf("Expected expiration within %v but got %v", MAX_IMPERSONATION_DURATION, token.ExpiresAt.Time)
+		}
+		if token.IsReadOnly() {
+			t.Errorf("Expected a token which allows writes")
+		}
+	})
+
+	var errorTests = []struct {
+		name     string
+		admin    User
+		target   User
+		expected error
+	}{
+		{"Non-admin", user, admin, ErrImpersonationNotAllowed},
+		{"Inactive admin", User{Id: &adminId, IsAdmin: true}, user, ErrImpersonationNotAllowed},
+		{"Self", admin, admin, ErrCannotImpersonateUser},
+		{"Other admin", admin, User{Id: &otherAdminId, IsActive: true, IsAdmin: true}, ErrCannotImpersonateUser},
+		{"Inactive user", admin, User{Id: &userId}, ErrCannotImpersonateUser},
+	}
+	for _, tc := range errorTests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := GenerateImpersonationToken(tc.admin, tc.target, 0, false); err != tc.expected {
+				t.Errorf("Expected %v but got %v", tc.expected, err)
+			}
+		})
+	}
+}
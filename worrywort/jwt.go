@@ -0,0 +1,132 @@
+package worrywort
+
+import (
+	"crypto/rsa"
+	"database/sql"
+	"errors"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"time"
+)
+
+// Signed JWT access tokens for browser sessions.  Unlike AuthToken these are never stored, so they are
+// validated without a database lookup.  They cannot be revoked one at a time, but AuthenticateJWTUser() refuses
+// every JWT a user had once they are deactivated or change their password.
+
+// How long a JWT access token is valid for if JWTConfig.TTL is not set
+const DefaultJWTTTL = 15 * time.Minute
+
+var ErrJWTNotConfigured = errors.New("JWT access tokens are not configured")
+
+type JWTConfig struct {
+	// Secret used to sign and verify HS256 tokens.  New tokens are signed with this if there is no RSASigningKey.
+	Secret []byte
+	// Public keys used to verify RS256 tokens, by the `kid` header.  When the signing key is rotated,
+	// keep the old public key here until tokens signed with it have expired.
+	RSAPublicKeys map[string]*rsa.PublicKey
+	// If set, new tokens are signed with this key using RS256 and RSASigningKeyId as the `kid`
+	RSASigningKey   *rsa.PrivateKey
+	RSASigningKeyId string
+	TTL             time.Duration
+}
+
+type jwtClaims struct {
+	UserId  int64              `json:"uid"`
+	Scope   AuthTokenScopeType `json:"scope"`
+	IsAdmin bool               `json:"adm,omitempty"`
+	// Subject is the user's UUID
+	jwt.StandardClaims
+}
+
+// Returns a signed access token for the user.  Use ForAuthenticationHeader() to get the JWT itself.
+func (c *JWTConfig) NewAccessToken(user User, scope AuthTokenScopeType) (AuthToken, error) {
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultJWTTTL
+	}
+	jti, err := uuid.NewRandom()
+	if err != nil {
+		return AuthToken{}, err
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	claims := jwtClaims{UserId: *user.Id, Scope: scope, IsAdmin: user.IsAdmin, StandardClaims: jwt.StandardClaims{
+		Id: jti.String(), Subject: user.UUID, IssuedAt: now.Unix(), ExpiresAt: expiresAt.Unix()}}
+
+	var token *jwt.Token
+	var key interface{}
+	if c.RSASigningKey != nil {
+		token = jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = c.RSASigningKeyId
+		key = c.RSASigningKey
+	} else if len(c.Secret) > 0 {
+		token = jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		key = c.Secret
+	} else {
+		return AuthToken{}, ErrJWTNotConfigured
+	}
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		return AuthToken{}, err
+	}
+	return AuthToken{Id: claims.Id, User: user, Scope: scope, Type: TOKEN_TYPE_JWT,
+		ExpiresAt: pq.NullTime{Time: time.Unix(claims.ExpiresAt, 0), Valid: true}, CreatedAt: time.Unix(claims.IssuedAt, 0),
+		fromString: signed}, nil
+}
+
+// Picks the key to verify a token with.  The algorithm is checked against the keys which are configured rather than
+// trusting the header so that, for example, an RSA public key can never be used as an HS256 secret.
+func (c *JWTConfig) verificationKey(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		if len(c.Secret) > 0 {
+			return c.Secret, nil
+		}
+	case jwt.SigningMethodRS256.Alg():
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := c.RSAPublicKeys[kid]; ok {
+			return key, nil
+		}
+		if c.RSASigningKey != nil && kid == c.RSASigningKeyId {
+			return &c.RSASigningKey.PublicKey, nil
+		}
+	}
+	return nil, ErrInvalidToken
+}
+
+// Validates a JWT access token.  The returned AuthToken's User only has the fields carried in the
+// token - Id, UUID, and IsAdmin - so look the user up if anything else is needed.
+func (c *JWTConfig) ParseAccessToken(tokenStr string) (AuthToken, error) {
+	claims := jwtClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, &claims, c.verificationKey)
+	// StandardClaims.Valid() accepts a token without exp, but every token issued here has one
+	if err != nil || !token.Valid || claims.ExpiresAt == 0 || claims.Subject == "" {
+		return AuthToken{}, ErrInvalidToken
+	}
+
+	userId := claims.UserId
+	user := User{Id: &userId, UUID: claims.Subject, IsActive: true, IsAdmin: claims.IsAdmin}
+	return AuthToken{Id: claims.Id, User: user, Scope: claims.Scope, Type: TOKEN_TYPE_JWT,
+		ExpiresAt: pq.NullTime{Time: time.Unix(claims.ExpiresAt, 0), Valid: true},
+		CreatedAt: time.Unix(claims.IssuedAt, 0), fromString: tokenStr}, nil
+}
+
+// Looks up the user a JWT access token was issued to.  Returns ErrInvalidToken if the user has been deactivated or
+// their password has changed since the token was issued.
+func AuthenticateJWTUser(token AuthToken, db *sqlx.DB) (*User, error) {
+	user, err := FindUser(map[string]interface{}{"id": *token.User.Id, "uuid": token.User.UUID, "is_active": true}, db)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	// iat only has whole seconds, so a token issued in the same second as the change is allowed rather than refusing
+	// one issued just after it, such as by logging in with the new password
+	if user.PasswordChangedAt != nil && token.CreatedAt.Before(user.PasswordChangedAt.Truncate(time.Second)) {
+		return nil, ErrInvalidToken
+	}
+	return user, nil
+}
@@ -0,0 +1,200 @@
+package worrywort
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWTAccessTokens(t *testing.T) {
+	uid := int64(1)
+	user := User{Id: &uid, UUID: "9a2a1f5e-3f8e-4a27-9e51-6f3b1c2d4e5f", Email: "user@example.com", IsActive: true,
+		IsAdmin: true}
+	// only what is carried in the token comes back out
+	expectedUser := User{Id: &uid, UUID: user.UUID, IsActive: true, IsAdmin: true}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	oldRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	hmacConfig := &JWTConfig{Secret: []byte("01234567890123456789012345678901")}
+	rsaConfig := &JWTConfig{RSASigningKey: rsaKey, RSASigningKeyId: "new",
+		RSAPublicKeys: map[string]*rsa.PublicKey{"old": &oldRSAKey.PublicKey}}
+
+	for name, config := range map[string]*JWTConfig{"HS256": hmacConfig, "RS256": rsaConfig} {
+		t.Run(name+" round trip", func(t *testing.T) {
+			token, err := config.NewAccessToken(user, TOKEN_SCOPE_READ_ALL)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if strings.Count(token.ForAuthenticationHeader(), ".") != 2 {
+				t.Errorf("Expected a JWT but got %s", token.ForAuthenticationHeader())
+			}
+
+			parsed, err := config.ParseAccessToken(token.ForAuthenticationHeader())
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !cmp.Equal(expectedUser, parsed.User) {
+				t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(expectedUser, parsed.User))
+			}
+			if parsed.Scope != TOKEN_SCOPE_READ_ALL || parsed.Type != TOKEN_TYPE_JWT || parsed.Id != token.Id {
+				t.Errorf("Unexpected token %v", parsed)
+			}
+			if !parsed.ExpiresAt.Valid || parsed.ExpiresAt.Time.Sub(time.Now()) > DefaultJWTTTL {
+				t.Errorf("Unexpected expiration %v", parsed.ExpiresAt)
+			}
+		})
+	}
+
+	t.Run("Token signed with rotated out key still validates", func(t *testing.T) {
+		oldConfig := &JWTConfig{RSASigningKey: oldRSAKey, RSASigningKeyId: "old"}
+		token, err := oldConfig.NewAccessToken(user, TOKEN_SCOPE_ALL)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := rsaConfig.ParseAccessToken(token.ForAuthenticationHeader()); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Unknown kid", func(t *testing.T) {
+		otherConfig := &JWTConfig{RSASigningKey: oldRSAKey, RSASigningKeyId: "unknown"}
+		token, err := otherConfig.NewAccessToken(user, TOKEN_SCOPE_ALL)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := rsaConfig.ParseAccessToken(token.ForAuthenticationHeader()); err != ErrInvalidToken {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidToken, err)
+		}
+	})
+
+	t.Run("Wrong secret", func(t *testing.T) {
+		token, err := hmacConfig.NewAccessToken(user, TOKEN_SCOPE_ALL)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		otherConfig := &JWTConfig{Secret: []byte("abcdefghijabcdefghijabcdefghijab")}
+		if _, err := otherConfig.ParseAccessToken(token.ForAuthenticationHeader()); err != ErrInvalidToken {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidToken, err)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		expiredConfig := &JWTConfig{Secret: hmacConfig.Secret, TTL: -1 * time.Minute}
+		token, err := expiredConfig.NewAccessToken(user, TOKEN_SCOPE_ALL)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := hmacConfig.ParseAccessToken(token.ForAuthenticationHeader()); err != ErrInvalidToken {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidToken, err)
+		}
+	})
+
+	t.Run("HS256 token is rejected when only RSA keys are configured", func(t *testing.T) {
+		// a token signed using the RSA public key as an HMAC secret must not validate
+		claims := jwtClaims{UserId: uid, StandardClaims: jwt.StandardClaims{Subject: user.UUID,
+			ExpiresAt: time.Now().Add(time.Minute).Unix()}}
+		forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		forged.Header["kid"] = "new"
+		signed, err := forged.SignedString([]byte("anything"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := rsaConfig.ParseAccessToken(signed); err != ErrInvalidToken {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidToken, err)
+		}
+	})
+
+	t.Run("Token without exp is rejected", func(t *testing.T) {
+		claims := jwtClaims{UserId: uid, StandardClaims: jwt.StandardClaims{Subject: user.UUID}}
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(hmacConfig.Secret)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := hmacConfig.ParseAccessToken(signed); err != ErrInvalidToken {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidToken, err)
+		}
+	})
+
+	t.Run("Not configured", func(t *testing.T) {
+		if _, err := (&JWTConfig{}).NewAccessToken(user, TOKEN_SCOPE_ALL); err != ErrJWTNotConfigured {
+			t.Errorf("Expected error: %v\nGot: %v", ErrJWTNotConfigured, err)
+		}
+	})
+}
+
+func TestAuthenticateJWTUser(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort", IsActive: true}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	config := &JWTConfig{Secret: []byte("01234567890123456789012345678901")}
+	newToken := func() AuthToken {
+		token, err := config.NewAccessToken(user, TOKEN_SCOPE_ALL)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		parsed, err := config.ParseAccessToken(token.ForAuthenticationHeader())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return parsed
+	}
+
+	t.Run("Active user", func(t *testing.T) {
+		found, err := AuthenticateJWTUser(newToken(), db)
+		if err != nil || *found.Id != *user.Id || found.Email != user.Email {
+			t.Errorf("Expected user %v but got %v, %v", user, found, err)
+		}
+	})
+
+	t.Run("Password changed", func(t *testing.T) {
+		token := newToken()
+		// as if the token was issued well before the password change
+		token.CreatedAt = token.CreatedAt.Add(-1 * time.Minute)
+		if err := SetUserPassword(&user, "changed", bcrypt.MinCost); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := user.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if user.PasswordChangedAt == nil {
+			t.Fatalf("Expected PasswordChangedAt to be set")
+		}
+		if _, err := AuthenticateJWTUser(token, db); err != ErrInvalidToken {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidToken, err)
+		}
+		// logging in again with the new password works
+		if _, err := AuthenticateJWTUser(newToken(), db); err != nil {
+			t.Errorf("%v", err)
+		}
+	})
+
+	t.Run("Deactivated user", func(t *testing.T) {
+		token := newToken()
+		user.IsActive = false
+		if err := user.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := AuthenticateJWTUser(token, db); err != ErrInvalidToken {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidToken, err)
+		}
+	})
+}
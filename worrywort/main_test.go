@@ -6,6 +6,7 @@ import (
 	"fmt"
 	txdb "github.com/DATA-DOG/go-txdb"
 	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
 	"os"
 	"testing"
 )
@@ -21,6 +22,8 @@ func TestMain(m *testing.M) {
 		connString += fmt.Sprintf(" password=%s", dbPassword)
 	}
 	txdb.Register("txdb", "postgres", connString)
+	// test users are hashed with bcrypt.MinCost, don't slow every login down by upgrading them
+	PasswordHashCost = bcrypt.MinCost
 	retCode := m.Run()
 	os.Exit(retCode)
 }
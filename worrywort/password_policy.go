@@ -0,0 +1,68 @@
+package worrywort
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Rules new passwords must follow.  Checked when a password is changed or reset.
+
+const DefaultMinPasswordLength = 10
+
+// bcrypt only uses the first 72 bytes, so anything past that would give a false sense of security
+const maxPasswordBytes = 72
+
+type PasswordPolicy struct {
+	MinLength int
+	// Lower cased passwords which may not be used, such as from a list of commonly used passwords
+	Blocklist map[string]bool
+}
+
+func NewPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{MinLength: DefaultMinPasswordLength, Blocklist: map[string]bool{}}
+}
+
+// Loads a blocklist file with one password per line.  Blank lines and lines starting with # are skipped.
+func LoadPasswordBlocklist(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	blocklist := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		blocklist[strings.ToLower(line)] = true
+	}
+	return blocklist, scanner.Err()
+}
+
+// Checks password against the policy.  Returns a message for each rule it breaks, suitable for showing to the user,
+// or an empty slice if the password is acceptable.  user may be nil, otherwise the password may not be their email.
+func (p *PasswordPolicy) Validate(password string, user *User) []string {
+	problems := []string{}
+	if password == "" {
+		problems = append(problems, "Password must not be blank.")
+	} else if utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("Password must be at least %d characters.", p.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("Password must be no more than %d bytes.", maxPasswordBytes))
+	}
+	lowered := strings.ToLower(password)
+	if p.Blocklist[lowered] {
+		problems = append(problems, "Password is too common.")
+	}
+	if user != nil && user.Email != "" && lowered == strings.ToLower(user.Email) {
+		problems = append(problems, "Password must not be the same as your email address.")
+	}
+	return problems
+}
@@ -0,0 +1,63 @@
+package worrywort
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 10, Blocklist: map[string]bool{"password123": true}}
+	user := &User{Email: "user@example.com"}
+
+	var tests = []struct {
+		name     string
+		password string
+		expected []string
+	}{
+		{"acceptable", "correct horse battery", []string{}},
+		{"blank", "", []string{"Password must not be blank."}},
+		{"too short", "short", []string{"Password must be at least 10 characters."}},
+		{"length counts characters not bytes", "ééééééééé", []string{"Password must be at least 10 characters."}},
+		{"too long", strings.Repeat("a", 73), []string{"Password must be no more than 72 bytes."}},
+		{"blocklisted ignoring case", "Password123", []string{"Password is too common."}},
+		{"same as email", "USER@example.com", []string{"Password must not be the same as your email address."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := policy.Validate(tt.password, user)
+			if !cmp.Equal(problems, tt.expected) {
+				t.Errorf("Expected: %v\nGot: %v", tt.expected, problems)
+			}
+		})
+	}
+
+	t.Run("nil user", func(t *testing.T) {
+		if problems := policy.Validate("user@example.com", nil); len(problems) != 0 {
+			t.Errorf("Unexpected problems: %v", problems)
+		}
+	})
+}
+
+func TestLoadPasswordBlocklist(t *testing.T) {
+	f, err := ioutil.TempFile("", "blocklist")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("# common passwords\nPassword1\n\n  qwertyuiop  \n"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	f.Close()
+
+	blocklist, err := LoadPasswordBlocklist(f.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := map[string]bool{"password1": true, "qwertyuiop": true}
+	if !cmp.Equal(blocklist, expected) {
+		t.Errorf("Expected: %v\nGot: %v", expected, blocklist)
+	}
+}
@@ -0,0 +1,157 @@
+package worrywort
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"strings"
+	"time"
+)
+
+// Password reset tokens are kept separate from AuthToken because they are single use, short lived,
+// and must never be usable to authenticate a request.
+
+// How long a password reset token is valid for if no other duration is specified
+const DefaultPasswordResetTokenTTL = time.Hour
+
+var ErrInvalidPasswordResetToken = errors.New("Invalid or expired password reset token.")
+
+type PasswordResetToken struct {
+	Id          string     `db:"id"`
+	Token       string     `db:"token"` // hashed, the same as AuthToken.Token
+	HashVersion int        `db:"hash_version"`
+	UserId      *int64     `db:"user_id"`
+	ExpiresAt   time.Time  `db:"expires_at"`
+	UsedAt      *time.Time `db:"used_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at"`
+
+	fromString string // usually empty, the string this token was generated from
+}
+
+// The token as it should be given to the user, such as in a password reset email.
+// This is only available on a newly generated token since only the hash is stored.
+func (t PasswordResetToken) ForPasswordReset() string {
+	return t.Id + ":" + t.fromString
+}
+
+func (t PasswordResetToken) Compare(token string) bool {
+	tokenHash, err := HashToken(token, t.HashVersion)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(tokenHash), []byte(t.Token)) == 1
+}
+
+// Generate a random password reset token for a user which expires after ttl.  The token must be saved before
+// ForPasswordReset() will return a usable value.
+func GeneratePasswordResetToken(user User, ttl time.Duration) (PasswordResetToken, error) {
+	token, err := uuid.NewRandom()
+	if err != nil {
+		return PasswordResetToken{}, err
+	}
+	tokenb64 := base64.URLEncoding.EncodeToString([]byte(token.String()))
+	version := CurrentTokenHashVersion()
+	// cannot fail, the current version always has a pepper
+	tokenHash, _ := HashToken(tokenb64, version)
+	return PasswordResetToken{Token: tokenHash, HashVersion: version, UserId: user.Id,
+		ExpiresAt: time.Now().Add(ttl), fromString: tokenb64}, nil
+}
+
+// Inserts the PasswordResetToken.  Reset tokens are never updated other than to mark them used, which is handled
+// by ResetPassword()
+func (t *PasswordResetToken) Save(db *sqlx.DB) error {
+	if t.Id != "" {
+		return nil
+	}
+	query := db.Rebind(`INSERT INTO user_password_reset_tokens (user_id, token, hash_version, expires_at, updated_at)
+		VALUES (?, ?, ?, ?, NOW()) RETURNING id, created_at, updated_at`)
+	return db.QueryRow(query, t.UserId, t.Token, t.HashVersion, t.ExpiresAt).Scan(&t.Id, &t.CreatedAt, &t.UpdatedAt)
+}
+
+// Finds an unused, unexpired reset token and the user it belongs to
+func findPasswordResetToken(tokenStr string, db *sqlx.DB) (*PasswordResetToken, *User, error) {
+	tokenParts := strings.SplitN(tokenStr, ":", 2)
+	if len(tokenParts) != 2 {
+		return nil, nil, ErrInvalidPasswordResetToken
+	}
+
+	token := PasswordResetToken{}
+	query := db.Rebind(`SELECT id, token, hash_version, user_id, expires_at, used_at, created_at, updated_at
+		FROM user_password_reset_tokens WHERE id = ? AND used_at IS NULL AND expires_at > ?`)
+	err := db.Get(&token, query, tokenParts[0], time.Now())
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidPasswordResetToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if !token.Compare(tokenParts[1]) {
+		return nil, nil, ErrInvalidPasswordResetToken
+	}
+
+	user, err := FindUser(map[string]interface{}{"id": *token.UserId}, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &token, user, nil
+}
+
+// Returns the user a reset token belongs to without using up the token, such as to check the new password
+// against the user before calling ResetPassword().
+func FindPasswordResetTokenUser(tokenStr string, db *sqlx.DB) (*User, error) {
+	_, user, err := findPasswordResetToken(tokenStr, db)
+	return user, err
+}
+
+// Sets a new password for the user the reset token belongs to.  The token is marked used so that it cannot
+// be used again, any other outstanding reset tokens for the user are deleted, and all login, TOTP challenge and
+// impersonation tokens for the user are deleted so that every session must log in again with the new password.
+func ResetPassword(tokenStr, newPassword string, hashCost int, db *sqlx.DB) (*User, error) {
+	token, user, err := findPasswordResetToken(tokenStr, db)
+	if err != nil {
+		return nil, err
+	}
+	// hashed before the transaction is started so that it is not held open for the slow bcrypt
+	if err := SetUserPassword(user, newPassword, hashCost); err != nil {
+		return nil, err
+	}
+
+	// All in one transaction so that a failure to save the password does not use up the token
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Checking used_at again here rather than trusting the SELECT keeps two requests racing with the same token
+	// from both succeeding.
+	query := tx.Rebind(`UPDATE user_password_reset_tokens SET used_at = NOW(), updated_at = NOW()
+		WHERE id = ? AND used_at IS NULL`)
+	result, err := tx.Exec(query, token.Id)
+	if err != nil {
+		return nil, err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if updated != 1 {
+		return nil, ErrInvalidPasswordResetToken
+	}
+
+	query = tx.Rebind(`UPDATE users SET password = ?, password_changed_at = NOW(), updated_at = NOW() WHERE id = ?
+		RETURNING password_changed_at, updated_at`)
+	if err := tx.QueryRow(query, user.Password, *user.Id).Scan(&user.PasswordChangedAt, &user.UpdatedAt); err != nil {
+		return nil, err
+	}
+	query = tx.Rebind(`DELETE FROM user_password_reset_tokens WHERE user_id = ? AND used_at IS NULL`)
+	if _, err := tx.Exec(query, *user.Id); err != nil {
+		return nil, err
+	}
+	if err := deleteInteractiveAuthTokens(*user.Id, "", tx); err != nil {
+		return nil, err
+	}
+	return user, tx.Commit()
+}
@@ -1,6 +1,7 @@
 package worrywort
 
 import (
+	"database/sql"
 	"fmt"
 	"github.com/elgris/sqrl"
 	"github.com/jmoiron/sqlx"
@@ -17,6 +18,9 @@ type Sensor struct {
 	Name      string `db:"name"`
 	CreatedBy *User  `db:"u"`
 	UserId    *int64 `db:"user_id"`
+	TeamId    *int64 `db:"team_id"`
+	// Identifies the device for sensors which report their own id, such as "ispindel:1234567".  Empty otherwise.
+	DeviceId string `db:"device_id"`
 
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
@@ -27,12 +31,13 @@ func buildSensorsQuery(params map[string]interface{}, db *sqlx.DB) *sqrl.SelectB
 	// TODO: test for filter by name... or make a more generic setup which just accepts anything
 	// or a variadic list of sqrl stuff or a new type with name, comparison, value...
 	// or maybe can leverage sqrl for that somehow?
-	for _, k := range []string{"id", "user_id", "uuid", "name"} {
+	for _, k := range []string{"id", "user_id", "uuid", "name", "device_id"} {
 		// TODO: return error if not ok?
 		if v, ok := params[k]; ok {
 			query = query.Where(sqrl.Eq{fmt.Sprintf("s.%s", k): v})
 		}
 	}
+	query = whereTeamAccess(query, "s.user_id", "s.team_id", params)
 
 	// TODO: nice API around letting this be optional? Leaning towards functions like
 	// FindSensor and FindSensors should return the query or an object which has the query
@@ -41,11 +46,11 @@ func buildSensorsQuery(params map[string]interface{}, db *sqlx.DB) *sqrl.SelectB
 	// TODO: related to above TODO, consider functional options - https://dave.cheney.net/2014/10/17/functional-options-for-friendly-apis
 	query = query.LeftJoin("users u ON s.user_id = u.id")
 
-	for _, k := range []string{"id", "uuid", "name", "created_at", "updated_at", "user_id"} {
+	for _, k := range []string{"id", "uuid", "name", "created_at", "updated_at", "user_id", "team_id", "device_id"} {
 		query = query.Column(fmt.Sprintf("s.%s", k))
 	}
 
-	for _, k := range []string{"id", "uuid", "full_name", "username", "email", "password", "created_at", "updated_at"} {
+	for _, k := range (User{}).queryColumns() {
 		query = query.Column(fmt.Sprintf("u.%s \"u.%s\"", k, k))
 	}
 
@@ -98,14 +103,19 @@ func (s *Sensor) Save(db *sqlx.DB) error {
 }
 
 func InsertSensor(db *sqlx.DB, t *Sensor) error {
+	return insertSensor(db, t)
+}
+
+// Inserts the sensor with either a DB or a Tx
+func insertSensor(db sqlx.Ext, t *Sensor) error {
 	var updatedAt time.Time
 	var createdAt time.Time
 	sensorId := new(int64)
 	_uuid := new(string)
 
-	query := db.Rebind(`INSERT INTO sensors (user_id, name, updated_at)
-		VALUES (?, ?, NOW()) RETURNING id, uuid, created_at, updated_at`)
-	err := db.QueryRow(query, t.UserId, t.Name).Scan(sensorId, _uuid, &createdAt, &updatedAt)
+	query := db.Rebind(`INSERT INTO sensors (user_id, team_id, name, device_id, updated_at)
+		VALUES (?, ?, ?, ?, NOW()) RETURNING id, uuid, created_at, updated_at`)
+	err := db.QueryRowx(query, t.UserId, t.TeamId, t.Name, t.DeviceId).Scan(sensorId, _uuid, &createdAt, &updatedAt)
 
 	// I prefer handling the error case in the if, but this actually makes for slightly less code
 	if err == nil {
@@ -123,12 +133,40 @@ func UpdateSensor(db *sqlx.DB, t *Sensor) error {
 	// TODO: TEST CASE
 	var updatedAt time.Time
 	// TODO: Use introspection and reflection to set these rather than manually managing this?
-	query := db.Rebind(`UPDATE sensors SET user_id = ?, name = ?, updated_at = NOW()
+	query := db.Rebind(`UPDATE sensors SET user_id = ?, team_id = ?, name = ?, device_id = ?, updated_at = NOW()
 		WHERE id = ? RETURNING updated_at`)
 	err := db.QueryRow(
-		query, t.UserId, t.Name, t.Id).Scan(&updatedAt)
+		query, t.UserId, t.TeamId, t.Name, t.DeviceId, t.Id).Scan(&updatedAt)
 	if err == nil {
 		t.UpdatedAt = updatedAt
 	}
 	return err
 }
+
+// Looks up the user's own sensor for a device which identifies itself, such as an iSpindel.  A sensor with
+// the device's name and no device id yet is claimed for the device, so that a sensor made ahead of time can be used.
+// If create is set, a sensor is made for the device when there is neither.  Returns sql.ErrNoRows otherwise.
+// Team members' sensors are not matched since device ids and names, such as a Tilt's color, are only unique to a user.
+func FindDeviceSensor(user User, deviceId, name string, create bool, db *sqlx.DB) (*Sensor, error) {
+	sensor, err := FindSensor(map[string]interface{}{"device_id": deviceId, "user_id": *user.Id}, db)
+	if err != sql.ErrNoRows {
+		return sensor, err
+	}
+	if name != "" {
+		sensor, err = FindSensor(map[string]interface{}{"name": name, "device_id": "", "user_id": *user.Id}, db)
+		if err == nil {
+			sensor.DeviceId = deviceId
+			return sensor, sensor.Save(db)
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	if !create {
+		return nil, sql.ErrNoRows
+	}
+	if name == "" {
+		name = deviceId
+	}
+	sensor = &Sensor{Name: name, DeviceId: deviceId, UserId: user.Id, CreatedBy: &user}
+	return sensor, sensor.Save(db)
+}
@@ -0,0 +1,120 @@
+package worrywort
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/elgris/sqrl"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// Sensor keys are pre-shared keys which devices sign measurements with rather than sending an auth token, for
+// devices such as deep sleeping ESP8266 boards where an HTTPS request costs too much battery.  Unlike a token, the key
+// itself has to be stored in order to check signatures, so a key only allows saving measurements for its one sensor.
+
+var ErrSensorKeyRevoked = errors.New("Sensor key has already been revoked.")
+
+const sensorKeyBytes = 32
+
+// Signatures are HMAC-SHA256 truncated to this many bytes, to keep messages small
+const SensorKeySignatureBytes = 16
+
+type SensorKey struct {
+	Id        int64      `db:"id"`
+	SensorId  *int64     `db:"sensor_id"`
+	UserId    *int64     `db:"user_id"` // who made the key.  Measurements signed with it are saved as them.
+	Key       []byte     `db:"key"`
+	RevokedAt *time.Time `db:"revoked_at"`
+	CreatedAt time.Time  `db:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at"`
+}
+
+func (k SensorKey) queryColumns() []string {
+	return []string{"id", "sensor_id", "user_id", "key", "revoked_at", "created_at", "updated_at"}
+}
+
+func (k SensorKey) IsActive() bool {
+	return k.RevokedAt == nil
+}
+
+// Makes a new random key for the sensor
+func NewSensorKey(sensor Sensor, user User) (SensorKey, error) {
+	key := make([]byte, sensorKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return SensorKey{}, err
+	}
+	return SensorKey{SensorId: sensor.Id, UserId: user.Id, Key: key}, nil
+}
+
+// The signature of a message signed with the key
+func (k SensorKey) Sign(message []byte) []byte {
+	mac := hmac.New(sha256.New, k.Key)
+	mac.Write(message)
+	return mac.Sum(nil)[:SensorKeySignatureBytes]
+}
+
+// Whether signature is the key's signature of message
+func (k SensorKey) Verify(message, signature []byte) bool {
+	return len(k.Key) > 0 && hmac.Equal(k.Sign(message), signature)
+}
+
+// Inserts the key.  Keys are never updated other than to revoke them, see Revoke().
+func (k *SensorKey) Save(db *sqlx.DB) error {
+	if k.Id != 0 {
+		return nil
+	}
+	query := db.Rebind(`INSERT INTO sensor_keys (sensor_id, user_id, key, updated_at) VALUES (?, ?, ?, NOW())
+		RETURNING id, created_at, updated_at`)
+	return db.QueryRow(query, k.SensorId, k.UserId, k.Key).Scan(&k.Id, &k.CreatedAt, &k.UpdatedAt)
+}
+
+// Stops the key from being accepted
+func (k *SensorKey) Revoke(db *sqlx.DB) error {
+	query := db.Rebind(`UPDATE sensor_keys SET revoked_at = NOW(), updated_at = NOW()
+		WHERE id = ? AND revoked_at IS NULL RETURNING revoked_at, updated_at`)
+	err := db.QueryRow(query, k.Id).Scan(&k.RevokedAt, &k.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return ErrSensorKeyRevoked
+	}
+	return err
+}
+
+func buildSensorKeysQuery(params map[string]interface{}) *sqrl.SelectBuilder {
+	query := sqrl.Select().From("sensor_keys k")
+	for _, k := range []string{"id", "sensor_id", "user_id"} {
+		if v, ok := params[k]; ok {
+			query = query.Where(sqrl.Eq{fmt.Sprintf("k.%s", k): v})
+		}
+	}
+	if v, ok := params["active"]; ok && v.(bool) {
+		query = query.Where("k.revoked_at IS NULL")
+	}
+	for _, k := range (SensorKey{}).queryColumns() {
+		query = query.Column(fmt.Sprintf("k.%s", k))
+	}
+	return query.OrderBy("k.created_at DESC")
+}
+
+// Look up a sensor key.  Accepts `id`, `sensor_id`, `user_id`, and `active` to only find keys which have not been
+// revoked.
+func FindSensorKey(params map[string]interface{}, db *sqlx.DB) (*SensorKey, error) {
+	key := new(SensorKey)
+	query, values, err := buildSensorKeysQuery(params).ToSql()
+	if err == nil {
+		err = db.Get(key, db.Rebind(query), values...)
+	}
+	return key, err
+}
+
+func FindSensorKeys(params map[string]interface{}, db *sqlx.DB) ([]*SensorKey, error) {
+	keys := []*SensorKey{}
+	query, values, err := buildSensorKeysQuery(params).ToSql()
+	if err == nil {
+		err = db.Select(&keys, db.Rebind(query), values...)
+	}
+	return keys, err
+}
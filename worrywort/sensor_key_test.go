@@ -0,0 +1,84 @@
+package worrywort
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+)
+
+func TestSensorKeySignature(t *testing.T) {
+	key := SensorKey{Key: []byte("0123456789abcdef0123456789abcdef")}
+	message := []byte(`{"value": 20.5, "recorded_at": 1555846233}`)
+	signature := key.Sign(message)
+	if len(signature) != SensorKeySignatureBytes {
+		t.Fatalf("Expected a %d byte signature but got %d", SensorKeySignatureBytes, len(signature))
+	}
+	if !key.Verify(message, signature) {
+		t.Errorf("Expected the signature to verify")
+	}
+	if key.Verify([]byte(`{"value": 30.5, "recorded_at": 1555846233}`), signature) {
+		t.Errorf("Expected the signature of a different message not to verify")
+	}
+	other := SensorKey{Key: []byte("fedcba9876543210fedcba9876543210")}
+	if other.Verify(message, signature) {
+		t.Errorf("Expected another key's signature not to verify")
+	}
+	if (SensorKey{}).Verify(message, (SensorKey{}).Sign(message)) {
+		t.Errorf("Expected a key without a key not to verify anything")
+	}
+}
+
+func TestSensorKeys(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	u := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := u.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	sensor := Sensor{Name: "Test Sensor", UserId: u.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	t.Run("Keys are random", func(t *testing.T) {
+		k1, err := NewSensorKey(sensor, u)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		k2, _ := NewSensorKey(sensor, u)
+		if len(k1.Key) != sensorKeyBytes || bytes.Equal(k1.Key, k2.Key) {
+			t.Errorf("Expected two different %d byte keys but got %x and %x", sensorKeyBytes, k1.Key, k2.Key)
+		}
+	})
+
+	t.Run("Revoked keys are not active", func(t *testing.T) {
+		key, _ := NewSensorKey(sensor, u)
+		if err := key.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		found, err := FindSensorKey(map[string]interface{}{"id": key.Id, "active": true}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !bytes.Equal(found.Key, key.Key) || *found.SensorId != *sensor.Id || *found.UserId != *u.Id {
+			t.Errorf("Expected %v but got %v", key, found)
+		}
+
+		if err := key.Revoke(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if key.IsActive() {
+			t.Errorf("Expected the revoked key not to be active")
+		}
+		if _, err := FindSensorKey(map[string]interface{}{"id": key.Id, "active": true}, db); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows but got %v", err)
+		}
+		if err := key.Revoke(db); err != ErrSensorKeyRevoked {
+			t.Errorf("Expected ErrSensorKeyRevoked but got %v", err)
+		}
+	})
+}
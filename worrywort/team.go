@@ -0,0 +1,204 @@
+package worrywort
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/elgris/sqrl"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// Teams let users share batches, sensors, and fermentors, such as a brewing club.  Anything with a TeamId can be seen
+// by every member of that team and changed by brewers and owners, as well as by the user who created it.
+
+// A member's role in a team.  Each role can do everything the roles before it can.
+type TeamRole int
+
+const (
+	TEAM_ROLE_VIEWER TeamRole = iota // can see the team's data
+	TEAM_ROLE_BREWER                 // can also change the team's data
+	TEAM_ROLE_OWNER                  // can also manage the team's members
+)
+
+var ErrLastTeamOwner = errors.New("A team must have at least one owner.")
+
+type Team struct {
+	Id        *int64    `db:"id"`
+	UUID      string    `db:"uuid"`
+	Name      string    `db:"name"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func (t Team) queryColumns() []string {
+	return []string{"id", "uuid", "name", "created_at", "updated_at"}
+}
+
+type TeamMember struct {
+	TeamId    *int64    `db:"team_id"`
+	UserId    *int64    `db:"user_id"`
+	Role      TeamRole  `db:"role"`
+	User      *User     `db:"u"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// Limits a query to rows the user created, by ownerColumn, or which belong to a team, by teamColumn, the user is at
+// least minRole in
+func teamAccess(ownerColumn, teamColumn string, userId interface{}, minRole TeamRole) sqrl.Sqlizer {
+	return sqrl.Expr(fmt.Sprintf(`(%s = ? OR %s IN (SELECT team_id FROM team_members WHERE user_id = ? AND role >= ?))`,
+		ownerColumn, teamColumn), userId, userId, minRole)
+}
+
+// Applies the `viewable_by` and `editable_by` params, which take a user id, to a query.  Viewers of a team may view
+// its rows and brewers may edit them.
+func whereTeamAccess(query *sqrl.SelectBuilder, ownerColumn, teamColumn string,
+	params map[string]interface{}) *sqrl.SelectBuilder {
+	if v, ok := params["viewable_by"]; ok {
+		query = query.Where(teamAccess(ownerColumn, teamColumn, v, TEAM_ROLE_VIEWER))
+	}
+	if v, ok := params["editable_by"]; ok {
+		query = query.Where(teamAccess(ownerColumn, teamColumn, v, TEAM_ROLE_BREWER))
+	}
+	return query
+}
+
+// Creates a team with owner as its first owner
+func CreateTeam(name string, owner User, db *sqlx.DB) (*Team, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	t := Team{Name: name}
+	query := tx.Rebind(`INSERT INTO teams (name, updated_at) VALUES (?, NOW()) RETURNING id, uuid, created_at,
+		updated_at`)
+	if err := tx.QueryRow(query, name).Scan(&t.Id, &t.UUID, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		return nil, err
+	}
+	query = tx.Rebind(`INSERT INTO team_members (team_id, user_id, role, updated_at) VALUES (?, ?, ?, NOW())`)
+	if _, err := tx.Exec(query, t.Id, owner.Id, TEAM_ROLE_OWNER); err != nil {
+		return nil, err
+	}
+	return &t, tx.Commit()
+}
+
+func buildTeamsQuery(params map[string]interface{}) *sqrl.SelectBuilder {
+	query := sqrl.Select().From("teams t")
+	for _, k := range []string{"id", "uuid"} {
+		if v, ok := params[k]; ok {
+			query = query.Where(sqrl.Eq{fmt.Sprintf("t.%s", k): v})
+		}
+	}
+	// teams the user is a member of, optionally with at least min_role
+	if v, ok := params["member_id"]; ok {
+		minRole := TEAM_ROLE_VIEWER
+		if r, ok := params["min_role"]; ok {
+			minRole = r.(TeamRole)
+		}
+		query = query.Where("t.id IN (SELECT team_id FROM team_members WHERE user_id = ? AND role >= ?)", v,
+			minRole)
+	}
+	for _, k := range (Team{}).queryColumns() {
+		query = query.Column(fmt.Sprintf("t.%s", k))
+	}
+	return query.OrderBy("t.name", "t.id")
+}
+
+// Look up a team.  Accepts `id`, `uuid`, and `member_id` with an optional `min_role` for teams a user belongs to.
+func FindTeam(params map[string]interface{}, db *sqlx.DB) (*Team, error) {
+	t := new(Team)
+	query, values, err := buildTeamsQuery(params).ToSql()
+	if err == nil {
+		err = db.Get(t, db.Rebind(query), values...)
+	}
+	return t, err
+}
+
+func FindTeams(params map[string]interface{}, db *sqlx.DB) ([]*Team, error) {
+	teams := []*Team{}
+	query, values, err := buildTeamsQuery(params).ToSql()
+	if err == nil {
+		err = db.Select(&teams, db.Rebind(query), values...)
+	}
+	return teams, err
+}
+
+// The team's members with their users, owners first
+func (t Team) Members(db *sqlx.DB) ([]*TeamMember, error) {
+	query := sqrl.Select("m.team_id", "m.user_id", "m.role", "m.created_at", "m.updated_at").
+		From("team_members m").Join("users u ON m.user_id = u.id").Where(sqrl.Eq{"m.team_id": t.Id}).
+		OrderBy("m.role DESC", "u.email")
+	for _, k := range (User{}).queryColumns() {
+		query = query.Column(fmt.Sprintf("u.%s \"u.%s\"", k, k))
+	}
+	members := []*TeamMember{}
+	q, values, err := query.ToSql()
+	if err == nil {
+		err = db.Select(&members, db.Rebind(q), values...)
+	}
+	return members, err
+}
+
+// The user's role in the team.  Returns sql.ErrNoRows if they are not a member.
+func (t Team) MemberRole(userId int64, db *sqlx.DB) (TeamRole, error) {
+	var role TeamRole
+	query := db.Rebind(`SELECT role FROM team_members WHERE team_id = ? AND user_id = ?`)
+	err := db.Get(&role, query, t.Id, userId)
+	return role, err
+}
+
+// Fails with ErrLastTeamOwner if the team has no owners left.  Called before committing a change to the members.
+func checkTeamHasOwner(teamId *int64, tx *sqlx.Tx) error {
+	owners := 0
+	query := tx.Rebind(`SELECT COUNT(*) FROM team_members WHERE team_id = ? AND role = ?`)
+	if err := tx.Get(&owners, query, teamId, TEAM_ROLE_OWNER); err != nil {
+		return err
+	}
+	if owners == 0 {
+		return ErrLastTeamOwner
+	}
+	return nil
+}
+
+// Adds the user to the team, or changes their role if they are already a member
+func (t Team) SetMember(userId int64, role TeamRole, db *sqlx.DB) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := tx.Rebind(`INSERT INTO team_members (team_id, user_id, role, updated_at) VALUES (?, ?, ?, NOW())
+		ON CONFLICT (team_id, user_id) DO UPDATE SET role = EXCLUDED.role, updated_at = NOW()`)
+	if _, err := tx.Exec(query, t.Id, userId, role); err != nil {
+		return err
+	}
+	if err := checkTeamHasOwner(t.Id, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Removes the user from the team.  Anything they created for the team stays with the team.
+func (t Team) RemoveMember(userId int64, db *sqlx.DB) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(tx.Rebind(`DELETE FROM team_members WHERE team_id = ? AND user_id = ?`), t.Id, userId)
+	if err != nil {
+		return err
+	}
+	if removed, err := result.RowsAffected(); err != nil {
+		return err
+	} else if removed == 0 {
+		return sql.ErrNoRows
+	}
+	if err := checkTeamHasOwner(t.Id, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
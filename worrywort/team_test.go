@@ -0,0 +1,166 @@
+package worrywort
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestTeams(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	makeUser := func(email string) User {
+		u := User{Email: email, FullName: "Brewer", Username: email, IsActive: true}
+		if err := u.Save(db); err != nil {
+			t.Fatalf("failed to insert user: %s", err)
+		}
+		return u
+	}
+	owner := makeUser("owner@example.com")
+	brewer := makeUser("brewer@example.com")
+	viewer := makeUser("viewer@example.com")
+	outsider := makeUser("outsider@example.com")
+
+	team, err := CreateTeam("Homebrew Club", owner, db)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := team.SetMember(*brewer.Id, TEAM_ROLE_BREWER, db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := team.SetMember(*viewer.Id, TEAM_ROLE_VIEWER, db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	batch := makeTestBatch(&owner, true)
+	batch.TeamId = team.Id
+	if err := batch.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+	sensor := Sensor{Name: "Team Sensor", UserId: owner.Id, TeamId: team.Id}
+	if err := sensor.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	t.Run("Creator is owner", func(t *testing.T) {
+		role, err := team.MemberRole(*owner.Id, db)
+		if err != nil || role != TEAM_ROLE_OWNER {
+			t.Errorf("Expected owner role but got %v, %v", role, err)
+		}
+	})
+
+	t.Run("FindTeams by member", func(t *testing.T) {
+		teams, err := FindTeams(map[string]interface{}{"member_id": *viewer.Id}, db)
+		if err != nil || len(teams) != 1 || *teams[0].Id != *team.Id {
+			t.Errorf("Expected the viewer's team but got %v, %v", teams, err)
+		}
+		teams, err = FindTeams(map[string]interface{}{"member_id": *viewer.Id, "min_role": TEAM_ROLE_BREWER}, db)
+		if err != nil || len(teams) != 0 {
+			t.Errorf("Expected no teams the viewer can brew in but got %v, %v", teams, err)
+		}
+	})
+
+	t.Run("Members", func(t *testing.T) {
+		members, err := team.Members(db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(members) != 3 || members[0].User.Email != owner.Email || members[0].Role != TEAM_ROLE_OWNER {
+			t.Errorf("Expected 3 members with the owner first but got %v", members)
+		}
+	})
+
+	var accessTests = []struct {
+		name     string
+		user     User
+		viewable bool
+		editable bool
+	}{
+		{"Owner", owner, true, true},
+		{"Brewer", brewer, true, true},
+		{"Viewer", viewer, true, false},
+		{"Outsider", outsider, false, false},
+	}
+	for _, tc := range accessTests {
+		t.Run(tc.name+" access", func(t *testing.T) {
+			for param, expected := range map[string]bool{"viewable_by": tc.viewable, "editable_by": tc.editable} {
+				_, err := FindBatch(map[string]interface{}{"id": *batch.Id, param: *tc.user.Id}, db)
+				if found := err == nil; found != expected {
+					t.Errorf("Batch %s: expected found %v but got error %v", param, expected, err)
+				}
+				_, err = FindSensor(map[string]interface{}{"id": *sensor.Id, param: *tc.user.Id}, db)
+				if found := err == nil; found != expected {
+					t.Errorf("Sensor %s: expected found %v but got error %v", param, expected, err)
+				}
+			}
+		})
+	}
+
+	t.Run("Measurements shared through a batch association", func(t *testing.T) {
+		// not on the team itself, only associated with the team's batch
+		personal := Sensor{Name: "Personal Sensor", UserId: owner.Id}
+		if err := personal.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		associatedAt := time.Now().Add(-time.Hour)
+		if _, err := AssociateBatchToSensor(&batch, &personal, "", &associatedAt, db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		during := TemperatureMeasurement{UserId: owner.Id, SensorId: personal.Id, Temperature: 68.0,
+			Units: FAHRENHEIT, RecordedAt: time.Now()}
+		before := TemperatureMeasurement{UserId: owner.Id, SensorId: personal.Id, Temperature: 68.0,
+			Units: FAHRENHEIT, RecordedAt: associatedAt.Add(-time.Hour)}
+		for _, m := range []*TemperatureMeasurement{&during, &before} {
+			if err := m.Save(db); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+
+		for _, tc := range accessTests {
+			for param, expected := range map[string]bool{"viewable_by": tc.viewable, "editable_by": tc.editable} {
+				_, err := FindTemperatureMeasurement(map[string]interface{}{"id": during.Id, param: *tc.user.Id}, db)
+				if found := err == nil; found != expected {
+					t.Errorf("%s %s: expected found %v but got error %v", tc.name, param, expected, err)
+				}
+			}
+		}
+		// only the owner may see measurements from before the sensor was associated with the batch
+		for _, u := range []User{owner, brewer} {
+			_, err := FindTemperatureMeasurement(map[string]interface{}{"id": before.Id, "viewable_by": *u.Id}, db)
+			if found := err == nil; found != (*u.Id == *owner.Id) {
+				t.Errorf("%s: unexpected access to a measurement from before the association, got error %v",
+					u.Email, err)
+			}
+		}
+	})
+
+	t.Run("Removing a member revokes access", func(t *testing.T) {
+		if err := team.RemoveMember(*viewer.Id, db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		_, err := FindBatch(map[string]interface{}{"id": *batch.Id, "viewable_by": *viewer.Id}, db)
+		if err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows but got %v", err)
+		}
+		if err := team.RemoveMember(*viewer.Id, db); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows removing a non-member but got %v", err)
+		}
+	})
+
+	t.Run("Last owner cannot leave", func(t *testing.T) {
+		if err := team.RemoveMember(*owner.Id, db); err != ErrLastTeamOwner {
+			t.Errorf("Expected ErrLastTeamOwner but got %v", err)
+		}
+		if err := team.SetMember(*owner.Id, TEAM_ROLE_BREWER, db); err != ErrLastTeamOwner {
+			t.Errorf("Expected ErrLastTeamOwner but got %v", err)
+		}
+		role, _ := team.MemberRole(*owner.Id, db)
+		if role != TEAM_ROLE_OWNER {
+			t.Errorf("Expected the owner to still be owner but got %v", role)
+		}
+	})
+}
@@ -1,13 +1,61 @@
 package worrywort
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	//"github.com/davecgh/go-spew/spew"
 	"github.com/elgris/sqrl"
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Returned when saving a new TemperatureMeasurement for a sensor which already has one recorded at the same time, such
+// as when a device retries after a timeout.  The TemperatureMeasurement is filled in with the original.
+var ErrDuplicateTemperatureMeasurement = errors.New("The sensor already has a measurement recorded at that time.")
+
+// Told about each newly created TemperatureMeasurement once it has been saved, such as to publish it to MQTT.  The
+// apis which save measurements are each given one and call it for the measurements they created, but not for
+// duplicates.  It is called by whatever saved the measurement, so it should not block.  A nil notifier is left off,
+// so the apis' Notifier fields are optional.
+type TemperatureMeasurementNotifier func(tm TemperatureMeasurement)
+
+// Passes a copy of tm to the notifier, if there is one
+func (n TemperatureMeasurementNotifier) Created(tm *TemperatureMeasurement) {
+	if n != nil {
+		n(*tm)
+	}
+}
+
+// Parses a measurement's RecordedAt as an RFC3339 timestamp or seconds since the Unix epoch, such as 1555846233 or
+// 1555846233.32838.  Devices without a real time clock often only have the epoch time from NTP.
+func ParseTimestamp(timestamp string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
+		return t, nil
+	}
+	// parsed by hand rather than as a float64 so that fractional seconds are not rounded off
+	parts := strings.SplitN(timestamp, ".", 2)
+	seconds, err := strconv.ParseUint(parts[0], 10, 63)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nanoseconds uint64
+	if len(parts) == 2 {
+		fraction := parts[1]
+		if len(fraction) > 9 {
+			fraction = fraction[:9]
+		}
+		fraction += strings.Repeat("0", 9-len(fraction))
+		if nanoseconds, err = strconv.ParseUint(fraction, 10, 32); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(int64(seconds), int64(nanoseconds)).UTC(), nil
+}
+
 // A single recorded temperature measurement from a temperatureSensor
 // This may get some tweaking to play nicely with data stored in Postgres or Influxdb
 type TemperatureMeasurement struct {
@@ -73,8 +121,14 @@ func (tm *TemperatureMeasurement) Save(db *sqlx.DB) error {
 	}
 }
 
-// Insert a new TemperatureMeasurement into the database
+// Insert a new TemperatureMeasurement into the database.  Returns ErrDuplicateTemperatureMeasurement, with tm
+// filled in from the original, if the sensor already has a measurement recorded at the same time.
 func InsertTemperatureMeasurement(db *sqlx.DB, tm *TemperatureMeasurement) error {
+	return insertTemperatureMeasurement(db, tm)
+}
+
+// Inserts the measurement with either a DB or a Tx
+func insertTemperatureMeasurement(db sqlx.Ext, tm *TemperatureMeasurement) error {
 	var updatedAt time.Time
 	var createdAt time.Time
 	var measurementId string
@@ -83,8 +137,15 @@ func InsertTemperatureMeasurement(db *sqlx.DB, tm *TemperatureMeasurement) error
 
 	query := db.Rebind(`INSERT INTO temperature_measurements (user_id, temperature, units, recorded_at, created_at,
 		updated_at, sensor_id)
-		VALUES (?, ?, ?, ?, NOW(), NOW(), ?) RETURNING id, created_at, updated_at`)
-	err := db.QueryRow(query, insertVals...).Scan(&measurementId, &createdAt, &updatedAt)
+		VALUES (?, ?, ?, ?, NOW(), NOW(), ?) ON CONFLICT (sensor_id, recorded_at) DO NOTHING
+		RETURNING id, created_at, updated_at`)
+	err := db.QueryRowx(query, insertVals...).Scan(&measurementId, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		if err := loadDuplicateTemperatureMeasurement(db, tm); err != nil {
+			return err
+		}
+		return ErrDuplicateTemperatureMeasurement
+	}
 	if err == nil {
 		tm.Id = measurementId
 		tm.CreatedAt = createdAt
@@ -93,6 +154,105 @@ func InsertTemperatureMeasurement(db *sqlx.DB, tm *TemperatureMeasurement) error
 	return err
 }
 
+// Replaces tm with the measurement already saved for its sensor and recorded_at
+func loadDuplicateTemperatureMeasurement(db sqlx.Ext, tm *TemperatureMeasurement) error {
+	var userId *int64
+	query := db.Rebind(`SELECT id, user_id, temperature, units, created_at, updated_at FROM temperature_measurements
+		WHERE sensor_id = ? AND recorded_at = ?`)
+	err := db.QueryRowx(query, tm.SensorId, tm.RecordedAt).Scan(&tm.Id, &userId, &tm.Temperature, &tm.Units,
+		&tm.CreatedAt, &tm.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	// the original may have been saved by someone else sharing the sensor
+	if userId == nil || tm.UserId == nil || *userId != *tm.UserId {
+		tm.CreatedBy = nil
+	}
+	tm.UserId = userId
+	return nil
+}
+
+// Rows per INSERT in InsertTemperatureMeasurements, to stay well under the postgres limit on query parameters
+const temperatureMeasurementInsertBatchSize = 1000
+
+// Inserts new TemperatureMeasurements in one transaction, so either all of them are saved or none are.  As with
+// InsertTemperatureMeasurement, a measurement for a sensor which already has one at the same time is filled in with
+// the original.  Returns whether each measurement was newly created.
+func InsertTemperatureMeasurements(db *sqlx.DB, measurements []*TemperatureMeasurement) ([]bool, error) {
+	created := make([]bool, len(measurements))
+	tx, err := db.Beginx()
+	if err != nil {
+		return created, err
+	}
+	for start := 0; start < len(measurements); start += temperatureMeasurementInsertBatchSize {
+		end := start + temperatureMeasurementInsertBatchSize
+		if end > len(measurements) {
+			end = len(measurements)
+		}
+		if err := insertTemperatureMeasurementRows(tx, measurements[start:end], created[start:end]); err != nil {
+			tx.Rollback()
+			for _, tm := range measurements[:end] {
+				tm.Id = ""
+			}
+			return make([]bool, len(measurements)), err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		for _, tm := range measurements {
+			tm.Id = ""
+		}
+		return make([]bool, len(measurements)), err
+	}
+	return created, nil
+}
+
+func insertTemperatureMeasurementRows(tx *sqlx.Tx, measurements []*TemperatureMeasurement, created []bool) error {
+	// ids are generated here rather than by the db so that the returned rows can be matched up to the measurements
+	byId := map[string]*TemperatureMeasurement{}
+	rowPlaceholders := make([]string, 0, len(measurements))
+	values := make([]interface{}, 0, len(measurements)*6)
+	for _, tm := range measurements {
+		id := uuid.New().String()
+		byId[id] = tm
+		rowPlaceholders = append(rowPlaceholders, "(?, ?, ?, ?, ?, NOW(), NOW(), ?)")
+		values = append(values, id, tm.UserId, tm.Temperature, tm.Units, tm.RecordedAt, tm.SensorId)
+	}
+	q := `INSERT INTO temperature_measurements (id, user_id, temperature, units, recorded_at, created_at, updated_at,
+		sensor_id) VALUES ` + strings.Join(rowPlaceholders, ", ") + `
+		ON CONFLICT (sensor_id, recorded_at) DO NOTHING RETURNING id, created_at, updated_at`
+	rows, err := tx.Query(tx.Rebind(q), values...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&id, &createdAt, &updatedAt); err != nil {
+			return err
+		}
+		if tm, ok := byId[id]; ok {
+			tm.Id = id
+			tm.CreatedAt = createdAt
+			tm.UpdatedAt = updatedAt
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	// rows not returned were duplicates, either of an existing measurement or of an earlier row in this insert
+	for i, tm := range measurements {
+		if tm.Id != "" {
+			created[i] = true
+		} else if err := loadDuplicateTemperatureMeasurement(tx, tm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Updates an existing TemperatureMeasurement in the database
 func UpdateTemperatureMeasurement(db *sqlx.DB, tm *TemperatureMeasurement) error {
 	var updatedAt time.Time
@@ -108,6 +268,12 @@ func UpdateTemperatureMeasurement(db *sqlx.DB, tm *TemperatureMeasurement) error
 	return err
 }
 
+// The orderings which may be passed as `order_by` when finding temperature measurements
+var temperatureMeasurementOrderings = map[string]string{
+	"recorded_at":  "tm.recorded_at, tm.id",
+	"-recorded_at": "tm.recorded_at DESC, tm.id",
+}
+
 // Build the query string and values slice for query for temperature measurement(s)
 // as needed by sqlx db.Get() and db.Select() and returns them
 func buildTemperatureMeasurementsQuery(params map[string]interface{}, db *sqlx.DB) *sqrl.SelectBuilder {
@@ -134,6 +300,19 @@ func buildTemperatureMeasurementsQuery(params map[string]interface{}, db *sqlx.D
 	if v, ok := params["sensor_uuid"]; ok {
 		query = query.Where(sqrl.Eq{"s.uuid": v})
 	}
+	// measurements are shared along with the sensor which took them and with the team of the batch the sensor was
+	// associated with when they were recorded
+	for k, minRole := range map[string]TeamRole{"viewable_by": TEAM_ROLE_VIEWER, "editable_by": TEAM_ROLE_BREWER} {
+		if v, ok := params[k]; ok {
+			query = query.Where(sqrl.Expr(`(tm.user_id = ? OR s.team_id IN (SELECT team_id FROM team_members
+				WHERE user_id = ? AND role >= ?) OR EXISTS (SELECT 1 FROM batch_sensor_association ta
+				JOIN batches tb ON tb.id = ta.batch_id WHERE ta.sensor_id = tm.sensor_id
+				AND tm.recorded_at >= ta.associated_at
+				AND (ta.disassociated_at IS NULL OR tm.recorded_at <= ta.disassociated_at)
+				AND tb.team_id IN (SELECT team_id FROM team_members WHERE user_id = ? AND role >= ?)))`,
+				v, v, minRole, v, minRole))
+		}
+	}
 
 	if v, ok := params["batch_uuid"]; ok {
 		// query = query.Where(sqrl.Eq{fmt.Sprintf("s.uuid", k): v})
@@ -162,6 +341,13 @@ func buildTemperatureMeasurementsQuery(params map[string]interface{}, db *sqlx.D
 		query = query.Column(fmt.Sprintf("tm.%s", k))
 	}
 
+	// `order_by` is one of temperatureMeasurementOrderings rather than raw sql
+	if v, ok := params["order_by"]; ok {
+		if ordering, ok := temperatureMeasurementOrderings[v.(string)]; ok {
+			query = query.OrderBy(ordering)
+		}
+	}
+
 	if v, ok := params["limit"]; ok {
 		query = query.Limit(uint64(v.(int)))
 	}
@@ -0,0 +1,144 @@
+package worrywort
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Auth tokens are hashed with HMAC-SHA512 keyed with a server side pepper so that a copy of the database alone is not
+// enough to check guesses at tokens.  Each pepper has a version which is stored with the hash.  Tokens hashed with an
+// older version, including version 0 which is the unkeyed MakeTokenHash used before peppers, are re-hashed with the
+// current pepper the next time they are used.
+
+// Peppers shorter than this are refused since the pepper is all that makes the hashes hard to check offline
+const minTokenPepperLength = 32
+
+var ErrUnknownTokenHashVersion = errors.New("No pepper is configured for the token's hash version")
+var ErrNoTokenPeppers = errors.New("No token peppers are configured")
+
+// Peppers by version, set from configuration at startup.  The highest version is used to hash new tokens.  If none
+// are set tokens are hashed with MakeTokenHash as version 0.
+var TokenPeppers = map[int][]byte{}
+
+// The version new tokens are hashed with
+func CurrentTokenHashVersion() int {
+	current := 0
+	for version := range TokenPeppers {
+		if version > current {
+			current = version
+		}
+	}
+	return current
+}
+
+// Hashes a token with the pepper for version
+func HashToken(tokenStr string, version int) (string, error) {
+	if version == 0 {
+		return MakeTokenHash(tokenStr), nil
+	}
+	pepper, ok := TokenPeppers[version]
+	if !ok {
+		return "", ErrUnknownTokenHashVersion
+	}
+	mac := hmac.New(sha512.New, pepper)
+	mac.Write([]byte(tokenStr))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Parses peppers formatted as a comma separated list of `version=pepper`, such as from WORRYWORTD_TOKEN_PEPPERS.
+// Versions start at 1.
+func ParseTokenPeppers(s string) (map[int][]byte, error) {
+	peppers := map[int][]byte{}
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("token pepper %q should be version=pepper", entry)
+		}
+		version, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("token pepper version %q must be a number 1 or greater", parts[0])
+		}
+		if _, ok := peppers[version]; ok {
+			return nil, fmt.Errorf("token pepper version %d is set more than once", version)
+		}
+		pepper := strings.TrimSpace(parts[1])
+		if len(pepper) < minTokenPepperLength {
+			return nil, fmt.Errorf("token pepper %d must be at least %d characters", version, minTokenPepperLength)
+		}
+		peppers[version] = []byte(pepper)
+	}
+	return peppers, nil
+}
+
+// Formats peppers the way ParseTokenPeppers reads them, oldest first
+func FormatTokenPeppers(peppers map[int][]byte) string {
+	versions := []int{}
+	for version := range peppers {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	entries := make([]string, len(versions))
+	for i, version := range versions {
+		entries[i] = fmt.Sprintf("%d=%s", version, peppers[version])
+	}
+	return strings.Join(entries, ",")
+}
+
+// Generates a random pepper
+func GenerateTokenPepper() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// no padding so that it never contains the `=` ParseTokenPeppers splits on
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// The number of stored auth tokens hashed with each version
+func CountAuthTokensByHashVersion(db *sqlx.DB) (map[int]int, error) {
+	rows := []struct {
+		Version int `db:"hash_version"`
+		Count   int `db:"count"`
+	}{}
+	query := `SELECT hash_version, COUNT(*) "count" FROM user_authtokens GROUP BY hash_version`
+	if err := db.Select(&rows, query); err != nil {
+		return nil, err
+	}
+	counts := map[int]int{}
+	for _, row := range rows {
+		counts[row.Version] = row.Count
+	}
+	return counts, nil
+}
+
+// Deletes auth tokens hashed with a version which is not in TokenPeppers, including the unpeppered version 0.  Those
+// tokens have not been used since their pepper was replaced, and once it is removed they cannot be used at all.
+func DeleteUnpepperedAuthTokens(db *sqlx.DB) (int64, error) {
+	if len(TokenPeppers) == 0 {
+		return 0, ErrNoTokenPeppers
+	}
+	versions := []int{}
+	for version := range TokenPeppers {
+		versions = append(versions, version)
+	}
+	query, args, err := sqlx.In(`DELETE FROM user_authtokens WHERE hash_version NOT IN (?)`, versions)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(db.Rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,139 @@
+package worrywort
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+const testPepper = "01234567890123456789012345678901"
+
+// Sets TokenPeppers and returns a func which puts back the old ones, for use as `defer setTokenPeppers(p)()`
+func setTokenPeppers(peppers map[int][]byte) func() {
+	original := TokenPeppers
+	TokenPeppers = peppers
+	return func() { TokenPeppers = original }
+}
+
+func TestParseTokenPeppers(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		peppers, err := ParseTokenPeppers(" 1=" + testPepper + ", 2=" + testPepper + "x,")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		expected := map[int][]byte{1: []byte(testPepper), 2: []byte(testPepper + "x")}
+		if !cmp.Equal(peppers, expected) {
+			t.Errorf("Expected: %v\nGot: %v", expected, peppers)
+		}
+		if formatted := FormatTokenPeppers(peppers); formatted != "1="+testPepper+",2="+testPepper+"x" {
+			t.Errorf("Unexpected format: %s", formatted)
+		}
+	})
+
+	var invalid = []struct {
+		name    string
+		peppers string
+	}{
+		{"Missing version", testPepper},
+		{"Version 0", "0=" + testPepper},
+		{"Duplicate version", "1=" + testPepper + ",1=" + testPepper},
+		{"Too short", "1=short"},
+	}
+	for _, tc := range invalid {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ParseTokenPeppers(tc.peppers); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestGenerateTokenPepper(t *testing.T) {
+	pepper, err := GenerateTokenPepper()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := ParseTokenPeppers("1=" + pepper); err != nil {
+		t.Errorf("Generated pepper could not be parsed: %v", err)
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	defer setTokenPeppers(map[int][]byte{1: []byte(testPepper), 2: []byte(testPepper + "x")})()
+
+	if v := CurrentTokenHashVersion(); v != 2 {
+		t.Errorf("Expected current version 2 but got %d", v)
+	}
+	unpeppered, _ := HashToken("token", 0)
+	if unpeppered != MakeTokenHash("token") {
+		t.Errorf("Version 0 should be MakeTokenHash")
+	}
+	v1, _ := HashToken("token", 1)
+	v2, _ := HashToken("token", 2)
+	if v1 == unpeppered || v1 == v2 {
+		t.Errorf("Each version should hash differently")
+	}
+	if _, err := HashToken("token", 3); err != ErrUnknownTokenHashVersion {
+		t.Errorf("Expected %v but got %v", ErrUnknownTokenHashVersion, err)
+	}
+
+	token := NewToken("token", User{}, TOKEN_SCOPE_ALL, TOKEN_TYPE_LOGIN)
+	if token.HashVersion != 2 || token.Token != v2 || !token.Compare("token") {
+		t.Errorf("New token should be hashed with the current pepper: %v", token)
+	}
+	token.HashVersion = 3
+	if token.Compare("token") {
+		t.Errorf("Token with an unknown version should not match")
+	}
+}
+
+func TestAuthTokenHashUpgrade(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort", IsActive: true}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	// made before any pepper was configured
+	defer setTokenPeppers(map[int][]byte{})()
+	token, err := GenerateTokenForUser(user, TOKEN_SCOPE_ALL)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := token.Save(db); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	TokenPeppers = map[int][]byte{1: []byte(testPepper)}
+	authenticated, err := AuthenticateUserByToken(token.ForAuthenticationHeader(), db)
+	if err != nil {
+		t.Fatalf("Unpeppered token should still work: %v", err)
+	}
+	if authenticated.HashVersion != 1 {
+		t.Errorf("Expected the token to be re-hashed with version 1 but got %d", authenticated.HashVersion)
+	}
+	counts, err := CountAuthTokensByHashVersion(db)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !cmp.Equal(counts, map[int]int{1: 1}) {
+		t.Errorf("Unexpected counts: %v", counts)
+	}
+	if _, err := AuthenticateUserByToken(token.ForAuthenticationHeader(), db); err != nil {
+		t.Errorf("Re-hashed token should work: %v", err)
+	}
+
+	t.Run("Prune", func(t *testing.T) {
+		TokenPeppers = map[int][]byte{2: []byte(testPepper + "x")}
+		deleted, err := DeleteUnpepperedAuthTokens(db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if deleted != 1 {
+			t.Errorf("Expected 1 token deleted but got %d", deleted)
+		}
+	})
+}
@@ -0,0 +1,318 @@
+package worrywort
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Optional TOTP (RFC 6238) two-factor authentication.  EnrollTOTP creates a secret for the user to add to an
+// authenticator app, ConfirmTOTP enables it once the user proves the app works and creates recovery codes.
+// After that a correct password only gets a challenge token from GenerateTOTPChallenge, which RedeemTOTPChallenge
+// exchanges for the user with a valid code.
+
+// Shown as the account's issuer in authenticator apps
+const TOTPIssuer = "WorryWort"
+
+// How long the user has to enter a code after entering their password
+const TOTPChallengeTTL = 5 * time.Minute
+
+// Wrong codes allowed for one challenge before the user has to enter their password again.  This applies even when
+// the optional login lockout is turned off, so that codes cannot be guessed for the whole TTL.
+const TOTPChallengeMaxFailures = 5
+
+const RecoveryCodeCount = 10
+
+const totpPeriod = 30
+
+// No vowels or look alike characters, for the same reasons as user codes in device_code.go
+const recoveryCodeCharset = "BCDFGHJKLMNPQRSTVWXZ23456789"
+const recoveryCodeLength = 10
+
+var ErrTOTPAlreadyEnabled = errors.New("Two-factor authentication is already enabled.")
+var ErrTOTPNotEnrolled = errors.New("Two-factor authentication has not been set up.")
+var ErrInvalidTOTPCode = errors.New("Invalid code.")
+var ErrInvalidTOTPChallenge = errors.New("Invalid or expired login. Please log in again.")
+
+var totpOpts = totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+// Generates a new TOTP secret for the user.  TOTP is not enabled until ConfirmTOTP is called with a code from it,
+// so enrolling again before confirming just replaces the secret.  The returned key's URL() is the provisioning URI.
+func EnrollTOTP(u *User, db *sqlx.DB) (*otp.Key, error) {
+	if u.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: TOTPIssuer, AccountName: u.Email, Period: totpPeriod})
+	if err != nil {
+		return nil, err
+	}
+	query := db.Rebind(`UPDATE users SET totp_secret = ?, updated_at = NOW() WHERE id = ? AND NOT totp_enabled`)
+	if _, err := db.Exec(query, key.Secret(), u.Id); err != nil {
+		return nil, err
+	}
+	u.TOTPSecret = key.Secret()
+	return key, nil
+}
+
+// Finds the time step the code is valid for, allowing one step either side for clock drift.  Returns 0 if
+// the code is not valid.
+func totpStep(secret, code string, now time.Time) int64 {
+	code = strings.Replace(code, " ", "", -1)
+	current := now.Unix() / totpPeriod
+	for _, step := range []int64{current - 1, current, current + 1} {
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totpOpts)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+// Checks a code and records its time step so that the same code cannot be used again.  The step is
+// compared in the UPDATE so that two requests racing with the same code do not both succeed.
+func useTOTPCode(u *User, code string, db *sqlx.DB) error {
+	step := totpStep(u.TOTPSecret, code, time.Now())
+	if step == 0 {
+		return ErrInvalidTOTPCode
+	}
+	query := db.Rebind(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`)
+	result, err := db.Exec(query, step, u.Id, step)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated != 1 {
+		return ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+// Enables TOTP if code is valid for the secret from EnrollTOTP.  Returns the recovery codes, which are only
+// stored hashed, so this is the only time they are available.
+func ConfirmTOTP(u *User, code string, db *sqlx.DB) ([]string, error) {
+	if u.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if u.TOTPSecret == "" {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err := useTOTPCode(u, code, db); err != nil {
+		return nil, err
+	}
+	query := db.Rebind(`UPDATE users SET totp_enabled = true, updated_at = NOW() WHERE id = ?`)
+	if _, err := db.Exec(query, u.Id); err != nil {
+		return nil, err
+	}
+	u.TOTPEnabled = true
+	return GenerateRecoveryCodes(u, db)
+}
+
+// Turns off TOTP and deletes the recovery codes
+func DisableTOTP(u *User, db *sqlx.DB) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM user_recovery_codes WHERE user_id = ?`), u.Id); err != nil {
+		return err
+	}
+	query := tx.Rebind(`UPDATE users SET totp_secret = '', totp_enabled = false, totp_last_step = 0,
+		updated_at = NOW() WHERE id = ?`)
+	if _, err := tx.Exec(query, u.Id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	u.TOTPSecret = ""
+	u.TOTPEnabled = false
+	return nil
+}
+
+func generateRecoveryCode() (string, error) {
+	max := big.NewInt(int64(len(recoveryCodeCharset)))
+	code := make([]byte, recoveryCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = recoveryCodeCharset[n.Int64()]
+	}
+	return string(code[:recoveryCodeLength/2]) + "-" + string(code[recoveryCodeLength/2:]), nil
+}
+
+// Uppercases and removes the separators so that recovery codes can be typed in however the user likes
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(code))
+}
+
+// Replaces the user's recovery codes with RecoveryCodeCount new ones
+func GenerateRecoveryCodes(u *User, db *sqlx.DB) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM user_recovery_codes WHERE user_id = ?`), u.Id); err != nil {
+		return nil, err
+	}
+	version := CurrentTokenHashVersion()
+	for _, code := range codes {
+		// cannot fail, the current version always has a pepper
+		hash, _ := HashToken(normalizeRecoveryCode(code), version)
+		query := tx.Rebind(`INSERT INTO user_recovery_codes (user_id, code, hash_version) VALUES (?, ?, ?)`)
+		if _, err := tx.Exec(query, u.Id, hash, version); err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// Marks an unused recovery code used.  Each code is checked against its own hash version since codes made before a
+// new pepper keep their old hash.
+func useRecoveryCode(u *User, code string, db *sqlx.DB) error {
+	unused := []struct {
+		Id          int64  `db:"id"`
+		Code        string `db:"code"`
+		HashVersion int    `db:"hash_version"`
+	}{}
+	query := db.Rebind(`SELECT id, code, hash_version FROM user_recovery_codes WHERE user_id = ? AND used_at IS NULL`)
+	if err := db.Select(&unused, query, u.Id); err != nil {
+		return err
+	}
+	var id *int64
+	for i, c := range unused {
+		hash, err := HashToken(normalizeRecoveryCode(code), c.HashVersion)
+		if err == nil && subtle.ConstantTimeCompare([]byte(hash), []byte(c.Code)) == 1 {
+			id = &unused[i].Id
+		}
+	}
+	if id == nil {
+		return ErrInvalidTOTPCode
+	}
+
+	query = db.Rebind(`UPDATE user_recovery_codes SET used_at = NOW() WHERE id = ? AND used_at IS NULL`)
+	result, err := db.Exec(query, *id)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated != 1 {
+		return ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+// Checks a code from the user's authenticator app or one of their recovery codes.  Each may only be used once.
+func ValidateTOTP(u *User, code string, db *sqlx.DB) error {
+	if !u.TOTPEnabled {
+		return ErrTOTPNotEnrolled
+	}
+	if err := useTOTPCode(u, code, db); err != ErrInvalidTOTPCode {
+		return err
+	}
+	// TOTP codes are six digits and recovery codes are ten characters, so only one of these can match
+	return useRecoveryCode(u, code, db)
+}
+
+// The number of unused recovery codes the user has left
+func CountRecoveryCodes(u *User, db *sqlx.DB) (int, error) {
+	count := 0
+	query := db.Rebind(`SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = ? AND used_at IS NULL`)
+	err := db.Get(&count, query, u.Id)
+	return count, err
+}
+
+// Generates the token returned by login when the user has TOTP enabled.  It can only be exchanged for a real token
+// with RedeemTOTPChallenge.  It must be saved.
+func GenerateTOTPChallenge(user User) (AuthToken, error) {
+	token, err := GenerateTokenForUser(user, TOKEN_SCOPE_ALL)
+	if err != nil {
+		return AuthToken{}, err
+	}
+	token.Type = TOKEN_TYPE_TOTP_CHALLENGE
+	token.ExpiresAt = pq.NullTime{Time: time.Now().Add(TOTPChallengeTTL), Valid: true}
+	return token, nil
+}
+
+// Looks up the challenge token and its user without checking a code, such as to check for a lockout first
+func findTOTPChallenge(challenge string, db *sqlx.DB) (*AuthToken, *User, error) {
+	parts := strings.SplitN(challenge, ":", 2)
+	if len(parts) != 2 {
+		return nil, nil, ErrInvalidTOTPChallenge
+	}
+	token := AuthToken{}
+	query := db.Rebind(`SELECT id, token, hash_version, user_id "user.id" FROM user_authtokens
+		WHERE id = ? AND type = ? AND expires_at > ? AND failed_attempts < ?`)
+	err := db.Get(&token, query, parts[0], TOKEN_TYPE_TOTP_CHALLENGE, time.Now(), TOTPChallengeMaxFailures)
+	if err == sql.ErrNoRows || (err == nil && !token.Compare(parts[1])) {
+		return nil, nil, ErrInvalidTOTPChallenge
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := FindUser(map[string]interface{}{"id": *token.User.Id, "is_active": true}, db)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidTOTPChallenge
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return &token, user, nil
+}
+
+// Returns the user a challenge from GenerateTOTPChallenge was issued to, or ErrInvalidTOTPChallenge
+func FindTOTPChallengeUser(challenge string, db *sqlx.DB) (*User, error) {
+	_, user, err := findTOTPChallenge(challenge, db)
+	return user, err
+}
+
+// Returns the user for a challenge from GenerateTOTPChallenge if code is valid.  The challenge is deleted once the
+// code is accepted so that it cannot be used again, and stops working after TOTPChallengeMaxFailures wrong codes.
+func RedeemTOTPChallenge(challenge, code string, db *sqlx.DB) (*User, error) {
+	token, user, err := findTOTPChallenge(challenge, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateTOTP(user, code, db); err == ErrInvalidTOTPCode {
+		query := db.Rebind(`UPDATE user_authtokens SET failed_attempts = failed_attempts + 1, updated_at = NOW()
+			WHERE id = ?`)
+		if _, err := db.Exec(query, token.Id); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidTOTPCode
+	} else if err != nil {
+		return nil, err
+	}
+
+	result, err := db.Exec(db.Rebind(`DELETE FROM user_authtokens WHERE id = ?`), token.Id)
+	if err != nil {
+		return nil, err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if deleted != 1 {
+		return nil, ErrInvalidTOTPChallenge
+	}
+	return user, nil
+}
@@ -0,0 +1,154 @@
+package worrywort
+
+import (
+	"github.com/pquerna/otp/totp"
+	"testing"
+	"time"
+)
+
+func TestTOTPStep(t *testing.T) {
+	secret := "JBSWY3DPEHPK3PXP"
+	now := time.Now()
+	current := now.Unix() / totpPeriod
+	code, err := totp.GenerateCodeCustom(secret, now, totpOpts)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	previous, err := totp.GenerateCodeCustom(secret, now.Add(-totpPeriod*time.Second), totpOpts)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	old, err := totp.GenerateCodeCustom(secret, now.Add(-5*totpPeriod*time.Second), totpOpts)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if step := totpStep(secret, code, now); step != current {
+		t.Errorf("Expected step %d, got %d", current, step)
+	}
+	if step := totpStep(secret, previous, now); step != current-1 {
+		t.Errorf("Expected step %d for the previous code, got %d", current-1, step)
+	}
+	// an old code is rejected unless it happens to match one of the codes around now
+	if step := totpStep(secret, old, now); step != 0 && step != current-1 && step != current && step != current+1 {
+		t.Errorf("Expected an old code to be rejected, got step %d", step)
+	} else if step == 0 && old == code {
+		t.Errorf("Expected code %s to match", old)
+	}
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort", IsActive: true}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+
+	key, err := EnrollTOTP(&user, db)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if key.Issuer() != TOTPIssuer || key.AccountName() != user.Email {
+		t.Errorf("Unexpected provisioning uri %s", key.URL())
+	}
+
+	if _, err := ConfirmTOTP(&user, "000000", db); err != ErrInvalidTOTPCode {
+		// there is a one in a million chance 000000 is actually right
+		t.Errorf("Expected error: %v\nGot: %v", ErrInvalidTOTPCode, err)
+	}
+	code, _ := totp.GenerateCodeCustom(key.Secret(), time.Now(), totpOpts)
+	recoveryCodes, err := ConfirmTOTP(&user, code, db)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(recoveryCodes) != RecoveryCodeCount {
+		t.Errorf("Expected %d recovery codes, got %d", RecoveryCodeCount, len(recoveryCodes))
+	}
+	found, err := FindUser(map[string]interface{}{"id": *user.Id}, db)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !found.TOTPEnabled || found.TOTPSecret != key.Secret() {
+		t.Errorf("Expected TOTP to be enabled with the enrolled secret")
+	}
+
+	t.Run("Codes cannot be reused", func(t *testing.T) {
+		if err := ValidateTOTP(found, code, db); err != ErrInvalidTOTPCode {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidTOTPCode, err)
+		}
+	})
+
+	t.Run("Recovery codes", func(t *testing.T) {
+		// lower case without the dash still works
+		if err := ValidateTOTP(found, normalizeRecoveryCode(recoveryCodes[0]), db); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if err := ValidateTOTP(found, recoveryCodes[0], db); err != ErrInvalidTOTPCode {
+			t.Errorf("Expected a used recovery code to fail, got %v", err)
+		}
+		if count, err := CountRecoveryCodes(found, db); err != nil || count != RecoveryCodeCount-1 {
+			t.Errorf("Expected %d recovery codes left, got %d %v", RecoveryCodeCount-1, count, err)
+		}
+	})
+
+	t.Run("Login challenge", func(t *testing.T) {
+		challenge, err := GenerateTOTPChallenge(*found)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := challenge.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := AuthenticateUserByToken(challenge.ForAuthenticationHeader(), db); err != ErrInvalidToken {
+			t.Errorf("Expected a challenge not to work as a token, got %v", err)
+		}
+		if _, err := RedeemTOTPChallenge(challenge.ForAuthenticationHeader(), "000000", db); err != ErrInvalidTOTPCode {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidTOTPCode, err)
+		}
+		u, err := RedeemTOTPChallenge(challenge.ForAuthenticationHeader(), recoveryCodes[1], db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if *u.Id != *user.Id {
+			t.Errorf("Expected user %d, got %d", *user.Id, *u.Id)
+		}
+		if _, err := RedeemTOTPChallenge(challenge.ForAuthenticationHeader(), recoveryCodes[2], db); err != ErrInvalidTOTPChallenge {
+			t.Errorf("Expected a redeemed challenge to fail with %v, got %v", ErrInvalidTOTPChallenge, err)
+		}
+	})
+
+	t.Run("Challenge failures", func(t *testing.T) {
+		challenge, err := GenerateTOTPChallenge(*found)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := challenge.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		for i := 0; i < TOTPChallengeMaxFailures; i++ {
+			if _, err := RedeemTOTPChallenge(challenge.ForAuthenticationHeader(), "000000", db); err != ErrInvalidTOTPCode {
+				t.Errorf("Expected error: %v\nGot: %v", ErrInvalidTOTPCode, err)
+			}
+		}
+		if _, err := RedeemTOTPChallenge(challenge.ForAuthenticationHeader(), recoveryCodes[3], db); err != ErrInvalidTOTPChallenge {
+			t.Errorf("Expected a challenge to fail with %v after too many wrong codes, got %v", ErrInvalidTOTPChallenge, err)
+		}
+	})
+
+	t.Run("Disable", func(t *testing.T) {
+		if err := DisableTOTP(found, db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if count, _ := CountRecoveryCodes(found, db); count != 0 {
+			t.Errorf("Expected recovery codes to be deleted, got %d", count)
+		}
+		if _, err := EnrollTOTP(found, db); err != nil {
+			t.Errorf("Expected to be able to enroll again, got %v", err)
+		}
+	})
+}
@@ -4,9 +4,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/elgris/sqrl"
 	"github.com/jmoiron/sqlx"
 	"golang.org/x/crypto/bcrypt"
-	"strings"
+	"log"
 	"time"
 	// "github.com/davecgh/go-spew/spew"
 )
@@ -17,7 +18,12 @@ import (
 // good info on cost here https://security.stackexchange.com/a/83382
 const DefaultPasswordHashCost int = 13
 
+// The bcrypt cost passwords are hashed with when no other cost is given.  Passwords hashed with a different cost
+// are re-hashed with this one the next time the user logs in, so raising it upgrades existing hashes over time.
+var PasswordHashCost int = DefaultPasswordHashCost
+
 var ErrUserNotFound error = errors.New("User not found")
+var ErrUserInactive error = errors.New("User account is not active")
 
 type User struct {
 	// really could use email as the pk for the db, but fudging it because I've been trained by ORMs
@@ -28,6 +34,13 @@ type User struct {
 	Username string `db:"username"`
 	Email    string `db:"email"`
 	Password string `db:"password" json:"-"`
+	IsActive bool   `db:"is_active"`
+	IsAdmin  bool   `db:"is_admin"`
+	// See EnrollTOTP.  The secret is set before TOTP is enabled, while the user is confirming it.
+	TOTPSecret  string `db:"totp_secret" json:"-"`
+	TOTPEnabled bool   `db:"totp_enabled"`
+	// Set by UpdateUser() whenever the password is different, so that JWTs issued before then are refused
+	PasswordChangedAt *time.Time `db:"password_changed_at"`
 
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
@@ -35,16 +48,17 @@ type User struct {
 
 func (u User) queryColumns() []string {
 	// TODO: Way to dynamically build this using the `db` tag and reflection/introspection
-	return []string{"id", "uuid", "full_name", "username", "email", "password", "created_at", "updated_at"}
+	return []string{"id", "uuid", "full_name", "username", "email", "password", "is_active", "is_admin", "totp_secret",
+		"totp_enabled", "password_changed_at", "created_at", "updated_at"}
 }
 
 // SetUserPassword hashes the given password and returns a new user with the password set to the bcrypt hashed value
-// using the given hashCost.  If hashCost is less than bcrypt.MinCost then worrywort.DefaultPasswordHashCost is used.
+// using the given hashCost.  If hashCost is less than bcrypt.MinCost then worrywort.PasswordHashCost is used.
 func SetUserPassword(u *User, password string, hashCost int) error {
 	// TODO: abstract this out to allow for easily using a different hashing algorithm
 	// or changing the hash cost, such as to something very low for tests?
-	if hashCost <= bcrypt.MinCost {
-		hashCost = DefaultPasswordHashCost
+	if hashCost < bcrypt.MinCost {
+		hashCost = PasswordHashCost
 	}
 	passwdBytes, err := bcrypt.GenerateFromPassword([]byte(password), hashCost)
 	if err != nil {
@@ -73,11 +87,12 @@ func InsertUser(db *sqlx.DB, u *User) error {
 	userId := new(int64)
 	guid := new(string)
 
-	query := db.Rebind(`INSERT INTO users (email, full_name, username, password, created_at, updated_at)
-		VALUES (?, ?, ?, ?, NOW(), NOW()) RETURNING id, uuid, created_at, updated_at`)
+	query := db.Rebind(`INSERT INTO users (email, full_name, username, password, is_active, is_admin, created_at,
+		updated_at) VALUES (?, ?, ?, ?, ?, ?, NOW(), NOW()) RETURNING id, uuid, created_at, updated_at`)
 	// TODO: just use StructScan?  Or at least scan right into user.Id?
 	err := db.QueryRow(
-		query, u.Email, u.FullName, u.Username, u.Password).Scan(userId, guid, &createdAt, &updatedAt)
+		query, u.Email, u.FullName, u.Username, u.Password, u.IsActive, u.IsAdmin).Scan(
+		userId, guid, &createdAt, &updatedAt)
 	if err != nil {
 		return err
 	}
@@ -92,18 +107,22 @@ func InsertUser(db *sqlx.DB, u *User) error {
 // Saves the passed in user to the database using an UPDATE
 // Returns a new copy of the user with any updated values set upon success.
 // Returns the same, unmodified User and errors on error
-func UpdateUser(db *sqlx.DB, u *User) error {
+func UpdateUser(db sqlx.Ext, u *User) error {
 	// TODO: TEST CASE
 	// TODO: maybe go to trigger for updated_at like https://stackoverflow.com/a/26284695
 	var updatedAt time.Time
-	query := db.Rebind(`UPDATE users SET email = ?, full_name = ?, username = ?, password = ?, updated_at = NOW()
-		WHERE id = ?) RETURNING updated_at`)
-	err := db.QueryRow(
-		query, u.Email, u.FullName, u.Username, u.Password, u.Id).Scan(&updatedAt)
+	var passwordChangedAt *time.Time
+	query := db.Rebind(`UPDATE users SET email = ?, full_name = ?, username = ?, password = ?, is_active = ?,
+		is_admin = ?, password_changed_at = CASE WHEN password = ? THEN password_changed_at ELSE NOW() END,
+		updated_at = NOW() WHERE id = ? RETURNING updated_at, password_changed_at`)
+	err := db.QueryRowx(
+		query, u.Email, u.FullName, u.Username, u.Password, u.IsActive, u.IsAdmin, u.Password, u.Id).Scan(
+		&updatedAt, &passwordChangedAt)
 	if err != nil {
 		return err
 	}
 	u.UpdatedAt = updatedAt
+	u.PasswordChangedAt = passwordChangedAt
 	return nil
 }
 
@@ -119,85 +138,147 @@ func AuthenticateLogin(username, password string, db *sqlx.DB) (*User, error) {
 		err = ErrUserNotFound
 	} else if err == nil {
 		err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+		// only after the password check so that whether an account is deactivated is not revealed to just anyone
+		if err == nil && !u.IsActive {
+			err = ErrUserInactive
+		}
+		if err == nil {
+			upgradePasswordHash(u, password, db)
+		}
 	}
 	return u, err
 }
 
+// Re-hashes the password if its cost is not PasswordHashCost.  This is the only time the plain text password is
+// available to do so.  Failures are only logged since the login itself was fine.
+func upgradePasswordHash(u *User, password string, db *sqlx.DB) {
+	cost, err := bcrypt.Cost([]byte(u.Password))
+	if err != nil || cost == PasswordHashCost {
+		return
+	}
+	upgraded := *u
+	if err := SetUserPassword(&upgraded, password, PasswordHashCost); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	query := db.Rebind(`UPDATE users SET password = ?, updated_at = NOW() WHERE id = ? AND password = ?`)
+	if _, err := db.Exec(query, upgraded.Password, u.Id, u.Password); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	u.Password = upgraded.Password
+}
+
 // Uses a token as passed in authentication headers by a user to look them up
+// Returns just the User for a token string.  See AuthenticateUserByToken() to get the AuthToken as well.
 func LookupUserByToken(tokenStr string, db *sqlx.DB) (User, error) {
-	// TODO: return the found token as well?
-	// TODO: Is there a good way to abstract this so that token data could optionally
-	// be stored in redis while other data is in postgres?  If two separate lookups
-	// are done even for db then it is easy.
-
-	// TODO: Considering making this taken token id and actual token as separate params
-	// for explicitness that token is passed in has 2 parts
-	tokenParts := strings.SplitN(tokenStr, ":", 2)
-	if len(tokenParts) != 2 {
-		return User{}, ErrBadTokenFormat
-	}
-
-	tokenId := tokenParts[0]
-	tokenSecret := tokenParts[1]
-	token := AuthToken{}
-	// TODO: sqrl?
-	query := db.Rebind(
-		`SELECT t.id, t.token, t.scope, t.expires_at, t.created_at, t.updated_at, u.id "user.id", u.uuid "user.uuid",
-			u.full_name "user.full_name", u.username "user.username", u.email "user.email", u.created_at "user.created_at",
-			u.updated_at "user.updated_at", u.password "user.password" FROM user_authtokens t
-			JOIN users u ON t.user_id = u.id
-			WHERE t.id = ? AND (t.expires_at IS NULL OR t.expires_at > ?)`)
-	err := db.Get(&token, query, tokenId, time.Now())
-
+	token, err := AuthenticateUserByToken(tokenStr, db)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return User{}, ErrInvalidToken
-		}
 		return User{}, err
 	}
+	return token.User, nil
+}
 
-	if token == (AuthToken{}) {
-		return User{}, ErrInvalidToken
+// Build the query for looking up users
+func buildUsersQuery(params map[string]interface{}, db *sqlx.DB) *sqrl.SelectBuilder {
+	query := sqrl.Select().From("users u")
+	for _, k := range []string{"id", "email", "uuid", "is_active", "is_admin"} {
+		if v, ok := params[k]; ok {
+			query = query.Where(sqrl.Eq{fmt.Sprintf("u.%s", k): v})
+		}
 	}
 
-	// could do this in the sql, but it keeps the hashing code all closer together
-	if !token.Compare(tokenSecret) {
-		return User{}, ErrInvalidToken
+	// case insensitive partial match on any of the user's names or email
+	if v, ok := params["search"]; ok {
+		term := "%" + v.(string) + "%"
+		query = query.Where("(u.email ILIKE ? OR u.username ILIKE ? OR u.full_name ILIKE ?)", term, term, term)
 	}
 
-	return token.User, nil
+	for _, k := range (User{}).queryColumns() {
+		query = query.Column(fmt.Sprintf("u.%s", k))
+	}
+
+	if v, ok := params["limit"]; ok {
+		query = query.Limit(uint64(v.(int)))
+	}
+	if v, ok := params["offset"]; ok {
+		query = query.Offset(uint64(v.(int)))
+	}
+	return query
 }
 
 func FindUser(params map[string]interface{}, db *sqlx.DB) (*User, error) {
-	// TODO: use sqrl
 	user := User{}
-	var values []interface{}
-	var where []string
-	for _, k := range []string{"id", "email", "uuid"} {
-		if v, ok := params[k]; ok {
-			values = append(values, v)
-			// TODO: Deal with values from sensor OR user table
-			where = append(where, fmt.Sprintf("u.%s = ?", k))
-		}
+	query, values, err := buildUsersQuery(params, db).ToSql()
+	if err == nil {
+		err = db.Get(&user, db.Rebind(query), values...)
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
-	selectCols := ""
-	// as in BatchesForUser, this now seems dumb
-	// queryCols := []string{"id", "name", "created_at", "updated_at", "user_id"}
-	// If I need this many places, maybe make a const
-	for _, k := range []string{"id", "uuid", "email", "full_name", "username", "password", "created_at", "updated_at"} {
-		selectCols += fmt.Sprintf("u.%s, ", k)
+	return &user, nil
+}
+
+// Look up users, such as for the admin user list.  Accepts the same params as FindUser plus
+// `search`, `limit`, and `offset`.  Users are ordered by id so that pagination is stable.
+func FindUsers(params map[string]interface{}, db *sqlx.DB) ([]*User, error) {
+	users := new([]*User)
+	query, values, err := buildUsersQuery(params, db).OrderBy("u.id").ToSql()
+	if err == nil {
+		err = db.Select(users, db.Rebind(query), values...)
 	}
+	return *users, err
+}
 
-	// TODO: Can I easily dynamically add in joining and attaching the User to this without overcomplicating the code?
-	q := `SELECT ` + strings.Trim(selectCols, ", ") + ` FROM users u WHERE ` + strings.Join(where, " AND ")
+// Counts of the data belonging to a user
+type UserCounts struct {
+	Batches                 int64 `db:"batches"`
+	Sensors                 int64 `db:"sensors"`
+	TemperatureMeasurements int64 `db:"temperature_measurements"`
+}
 
-	query := db.Rebind(q)
-	err := db.Get(&user, query, values...)
+func FindUserCounts(userId int64, db *sqlx.DB) (UserCounts, error) {
+	counts := UserCounts{}
+	query := db.Rebind(`SELECT
+		(SELECT COUNT(*) FROM batches WHERE user_id = ?) AS batches,
+		(SELECT COUNT(*) FROM sensors WHERE user_id = ?) AS sensors,
+		(SELECT COUNT(*) FROM temperature_measurements WHERE user_id = ?) AS temperature_measurements`)
+	err := db.Get(&counts, query, userId, userId, userId)
+	return counts, err
+}
 
+// ChangeUserPassword verifies that currentPassword matches the user's existing password and then hashes
+// and saves newPassword.  Every interactive token for the user is deleted so that other sessions must log in again,
+// and the returned login token replaces the caller's.  Personal access tokens, such as those used by sensors, are
+// left alone.
+func ChangeUserPassword(u *User, currentPassword, newPassword string, hashCost int, db *sqlx.DB) (AuthToken, error) {
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(currentPassword)); err != nil {
+		return AuthToken{}, err
+	}
+	if err := SetUserPassword(u, newPassword, hashCost); err != nil {
+		return AuthToken{}, err
+	}
+	token, err := GenerateTokenForUser(*u, TOKEN_SCOPE_ALL)
 	if err != nil {
-		return nil, err
+		return AuthToken{}, err
 	}
 
-	return &user, nil
+	// All in one transaction so that the other sessions are never left valid for the new password
+	tx, err := db.Beginx()
+	if err != nil {
+		return AuthToken{}, err
+	}
+	defer tx.Rollback()
+	if err := UpdateUser(tx, u); err != nil {
+		return AuthToken{}, err
+	}
+	if err := insertAuthToken(tx, &token); err != nil {
+		return AuthToken{}, err
+	}
+	if err := deleteInteractiveAuthTokens(*u.Id, token.Id, tx); err != nil {
+		return AuthToken{}, err
+	}
+	return token, tx.Commit()
 }
@@ -44,7 +44,7 @@ func TestUserDatabaseFunctionality(t *testing.T) {
 	}
 	defer db.Close()
 
-	user := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	user := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort", IsActive: true}
 	password := "password"
 	err = SetUserPassword(&user, password, bcrypt.MinCost)
 	if err != nil {
@@ -201,5 +201,304 @@ func TestUserDatabaseFunctionality(t *testing.T) {
 				t.Errorf("Expected: %v\nGot: %v", ErrUserNotFound, err)
 			}
 		})
+
+		t.Run("Test password is re-hashed when the cost has changed", func(t *testing.T) {
+			PasswordHashCost = bcrypt.MinCost + 1
+			defer func() { PasswordHashCost = bcrypt.MinCost }()
+
+			u, err := AuthenticateLogin(user.Email, password, db)
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+			stored, err := FindUser(map[string]interface{}{"id": *user.Id}, db)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if cost, _ := bcrypt.Cost([]byte(stored.Password)); cost != bcrypt.MinCost+1 {
+				t.Errorf("Expected cost %d but got %d", bcrypt.MinCost+1, cost)
+			}
+			if stored.Password != u.Password {
+				t.Errorf("Returned user does not have the new hash")
+			}
+			if _, err := AuthenticateLogin(user.Email, password, db); err != nil {
+				t.Errorf("Could not log in with the re-hashed password: %v", err)
+			}
+		})
+	})
+}
+
+func TestUpdateUser(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort"}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+
+	user.FullName = "Updated Name"
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to update user: %s", err)
+	}
+
+	updated, err := FindUser(map[string]interface{}{"id": *user.Id}, db)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !cmp.Equal(&user, updated) {
+		t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(&user, updated))
+	}
+}
+
+func TestPasswordChanges(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort", IsActive: true}
+	if err := SetUserPassword(&user, "password", bcrypt.MinCost); err != nil {
+		t.Fatalf("Error hashing password for test: %v", err)
+	}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+
+	// helper to check whether a login token still exists after a password change
+	tokenExists := func(tokenId string) bool {
+		var count int
+		if err := db.Get(&count, db.Rebind(`SELECT COUNT(*) FROM user_authtokens WHERE id = ?`), tokenId); err != nil {
+			t.Fatalf("%v", err)
+		}
+		return count > 0
+	}
+
+	t.Run("ChangeUserPassword()", func(t *testing.T) {
+		loginToken := NewLoginToken("secret", user, TOKEN_SCOPE_ALL)
+		if err := loginToken.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		accessToken := NewToken("secret2", user, TOKEN_SCOPE_WRITE_TEMPS, TOKEN_TYPE_PERSONAL_ACCESS)
+		if err := accessToken.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		challengeToken := NewToken("secret3", user, TOKEN_SCOPE_ALL, TOKEN_TYPE_TOTP_CHALLENGE)
+		if err := challengeToken.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		if _, err := ChangeUserPassword(&user, "wrong", "newpassword", bcrypt.MinCost, db); err != bcrypt.ErrMismatchedHashAndPassword {
+			t.Errorf("Expected error: %v\nGot: %v", bcrypt.ErrMismatchedHashAndPassword, err)
+		}
+
+		newToken, err := ChangeUserPassword(&user, "password", "newpassword", bcrypt.MinCost, db)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !tokenExists(newToken.Id) {
+			t.Errorf("Expected the replacement login token to be saved")
+		}
+		if tokenExists(challengeToken.Id) {
+			t.Errorf("Expected TOTP challenge token to be deleted")
+		}
+
+		if _, err := AuthenticateLogin(user.Email, "newpassword", db); err != nil {
+			t.Errorf("Could not log in with the new password: %v", err)
+		}
+
+		if tokenExists(loginToken.Id) {
+			t.Errorf("Expected login token to be deleted")
+		}
+
+		if !tokenExists(accessToken.Id) {
+			t.Errorf("Expected personal access token to not be deleted")
+		}
+	})
+
+	t.Run("ResetPassword()", func(t *testing.T) {
+		token, err := GeneratePasswordResetToken(user, DefaultPasswordResetTokenTTL)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := token.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		if _, err := ResetPassword(token.Id+":wrong", "resetpassword", bcrypt.MinCost, db); err != ErrInvalidPasswordResetToken {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidPasswordResetToken, err)
+		}
+
+		u, err := ResetPassword(token.ForPasswordReset(), "resetpassword", bcrypt.MinCost, db)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if *u.Id != *user.Id {
+			t.Errorf("Expected user %d but got %d", *user.Id, *u.Id)
+		}
+
+		if _, err := AuthenticateLogin(user.Email, "resetpassword", db); err != nil {
+			t.Errorf("Could not log in with the new password: %v", err)
+		}
+
+		// tokens are single use
+		if _, err := ResetPassword(token.ForPasswordReset(), "again", bcrypt.MinCost, db); err != ErrInvalidPasswordResetToken {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidPasswordResetToken, err)
+		}
+	})
+
+	t.Run("ResetPassword() with peppered token", func(t *testing.T) {
+		defer setTokenPeppers(map[int][]byte{1: []byte(testPepper)})()
+		token, err := GeneratePasswordResetToken(user, DefaultPasswordResetTokenTTL)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := token.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if token.HashVersion != 1 || !token.Compare(token.fromString) {
+			t.Errorf("Expected the token to be hashed with version 1 but got %d", token.HashVersion)
+		}
+
+		// still checked with the pepper it was made with after a new one is added
+		TokenPeppers = map[int][]byte{1: []byte(testPepper), 2: []byte(testPepper + "x")}
+		if _, err := ResetPassword(token.ForPasswordReset(), "pepperedpassword", bcrypt.MinCost, db); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ResetPassword() with expired token", func(t *testing.T) {
+		token, err := GeneratePasswordResetToken(user, -1*time.Minute)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := token.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		if _, err := ResetPassword(token.ForPasswordReset(), "expired", bcrypt.MinCost, db); err != ErrInvalidPasswordResetToken {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidPasswordResetToken, err)
+		}
+	})
+}
+
+func TestInactiveUser(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	user := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort", IsActive: false}
+	if err := SetUserPassword(&user, "password", bcrypt.MinCost); err != nil {
+		t.Fatalf("Error hashing password for test: %v", err)
+	}
+	if err := user.Save(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+
+	t.Run("AuthenticateLogin() returns ErrUserInactive", func(t *testing.T) {
+		if _, err := AuthenticateLogin(user.Email, "password", db); err != ErrUserInactive {
+			t.Errorf("Expected error: %v\nGot: %v", ErrUserInactive, err)
+		}
+	})
+
+	t.Run("AuthenticateLogin() with wrong password does not reveal inactive", func(t *testing.T) {
+		if _, err := AuthenticateLogin(user.Email, "wrong", db); err != bcrypt.ErrMismatchedHashAndPassword {
+			t.Errorf("Expected error: %v\nGot: %v", bcrypt.ErrMismatchedHashAndPassword, err)
+		}
+	})
+
+	t.Run("AuthenticateUserByToken() returns ErrInvalidToken", func(t *testing.T) {
+		token := NewLoginToken("secret", user, TOKEN_SCOPE_ALL)
+		if err := token.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := AuthenticateUserByToken(token.Id+":secret", db); err != ErrInvalidToken {
+			t.Errorf("Expected error: %v\nGot: %v", ErrInvalidToken, err)
+		}
+	})
+}
+
+func TestFindUsers(t *testing.T) {
+	db, err := setUpTestDb()
+	if err != nil {
+		t.Fatalf("Got error setting up database: %s", err)
+	}
+	defer db.Close()
+
+	u1 := User{Email: "user@example.com", FullName: "Justin Michalicek", Username: "worrywort", IsActive: true}
+	u2 := User{Email: "brewer@example.com", FullName: "Some Brewer", Username: "brewer", IsActive: false}
+	for _, u := range []*User{&u1, &u2} {
+		if err := u.Save(db); err != nil {
+			t.Fatalf("failed to insert user: %s", err)
+		}
+	}
+
+	t.Run("All users ordered by id", func(t *testing.T) {
+		users, err := FindUsers(map[string]interface{}{}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		expected := []*User{&u1, &u2}
+		if !cmp.Equal(expected, users) {
+			t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(expected, users))
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		users, err := FindUsers(map[string]interface{}{"search": "BREW"}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		expected := []*User{&u2}
+		if !cmp.Equal(expected, users) {
+			t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(expected, users))
+		}
+	})
+
+	t.Run("Filter by is_active", func(t *testing.T) {
+		users, err := FindUsers(map[string]interface{}{"is_active": true}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		expected := []*User{&u1}
+		if !cmp.Equal(expected, users) {
+			t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(expected, users))
+		}
+	})
+
+	t.Run("Limit and offset", func(t *testing.T) {
+		users, err := FindUsers(map[string]interface{}{"limit": 1, "offset": 1}, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		expected := []*User{&u2}
+		if !cmp.Equal(expected, users) {
+			t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(expected, users))
+		}
+	})
+
+	t.Run("FindUserCounts()", func(t *testing.T) {
+		b := makeTestBatch(&u1, true)
+		if err := b.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+		sensor := Sensor{Name: "Test Sensor", UserId: u1.Id, CreatedBy: &u1}
+		if err := sensor.Save(db); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		counts, err := FindUserCounts(*u1.Id, db)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		expected := UserCounts{Batches: 1, Sensors: 1, TemperatureMeasurements: 0}
+		if expected != counts {
+			t.Errorf("Expected: - | Got: +\n%s", cmp.Diff(expected, counts))
+		}
 	})
 }